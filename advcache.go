@@ -0,0 +1,132 @@
+package githttp
+
+import (
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// An advertisementCache remembers the reference advertisements that were sent
+// for each repository. Unlike the reachabilityCache, the key does not depend
+// on the state of the references, so the entries of a repository need to be
+// evicted whenever its references are updated.
+type advertisementCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+	hits       int
+
+	// generation is incremented on every eviction, so that advertisements that
+	// were generated before an eviction (and might reflect the references prior
+	// to the update) are not stored.
+	generation uint64
+}
+
+type advertisementCacheEntry struct {
+	key           string
+	advertisement []byte
+}
+
+func newAdvertisementCache(maxEntries int) *advertisementCache {
+	return &advertisementCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// advertisementCachePath returns the path under which the advertisements of
+// the repository at repositoryPath are cached. libgit2 resolves the symbolic
+// links of the paths of the repositories it opens, so this is also done here
+// in order for repository.Path() to evict the same entries.
+func advertisementCachePath(repositoryPath string) string {
+	if resolvedPath, err := filepath.EvalSymlinks(repositoryPath); err == nil {
+		repositoryPath = resolvedPath
+	}
+	if absPath, err := filepath.Abs(repositoryPath); err == nil {
+		return absPath
+	}
+	return filepath.Clean(repositoryPath)
+}
+
+// advertisementCacheKey returns the key of the advertisement of the provided
+// service in the provided repository. Everything that can change the contents
+// of the advertisement (like which references are visible, or the protocol
+// version) is part of the key.
+func advertisementCacheKey(
+	repositoryPath string,
+	serviceName string,
+	protocolVersion int,
+	level AuthorizationLevel,
+	namespace string,
+	username string,
+) string {
+	return fmt.Sprintf(
+		"%s\x00%s\x00%d\x00%d\x00%s\x00%s",
+		advertisementCachePath(repositoryPath),
+		serviceName,
+		protocolVersion,
+		level,
+		namespace,
+		username,
+	)
+}
+
+// get returns the advertisement with the provided key, and the generation
+// that needs to be passed to put if it was not present.
+func (c *advertisementCache) get(key string) (advertisement []byte, generation uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, c.generation, false
+	}
+	c.hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*advertisementCacheEntry).advertisement, c.generation, true
+}
+
+// put stores the advertisement with the provided key, evicting the least
+// recently used entry if the cache is full. Nothing is stored if there was an
+// eviction since the generation was obtained.
+func (c *advertisementCache) put(key string, generation uint64, advertisement []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*advertisementCacheEntry).advertisement = advertisement
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&advertisementCacheEntry{
+		key:           key,
+		advertisement: advertisement,
+	})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*advertisementCacheEntry).key)
+	}
+}
+
+// evict removes all the advertisements of the provided repository.
+func (c *advertisementCache) evict(repositoryPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	prefix := advertisementCachePath(repositoryPath) + "\x00"
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.lru.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/omegaup/go-base/logging/log15/v3"
+)
+
+func TestAdvertisementCache(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "advcache_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+	topic, err := repository.References.Lookup("refs/heads/topic")
+	if err != nil {
+		t.Fatalf("Failed to look up refs/heads/topic: %v", err)
+	}
+	topicID := topic.Target()
+	topic.Free()
+
+	protocol := NewGitProtocol(GitProtocolOpts{
+		AdvertisementCacheSize: 2,
+		AllowDeletes:           true,
+		Log:                    log,
+	})
+
+	advertisement := func(protocolVersion int) []byte {
+		t.Helper()
+		advertisement, err := Advertisement(
+			WithProtocolVersion(context.Background(), protocolVersion),
+			m,
+			dir,
+			"git-upload-pack",
+			AuthorizationAllowed,
+			protocol,
+			log,
+		)
+		if err != nil {
+			t.Fatalf("Failed to get the advertisement: %v", err)
+		}
+		return advertisement
+	}
+
+	original := advertisement(0)
+	if !bytes.Equal(original, advertisement(0)) {
+		t.Errorf("Expected the cached advertisement to match %q", original)
+	}
+	if protocol.advertisementCache.hits != 1 {
+		t.Errorf("Expected %d hits, got %d", 1, protocol.advertisementCache.hits)
+	}
+
+	// Protocol v2 clients get a list of capabilities instead, which is cached
+	// separately.
+	if v2 := advertisement(2); bytes.Equal(original, v2) {
+		t.Errorf("Expected the v2 advertisement to not match %q", original)
+	}
+	if protocol.advertisementCache.hits != 1 {
+		t.Errorf("Expected %d hits, got %d", 1, protocol.advertisementCache.hits)
+	}
+
+	var inBuf, outBuf bytes.Buffer
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(fmt.Sprintf(
+			"%s 0000000000000000000000000000000000000000 refs/heads/topic\x00report-status delete-refs\n",
+			topicID,
+		)))
+		pw.Flush()
+	}
+	if err := handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		protocol,
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	); err != nil {
+		t.Fatalf("Failed to push the delete of refs/heads/topic: %v", err)
+	}
+
+	// The push evicts the advertisement, so the next one reflects the delete.
+	updated := advertisement(0)
+	if protocol.advertisementCache.hits != 1 {
+		t.Errorf("Expected %d hits, got %d", 1, protocol.advertisementCache.hits)
+	}
+	if bytes.Contains(updated, []byte("refs/heads/topic")) {
+		t.Errorf("Expected refs/heads/topic to not be advertised, got %q", updated)
+	}
+
+	var buf bytes.Buffer
+	if err := handlePrePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		protocol,
+		log,
+		&buf,
+	); err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), updated) {
+		t.Errorf("Expected %q, got %q", buf.String(), updated)
+	}
+}
@@ -3,19 +3,31 @@ package githttp
 import (
 	"archive/tar"
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dsnet/compress/bzip2"
 	base "github.com/omegaup/go-base/v3"
 	tracing "github.com/omegaup/go-base/v3/tracing"
 
@@ -23,10 +35,53 @@ import (
 	"github.com/pkg/errors"
 )
 
+var (
+	trailerRegexp = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*)\s*:\s*(.*?)\s*$`)
+
+	// errDiffTruncated stops the iteration of a diff once it reaches one of
+	// its limits.
+	errDiffTruncated = errors.New("diff truncated")
+)
+
 const (
 	// BlobDisplayMaxSize is the maximum size that a blob can be in order to
 	// display it.
 	BlobDisplayMaxSize = 1 * 1024 * 1024
+
+	// ObjectTypeHeader is the name of the header that contains the type of the
+	// object (commit, tree, blob, or tag) in /+object/ responses.
+	ObjectTypeHeader = "X-Git-Object-Type"
+
+	// reflogLimit is the maximum number of reflog entries that will be
+	// returned, starting from the most recent one.
+	reflogLimit = 100
+
+	// logLimit is the number of commits that the log returns by default,
+	// which is the page size that it had before the limit was configurable.
+	logLimit = 101
+
+	// maxLogLimit is the maximum number of commits that the log can return.
+	maxLogLimit = 1000
+
+	// maxCommitsBatchSize is the maximum number of revisions that can be
+	// requested in a single /+commits request.
+	maxCommitsBatchSize = 100
+
+	// maxOverviewBranches is the maximum number of branches that are returned
+	// in a /+overview request.
+	maxOverviewBranches = 100
+
+	// maxOverviewTags is the maximum number of tags that are returned in a
+	// /+overview request.
+	maxOverviewTags = 100
+
+	// maxDiffFiles is the maximum number of files that are returned in a
+	// /+diff request.
+	maxDiffFiles = 300
+
+	// maxDiffHunks is the maximum number of hunks (across all files) that are
+	// returned in a /+diff request.
+	maxDiffHunks = 1000
 )
 
 // A RefResult represents a single reference in a git repository.
@@ -45,6 +100,131 @@ func (r *RefsResult) String() string {
 	return buf.String()
 }
 
+// A mediaRange is one of the entries of an Accept header.
+type mediaRange struct {
+	mediaType string
+	subtype   string
+	quality   float64
+}
+
+// parseAccept parses the media ranges of an Accept header, as described in
+// RFC 7231, section 5.3.2. Malformed entries are ignored.
+func parseAccept(accept string) []mediaRange {
+	var result []mediaRange
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		types := strings.SplitN(strings.TrimSpace(params[0]), "/", 2)
+		if len(types) != 2 || types[0] == "" || types[1] == "" {
+			continue
+		}
+		r := mediaRange{
+			mediaType: strings.ToLower(types[0]),
+			subtype:   strings.ToLower(types[1]),
+			quality:   1,
+		}
+		for _, param := range params[1:] {
+			keyValue := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(keyValue) != 2 || strings.ToLower(keyValue[0]) != "q" {
+				continue
+			}
+			if quality, err := strconv.ParseFloat(keyValue[1], 64); err == nil {
+				r.quality = quality
+			}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// negotiateContentType returns the content type among offeredTypes that is
+// preferred by the client according to the accept header. Each offered type
+// uses the quality of the most specific media range that matches it, and ties
+// are broken by the order of offeredTypes. An empty accept header accepts the
+// first offered type.
+func negotiateContentType(accept string, offeredTypes ...string) (string, error) {
+	if strings.TrimSpace(accept) == "" {
+		return offeredTypes[0], nil
+	}
+	ranges := parseAccept(accept)
+	bestType := ""
+	bestQuality := 0.0
+	for _, offeredType := range offeredTypes {
+		types := strings.SplitN(offeredType, "/", 2)
+		quality := 0.0
+		specificity := -1
+		for _, r := range ranges {
+			var rangeSpecificity int
+			if r.mediaType == types[0] && r.subtype == types[1] {
+				rangeSpecificity = 2
+			} else if r.mediaType == types[0] && r.subtype == "*" {
+				rangeSpecificity = 1
+			} else if r.mediaType == "*" && r.subtype == "*" {
+				rangeSpecificity = 0
+			} else {
+				continue
+			}
+			if rangeSpecificity > specificity {
+				specificity = rangeSpecificity
+				quality = r.quality
+			}
+		}
+		if quality > bestQuality {
+			bestType = offeredType
+			bestQuality = quality
+		}
+	}
+	if bestType == "" {
+		return "", base.ErrorWithCategory(
+			ErrNotAcceptable,
+			errors.Errorf(
+				"none of %v are acceptable for %q",
+				offeredTypes,
+				accept,
+			),
+		)
+	}
+	return bestType, nil
+}
+
+// A DefaultBranchResult represents the branch that HEAD points to.
+type DefaultBranchResult struct {
+	DefaultBranch string `json:"default_branch"`
+}
+
+func (r *DefaultBranchResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// An OverviewRefResult represents a branch or a tag in an OverviewResult.
+// Branches include the commit at their tip, and annotated tags include the
+// object that they ultimately point to.
+type OverviewRefResult struct {
+	Name   string        `json:"name"`
+	Value  string        `json:"value"`
+	Peeled string        `json:"peeled,omitempty"`
+	Commit *CommitResult `json:"commit,omitempty"`
+}
+
+// An OverviewResult represents a summary of a repository, with everything
+// needed to render its main page.
+type OverviewResult struct {
+	DefaultBranch     string               `json:"default_branch,omitempty"`
+	Head              string               `json:"head,omitempty"`
+	Branches          []*OverviewRefResult `json:"branches"`
+	BranchesTruncated bool                 `json:"branches_truncated,omitempty"`
+	Tags              []*OverviewRefResult `json:"tags"`
+	TagsTruncated     bool                 `json:"tags_truncated,omitempty"`
+	Size              int64                `json:"size"`
+}
+
+func (r *OverviewResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
 // A SignatureResult represents one of the signatures of the commit.
 type SignatureResult struct {
 	Name  string `json:"name"`
@@ -54,12 +234,14 @@ type SignatureResult struct {
 
 // A CommitResult represents a git commit.
 type CommitResult struct {
-	Commit    string           `json:"commit"`
-	Tree      string           `json:"tree"`
-	Parents   []string         `json:"parents"`
-	Author    *SignatureResult `json:"author"`
-	Committer *SignatureResult `json:"committer"`
-	Message   string           `json:"message"`
+	Commit           string              `json:"commit"`
+	Tree             string              `json:"tree"`
+	Parents          []string            `json:"parents"`
+	ParentsTruncated bool                `json:"parents_truncated,omitempty"`
+	Author           *SignatureResult    `json:"author"`
+	Committer        *SignatureResult    `json:"committer"`
+	Message          string              `json:"message"`
+	Trailers         map[string][]string `json:"trailers,omitempty"`
 }
 
 func (r *CommitResult) String() string {
@@ -68,10 +250,22 @@ func (r *CommitResult) String() string {
 	return buf.String()
 }
 
+// A CommitsResult represents the commits of a /+commits request, in the order
+// in which their revisions were requested. Revisions that do not exist or are
+// not reachable have a nil entry.
+type CommitsResult []*CommitResult
+
+func (r *CommitsResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
 // A LogResult represents the result of a git log operation.
 type LogResult struct {
-	Log  []*CommitResult `json:"log,omitempty"`
-	Next string          `json:"next,omitempty"`
+	Log       []*CommitResult `json:"log,omitempty"`
+	Next      string          `json:"next,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
 }
 
 func (r *LogResult) String() string {
@@ -129,33 +323,174 @@ func (r *BlobResult) String() string {
 	return buf.String()
 }
 
+// A TagResult represents an annotated git tag.
+type TagResult struct {
+	ID         string           `json:"id"`
+	Name       string           `json:"name"`
+	Target     string           `json:"target"`
+	TargetType string           `json:"target_type"`
+	Tagger     *SignatureResult `json:"tagger,omitempty"`
+	Message    string           `json:"message"`
+}
+
+func (r *TagResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// decodeText returns text, which is stored in the provided encoding, as valid
+// UTF-8. Only UTF-8 and ISO-8859-1 (which some legacy commits use) are
+// decoded. Any other encoding, as well as invalid UTF-8 text, gets its invalid
+// bytes replaced with U+FFFD, so that it can always be encoded as JSON.
+func decodeText(text string, encoding git.MessageEncoding) string {
+	switch strings.ToUpper(string(encoding)) {
+	case "ISO-8859-1", "ISO8859-1", "LATIN1", "LATIN-1":
+		// Every ISO-8859-1 byte maps to the Unicode code point of the same
+		// value.
+		runes := make([]rune, len(text))
+		for i := 0; i < len(text); i++ {
+			runes[i] = rune(text[i])
+		}
+		return string(runes)
+	}
+	return strings.ToValidUTF8(text, "\uFFFD")
+}
+
 func formatSignature(
 	signature *git.Signature,
+) *SignatureResult {
+	return formatEncodedSignature(signature, git.MessageEncodingUTF8)
+}
+
+// formatEncodedSignature returns the representation of a signature whose name
+// and email are stored in the provided encoding.
+func formatEncodedSignature(
+	signature *git.Signature,
+	encoding git.MessageEncoding,
 ) *SignatureResult {
 	return &SignatureResult{
-		Name:  signature.Name,
-		Email: signature.Email,
+		Name:  decodeText(signature.Name, encoding),
+		Email: decodeText(signature.Email, encoding),
 		Time:  signature.When.Format(time.RFC1123Z),
 	}
 }
 
+// parseTrailers returns the trailers (as in git-interpret-trailers(1)) at the
+// end of the last paragraph of a commit message, keyed by their token. This
+// includes the tag that SplitCommit and SpliceCommit append to the message.
+func parseTrailers(message string) map[string][]string {
+	// The first line is the subject, which is never a trailer, and only the
+	// last paragraph can contain trailers.
+	lines := strings.Split(strings.TrimRight(message, "\n"), "\n")[1:]
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) == "" {
+			lines = lines[i+1:]
+			break
+		}
+	}
+
+	// The trailers are the longest run of trailer lines (and their
+	// continuation lines) at the end of the paragraph.
+	start := len(lines)
+	for i := len(lines) - 1; i >= 0; i-- {
+		if trailerRegexp.MatchString(lines[i]) {
+			start = i
+		} else if !strings.HasPrefix(lines[i], " ") && !strings.HasPrefix(lines[i], "\t") {
+			break
+		}
+	}
+	if start == len(lines) {
+		return nil
+	}
+
+	trailers := make(map[string][]string)
+	var lastToken string
+	for _, line := range lines[start:] {
+		if match := trailerRegexp.FindStringSubmatch(line); match != nil {
+			lastToken = match[1]
+			trailers[lastToken] = append(trailers[lastToken], match[2])
+			continue
+		}
+		values := trailers[lastToken]
+		values[len(values)-1] += " " + strings.TrimSpace(line)
+	}
+	return trailers
+}
+
+// formatCommit returns the representation of the commit. Only the first
+// maxParents parents are included. The message and signatures are decoded
+// from the commit's encoding into UTF-8.
 func formatCommit(
 	commit *git.Commit,
+	maxParents int,
 ) *CommitResult {
+	parentCount := commit.ParentCount()
+	encoding := commit.MessageEncoding()
+	message := decodeText(commit.Message(), encoding)
 	result := &CommitResult{
 		Commit:    commit.Id().String(),
-		Author:    formatSignature(commit.Author()),
-		Committer: formatSignature(commit.Committer()),
-		Message:   commit.Message(),
-		Parents:   make([]string, commit.ParentCount()),
+		Author:    formatEncodedSignature(commit.Author(), encoding),
+		Committer: formatEncodedSignature(commit.Committer(), encoding),
+		Message:   message,
+		Trailers:  parseTrailers(message),
 		Tree:      commit.TreeId().String(),
 	}
-	for i := uint(0); i < commit.ParentCount(); i++ {
+	if parentCount > uint(maxParents) {
+		parentCount = uint(maxParents)
+		result.ParentsTruncated = true
+	}
+	result.Parents = make([]string, parentCount)
+	for i := uint(0); i < parentCount; i++ {
 		result.Parents[i] = commit.ParentId(i).String()
 	}
 	return result
 }
 
+func formatTag(
+	tag *git.Tag,
+) *TagResult {
+	result := &TagResult{
+		ID:         tag.Id().String(),
+		Name:       tag.Name(),
+		Target:     tag.TargetId().String(),
+		TargetType: strings.ToLower(tag.TargetType().String()),
+		Message:    decodeText(tag.Message(), git.MessageEncodingUTF8),
+	}
+	if tagger := tag.Tagger(); tagger != nil {
+		result.Tagger = formatSignature(tagger)
+	}
+	return result
+}
+
+// readRawTree returns a copy of the raw contents of the tree object with the
+// provided id, as stored in the odb.
+func readRawTree(
+	repository *git.Repository,
+	treeID *git.Oid,
+) ([]byte, error) {
+	odb, err := repository.Odb()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get odb for repository",
+		)
+	}
+	defer odb.Free()
+	odbObj, err := odb.Read(treeID)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to lookup %s",
+			treeID,
+		)
+	}
+	defer odbObj.Free()
+
+	// The data is owned by libgit2 and will be freed with odbObj.
+	return append([]byte{}, odbObj.Data()...), nil
+}
+
 // formatTree reads the raw git tree data, parses it, and looks up the file
 // size for all the blobs in the tree. This is done to avoid having to make ~5
 // cgo calls per entry, which makes things a bit faster.
@@ -240,18 +575,59 @@ func formatBlob(
 	return result
 }
 
-// isCommitIDReachable returns whether a particular commit ID is reachable from any
-// of the refs that are viewable by the requestor.
-func isCommitIDReachable(
+// A rawBlob is a blob that is served as-is, along with the path it was
+// requested with (if any), which is used to choose its content type. Only the
+// contents of blobs that are small enough to be Git LFS pointers are loaded
+// beforehand. The rest are streamed from the odb.
+type rawBlob struct {
+	path     string
+	id       *git.Oid
+	size     uint64
+	contents []byte
+}
+
+// blobExtensionContentTypes contains the content types of well-known file
+// extensions, which take precedence over the ones detected from the contents
+// of blobs.
+var blobExtensionContentTypes = map[string]string{
+	".css":  "text/css; charset=utf-8",
+	".gif":  "image/gif",
+	".ico":  "image/x-icon",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".json": "application/json",
+	".md":   "text/plain; charset=utf-8",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".txt":  "text/plain; charset=utf-8",
+	".webp": "image/webp",
+}
+
+// blobContentType returns the content type of the raw contents of a blob. All
+// text is served as text/plain so that browsers don't render any HTML that is
+// stored in the repository.
+func blobContentType(blobPath string, contents []byte) string {
+	if contentType, ok := blobExtensionContentTypes[strings.ToLower(path.Ext(blobPath))]; ok {
+		return contentType
+	}
+	contentType := http.DetectContentType(contents)
+	if strings.HasPrefix(contentType, "text/") {
+		return "text/plain; charset=utf-8"
+	}
+	return contentType
+}
+
+// lookupViewableReferences returns the targets of the references in the
+// namespace that are viewable by the requestor, keyed by name.
+func lookupViewableReferences(
 	ctx context.Context,
 	repository *git.Repository,
 	level AuthorizationLevel,
 	protocol *GitProtocol,
-	commitID *git.Oid,
-) error {
+) (map[string]*git.Oid, error) {
 	it, err := repository.NewReferenceIterator()
 	if err != nil {
-		return errors.Wrap(
+		return nil, errors.Wrap(
 			err,
 			"failed to create a reference iterator",
 		)
@@ -265,17 +641,21 @@ func isCommitIDReachable(
 			if git.IsErrorCode(err, git.ErrorCodeIterOver) {
 				break
 			}
-			return errors.Wrap(
+			return nil, errors.Wrap(
 				err,
 				"failed to get an entry from the reference iterator",
 			)
 		}
 		defer ref.Free()
 
-		references[ref.Name()] = ref.Target()
+		refName, ok := stripNamespace(NamespaceFromContext(ctx), ref.Name())
+		if !ok {
+			continue
+		}
+		references[refName] = ref.Target()
 	}
 
-	var oids []*git.Oid
+	viewableReferences := make(map[string]*git.Oid)
 	for name, target := range references {
 		if level == AuthorizationAllowedRestricted && isRestrictedRef(name) {
 			continue
@@ -283,11 +663,42 @@ func isCommitIDReachable(
 		if !protocol.ReferenceDiscoveryCallback(ctx, repository, name) {
 			continue
 		}
+		viewableReferences[name] = target
+	}
+	return viewableReferences, nil
+}
 
+// isCommitIDReachable returns whether a particular commit ID is reachable from any
+// of the refs that are viewable by the requestor.
+func isCommitIDReachable(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	commitID *git.Oid,
+) error {
+	viewableReferences, err := lookupViewableReferences(ctx, repository, level, protocol)
+	if err != nil {
+		return err
+	}
+	var oids []*git.Oid
+	for _, target := range viewableReferences {
 		oids = append(oids, target)
 	}
 
-	reachable, err := repository.ReachableFromAny(commitID, oids)
+	var reachable bool
+	cacheKey := ""
+	cached := false
+	if protocol.reachabilityCache != nil {
+		cacheKey = reachabilityCacheKey(repository.Path(), commitID, viewableReferences)
+		reachable, cached = protocol.reachabilityCache.get(cacheKey)
+	}
+	if !cached {
+		reachable, err = repository.ReachableFromAny(commitID, oids)
+		if err == nil && cacheKey != "" {
+			protocol.reachabilityCache.put(cacheKey, reachable)
+		}
+	}
 	if err != nil {
 		return base.ErrorWithCategory(
 			ErrNotFound,
@@ -333,8 +744,9 @@ func handleRefs(
 
 	result := make(RefsResult)
 
-	head, err := repository.Head()
-	if err == nil {
+	namespace := NamespaceFromContext(ctx)
+	head, err := lookupHead(repository, namespace)
+	if err == nil && head != nil {
 		defer head.Free()
 	}
 
@@ -351,21 +763,31 @@ func handleRefs(
 		}
 		defer ref.Free()
 
-		if level == AuthorizationAllowedRestricted && isRestrictedRef(ref.Name()) {
+		refName, ok := stripNamespace(namespace, ref.Name())
+		if !ok || refName == "HEAD" {
+			continue
+		}
+		if level == AuthorizationAllowedRestricted && isRestrictedRef(refName) {
+			continue
+		}
+		if protocol.isHiddenRef(refName) {
 			continue
 		}
-		if !protocol.ReferenceDiscoveryCallback(ctx, repository, ref.Name()) {
+		if !protocol.ReferenceDiscoveryCallback(ctx, repository, refName) {
 			continue
 		}
 		if head != nil && head.Name() == ref.Name() {
 			result["HEAD"] = &RefResult{
-				Target: head.Name(),
+				Target: refName,
 				Value:  head.Target().String(),
 			}
 		}
 		refResult := &RefResult{}
 		if ref.Type() == git.ReferenceSymbolic {
 			refResult.Target = ref.SymbolicTarget()
+			if targetName, ok := stripNamespace(namespace, refResult.Target); ok {
+				refResult.Target = targetName
+			}
 			target, err := ref.Resolve()
 			if err != nil {
 				return nil, errors.Wrapf(
@@ -380,344 +802,2954 @@ func handleRefs(
 		} else if ref.Type() == git.ReferenceOid {
 			refResult.Value = ref.Target().String()
 		}
-		result[ref.Name()] = refResult
+		result[refName] = refResult
 	}
 
 	return result, nil
 }
 
-func handleLog(
+// handleDefaultBranch returns the name of the branch that HEAD points to, even
+// if that branch does not exist yet.
+func handleDefaultBranch(
 	ctx context.Context,
 	repository *git.Repository,
 	level AuthorizationLevel,
 	protocol *GitProtocol,
-	requestPath string,
 	method string,
-) (*LogResult, error) {
-	splitPath := strings.SplitN(requestPath, "/", 3)
-	if len(splitPath) < 2 {
+) (*DefaultBranchResult, error) {
+	namespace := NamespaceFromContext(ctx)
+	head, err := repository.References.Lookup(namespacedReferenceName(namespace, "HEAD"))
+	if err != nil {
 		return nil, base.ErrorWithCategory(
 			ErrNotFound,
-			errors.Errorf("invalid path: %s", requestPath),
+			errors.Wrap(
+				err,
+				"failed to look up HEAD",
+			),
 		)
 	}
-	rev := "HEAD"
-	if len(splitPath) == 3 && len(splitPath[2]) != 0 {
-		rev = splitPath[2]
+	defer head.Free()
+	if head.Type() != git.ReferenceSymbolic {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.New("HEAD is not a symbolic reference"),
+		)
 	}
-	obj, err := repository.RevparseSingle(rev)
-	if err != nil {
+	defaultBranch, ok := stripNamespace(namespace, head.SymbolicTarget())
+	if !ok {
 		return nil, base.ErrorWithCategory(
 			ErrNotFound,
-			errors.Wrapf(
-				err,
-				"failed to parse revision %s",
-				rev,
-			),
+			errors.Errorf("HEAD points outside of the namespace: %s", head.SymbolicTarget()),
 		)
 	}
-	defer obj.Free()
-	if obj.Type() != git.ObjectCommit {
+	if level == AuthorizationAllowedRestricted && isRestrictedRef(defaultBranch) {
 		return nil, base.ErrorWithCategory(
 			ErrNotFound,
-			errors.Errorf("revision %s is not a commit: %v", rev, obj.Type()),
+			errors.Errorf("default branch %s is not viewable", defaultBranch),
 		)
 	}
-
-	if err := isCommitIDReachable(
-		ctx,
-		repository,
-		level,
-		protocol,
-		obj.Id(),
-	); err != nil {
-		return nil, err
+	if !protocol.ReferenceDiscoveryCallback(ctx, repository, defaultBranch) {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("default branch %s is not viewable", defaultBranch),
+		)
 	}
 
 	if method == "HEAD" {
 		return nil, nil
 	}
 
-	walk, err := repository.Walk()
+	return &DefaultBranchResult{
+		DefaultBranch: defaultBranch,
+	}, nil
+}
+
+// handleOverview returns the default branch, HEAD, and the (first
+// maxOverviewBranches) branches and (first maxOverviewTags) tags of the
+// repository, sorted by name, along with its size.
+func handleOverview(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	method string,
+) (*OverviewResult, error) {
+	refs, err := handleRefs(ctx, repository, level, protocol, method)
 	if err != nil {
-		return nil, errors.Wrap(
-			err,
-			"failed to create the repository revwalk",
-		)
+		return nil, err
 	}
-	defer walk.Free()
-	walk.SimplifyFirstParent()
-	if err = walk.Push(obj.Id()); err != nil {
+	size, err := repositorySize(repository.Path())
+	if err != nil {
 		return nil, errors.Wrap(
 			err,
-			"failed to add the original object to the revwalk",
+			"failed to get the size of the repository",
 		)
 	}
-	result := &LogResult{
-		Log: make([]*CommitResult, 0),
+
+	if method == "HEAD" {
+		return nil, nil
 	}
-	if err := walk.Iterate(func(commit *git.Commit) bool {
-		defer commit.Free()
-		if len(result.Log) > 100 {
-			result.Next = commit.Id().String()
-			return false
+
+	result := &OverviewResult{
+		Branches: []*OverviewRefResult{},
+		Tags:     []*OverviewRefResult{},
+		Size:     size,
+	}
+	// The default branch is not an error if it is missing (e.g. HEAD is
+	// detached), since the rest of the overview is still useful.
+	if defaultBranch, err := handleDefaultBranch(ctx, repository, level, protocol, method); err == nil {
+		result.DefaultBranch = defaultBranch.DefaultBranch
+	}
+	if head, ok := refs["HEAD"]; ok {
+		result.Head = head.Value
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ref := refs[name]
+		if strings.HasPrefix(name, "refs/heads/") {
+			if len(result.Branches) == maxOverviewBranches {
+				result.BranchesTruncated = true
+				continue
+			}
+			branch := &OverviewRefResult{
+				Name:  name,
+				Value: ref.Value,
+			}
+			if oid, err := git.NewOid(ref.Value); err == nil {
+				if commit, err := repository.LookupCommit(oid); err == nil {
+					branch.Commit = formatCommit(commit, protocol.MaxCommitParents)
+					commit.Free()
+				}
+			}
+			result.Branches = append(result.Branches, branch)
+		} else if strings.HasPrefix(name, "refs/tags/") {
+			if len(result.Tags) == maxOverviewTags {
+				result.TagsTruncated = true
+				continue
+			}
+			tag := &OverviewRefResult{
+				Name:  name,
+				Value: ref.Value,
+			}
+			if peeled := peeledTagTarget(repository, ref.Value); peeled != nil {
+				tag.Peeled = peeled.String()
+			}
+			result.Tags = append(result.Tags, tag)
 		}
-		result.Log = append(result.Log, formatCommit(commit))
-		return true
-	}); err != nil {
-		return nil, errors.Wrap(
-			err,
-			"failed to walk the repository",
-		)
 	}
 
 	return result, nil
 }
 
-type archive interface {
-	Close() error
-	Create(path string, size int64) (io.Writer, error)
+// repositorySize returns the number of bytes used by the objects of the
+// repository in the provided path.
+func repositorySize(repositoryPath string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(path.Join(repositoryPath, "objects"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
 }
 
-type zipArchive zip.Writer
-
-func (a *zipArchive) Close() error {
-	return (*zip.Writer)(a).Close()
+// handleReflog returns the most recent entries of the reflog of a reference.
+// Note that bare repositories only keep reflogs if core.logAllRefUpdates is
+// set.
+func handleReflog(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*ReflogResult, error) {
+	splitPath := strings.SplitN(requestPath, "/", 3)
+	if len(splitPath) < 3 || splitPath[2] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	refName := strings.TrimSuffix(splitPath[2], "/")
+	if level == AuthorizationAllowedRestricted && isRestrictedRef(refName) ||
+		protocol.isHiddenRef(refName) ||
+		!protocol.ReferenceDiscoveryCallback(ctx, repository, refName) {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("reference %s is not viewable", refName),
+		)
+	}
+
+	namespace := NamespaceFromContext(ctx)
+	ref, err := repository.References.Lookup(namespacedReferenceName(namespace, refName))
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to look up %s",
+				refName,
+			),
+		)
+	}
+	defer ref.Free()
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	reflog, err := repository.ReflogRead(ref.Name())
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to read the reflog of %s",
+			refName,
+		)
+	}
+	defer reflog.Free()
+
+	result := &ReflogResult{
+		Entries: make([]*ReflogEntryResult, 0),
+	}
+	count := reflog.EntryCount()
+	if count > reflogLimit {
+		count = reflogLimit
+		result.Truncated = true
+	}
+	for i := uint(0); i < count; i++ {
+		entry := reflog.EntryByIndex(i)
+		if entry == nil {
+			break
+		}
+		result.Entries = append(result.Entries, &ReflogEntryResult{
+			Old:       entry.Old.String(),
+			New:       entry.New.String(),
+			Committer: formatSignature(entry.Committer),
+			Message:   entry.Message,
+		})
+	}
+	return result, nil
+}
+
+// resolveLogCommitID returns the id of the commit from which the log for
+// requestPath starts, after ensuring that it is reachable, and the path the
+// log is restricted to, if any. Revisions that contain slashes (like
+// refs/heads/master) take precedence over `<rev>/<path>`, and the longest
+// prefix that is a valid revision is the one that is used.
+func resolveLogCommitID(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+) (*git.Oid, string, error) {
+	splitPath := strings.SplitN(requestPath, "/", 3)
+	if len(splitPath) < 2 {
+		return nil, "", base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	rev := "HEAD"
+	if len(splitPath) == 3 && len(splitPath[2]) != 0 {
+		rev = splitPath[2]
+	}
+	logPath := ""
+	obj, err := revparseSingle(ctx, repository, rev)
+	if err != nil {
+		// URLs of the form /+log/rev/path. Revisions can also contain slashes
+		// (e.g. refs/heads/feature/x), so the longest prefix that is a valid
+		// revision is used.
+		for i := strings.LastIndex(rev, "/"); i > 0; i = strings.LastIndex(rev[:i], "/") {
+			if rev[i+1:] == "" {
+				continue
+			}
+			prefixObj, prefixErr := revparseSingle(ctx, repository, rev[:i])
+			if prefixErr != nil {
+				continue
+			}
+			obj, err = prefixObj, nil
+			logPath = strings.TrimSuffix(rev[i+1:], "/")
+			rev = rev[:i]
+			break
+		}
+	}
+	if err != nil {
+		return nil, "", base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to parse revision %s",
+				rev,
+			),
+		)
+	}
+	defer obj.Free()
+	if obj.Type() != git.ObjectCommit {
+		return nil, "", base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("revision %s is not a commit: %v", rev, obj.Type()),
+		)
+	}
+
+	if err := isCommitIDReachable(
+		ctx,
+		repository,
+		level,
+		protocol,
+		obj.Id(),
+	); err != nil {
+		return nil, "", err
+	}
+
+	return obj.Id(), logPath, nil
+}
+
+// logOptions are the options of the log. All of them except for path are set
+// through query parameters.
+type logOptions struct {
+	// limit is the maximum number of commits that are visited.
+	limit int
+
+	// firstParent makes the log only follow the first parent of merges.
+	firstParent bool
+
+	// start is the id of the commit where the walk starts, which is typically
+	// the Next continuation token of a previous page.
+	start *git.Oid
+
+	// path, if not empty, restricts the log to the commits that changed the
+	// file or directory at that path.
+	path string
+}
+
+// parseLogOptions parses the `limit`, `first_parent`, and `start` query
+// parameters of the log.
+func parseLogOptions(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	query url.Values,
+) (*logOptions, error) {
+	opts := &logOptions{
+		limit:       logLimit,
+		firstParent: true,
+	}
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			return nil, base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf("invalid limit: %q", limit),
+			)
+		}
+		opts.limit = parsed
+		if opts.limit > maxLogLimit {
+			opts.limit = maxLogLimit
+		}
+	}
+	if firstParent := query.Get("first_parent"); firstParent != "" {
+		parsed, err := strconv.ParseBool(firstParent)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf("invalid first_parent: %q", firstParent),
+			)
+		}
+		opts.firstParent = parsed
+	}
+	if start := query.Get("start"); start != "" {
+		startID, err := git.NewOid(start)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Wrapf(
+					err,
+					"invalid start: %q",
+					start,
+				),
+			)
+		}
+		if err := isCommitIDReachable(
+			ctx,
+			repository,
+			level,
+			protocol,
+			startID,
+		); err != nil {
+			return nil, err
+		}
+		opts.start = startID
+	}
+	return opts, nil
+}
+
+// commitTouchesPath returns whether the commit changed the file or directory
+// at the provided path, relative to its first parent. Root commits are
+// compared against the empty tree.
+func commitTouchesPath(
+	repository *git.Repository,
+	commit *git.Commit,
+	path string,
+) (bool, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return false, errors.Wrapf(
+			err,
+			"failed to get the tree of %s",
+			commit.Id(),
+		)
+	}
+	defer tree.Free()
+
+	var parentTree *git.Tree
+	if parent := commit.Parent(0); parent != nil {
+		defer parent.Free()
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return false, errors.Wrapf(
+				err,
+				"failed to get the tree of %s",
+				parent.Id(),
+			)
+		}
+		defer parentTree.Free()
+	}
+
+	diffOpts, err := git.DefaultDiffOptions()
+	if err != nil {
+		return false, errors.Wrap(
+			err,
+			"failed to get the default diff options",
+		)
+	}
+	diffOpts.Flags |= git.DiffDisablePathspecMatch
+	diffOpts.Pathspec = []string{path}
+	diff, err := repository.DiffTreeToTree(parentTree, tree, &diffOpts)
+	if err != nil {
+		return false, errors.Wrapf(
+			err,
+			"failed to diff %s",
+			commit.Id(),
+		)
+	}
+	defer diff.Free()
+	deltas, err := diff.NumDeltas()
+	if err != nil {
+		return false, errors.Wrapf(
+			err,
+			"failed to count the deltas of %s",
+			commit.Id(),
+		)
+	}
+	return deltas != 0, nil
+}
+
+// walkLog invokes callback for each commit in the history of commitID (or
+// opts.start, if set), up to opts.limit commits. The walk fetches one more
+// commit than that: if it exists, its id is returned so that the log can be
+// resumed from there. When the whole history is walked, resuming only
+// follows the history of that commit, so commits in other branches that have
+// not been visited yet are skipped. If opts.path is set, at most revWalkLimit
+// commits are examined, and whether the walk stopped early because of that is
+// also returned.
+func walkLog(
+	repository *git.Repository,
+	commitID *git.Oid,
+	opts *logOptions,
+	callback func(commit *git.Commit) error,
+) (string, bool, error) {
+	walk, err := repository.Walk()
+	if err != nil {
+		return "", false, errors.Wrap(
+			err,
+			"failed to create the repository revwalk",
+		)
+	}
+	defer walk.Free()
+	if opts.firstParent {
+		walk.SimplifyFirstParent()
+	} else {
+		walk.Sorting(git.SortTopological | git.SortTime)
+	}
+	if opts.start != nil {
+		commitID = opts.start
+	}
+	if err = walk.Push(commitID); err != nil {
+		return "", false, errors.Wrap(
+			err,
+			"failed to add the original object to the revwalk",
+		)
+	}
+	var next string
+	var callbackErr error
+	count := 0
+	examined := 0
+	truncated := false
+	if err := walk.Iterate(func(commit *git.Commit) bool {
+		defer commit.Free()
+		if opts.path != "" {
+			// Each commit needs to be diffed, and the ones that touch the path
+			// can be arbitrarily far apart, so the walk is capped.
+			examined++
+			if examined > revWalkLimit {
+				next = commit.Id().String()
+				truncated = true
+				return false
+			}
+			touched, err := commitTouchesPath(repository, commit, opts.path)
+			if err != nil {
+				callbackErr = err
+				return false
+			}
+			if !touched {
+				return true
+			}
+		}
+		if count == opts.limit {
+			// This is the extra commit, which starts the next page.
+			next = commit.Id().String()
+			return false
+		}
+		count++
+		if callbackErr = callback(commit); callbackErr != nil {
+			return false
+		}
+		return true
+	}); err != nil {
+		return "", false, errors.Wrap(
+			err,
+			"failed to walk the repository",
+		)
+	}
+	if callbackErr != nil {
+		return "", false, callbackErr
+	}
+
+	return next, truncated, nil
+}
+
+func handleLog(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+	query url.Values,
+) (*LogResult, error) {
+	commitID, logPath, err := resolveLogCommitID(ctx, repository, level, protocol, requestPath)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseLogOptions(ctx, repository, level, protocol, query)
+	if err != nil {
+		return nil, err
+	}
+	opts.path = logPath
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	result := &LogResult{
+		Log: make([]*CommitResult, 0),
+	}
+	result.Next, result.Truncated, err = walkLog(repository, commitID, opts, func(commit *git.Commit) error {
+		result.Log = append(result.Log, formatCommit(commit, protocol.MaxCommitParents))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// handleLogText writes the log in a format similar to `git log --oneline`:
+// one line per commit with its abbreviated id and its summary. The id of the
+// commit where the log can be resumed is sent in the Omegaup-Log-Next trailer,
+// and the Omegaup-Log-Truncated trailer is set if the walk stopped early.
+func handleLogText(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+	query url.Values,
+	w http.ResponseWriter,
+) error {
+	commitID, logPath, err := resolveLogCommitID(ctx, repository, level, protocol, requestPath)
+	if err != nil {
+		return err
+	}
+	opts, err := parseLogOptions(ctx, repository, level, protocol, query)
+	if err != nil {
+		return err
+	}
+	opts.path = logPath
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if method == "HEAD" {
+		return nil
+	}
+	w.Header().Set("Trailer", "Omegaup-Log-Next")
+	w.Header().Add("Trailer", "Omegaup-Log-Truncated")
+
+	next, truncated, err := walkLog(repository, commitID, opts, func(commit *git.Commit) error {
+		_, err := fmt.Fprintf(
+			w,
+			"%s %s\n",
+			commit.Id().String()[:7],
+			commit.Summary(),
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		w.Header().Set("Omegaup-Log-Next", next)
+	}
+	if truncated {
+		w.Header().Set("Omegaup-Log-Truncated", "true")
+	}
+	return nil
+}
+
+// A DiffStatEntryResult represents the number of lines changed in a single
+// file.
+type DiffStatEntryResult struct {
+	Path      string `json:"path"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// A DiffStatResult represents the diffstat of a revision relative to its merge
+// base with another revision. Truncated is set if the ahead and behind counts
+// were capped, or if there were too many files and only the first ones are
+// included.
+type DiffStatResult struct {
+	MergeBase string                 `json:"merge_base"`
+	Ahead     int                    `json:"ahead"`
+	Behind    int                    `json:"behind"`
+	Truncated bool                   `json:"truncated,omitempty"`
+	Files     []*DiffStatEntryResult `json:"files"`
+}
+
+func (r *DiffStatResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// A DiffHunkResult represents a contiguous set of changed lines in a file.
+// Each line is prefixed by '+', '-', or ' ' as in a unified diff.
+type DiffHunkResult struct {
+	Header   string   `json:"header"`
+	OldStart int      `json:"old_start"`
+	OldLines int      `json:"old_lines"`
+	NewStart int      `json:"new_start"`
+	NewLines int      `json:"new_lines"`
+	Lines    []string `json:"lines"`
+}
+
+// A DiffFileResult represents the changes made to a single file.
+type DiffFileResult struct {
+	Status    string            `json:"status"`
+	OldPath   string            `json:"old_path"`
+	NewPath   string            `json:"new_path"`
+	OldMode   string            `json:"old_mode"`
+	NewMode   string            `json:"new_mode"`
+	Additions int               `json:"additions"`
+	Deletions int               `json:"deletions"`
+	Hunks     []*DiffHunkResult `json:"hunks"`
+
+	// Binary files have no hunks. Only their sizes are reported.
+	Binary  bool `json:"binary,omitempty"`
+	OldSize int  `json:"old_size,omitempty"`
+	NewSize int  `json:"new_size,omitempty"`
+}
+
+// A DiffResult represents the changes between two revisions. If there are
+// too many files or hunks, only the first ones are returned and Truncated is
+// set.
+type DiffResult struct {
+	Old       string            `json:"old,omitempty"`
+	New       string            `json:"new"`
+	Files     []*DiffFileResult `json:"files"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+func (r *DiffResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// A FilesResult represents the paths of the files that a commit changed
+// relative to its first parent.
+type FilesResult struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Deleted  []string `json:"deleted"`
+}
+
+func (r *FilesResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// A BlameHunkResult represents a range of lines of a file that were last
+// changed by the same commit.
+type BlameHunkResult struct {
+	Commit        string           `json:"commit"`
+	Author        *SignatureResult `json:"author"`
+	StartLine     int              `json:"start_line"`
+	Lines         int              `json:"lines"`
+	OrigPath      string           `json:"orig_path"`
+	OrigStartLine int              `json:"orig_start_line"`
+}
+
+// A BlameResult represents the line-level attribution of a file.
+type BlameResult struct {
+	Hunks []*BlameHunkResult `json:"hunks"`
+}
+
+func (r *BlameResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// An AheadBehindResult represents the number of commits that a revision is
+// ahead and behind of a base revision.
+type AheadBehindResult struct {
+	Ahead     int  `json:"ahead"`
+	Behind    int  `json:"behind"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func (r *AheadBehindResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// An IsAncestorResult represents whether a revision is an ancestor of
+// another.
+type IsAncestorResult struct {
+	IsAncestor bool `json:"is_ancestor"`
+}
+
+func (r *IsAncestorResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// A MergeBaseResult represents a common ancestor of two revisions.
+type MergeBaseResult struct {
+	Commit string `json:"commit"`
+}
+
+func (r *MergeBaseResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// MergeBasesResult represents all the best common ancestors of two revisions.
+type MergeBasesResult []*MergeBaseResult
+
+func (r *MergeBasesResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// A ContributorResult represents the number of commits that an author made to
+// a path.
+type ContributorResult struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Commits int    `json:"commits"`
+}
+
+// A ContributorsResult represents the list of authors that contributed to a
+// path, sorted by decreasing number of commits. Truncated is set if the
+// history was too long and only the most recent commits were considered.
+type ContributorsResult struct {
+	Contributors []*ContributorResult `json:"contributors"`
+	Truncated    bool                 `json:"truncated,omitempty"`
+}
+
+func (r *ContributorsResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// A ReflogEntryResult represents one of the updates of a reference.
+type ReflogEntryResult struct {
+	Old       string           `json:"old"`
+	New       string           `json:"new"`
+	Committer *SignatureResult `json:"committer"`
+	Message   string           `json:"message"`
+}
+
+// A ReflogResult represents the updates of a reference, most recent first.
+type ReflogResult struct {
+	Entries   []*ReflogEntryResult `json:"entries"`
+	Truncated bool                 `json:"truncated,omitempty"`
+}
+
+func (r *ReflogResult) String() string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(r)
+	return buf.String()
+}
+
+// checkTreeRevision returns an error if the tree named by rev is not viewable
+// by the requestor. Trees are viewable if they are expressed as the full
+// object id, or as `<rev>^{tree}` where <rev> names a commit that is reachable
+// from any of the refs that are viewable by the requestor.
+func checkTreeRevision(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	rev string,
+) error {
+	if isGitObjectID(rev) {
+		return nil
+	}
+	commitRev := strings.TrimSuffix(rev, "^{tree}")
+	if commitRev == rev {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("%q is not a valid tree-id", rev),
+		)
+	}
+	commit, err := resolveCommit(ctx, repository, level, protocol, commitRev)
+	if err != nil {
+		return err
+	}
+	commit.Free()
+	return nil
+}
+
+// resolveCommit parses the provided revision and returns the commit it points
+// to, as long as it is reachable from any of the refs that are viewable by the
+// requestor.
+func resolveCommit(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	rev string,
+) (*git.Commit, error) {
+	obj, err := revparseSingle(ctx, repository, rev)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to parse revision %s",
+				rev,
+			),
+		)
+	}
+	defer obj.Free()
+	if obj.Type() != git.ObjectCommit {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("revision %s is not a commit: %v", rev, obj.Type()),
+		)
+	}
+
+	if err := isCommitIDReachable(
+		ctx,
+		repository,
+		level,
+		protocol,
+		obj.Id(),
+	); err != nil {
+		return nil, err
+	}
+
+	commit, err := obj.AsCommit()
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to get the commit for %s",
+			rev,
+		)
+	}
+	return commit, nil
+}
+
+func handleDiffStat(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*DiffStatResult, error) {
+	splitPath := strings.SplitN(requestPath, "/", 3)
+	if len(splitPath) < 3 {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	revs := strings.SplitN(splitPath[2], "...", 2)
+	if len(revs) != 2 || revs[0] == "" || revs[1] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid revision range: %s", splitPath[2]),
+		)
+	}
+
+	baseCommit, err := resolveCommit(ctx, repository, level, protocol, revs[0])
+	if err != nil {
+		return nil, err
+	}
+	defer baseCommit.Free()
+	commit, err := resolveCommit(ctx, repository, level, protocol, revs[1])
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	mergeBaseID, err := repository.MergeBase(baseCommit.Id(), commit.Id())
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to find a merge base between %s and %s",
+				revs[0],
+				revs[1],
+			),
+		)
+	}
+	mergeBase, err := repository.LookupCommit(mergeBaseID)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to look up merge base %s",
+			mergeBaseID,
+		)
+	}
+	defer mergeBase.Free()
+
+	// The counts are capped like in handleAheadBehind.
+	ahead, aheadTruncated, err := countUniqueCommits(
+		repository,
+		commit.Id(),
+		baseCommit.Id(),
+		revWalkLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	behind, behindTruncated, err := countUniqueCommits(
+		repository,
+		baseCommit.Id(),
+		commit.Id(),
+		revWalkLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	oldTree, err := mergeBase.Tree()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get the merge base's tree",
+		)
+	}
+	defer oldTree.Free()
+	newTree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get the commit's tree",
+		)
+	}
+	defer newTree.Free()
+
+	diff, err := repository.DiffTreeToTree(oldTree, newTree, nil)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to diff the trees",
+		)
+	}
+	defer diff.Free()
+
+	result := &DiffStatResult{
+		MergeBase: mergeBaseID.String(),
+		Ahead:     ahead,
+		Behind:    behind,
+		Truncated: aheadTruncated || behindTruncated,
+		Files:     make([]*DiffStatEntryResult, 0),
+	}
+	if err := diff.ForEach(func(delta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
+		if len(result.Files) == maxDiffFiles {
+			result.Truncated = true
+			return nil, errDiffTruncated
+		}
+		entry := &DiffStatEntryResult{
+			Path: delta.NewFile.Path,
+		}
+		if delta.Status == git.DeltaDeleted {
+			entry.Path = delta.OldFile.Path
+		}
+		result.Files = append(result.Files, entry)
+		return func(hunk git.DiffHunk) (git.DiffForEachLineCallback, error) {
+			return func(line git.DiffLine) error {
+				if line.Origin == git.DiffLineAddition {
+					entry.Additions++
+				} else if line.Origin == git.DiffLineDeletion {
+					entry.Deletions++
+				}
+				return nil
+			}, nil
+		}, nil
+	}, git.DiffDetailLines); err != nil && err != errDiffTruncated {
+		return nil, errors.Wrap(
+			err,
+			"failed to compute the diffstat",
+		)
+	}
+
+	return result, nil
+}
+
+// diffStatus returns the name of the status of a delta as it is presented in
+// the browse API.
+func diffStatus(status git.Delta) string {
+	switch status {
+	case git.DeltaAdded:
+		return "added"
+	case git.DeltaDeleted:
+		return "deleted"
+	case git.DeltaModified:
+		return "modified"
+	case git.DeltaRenamed:
+		return "renamed"
+	case git.DeltaCopied:
+		return "copied"
+	case git.DeltaTypeChange:
+		return "typechange"
+	default:
+		return "unmodified"
+	}
+}
+
+// resolveDiffRange resolves the commits of the `<rev>` or `<old>..<new>`
+// revision range of a /+diff/ request. When only one revision is provided, it
+// is compared against its first parent, and root commits are compared against
+// the empty tree, in which case the old commit is nil.
+func resolveDiffRange(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+) (*git.Commit, *git.Commit, error) {
+	splitPath := strings.SplitN(requestPath, "/", 3)
+	if len(splitPath) < 3 || splitPath[2] == "" {
+		return nil, nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	revs := strings.SplitN(splitPath[2], "..", 2)
+	for _, rev := range revs {
+		// Symmetric differences (`<old>...<new>`) are served by /+diffstat/.
+		if rev == "" || strings.HasPrefix(rev, ".") {
+			return nil, nil, base.ErrorWithCategory(
+				ErrNotFound,
+				errors.Errorf("invalid revision range: %s", splitPath[2]),
+			)
+		}
+	}
+
+	commit, err := resolveCommit(ctx, repository, level, protocol, revs[len(revs)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	var oldCommit *git.Commit
+	if len(revs) == 2 {
+		oldCommit, err = resolveCommit(ctx, repository, level, protocol, revs[0])
+		if err != nil {
+			commit.Free()
+			return nil, nil, err
+		}
+	} else {
+		oldCommit = commit.Parent(0)
+	}
+	return oldCommit, commit, nil
+}
+
+// diffCommits returns the diff between the trees of two commits. oldCommit
+// can be nil to diff against the empty tree.
+func diffCommits(
+	repository *git.Repository,
+	oldCommit, commit *git.Commit,
+) (*git.Diff, error) {
+	var oldTree *git.Tree
+	if oldCommit != nil {
+		var err error
+		oldTree, err = oldCommit.Tree()
+		if err != nil {
+			return nil, errors.Wrap(
+				err,
+				"failed to get the old commit's tree",
+			)
+		}
+		defer oldTree.Free()
+	}
+	newTree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get the commit's tree",
+		)
+	}
+	defer newTree.Free()
+
+	diff, err := repository.DiffTreeToTree(oldTree, newTree, nil)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to diff the trees",
+		)
+	}
+	return diff, nil
+}
+
+// handleFiles returns the paths of the files changed by the commit of a
+// /+files/ request. Only the trees are compared, so this is much cheaper than
+// /+diff/ for commits that touch large files.
+func handleFiles(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*FilesResult, error) {
+	splitPath := strings.SplitN(strings.TrimSuffix(requestPath, "/"), "/", 3)
+	if len(splitPath) < 3 || splitPath[2] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+
+	commit, err := resolveCommit(ctx, repository, level, protocol, splitPath[2])
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	// Root commits are compared against the empty tree.
+	parent := commit.Parent(0)
+	if parent != nil {
+		defer parent.Free()
+	}
+	diff, err := diffCommits(repository, parent, commit)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+	deltas, err := diff.NumDeltas()
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to count the deltas of %s",
+			commit.Id(),
+		)
+	}
+
+	result := &FilesResult{
+		Added:    make([]string, 0),
+		Modified: make([]string, 0),
+		Deleted:  make([]string, 0),
+	}
+	for i := 0; i < deltas; i++ {
+		delta, err := diff.Delta(i)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"failed to get delta %d of %s",
+				i,
+				commit.Id(),
+			)
+		}
+		switch delta.Status {
+		case git.DeltaAdded:
+			result.Added = append(result.Added, delta.NewFile.Path)
+		case git.DeltaDeleted:
+			result.Deleted = append(result.Deleted, delta.OldFile.Path)
+		default:
+			// Renames are not detected, so anything else (including type
+			// changes) modified the file in place.
+			result.Modified = append(result.Modified, delta.NewFile.Path)
+		}
+	}
+	return result, nil
+}
+
+// handleDiff returns the changes between two revisions, expressed as either
+// `<rev>` (which is compared against its first parent) or `<old>..<new>`.
+func handleDiff(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*DiffResult, error) {
+	oldCommit, commit, err := resolveDiffRange(ctx, repository, level, protocol, requestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	if oldCommit != nil {
+		defer oldCommit.Free()
+	}
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	result := &DiffResult{
+		New:   commit.Id().String(),
+		Files: make([]*DiffFileResult, 0),
+	}
+	if oldCommit != nil {
+		result.Old = oldCommit.Id().String()
+	}
+	diff, err := diffCommits(repository, oldCommit, commit)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+
+	hunks := 0
+	if err := diff.ForEach(func(delta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
+		if len(result.Files) == maxDiffFiles {
+			result.Truncated = true
+			return nil, errDiffTruncated
+		}
+		file := &DiffFileResult{
+			Status:  diffStatus(delta.Status),
+			OldPath: delta.OldFile.Path,
+			NewPath: delta.NewFile.Path,
+			OldMode: fmt.Sprintf("%06o", delta.OldFile.Mode),
+			NewMode: fmt.Sprintf("%06o", delta.NewFile.Mode),
+			Hunks:   make([]*DiffHunkResult, 0),
+		}
+		if delta.Flags&git.DiffFlagBinary != 0 {
+			// This is detected from the contents of the blobs or their
+			// attributes, so the flag is only set once the file is loaded.
+			file.Binary = true
+			file.OldSize = delta.OldFile.Size
+			file.NewSize = delta.NewFile.Size
+		}
+		result.Files = append(result.Files, file)
+		return func(hunk git.DiffHunk) (git.DiffForEachLineCallback, error) {
+			if hunks == maxDiffHunks {
+				result.Truncated = true
+				return nil, errDiffTruncated
+			}
+			hunks++
+			hunkResult := &DiffHunkResult{
+				Header:   strings.TrimSuffix(hunk.Header, "\n"),
+				OldStart: hunk.OldStart,
+				OldLines: hunk.OldLines,
+				NewStart: hunk.NewStart,
+				NewLines: hunk.NewLines,
+				Lines:    make([]string, 0),
+			}
+			file.Hunks = append(file.Hunks, hunkResult)
+			return func(line git.DiffLine) error {
+				prefix := " "
+				if line.Origin == git.DiffLineAddition {
+					prefix = "+"
+					file.Additions++
+				} else if line.Origin == git.DiffLineDeletion {
+					prefix = "-"
+					file.Deletions++
+				} else if line.Origin != git.DiffLineContext {
+					// End-of-file newline markers are not lines of the file.
+					return nil
+				}
+				hunkResult.Lines = append(
+					hunkResult.Lines,
+					prefix+strings.TrimSuffix(line.Content, "\n"),
+				)
+				return nil
+			}, nil
+		}, nil
+	}, git.DiffDetailLines); err != nil && err != errDiffTruncated {
+		return nil, errors.Wrap(
+			err,
+			"failed to compute the diff",
+		)
+	}
+
+	return result, nil
+}
+
+// handleDiffText writes the diff of a /+diff/ request in the unified format
+// of git-diff(1). Changes to binary files are reported as `Binary files ...
+// differ`. If there are too many files or hunks, only the first ones are
+// written and the Omegaup-Diff-Truncated trailer is set.
+func handleDiffText(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+	w http.ResponseWriter,
+) error {
+	oldCommit, commit, err := resolveDiffRange(ctx, repository, level, protocol, requestPath)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	if oldCommit != nil {
+		defer oldCommit.Free()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if method == "HEAD" {
+		return nil
+	}
+
+	diff, err := diffCommits(repository, oldCommit, commit)
+	if err != nil {
+		return err
+	}
+	defer diff.Free()
+	deltas, err := diff.NumDeltas()
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"failed to count the deltas",
+		)
+	}
+
+	// The diff is written one file at a time, and it is capped like the JSON
+	// diff. Whether it was truncated is only known once it has been written.
+	w.Header().Set("Trailer", "Omegaup-Diff-Truncated")
+	truncated := false
+	hunks := 0
+	for i := 0; i < deltas && !truncated; i++ {
+		if i == maxDiffFiles {
+			truncated = true
+			break
+		}
+		patch, err := diff.Patch(i)
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to get the patch of delta %d",
+				i,
+			)
+		}
+		contents, err := patch.String()
+		patch.Free()
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to format the patch of delta %d",
+				i,
+			)
+		}
+		var fileHunks int
+		contents, fileHunks, truncated = truncatePatchHunks(contents, maxDiffHunks-hunks)
+		hunks += fileHunks
+		if truncated && fileHunks == 0 {
+			// None of the hunks of the file fit, so not even its header is
+			// written.
+			break
+		}
+		if _, err := io.WriteString(w, contents); err != nil {
+			return err
+		}
+	}
+	if truncated {
+		w.Header().Set("Omegaup-Diff-Truncated", "true")
+	}
+	return nil
+}
+
+// truncatePatchHunks returns the patch of a single file with at most maxHunks
+// hunks, along with the number of hunks it has and whether any were removed.
+func truncatePatchHunks(patch string, maxHunks int) (string, int, bool) {
+	hunks := 0
+	for offset := 0; offset < len(patch); {
+		// Every line of a hunk starts with ' ', '+', '-', or '\', so only
+		// the hunk headers start with "@@".
+		if strings.HasPrefix(patch[offset:], "@@ ") {
+			if hunks == maxHunks {
+				return patch[:offset], hunks, true
+			}
+			hunks++
+		}
+		next := strings.IndexByte(patch[offset:], '\n')
+		if next == -1 {
+			break
+		}
+		offset += next + 1
+	}
+	return patch, hunks, false
+}
+
+// handleBlame returns the commit that last changed each line of the file at
+// `<rev>/<path>`.
+func handleBlame(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*BlameResult, error) {
+	splitPath := strings.SplitN(requestPath, "/", 4)
+	if len(splitPath) < 4 || splitPath[2] == "" || splitPath[3] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	rev, blobPath := splitPath[2], splitPath[3]
+
+	commit, err := resolveCommit(ctx, repository, level, protocol, rev)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get the commit's tree",
+		)
+	}
+	defer tree.Free()
+	entry, err := tree.EntryByPath(blobPath)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"path %q not found in %s",
+				blobPath,
+				rev,
+			),
+		)
+	}
+	if entry.Type != git.ObjectBlob {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("path %q in %s is not a blob: %v", blobPath, rev, entry.Type),
+		)
+	}
+
+	odb, err := repository.Odb()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get odb for repository",
+		)
+	}
+	defer odb.Free()
+	size, _, err := odb.ReadHeader(entry.Id)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to read the header of %s",
+			entry.Id,
+		)
+	}
+	if size > BlobDisplayMaxSize {
+		return nil, base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Errorf("blob %s is too large to blame: %d bytes", entry.Id, size),
+		)
+	}
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	opts, err := git.DefaultBlameOptions()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get the default blame options",
+		)
+	}
+	opts.NewestCommit = commit.Id()
+	blame, err := repository.BlameFile(blobPath, &opts)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to blame %q in %s",
+			blobPath,
+			rev,
+		)
+	}
+	defer blame.Free()
+
+	result := &BlameResult{
+		Hunks: make([]*BlameHunkResult, 0, blame.HunkCount()),
+	}
+	for i := 0; i < blame.HunkCount(); i++ {
+		hunk, err := blame.HunkByIndex(i)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"failed to get blame hunk %d",
+				i,
+			)
+		}
+		result.Hunks = append(result.Hunks, &BlameHunkResult{
+			Commit:        hunk.FinalCommitId.String(),
+			Author:        formatSignature(hunk.FinalSignature),
+			StartLine:     int(hunk.FinalStartLineNumber),
+			Lines:         int(hunk.LinesInHunk),
+			OrigPath:      hunk.OrigPath,
+			OrigStartLine: int(hunk.OrigStartLineNumber),
+		})
+	}
+
+	return result, nil
+}
+
+// countUniqueCommits returns the number of commits that are reachable from
+// commitID but not from hiddenID, up to limit. The second return value is true
+// if the count was truncated.
+func countUniqueCommits(
+	repository *git.Repository,
+	commitID *git.Oid,
+	hiddenID *git.Oid,
+	limit int,
+) (int, bool, error) {
+	walk, err := repository.Walk()
+	if err != nil {
+		return 0, false, errors.Wrap(
+			err,
+			"failed to create the repository revwalk",
+		)
+	}
+	defer walk.Free()
+	if err := walk.Push(commitID); err != nil {
+		return 0, false, errors.Wrap(
+			err,
+			"failed to add the commit to the revwalk",
+		)
+	}
+	if err := walk.Hide(hiddenID); err != nil {
+		return 0, false, errors.Wrap(
+			err,
+			"failed to hide the base commit from the revwalk",
+		)
+	}
+
+	count := 0
+	var id git.Oid
+	for {
+		if err := walk.Next(&id); err != nil {
+			if git.IsErrorCode(err, git.ErrorCodeIterOver) {
+				return count, false, nil
+			}
+			return 0, false, errors.Wrap(
+				err,
+				"failed to walk the repository",
+			)
+		}
+		if count == limit {
+			return count, true, nil
+		}
+		count++
+	}
+}
+
+// handleAheadBehind returns the number of commits that rev is ahead and behind
+// of base. This matches what git.Repository.AheadBehind computes, but the
+// walks are capped so that very divergent histories don't become too
+// expensive.
+func handleAheadBehind(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*AheadBehindResult, error) {
+	// Only the last revision can contain slashes.
+	splitPath := strings.SplitN(requestPath, "/", 4)
+	if len(splitPath) < 4 || splitPath[2] == "" || splitPath[3] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+
+	baseCommit, err := resolveCommit(ctx, repository, level, protocol, splitPath[2])
+	if err != nil {
+		return nil, err
+	}
+	defer baseCommit.Free()
+	commit, err := resolveCommit(ctx, repository, level, protocol, splitPath[3])
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	result := &AheadBehindResult{}
+	var aheadTruncated, behindTruncated bool
+	result.Ahead, aheadTruncated, err = countUniqueCommits(
+		repository,
+		commit.Id(),
+		baseCommit.Id(),
+		revWalkLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	result.Behind, behindTruncated, err = countUniqueCommits(
+		repository,
+		baseCommit.Id(),
+		commit.Id(),
+		revWalkLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	result.Truncated = aheadTruncated || behindTruncated
+
+	return result, nil
+}
+
+// handleIsAncestor returns whether the first revision is an ancestor of the
+// second one. As in git-merge-base(1), a commit is an ancestor of itself.
+func handleIsAncestor(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*IsAncestorResult, error) {
+	// Only the last revision can contain slashes.
+	splitPath := strings.SplitN(requestPath, "/", 4)
+	if len(splitPath) < 4 || splitPath[2] == "" || splitPath[3] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+
+	ancestor, err := resolveCommit(ctx, repository, level, protocol, splitPath[2])
+	if err != nil {
+		return nil, err
+	}
+	defer ancestor.Free()
+	descendant, err := resolveCommit(ctx, repository, level, protocol, splitPath[3])
+	if err != nil {
+		return nil, err
+	}
+	defer descendant.Free()
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	if ancestor.Id().Equal(descendant.Id()) {
+		return &IsAncestorResult{IsAncestor: true}, nil
+	}
+	isAncestor, err := repository.DescendantOf(descendant.Id(), ancestor.Id())
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to check whether %s is an ancestor of %s",
+			ancestor.Id(),
+			descendant.Id(),
+		)
+	}
+	return &IsAncestorResult{IsAncestor: isAncestor}, nil
+}
+
+// handleMergeBase returns the best common ancestor of two revisions, as in
+// git-merge-base(1). If the `all` query parameter is set, all the best common
+// ancestors are returned instead, since criss-cross merges can have more than
+// one.
+func handleMergeBase(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+	query url.Values,
+) (any, error) {
+	// Only the last revision can contain slashes.
+	splitPath := strings.SplitN(requestPath, "/", 4)
+	if len(splitPath) < 4 || splitPath[2] == "" || splitPath[3] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	all := false
+	if value := query.Get("all"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf("invalid all: %q", value),
+			)
+		}
+		all = parsed
+	}
+
+	one, err := resolveCommit(ctx, repository, level, protocol, splitPath[2])
+	if err != nil {
+		return nil, err
+	}
+	defer one.Free()
+	two, err := resolveCommit(ctx, repository, level, protocol, splitPath[3])
+	if err != nil {
+		return nil, err
+	}
+	defer two.Free()
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	if !all {
+		mergeBaseID, err := repository.MergeBase(one.Id(), two.Id())
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrNotFound,
+				errors.Wrapf(
+					err,
+					"failed to find a merge base between %s and %s",
+					splitPath[2],
+					splitPath[3],
+				),
+			)
+		}
+		return &MergeBaseResult{Commit: mergeBaseID.String()}, nil
+	}
+
+	mergeBaseIDs, err := repository.MergeBases(one.Id(), two.Id())
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to find the merge bases between %s and %s",
+				splitPath[2],
+				splitPath[3],
+			),
+		)
+	}
+	result := make(MergeBasesResult, 0, len(mergeBaseIDs))
+	for _, mergeBaseID := range mergeBaseIDs {
+		result = append(result, &MergeBaseResult{Commit: mergeBaseID.String()})
+	}
+	return &result, nil
+}
+
+// commitsRequestRevisions returns the revisions of a /+commits request. They
+// can be provided as `rev` parameters in the query string or in a
+// form-encoded body, or as a JSON array of strings in the body.
+func commitsRequestRevisions(r *http.Request) ([]string, error) {
+	if r.Method == "POST" {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			var revs []string
+			if err := json.NewDecoder(r.Body).Decode(&revs); err != nil {
+				return nil, base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Wrap(
+						err,
+						"failed to parse the request",
+					),
+				)
+			}
+			return revs, nil
+		}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Wrap(
+				err,
+				"failed to parse the request",
+			),
+		)
+	}
+	return r.Form["rev"], nil
+}
+
+// handleCommits returns the commits of all the revisions of a /+commits
+// request, which saves clients from making one request per commit.
+func handleCommits(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	r *http.Request,
+) (any, error) {
+	revs, err := commitsRequestRevisions(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		return nil, base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.New("no revisions were requested"),
+		)
+	}
+	if len(revs) > maxCommitsBatchSize {
+		return nil, base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Errorf(
+				"too many revisions requested: %d, maximum %d",
+				len(revs),
+				maxCommitsBatchSize,
+			),
+		)
+	}
+
+	if r.Method == "HEAD" {
+		return nil, nil
+	}
+
+	result := make(CommitsResult, 0, len(revs))
+	for _, rev := range revs {
+		commit, err := resolveCommit(ctx, repository, level, protocol, rev)
+		if err != nil {
+			if base.HasErrorCategory(err, ErrNotFound) {
+				result = append(result, nil)
+				continue
+			}
+			return nil, err
+		}
+		result = append(result, formatCommit(commit, protocol.MaxCommitParents))
+		commit.Free()
+	}
+	return &result, nil
+}
+
+// pathEntryID returns the id of the object at path p in the commit's tree, or
+// nil if it does not exist. An empty path refers to the root tree.
+func pathEntryID(commit *git.Commit, p string) (*git.Oid, error) {
+	if p == "" {
+		return commit.TreeId(), nil
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to get the tree for %s",
+			commit.Id(),
+		)
+	}
+	defer tree.Free()
+	entry, err := tree.EntryByPath(p)
+	if err != nil {
+		return nil, nil
+	}
+	return entry.Id, nil
+}
+
+// handleContributors returns the authors of the commits that modified a path,
+// along with how many commits each one of them made. Commits are considered
+// to modify the path if its contents differ from the ones in all of their
+// parents.
+func handleContributors(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	method string,
+) (*ContributorsResult, error) {
+	splitPath := strings.SplitN(requestPath, "/", 4)
+	if len(splitPath) < 3 || splitPath[2] == "" {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	p := ""
+	if len(splitPath) == 4 {
+		p = strings.Trim(splitPath[3], "/")
+	}
+
+	commit, err := resolveCommit(ctx, repository, level, protocol, splitPath[2])
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	if method == "HEAD" {
+		return nil, nil
+	}
+
+	walk, err := repository.Walk()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to create the repository revwalk",
+		)
+	}
+	defer walk.Free()
+	if err = walk.Push(commit.Id()); err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to add the original object to the revwalk",
+		)
+	}
+
+	contributors := make(map[string]*ContributorResult)
+	truncated := false
+	revWalkCount := 0
+	var walkErr error
+	if err := walk.Iterate(func(current *git.Commit) bool {
+		defer current.Free()
+		revWalkCount++
+		if revWalkCount > revWalkLimit {
+			// Bail out, this walk was too expensive.
+			truncated = true
+			return false
+		}
+
+		id, err := pathEntryID(current, p)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		modified := id != nil
+		for i := uint(0); i < current.ParentCount(); i++ {
+			parent := current.Parent(i)
+			if parent == nil {
+				continue
+			}
+			parentID, err := pathEntryID(parent, p)
+			parent.Free()
+			if err != nil {
+				walkErr = err
+				return false
+			}
+			if (id == nil && parentID == nil) || (id != nil && parentID != nil && id.Equal(parentID)) {
+				modified = false
+				break
+			}
+			modified = true
+		}
+		if !modified {
+			return true
+		}
+
+		author := current.Author()
+		key := fmt.Sprintf("%s <%s>", author.Name, author.Email)
+		contributor, ok := contributors[key]
+		if !ok {
+			contributor = &ContributorResult{
+				Name:  author.Name,
+				Email: author.Email,
+			}
+			contributors[key] = contributor
+		}
+		contributor.Commits++
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to walk the repository",
+		)
+	}
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	result := &ContributorsResult{
+		Contributors: make([]*ContributorResult, 0, len(contributors)),
+		Truncated:    truncated,
+	}
+	for _, contributor := range contributors {
+		result.Contributors = append(result.Contributors, contributor)
+	}
+	sort.Slice(result.Contributors, func(i, j int) bool {
+		a, b := result.Contributors[i], result.Contributors[j]
+		if a.Commits != b.Commits {
+			return a.Commits > b.Commits
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Email < b.Email
+	})
+
+	return result, nil
+}
+
+type archive interface {
+	Close() error
+	Create(path string, mode git.Filemode, size int64) (io.Writer, error)
+	Symlink(path string, target string) error
+}
+
+// archiveFileMode returns the mode of an archive entry for a tree entry with
+// the provided git mode.
+func archiveFileMode(mode git.Filemode) os.FileMode {
+	switch mode {
+	case git.FilemodeTree:
+		return os.ModeDir | 0o755
+	case git.FilemodeBlobExecutable:
+		return 0o755
+	case git.FilemodeLink:
+		return os.ModeSymlink | 0o777
+	default:
+		return 0o644
+	}
+}
+
+type zipArchive zip.Writer
+
+func (a *zipArchive) Close() error {
+	return (*zip.Writer)(a).Close()
+}
+
+func (a *zipArchive) Create(path string, mode git.Filemode, size int64) (io.Writer, error) {
+	hdr := &zip.FileHeader{
+		Name: path,
+	}
+	hdr.SetMode(archiveFileMode(mode))
+	return (*zip.Writer)(a).CreateHeader(hdr)
+}
+
+// Symlink adds a symbolic link to the archive. Like Info-ZIP, this is stored
+// as a file whose contents are the target of the link, with the symlink bit
+// set in its unix mode.
+func (a *zipArchive) Symlink(path string, target string) error {
+	w, err := a.Create(path, git.FilemodeLink, int64(len(target)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+// A tarArchive writes PAX archives, so that paths longer than the 100 bytes
+// that fit in ustar headers, or that are not ASCII, are stored in extended
+// headers instead of being truncated. Short paths still produce plain ustar
+// headers.
+type tarArchive tar.Writer
+
+func (a *tarArchive) Close() error {
+	return (*tar.Writer)(a).Close()
+}
+
+func (a *tarArchive) Create(path string, mode git.Filemode, size int64) (io.Writer, error) {
+	hdr := &tar.Header{
+		Name:   path,
+		Size:   size,
+		Mode:   int64(archiveFileMode(mode).Perm()),
+		Format: tar.FormatPAX,
+	}
+	if mode == git.FilemodeTree {
+		hdr.Typeflag = tar.TypeDir
+	} else {
+		hdr.Typeflag = tar.TypeReg
+	}
+	err := (*tar.Writer)(a).WriteHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return (*tar.Writer)(a), nil
 }
 
-func (a *zipArchive) Create(path string, size int64) (io.Writer, error) {
-	return (*zip.Writer)(a).CreateHeader(&zip.FileHeader{
-		Name: path,
+func (a *tarArchive) Symlink(path string, target string) error {
+	return (*tar.Writer)(a).WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     path,
+		Linkname: target,
+		Mode:     int64(archiveFileMode(git.FilemodeLink).Perm()),
+		Format:   tar.FormatPAX,
+	})
+}
+
+func handleArchive(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	requestPath string,
+	r *http.Request,
+	w http.ResponseWriter,
+) error {
+	if !protocol.ArchiveCallback(ctx, repository, level) {
+		return base.ErrorWithCategory(
+			ErrForbidden,
+			errors.New("archives are not allowed"),
+		)
+	}
+	splitPath := strings.SplitN(requestPath, "/", 3)
+	if len(splitPath) < 3 {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("invalid path: %s", requestPath),
+		)
+	}
+	rev := ""
+	contentType := "application/zip"
+	for extension, mimeType := range map[string]string{
+		".zip":     "application/zip",
+		".tar":     "application/x-tar",
+		".tar.gz":  "application/gzip",
+		".tar.bz2": "application/x-bzip2",
+	} {
+		if !strings.HasSuffix(splitPath[2], extension) {
+			continue
+		}
+
+		rev = strings.TrimSuffix(splitPath[2], extension)
+		contentType = mimeType
+		break
+	}
+	if rev == "" {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.New("empty revision"),
+		)
+	}
+	checksum := r.URL.Query().Get("checksum")
+	if checksum != "" && checksum != "sha256" {
+		return base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Errorf("unsupported checksum: %s", checksum),
+		)
+	}
+	odb, err := repository.Odb()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get repository odb")
+	}
+	defer odb.Free()
+	obj, err := revparseSingle(ctx, repository, rev)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to parse revision %s",
+				rev,
+			),
+		)
+	}
+	defer obj.Free()
+	var tree *git.Tree
+	if obj.Type() == git.ObjectCommit {
+		if err := isCommitIDReachable(
+			ctx,
+			repository,
+			level,
+			protocol,
+			obj.Id(),
+		); err != nil {
+			return err
+		}
+
+		commit, err := obj.AsCommit()
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to get object for %s",
+				rev,
+			)
+		}
+		defer commit.Free()
+		tree, err = commit.Tree()
+		if err != nil {
+			return errors.Wrap(
+				err,
+				"failed to get the commit's tree",
+			)
+		}
+		defer tree.Free()
+	} else if obj.Type() == git.ObjectTree {
+		if err := checkTreeRevision(ctx, repository, level, protocol, rev); err != nil {
+			return err
+		}
+		tree, err = obj.AsTree()
+		if err != nil {
+			return errors.Wrap(
+				err,
+				"failed to get the tree",
+			)
+		}
+		defer tree.Free()
+	} else {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("revision %s is not a commit: %v", rev, obj.Type()),
+		)
+	}
+
+	// The tree is checked before anything is written so that the error can
+	// still be reported to the client.
+	archiveObjectLimit := protocol.ArchiveObjectLimit
+	if archiveObjectLimit == 0 {
+		archiveObjectLimit = objectLimit
+	}
+	objectCount := 0
+	var headUncompressedSize int64
+	if err := tree.Walk(func(parent string, entry *git.TreeEntry) error {
+		objectCount++
+		if objectCount > archiveObjectLimit {
+			return ErrObjectLimitExceeded
+		}
+		if r.Method == "HEAD" && entry.Type == git.ObjectBlob {
+			// HEAD requests get the uncompressed size as a header, since the
+			// archive is not generated. Only the headers of the blobs are read.
+			size, _, err := odb.ReadHeader(entry.Id)
+			if err != nil {
+				return errors.Wrapf(
+					err,
+					"failed to read the header of object %s",
+					entry.Id,
+				)
+			}
+			headUncompressedSize += int64(size)
+		}
+		return nil
+	}); err != nil {
+		if errors.Is(err, ErrObjectLimitExceeded) {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Wrapf(
+					ErrObjectLimitExceeded,
+					"tree %s has more than %d objects",
+					tree.Id(),
+					archiveObjectLimit,
+				),
+			)
+		}
+		return errors.Wrap(
+			err,
+			"failed to walk the repository",
+		)
+	}
+
+	if r.Method == "HEAD" {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Omegaup-Uncompressed-Size", strconv.FormatInt(headUncompressedSize, 10))
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(
+			ctx.Err(),
+			"context cancelled",
+		)
+	default:
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Trailer", "Omegaup-Uncompressed-Size")
+
+	// The checksum is computed over the archive bytes as they are streamed.
+	var out io.Writer = w
+	var archiveHash hash.Hash
+	if checksum == "sha256" {
+		w.Header().Add("Trailer", "Omegaup-Archive-SHA256")
+		archiveHash = sha256.New()
+		out = io.MultiWriter(w, archiveHash)
+	}
+
+	var z archive
+	var compressor io.WriteCloser
+	if contentType == "application/gzip" {
+		compressor = gzip.NewWriter(out)
+	} else if contentType == "application/x-bzip2" {
+		bz, err := bzip2.NewWriter(out, nil)
+		if err != nil {
+			return errors.Wrap(
+				err,
+				"failed to create the bzip2 stream",
+			)
+		}
+		compressor = bz
+	}
+	if compressor != nil {
+		z = (*tarArchive)(tar.NewWriter(compressor))
+	} else if contentType == "application/x-tar" {
+		z = (*tarArchive)(tar.NewWriter(out))
+	} else {
+		z = (*zipArchive)(zip.NewWriter(out))
+	}
+
+	var uncompressedSize int64
+	err = tree.Walk(func(parent string, entry *git.TreeEntry) error {
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(
+				ctx.Err(),
+				"context cancelled",
+			)
+		default:
+		}
+		fullPath := path.Join(parent, entry.Name)
+		if entry.Type == git.ObjectTree {
+			_, err := z.Create(fullPath+"/", git.FilemodeTree, 0)
+			if err != nil {
+				return errors.Wrap(
+					err,
+					"failed to create zip header",
+				)
+			}
+			return nil
+		}
+
+		// Object is a blob. Only its header is read to get its size, so that
+		// its contents are not loaded into memory.
+		size, _, err := odb.ReadHeader(entry.Id)
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to read the header of object %s",
+				entry.Id,
+			)
+		}
+		uncompressedSize += int64(size)
+		if entry.Filemode == git.FilemodeLink {
+			// The contents of symbolic links are their targets, which are small.
+			blob, err := repository.LookupBlob(entry.Id)
+			if err != nil {
+				return errors.Wrapf(
+					err,
+					"failed to lookup object %s",
+					entry.Id,
+				)
+			}
+			defer blob.Free()
+			if err := z.Symlink(fullPath, string(blob.Contents())); err != nil {
+				return errors.Wrap(
+					err,
+					"failed to create symlink",
+				)
+			}
+			return nil
+		}
+		w, err := z.Create(fullPath, entry.Filemode, int64(size))
+		if err != nil {
+			return errors.Wrap(
+				err,
+				"failed to create zip writer",
+			)
+		}
+
+		// Attempt to uncompress this object on the fly from the gzip stream
+		// rather than decompressing completely it in memory. This is only
+		// possible if the object is not deltified.
+		stream, err := odb.NewReadStream(entry.Id)
+		if err == nil {
+			defer stream.Free()
+			_, err = io.Copy(w, stream)
+			if err != nil {
+				return errors.Wrapf(err, "failed to copy blob stream %s", entry.Id)
+			}
+			return nil
+		}
+
+		blob, err := repository.LookupBlob(entry.Id)
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to lookup object %s",
+				entry.Id,
+			)
+		}
+		defer blob.Free()
+		if _, err := w.Write(blob.Contents()); err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to write object %s",
+				entry.Id,
+			)
+		}
+		return nil
 	})
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"failed to walk the repository",
+		)
+	}
+	w.Header().Set("Omegaup-Uncompressed-Size", strconv.FormatInt(uncompressedSize, 10))
+
+	// The archive is only closed once it was completely written, since closing
+	// it writes its trailing metadata. Neither the archive nor the compressor
+	// hold any resources that need to be released if that never happens.
+	if err := z.Close(); err != nil {
+		return errors.Wrap(
+			err,
+			"failed to close the archive",
+		)
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return errors.Wrap(
+				err,
+				"failed to close the compressed stream",
+			)
+		}
+	}
+	if archiveHash != nil {
+		w.Header().Set("Omegaup-Archive-SHA256", hex.EncodeToString(archiveHash.Sum(nil)))
+	}
+	return nil
 }
 
-type tarArchive tar.Writer
+// checkObjectExists returns an error if the object with the provided id does
+// not exist in the repository or, if it's a commit or a tag, if it cannot be
+// shown because of the same reachability checks that handleShow does. Only
+// the object's header is read.
+func checkObjectExists(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	rev string,
+) error {
+	oid, err := git.NewOid(rev)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"invalid object id %s",
+				rev,
+			),
+		)
+	}
+	odb, err := repository.Odb()
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"failed to get odb for repository",
+		)
+	}
+	defer odb.Free()
+	_, objectType, err := odb.ReadHeader(oid)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to read the header of %s",
+				rev,
+			),
+		)
+	}
+	if objectType != git.ObjectCommit && objectType != git.ObjectTag {
+		return nil
+	}
+	return isObjectIDReachable(ctx, repository, level, protocol, oid, objectType)
+}
 
-func (a *tarArchive) Close() error {
-	return (*tar.Writer)(a).Close()
+// treeContainsObject returns whether the object with the provided id is the
+// tree with id treeID or any of its (transitive) entries. Trees that are in
+// seen were already searched, so they are skipped.
+func treeContainsObject(
+	repository *git.Repository,
+	treeID *git.Oid,
+	oid *git.Oid,
+	seen map[git.Oid]struct{},
+) (bool, error) {
+	if treeID.Equal(oid) {
+		return true, nil
+	}
+	if _, ok := seen[*treeID]; ok {
+		return false, nil
+	}
+	seen[*treeID] = struct{}{}
+
+	tree, err := repository.LookupTree(treeID)
+	if err != nil {
+		return false, errors.Wrapf(
+			err,
+			"failed to look up tree %s",
+			treeID,
+		)
+	}
+	defer tree.Free()
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		entry := tree.EntryByIndex(i)
+		if entry.Id.Equal(oid) {
+			return true, nil
+		}
+		if entry.Type != git.ObjectTree {
+			continue
+		}
+		found, err := treeContainsObject(repository, entry.Id, oid, seen)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
 }
 
-func (a *tarArchive) Create(path string, size int64) (io.Writer, error) {
-	hdr := &tar.Header{
-		Name: path,
-		Size: size,
+// isObjectIDReachable returns whether an object is reachable from any of the
+// refs that are viewable by the requestor. Annotated tags need to be the
+// target of one of the refs, and trees and blobs need to be contained in the
+// tree of a reachable commit. Since finding those requires walking the trees
+// of the commits, only the newest revWalkLimit commits are searched.
+func isObjectIDReachable(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	oid *git.Oid,
+	objectType git.ObjectType,
+) error {
+	if objectType == git.ObjectCommit {
+		return isCommitIDReachable(ctx, repository, level, protocol, oid)
 	}
-	if strings.HasSuffix(path, "/") {
-		hdr.Typeflag = tar.TypeDir
-		hdr.Mode = 0o755
-	} else {
-		hdr.Typeflag = tar.TypeReg
-		hdr.Mode = 0o644
+
+	viewableReferences, err := lookupViewableReferences(ctx, repository, level, protocol)
+	if err != nil {
+		return err
 	}
-	err := (*tar.Writer)(a).WriteHeader(hdr)
+	if objectType == git.ObjectTag {
+		for _, target := range viewableReferences {
+			if target != nil && target.Equal(oid) {
+				return nil
+			}
+		}
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf(
+				"tag %s is not the target of any of the viewable references",
+				oid,
+			),
+		)
+	}
+
+	walk, err := repository.Walk()
 	if err != nil {
-		return nil, err
+		return errors.Wrap(
+			err,
+			"failed to create revwalk",
+		)
 	}
-	return (*tar.Writer)(a), nil
+	defer walk.Free()
+	walk.Sorting(git.SortTime)
+	for _, target := range viewableReferences {
+		if target == nil {
+			continue
+		}
+		// References that don't point to commits cannot be walked.
+		walk.Push(target)
+	}
+
+	seen := make(map[git.Oid]struct{})
+	found := false
+	revWalkCount := 0
+	var walkErr error
+	if err := walk.Iterate(func(current *git.Commit) bool {
+		defer current.Free()
+		revWalkCount++
+		if revWalkCount > revWalkLimit {
+			// Bail out, this walk was too expensive.
+			return false
+		}
+		found, walkErr = treeContainsObject(repository, current.TreeId(), oid, seen)
+		return !found && walkErr == nil
+	}); err != nil {
+		return errors.Wrap(
+			err,
+			"failed to walk the commits",
+		)
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+	if !found {
+		// Even though the object itself exists, we tell the caller that it
+		// doesn't, since it was not reachable from any of the references that they
+		// can view.
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf(
+				"object %s not reachable from any of the viewable references",
+				oid,
+			),
+		)
+	}
+	return nil
 }
 
-func handleArchive(
+// handleObject writes the raw contents of the object at `/+object/<oid>`, as
+// git-cat-file(1) would. The type of the object is sent in the
+// ObjectTypeHeader header.
+func handleObject(
 	ctx context.Context,
 	repository *git.Repository,
 	level AuthorizationLevel,
 	protocol *GitProtocol,
 	requestPath string,
-	r *http.Request,
+	method string,
 	w http.ResponseWriter,
 ) error {
 	splitPath := strings.SplitN(requestPath, "/", 3)
-	if len(splitPath) < 3 {
+	if len(splitPath) != 3 || !isGitObjectID(splitPath[2]) {
 		return base.ErrorWithCategory(
 			ErrNotFound,
 			errors.Errorf("invalid path: %s", requestPath),
 		)
 	}
-	rev := ""
-	contentType := "application/zip"
-	for extension, mimeType := range map[string]string{
-		".zip":    "application/zip",
-		".tar.gz": "application/gzip",
-	} {
-		if !strings.HasSuffix(splitPath[2], extension) {
-			continue
-		}
-
-		rev = strings.TrimSuffix(splitPath[2], extension)
-		contentType = mimeType
-		break
-	}
-	if rev == "" {
+	oid, err := git.NewOid(splitPath[2])
+	if err != nil {
 		return base.ErrorWithCategory(
 			ErrNotFound,
-			errors.New("empty revision"),
+			errors.Wrapf(
+				err,
+				"invalid object id %s",
+				splitPath[2],
+			),
 		)
 	}
 	odb, err := repository.Odb()
 	if err != nil {
-		return errors.Wrapf(err, "failed to get repository odb")
+		return errors.Wrap(
+			err,
+			"failed to get odb for repository",
+		)
 	}
 	defer odb.Free()
-	obj, err := repository.RevparseSingle(rev)
+	size, objectType, err := odb.ReadHeader(oid)
 	if err != nil {
 		return base.ErrorWithCategory(
 			ErrNotFound,
 			errors.Wrapf(
 				err,
-				"failed to parse revision %s",
-				rev,
+				"failed to read the header of %s",
+				oid,
 			),
 		)
 	}
-	defer obj.Free()
-	var tree *git.Tree
-	if obj.Type() == git.ObjectCommit {
-		if err := isCommitIDReachable(
-			ctx,
-			repository,
-			level,
-			protocol,
-			obj.Id(),
-		); err != nil {
-			return err
-		}
+	if err := isObjectIDReachable(ctx, repository, level, protocol, oid, objectType); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(ObjectTypeHeader, strings.ToLower(objectType.String()))
+	w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+	if method == "HEAD" {
+		return nil
+	}
+
+	reader, err := openObjectReader(odb, oid, size, protocol.MaxBufferedBlobSize)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if _, err := io.Copy(w, reader); err != nil {
+		return errors.Wrapf(
+			err,
+			"failed to write object %s",
+			oid,
+		)
+	}
+	return nil
+}
+
+// An objectReader reads the contents of an object from the odb, and releases
+// it once it is closed.
+type objectReader struct {
+	io.Reader
+	free func()
+}
+
+func (r *objectReader) Close() error {
+	r.free()
+	return nil
+}
+
+// openObjectReader returns a reader of the contents of the object with the
+// provided id and size. The object is streamed if possible so that large blobs
+// are not completely loaded in memory. This is only possible if the object is
+// loose, so any other object is loaded, unless it is larger than
+// maxBufferedSize.
+func openObjectReader(
+	odb *git.Odb,
+	oid *git.Oid,
+	size uint64,
+	maxBufferedSize int64,
+) (io.ReadCloser, error) {
+	stream, err := odb.NewReadStream(oid)
+	if err == nil {
+		return &objectReader{Reader: stream, free: stream.Free}, nil
+	}
+
+	if size > uint64(maxBufferedSize) {
+		return nil, base.ErrorWithCategory(
+			ErrNotAcceptable,
+			errors.Errorf(
+				"object %s cannot be streamed and is too large: %d bytes, maximum %d",
+				oid,
+				size,
+				maxBufferedSize,
+			),
+		)
+	}
+	obj, err := odb.Read(oid)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to read object %s",
+			oid,
+		)
+	}
+	return &objectReader{Reader: bytes.NewReader(obj.Data()), free: obj.Free}, nil
+}
 
-		commit, err := obj.AsCommit()
-		if err != nil {
-			return errors.Wrapf(
-				err,
-				"failed to get object for %s",
-				rev,
-			)
-		}
-		defer commit.Free()
-		tree, err = commit.Tree()
+// writeRawBlob writes the contents of the blob with its content type, unless
+// octetStream is set, in which case it is served as
+// application/octet-stream.
+func writeRawBlob(
+	repository *git.Repository,
+	protocol *GitProtocol,
+	blob *rawBlob,
+	octetStream bool,
+	w http.ResponseWriter,
+) error {
+	var r io.Reader = bytes.NewReader(blob.contents)
+	if blob.contents == nil {
+		odb, err := repository.Odb()
 		if err != nil {
 			return errors.Wrap(
 				err,
-				"failed to get the commit's tree",
-			)
-		}
-		defer tree.Free()
-	} else if obj.Type() == git.ObjectTree {
-		// Trees are allowed only if they are expressed as the full object id.
-		if !isGitObjectID(rev) {
-			return base.ErrorWithCategory(
-				ErrNotFound,
-				errors.Errorf("%q is not a valid tree-id", rev),
+				"failed to get odb for repository",
 			)
 		}
-		tree, err = obj.AsTree()
+		defer odb.Free()
+		reader, err := openObjectReader(odb, blob.id, blob.size, protocol.MaxBufferedBlobSize)
 		if err != nil {
-			return errors.Wrap(
-				err,
-				"failed to get the tree",
-			)
+			return err
 		}
-		defer tree.Free()
-	} else {
-		return base.ErrorWithCategory(
-			ErrNotFound,
-			errors.Errorf("revision %s is not a commit: %v", rev, obj.Type()),
+		defer reader.Close()
+		r = reader
+	}
+
+	contentType := "application/octet-stream"
+	if !octetStream {
+		// The content type is detected from the first 512 bytes at most.
+		br := bufio.NewReaderSize(r, 512)
+		head, _ := br.Peek(512)
+		contentType = blobContentType(blob.path, head)
+		r = br
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatUint(blob.size, 10))
+	if _, err := io.Copy(w, r); err != nil {
+		return errors.Wrapf(
+			err,
+			"failed to write blob %s",
+			blob.id,
 		)
 	}
+	return nil
+}
 
-	if r.Method == "HEAD" {
+// blobObjectID returns the id of the object rev (an object id) if it is a
+// blob, or nil otherwise. Only the header of the object is read.
+func blobObjectID(repository *git.Repository, rev string) *git.Oid {
+	oid, err := git.NewOid(rev)
+	if err != nil {
+		return nil
+	}
+	odb, err := repository.Odb()
+	if err != nil {
+		return nil
+	}
+	defer odb.Free()
+	if _, objectType, err := odb.ReadHeader(oid); err != nil || objectType != git.ObjectBlob {
 		return nil
 	}
+	return oid
+}
 
-	select {
-	case <-ctx.Done():
-		return errors.Wrap(
-			ctx.Err(),
-			"context cancelled",
+// blobEntryID returns the id of the blob at path p in the tree of obj, or nil
+// if there is no blob there. Unlike RevparseSingle, this does not load the
+// blob.
+func blobEntryID(obj *git.Object, p string) (*git.Oid, error) {
+	treeObj, err := obj.Peel(git.ObjectTree)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to get the tree of %s",
+			obj.Id(),
 		)
-	default:
 	}
+	defer treeObj.Free()
+	tree, err := treeObj.AsTree()
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to get the tree of %s",
+			obj.Id(),
+		)
+	}
+	defer tree.Free()
+	entry, err := tree.EntryByPath(p)
+	if err != nil || entry.Type != git.ObjectBlob {
+		return nil, nil
+	}
+	return entry.Id, nil
+}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Trailer", "Omegaup-Uncompressed-Size")
-	var z archive
-	if contentType == "application/gzip" {
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
+// handleShowBlob returns the representation of the blob with the provided id.
+// The blob is only loaded if its contents are going to be included in the
+// JSON representation, or if it is small enough to be a Git LFS pointer. The
+// raw contents of any other blob are streamed when the response is written.
+func handleShowBlob(
+	ctx context.Context,
+	repository *git.Repository,
+	protocol *GitProtocol,
+	blobID *git.Oid,
+	blobPath string,
+	method string,
+	accept string,
+) (any, error) {
+	contentType, err := negotiateContentType(accept, "application/json", "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
 
-		z = (*tarArchive)(tar.NewWriter(gz))
-	} else {
-		z = (*zipArchive)(zip.NewWriter(w))
+	if method == "HEAD" {
+		return nil, nil
 	}
-	defer z.Close()
 
-	var uncompressedSize int64
-	err = tree.Walk(func(parent string, entry *git.TreeEntry) error {
-		select {
-		case <-ctx.Done():
-			return errors.Wrap(
-				ctx.Err(),
-				"context cancelled",
-			)
-		default:
+	odb, err := repository.Odb()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get odb for repository",
+		)
+	}
+	defer odb.Free()
+	size, _, err := odb.ReadHeader(blobID)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(
+				err,
+				"failed to read the header of %s",
+				blobID,
+			),
+		)
+	}
+
+	if contentType == "application/octet-stream" {
+		result := &rawBlob{
+			path: blobPath,
+			id:   blobID,
+			size: size,
 		}
-		fullPath := path.Join(parent, entry.Name)
-		if entry.Type == git.ObjectTree {
-			_, err := z.Create(fullPath+"/", 0)
-			if err != nil {
-				return errors.Wrap(
-					err,
-					"failed to create zip header",
-				)
-			}
-			return nil
+		if size > lfsPointerMaxSize {
+			return result, nil
 		}
-
-		blob, err := repository.LookupBlob(entry.Id)
+		blob, err := repository.LookupBlob(blobID)
 		if err != nil {
-			return errors.Wrapf(
+			return nil, errors.Wrapf(
 				err,
-				"failed to lookup object %s",
-				entry.Id,
+				"failed to get blob %s",
+				blobID,
 			)
 		}
 		defer blob.Free()
-
-		// Object is a blob.
-		uncompressedSize += blob.Size()
-		w, err := z.Create(fullPath, blob.Size())
+		object, err := resolveLFSPointer(ctx, protocol, blob.Contents())
 		if err != nil {
-			return errors.Wrap(
-				err,
-				"failed to create zip writer",
-			)
+			return nil, err
 		}
-
-		// Attempt to uncompress this object on the fly from the gzip stream
-		// rather than decompressing completely it in memory. This is only
-		// possible if the object is not deltified.
-		stream, err := odb.NewReadStream(entry.Id)
-		if err == nil {
-			defer stream.Free()
-			_, err = io.Copy(w, stream)
-			if err != nil {
-				return errors.Wrapf(err, "failed to copy blob stream %s", entry.Id)
-			}
-		} else {
-			if _, err := w.Write(blob.Contents()); err != nil {
-				return errors.Wrapf(
-					err,
-					"failed to write object %s",
-					entry.Id,
-				)
-			}
+		if object != nil {
+			return object, nil
 		}
-		return nil
-	})
+		result.contents = blob.Contents()
+		return result, nil
+	}
+
+	if size >= BlobDisplayMaxSize {
+		// The contents are not displayed anyway.
+		return &BlobResult{
+			ID:   blobID.String(),
+			Size: int64(size),
+		}, nil
+	}
+	blob, err := repository.LookupBlob(blobID)
 	if err != nil {
-		return errors.Wrap(
+		return nil, errors.Wrapf(
 			err,
-			"failed to walk the repository",
+			"failed to get blob %s",
+			blobID,
 		)
 	}
-	w.Header().Set("Omegaup-Uncompressed-Size", strconv.FormatInt(uncompressedSize, 10))
-	return nil
+	defer blob.Free()
+	return formatBlob(blob), nil
 }
 
 func handleShow(
@@ -727,7 +3759,7 @@ func handleShow(
 	protocol *GitProtocol,
 	requestPath string,
 	method string,
-	acceptMIMEType string,
+	accept string,
 ) (any, error) {
 	splitPath := strings.SplitN(requestPath, "/", 4)
 	if len(splitPath) < 3 {
@@ -738,7 +3770,20 @@ func handleShow(
 	}
 	rev := splitPath[2]
 
-	obj, err := repository.RevparseSingle(rev)
+	if method == "HEAD" && len(splitPath) == 3 && isGitObjectID(rev) {
+		// This is just an existence check, so the object does not need to be
+		// fully parsed.
+		return nil, checkObjectExists(ctx, repository, level, protocol, rev)
+	}
+	if len(splitPath) == 3 && isGitObjectID(rev) {
+		// Blobs can be arbitrarily large, so they are not looked up (which would
+		// load them completely) when they are requested by their object id.
+		if blobID := blobObjectID(repository, rev); blobID != nil {
+			return handleShowBlob(ctx, repository, protocol, blobID, "", method, accept)
+		}
+	}
+
+	obj, err := revparseSingle(ctx, repository, rev)
 	if err != nil {
 		return nil, base.ErrorWithCategory(
 			ErrNotFound,
@@ -751,6 +3796,26 @@ func handleShow(
 	}
 	defer obj.Free()
 
+	if obj.Type() == git.ObjectTag && (!isGitObjectID(rev) || len(splitPath) > 3) {
+		// Annotated tags that are requested by name (e.g. /+/v1.0) or with a
+		// path are peeled to the commit they point to, so that the commit is
+		// subject to the same reachability checks as any other commit. Tag
+		// objects themselves can only be shown through their object id.
+		peeled, err := obj.Peel(git.ObjectCommit)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrNotFound,
+				errors.Wrapf(
+					err,
+					"failed to peel tag %s to a commit",
+					rev,
+				),
+			)
+		}
+		defer peeled.Free()
+		obj = peeled
+	}
+
 	if obj.Type() == git.ObjectCommit {
 		if err := isCommitIDReachable(
 			ctx,
@@ -762,10 +3827,28 @@ func handleShow(
 			return nil, err
 		}
 
-		if len(splitPath) > 3 {
+		if len(splitPath) > 3 && splitPath[3] == "" {
+			// URLs of the form /+/rev/ (note the trailing slash). This shows the
+			// root tree of the commit.
+			obj, err = obj.Peel(git.ObjectTree)
+			if err != nil {
+				return nil, errors.Wrapf(
+					err,
+					"failed to get the tree of %s",
+					rev,
+				)
+			}
+			defer obj.Free()
+		} else if len(splitPath) > 3 {
 			// URLs of the form /+/rev/path. This shows either a tree or a blob.
+			// Blobs are resolved through the tree so that they are not loaded.
+			if blobID, err := blobEntryID(obj, splitPath[3]); err != nil {
+				return nil, err
+			} else if blobID != nil {
+				return handleShowBlob(ctx, repository, protocol, blobID, splitPath[3], method, accept)
+			}
 			rev = fmt.Sprintf("%s:%s", rev, splitPath[3])
-			obj, err = repository.RevparseSingle(rev)
+			obj, err = revparseSingle(ctx, repository, rev)
 			if err != nil {
 				return nil, base.ErrorWithCategory(
 					ErrNotFound,
@@ -780,11 +3863,8 @@ func handleShow(
 		}
 	} else if obj.Type() == git.ObjectTree {
 		// URLs of the form /+/tree-id/path.
-		if !isGitObjectID(rev) {
-			return nil, base.ErrorWithCategory(
-				ErrNotFound,
-				errors.Errorf("%q is not a valid tree-id", rev),
-			)
+		if err := checkTreeRevision(ctx, repository, level, protocol, rev); err != nil {
+			return nil, err
 		}
 		if len(splitPath) > 3 {
 			tree, err := obj.AsTree()
@@ -804,6 +3884,9 @@ func handleShow(
 					),
 				)
 			}
+			if entry.Type == git.ObjectBlob {
+				return handleShowBlob(ctx, repository, protocol, entry.Id, splitPath[3], method, accept)
+			}
 			obj, err = repository.Lookup(entry.Id)
 			if err != nil {
 				return nil, base.ErrorWithCategory(
@@ -835,6 +3918,31 @@ func handleShow(
 				errors.Errorf("cannot use paths with an object-id for %q", splitPath),
 			)
 		}
+		if obj.Type() == git.ObjectTag {
+			// Tag objects are subject to the same checks as the references that
+			// are listed, so they can only be shown if a viewable tag points to
+			// them.
+			if err := isObjectIDReachable(
+				ctx,
+				repository,
+				level,
+				protocol,
+				obj.Id(),
+				git.ObjectTag,
+			); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Only trees and blobs have a raw representation.
+	offeredTypes := []string{"application/json"}
+	if obj.Type() == git.ObjectTree || obj.Type() == git.ObjectBlob {
+		offeredTypes = append(offeredTypes, "application/octet-stream")
+	}
+	contentType, err := negotiateContentType(accept, offeredTypes...)
+	if err != nil {
+		return nil, err
 	}
 
 	if method == "HEAD" {
@@ -852,25 +3960,31 @@ func handleShow(
 		}
 		defer commit.Free()
 
-		return formatCommit(commit), nil
+		return formatCommit(commit, protocol.MaxCommitParents), nil
 	} else if obj.Type() == git.ObjectTree {
+		if contentType == "application/octet-stream" {
+			return readRawTree(repository, obj.Id())
+		}
+
 		return formatTree(repository, obj.Id())
 	} else if obj.Type() == git.ObjectBlob {
-		blob, err := obj.AsBlob()
+		blobPath := ""
+		if len(splitPath) > 3 {
+			blobPath = splitPath[3]
+		}
+		return handleShowBlob(ctx, repository, protocol, obj.Id(), blobPath, method, accept)
+	} else if obj.Type() == git.ObjectTag {
+		tag, err := obj.AsTag()
 		if err != nil {
 			return nil, errors.Wrapf(
 				err,
-				"failed to get blob for %s",
+				"failed to get tag for %s",
 				rev,
 			)
 		}
-		defer blob.Free()
-
-		if acceptMIMEType == "application/octet-stream" {
-			return blob.Contents(), nil
-		}
+		defer tag.Free()
 
-		return formatBlob(blob), nil
+		return formatTag(tag), nil
 	}
 
 	return nil, base.ErrorWithCategory(
@@ -894,7 +4008,7 @@ func handleBrowse(
 	w http.ResponseWriter,
 ) error {
 	method := r.Method
-	acceptMIMEType := r.Header.Get("Accept")
+	accept := r.Header.Get("Accept")
 	txn := tracing.FromContext(ctx)
 	repository, err := openRepository(ctx, repositoryPath)
 	if err != nil {
@@ -913,7 +4027,7 @@ func handleBrowse(
 				"err": err,
 			},
 		)
-		if err := lockfile.RLock(); err != nil {
+		if err := lockfile.RLockContext(ctx); err != nil {
 			protocol.log.Error(
 				"Failed to acquire the lockfile",
 				map[string]interface{}{
@@ -932,9 +4046,95 @@ func handleBrowse(
 		if err != nil {
 			return err
 		}
+	} else if requestPath == "/+default-branch" || requestPath == "/+default-branch/" {
+		txn.SetName(method + " /:repo/+default-branch/")
+		result, err = handleDefaultBranch(ctx, repository, level, protocol, method)
+		if err != nil {
+			return err
+		}
+	} else if requestPath == "/+overview" || requestPath == "/+overview/" {
+		txn.SetName(method + " /:repo/+overview/")
+		result, err = handleOverview(ctx, repository, level, protocol, method)
+		if err != nil {
+			return err
+		}
+	} else if requestPath == "/+commits" || requestPath == "/+commits/" {
+		txn.SetName(method + " /:repo/+commits/")
+		result, err = handleCommits(ctx, repository, level, protocol, r)
+		if err != nil {
+			return err
+		}
 	} else if strings.HasPrefix(requestPath, "/+log/") {
 		txn.SetName(method + " /:repo/+log/")
-		result, err = handleLog(ctx, repository, level, protocol, requestPath, method)
+		if contentType, _ := negotiateContentType(accept, "application/json", "text/plain"); contentType == "text/plain" {
+			err = handleLogText(ctx, repository, level, protocol, requestPath, method, r.URL.Query(), w)
+		} else {
+			result, err = handleLog(ctx, repository, level, protocol, requestPath, method, r.URL.Query())
+		}
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+blame/") {
+		txn.SetName(method + " /:repo/+blame/")
+		result, err = handleBlame(ctx, repository, level, protocol, requestPath, method)
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+diff/") {
+		txn.SetName(method + " /:repo/+diff/")
+		if contentType, _ := negotiateContentType(accept, "application/json", "text/plain"); contentType == "text/plain" {
+			err = handleDiffText(ctx, repository, level, protocol, requestPath, method, w)
+		} else {
+			result, err = handleDiff(ctx, repository, level, protocol, requestPath, method)
+		}
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+files/") {
+		txn.SetName(method + " /:repo/+files/")
+		result, err = handleFiles(ctx, repository, level, protocol, requestPath, method)
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+diffstat/") {
+		txn.SetName(method + " /:repo/+diffstat/")
+		result, err = handleDiffStat(ctx, repository, level, protocol, requestPath, method)
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+ahead-behind/") {
+		txn.SetName(method + " /:repo/+ahead-behind/")
+		result, err = handleAheadBehind(ctx, repository, level, protocol, requestPath, method)
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+is-ancestor/") {
+		txn.SetName(method + " /:repo/+is-ancestor/")
+		result, err = handleIsAncestor(ctx, repository, level, protocol, requestPath, method)
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+merge-base/") {
+		txn.SetName(method + " /:repo/+merge-base/")
+		result, err = handleMergeBase(ctx, repository, level, protocol, requestPath, method, r.URL.Query())
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+contributors/") {
+		txn.SetName(method + " /:repo/+contributors/")
+		result, err = handleContributors(ctx, repository, level, protocol, requestPath, method)
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+reflog/") {
+		txn.SetName(method + " /:repo/+reflog/")
+		result, err = handleReflog(ctx, repository, level, protocol, requestPath, method)
+		if err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(requestPath, "/+object/") {
+		txn.SetName(method + " /:repo/+object/")
+		err = handleObject(ctx, repository, level, protocol, requestPath, method, w)
 		if err != nil {
 			return err
 		}
@@ -946,7 +4146,7 @@ func handleBrowse(
 		}
 	} else if strings.HasPrefix(requestPath, "/+/") {
 		txn.SetName(method + " /:repo/+/")
-		result, err = handleShow(ctx, repository, level, protocol, requestPath, method, acceptMIMEType)
+		result, err = handleShow(ctx, repository, level, protocol, requestPath, method, accept)
 		if err != nil {
 			return err
 		}
@@ -964,11 +4164,40 @@ func handleBrowse(
 		return nil
 	}
 
+	if object, ok := result.(*lfsObject); ok {
+		defer object.r.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// The length is the size of the LFS object declared in the pointer, not
+		// the size of the pointer blob itself.
+		w.Header().Set("Content-Length", strconv.FormatInt(object.pointer.Size, 10))
+		w.Header().Set("Omegaup-LFS-OID", object.pointer.OID)
+		if _, err := io.CopyN(w, object.r, object.pointer.Size); err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to write LFS object %s",
+				object.pointer.OID,
+			)
+		}
+		return nil
+	}
+	if blob, ok := result.(*rawBlob); ok {
+		octetStream, _ := strconv.ParseBool(r.URL.Query().Get("octet_stream"))
+		return writeRawBlob(repository, protocol, blob, octetStream, w)
+	}
 	if rawBytes, ok := result.([]byte); ok {
 		w.Header().Set("Content-Type", "application/octet-stream")
 		w.Header().Set("Content-Length", strconv.Itoa(len(rawBytes)))
 		_, err := w.Write(rawBytes)
 		return err
 	}
-	return json.NewEncoder(w).Encode(result)
+	// Everything else is presented as JSON. This is checked after the handler
+	// has run so that missing objects are still reported as such.
+	if _, err := negotiateContentType(accept, "application/json"); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(result)
 }
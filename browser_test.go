@@ -4,20 +4,124 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/omegaup/go-base/logging/log15/v3"
 	"github.com/omegaup/go-base/v3"
+	"github.com/omegaup/go-base/v3/logging"
 
 	git "github.com/libgit2/git2go/v33"
 )
 
+// createTestCommit creates a commit with the provided files and parents, and
+// points referenceName to it.
+func createTestCommit(
+	t *testing.T,
+	repository *git.Repository,
+	log logging.Logger,
+	referenceName string,
+	files map[string]string,
+	message string,
+	parents ...*git.Oid,
+) *git.Oid {
+	t.Helper()
+
+	readers := make(map[string]io.Reader)
+	for name, contents := range files {
+		readers[name] = strings.NewReader(contents)
+	}
+	tree, err := BuildTree(repository, readers, log)
+	if err != nil {
+		t.Fatalf("Failed to build tree: %v", err)
+	}
+	defer tree.Free()
+
+	signature := &git.Signature{
+		Name:  "author",
+		Email: "author@test.test",
+		When:  time.Unix(0, 0).In(time.UTC),
+	}
+	commitID, err := repository.CreateCommitFromIds(
+		"",
+		signature,
+		signature,
+		message,
+		tree.Id(),
+		parents...,
+	)
+	if err != nil {
+		t.Fatalf("Failed to create commit: %v", err)
+	}
+	ref, err := repository.References.Create(referenceName, commitID, true, message)
+	if err != nil {
+		t.Fatalf("Failed to create reference %s: %v", referenceName, err)
+	}
+	ref.Free()
+	return commitID
+}
+
+// createDivergedRepository creates a repository in dir where refs/heads/topic
+// has diverged from refs/heads/master: topic is two commits ahead and one
+// commit behind master.
+func createDivergedRepository(
+	t *testing.T,
+	dir string,
+	log logging.Logger,
+) *git.Repository {
+	t.Helper()
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+
+	baseID := createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"a": "1\n2\n3\n"},
+		"Base\n",
+	)
+	createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"a": "1\n2\n3\n", "b": "b\n"},
+		"Add b\n",
+		baseID,
+	)
+	topicID := createTestCommit(
+		t, repository, log, "refs/heads/topic",
+		map[string]string{"a": "1\nx\n3\n4\n"},
+		"Change a\n",
+		baseID,
+	)
+	createTestCommit(
+		t, repository, log, "refs/heads/topic",
+		map[string]string{"a": "1\nx\n3\n4\n", "c": "c\n"},
+		"Add c\n",
+		topicID,
+	)
+
+	return repository
+}
+
 func TestHandleRefs(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
@@ -58,6 +162,84 @@ func TestHandleRefs(t *testing.T) {
 	}
 }
 
+func TestHandleDefaultBranch(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	result, err := handleDefaultBranch(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the default branch: %v", err)
+	}
+
+	expected := &DefaultBranchResult{
+		DefaultBranch: "refs/heads/master",
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestHandleOverview(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	result, err := handleOverview(
+		context.Background(),
+		repository,
+		AuthorizationAllowedRestricted,
+		protocol,
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the overview: %v", err)
+	}
+
+	if expected := "refs/heads/master"; expected != result.DefaultBranch {
+		t.Errorf("Expected default branch %q, got %q", expected, result.DefaultBranch)
+	}
+	if expected := "6d2439d2e920ba92d8e485e75d1b740ae51b609a"; expected != result.Head {
+		t.Errorf("Expected HEAD %q, got %q", expected, result.Head)
+	}
+	if len(result.Branches) != 1 || result.BranchesTruncated {
+		t.Fatalf("Expected a single branch, got %v", result)
+	}
+	branch := result.Branches[0]
+	if branch.Name != "refs/heads/master" || branch.Value != "6d2439d2e920ba92d8e485e75d1b740ae51b609a" {
+		t.Errorf("Unexpected branch %v", branch)
+	}
+	if branch.Commit == nil || branch.Commit.Commit != branch.Value || branch.Commit.Message != "Copy\n" {
+		t.Errorf("Unexpected tip of the branch %v", branch.Commit)
+	}
+	if len(result.Tags) != 0 || result.TagsTruncated {
+		t.Errorf("Expected no tags, got %v", result.Tags)
+	}
+	if result.Size <= 0 {
+		t.Errorf("Expected a positive repository size, got %d", result.Size)
+	}
+}
+
 func TestHandleRefsWithReferenceDiscoveryCallback(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
@@ -175,26 +357,42 @@ func TestHandleArchiveCommitZip(t *testing.T) {
 	}
 }
 
-func TestHandleArchiveCommitTarball(t *testing.T) {
+func TestHandleArchiveLargeBlob(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
 		Log: log,
 	})
 
-	repository, err := git.OpenRepository("testdata/repo.git")
+	dir, err := ioutil.TempDir("", "browser_test")
 	if err != nil {
-		t.Fatalf("Error opening git repository: %v", err)
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
 	}
 	defer repository.Free()
 
-	requestPath := "/+archive/88aa3454adb27c3c343ab57564d962a0a7f6a3c1.tar.gz"
+	const blobSize = 16 * 1024 * 1024
+	commitID := createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"large": strings.Repeat("\x00", blobSize)},
+		"Large file\n",
+	)
+
+	requestPath := fmt.Sprintf("/+archive/%s.zip", commitID)
 	req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
 	if err != nil {
 		t.Fatalf("failed to create request: %v", err)
 	}
-	req.Header.Add("Accept", "application/gzip")
-	req.Header.Add("If-Tree", "417c01c8795a35b8e835113a85a5c0c1c77f67fb")
 
+	// The blob compresses really well, so the response is small and most of
+	// the allocations would come from loading the blob into memory.
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
 	response := httptest.NewRecorder()
 	if err := handleArchive(
 		context.Background(),
@@ -207,44 +405,257 @@ func TestHandleArchiveCommitTarball(t *testing.T) {
 	); err != nil {
 		t.Fatalf("Error getting archive: %v", err)
 	}
-	if "application/gzip" != response.Header().Get("Content-Type") {
-		t.Fatalf("Content-Type. Expected %s, got %s", "application/gzip", response.Header().Get("Content-Type"))
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > blobSize/4 {
+		t.Errorf("Expected fewer than %d bytes to be allocated, got %d", blobSize/4, allocated)
 	}
-	trailers := response.Result().Trailer
-	if _, ok := trailers["Omegaup-Uncompressed-Size"]; !ok {
-		t.Errorf("Omegaup-Uncompressed-Size was not present in the trailers: %v", trailers)
+
+	z, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+	if err != nil {
+		t.Fatalf("Error opening zip from response: %v", err)
 	}
+	if len(z.File) != 1 {
+		t.Fatalf("Expected 1 file, got %d", len(z.File))
+	}
+	if z.File[0].Name != "large" || z.File[0].UncompressedSize64 != blobSize {
+		t.Errorf("Expected large with size %d, got %s with size %d", blobSize, z.File[0].Name, z.File[0].UncompressedSize64)
+	}
+	if expected, actual := strconv.Itoa(blobSize), response.Result().Trailer.Get("Omegaup-Uncompressed-Size"); expected != actual {
+		t.Errorf("Expected uncompressed size %s, got %s", expected, actual)
+	}
+}
 
-	gz, err := gzip.NewReader(bytes.NewReader(response.Body.Bytes()))
+func TestHandleArchiveChecksum(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
 	if err != nil {
-		t.Fatalf("Error opening gzip from response: %v", err)
+		t.Fatalf("Error opening git repository: %v", err)
 	}
+	defer repository.Free()
 
-	a := tar.NewReader(gz)
-	hdr, err := a.Next()
+	for _, requestPath := range []string{
+		"/+archive/88aa3454adb27c3c343ab57564d962a0a7f6a3c1.zip",
+		"/+archive/88aa3454adb27c3c343ab57564d962a0a7f6a3c1.tar.gz",
+	} {
+		req, err := http.NewRequest("GET", "http://test"+requestPath+"?checksum=sha256", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		response := httptest.NewRecorder()
+		if err := handleArchive(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			req,
+			response,
+		); err != nil {
+			t.Fatalf("Error getting archive: %v", err)
+		}
+
+		sum := sha256.Sum256(response.Body.Bytes())
+		expected := hex.EncodeToString(sum[:])
+		if actual := response.Result().Trailer.Get("Omegaup-Archive-SHA256"); expected != actual {
+			t.Errorf("For %s, expected checksum %q, got %q", requestPath, expected, actual)
+		}
+	}
+}
+
+func TestHandleRevisionSyntax(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
 	if err != nil {
-		t.Fatalf("Tarball is empty: %v", err)
+		t.Fatalf("Error opening git repository: %v", err)
 	}
+	defer repository.Free()
 
-	if "empty" != hdr.Name {
-		t.Errorf("Expected %s, got %v", "empty", hdr.Name)
+	expectedCommitID := "88aa3454adb27c3c343ab57564d962a0a7f6a3c1"
+	expectedTreeID := "417c01c8795a35b8e835113a85a5c0c1c77f67fb"
+
+	logResult, err := handleLog(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/master~1",
+		"GET",
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v", err)
 	}
-	_, err = io.Copy(io.Discard, a)
+	if len(logResult.Log) != 1 || expectedCommitID != logResult.Log[0].Commit {
+		t.Errorf("Expected a log with only %s, got %v", expectedCommitID, logResult)
+	}
+
+	showResult, err := handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/master~1",
+		"GET",
+		"",
+	)
 	if err != nil {
-		t.Fatalf("Error reading tar file: %v", err)
+		t.Fatalf("Error showing the commit: %v", err)
 	}
-	hdr, err = a.Next()
-	if err == nil {
-		t.Fatalf("Tarball has unexpected extra files: %v", hdr)
+	if commitResult, ok := showResult.(*CommitResult); !ok || expectedCommitID != commitResult.Commit {
+		t.Errorf("Expected commit %s, got %v", expectedCommitID, showResult)
 	}
-	gz.Close()
 
-	if "0" != trailers.Get("Omegaup-Uncompressed-Size") {
-		t.Errorf("Omegaup-Uncompressed-Size trailer. Expected 0, got %v", trailers.Get("Omegaup-Uncompressed-Size"))
+	showResult, err = handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/master^^{tree}",
+		"GET",
+		"",
+	)
+	if err != nil {
+		t.Fatalf("Error showing the tree: %v", err)
+	}
+	if treeResult, ok := showResult.(*TreeResult); !ok || expectedTreeID != treeResult.ID {
+		t.Errorf("Expected tree %s, got %v", expectedTreeID, showResult)
+	}
+
+	for _, requestPath := range []string{
+		"/+archive/master~1.zip",
+		"/+archive/master~1^{tree}.tar.gz",
+	} {
+		req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		response := httptest.NewRecorder()
+		if err := handleArchive(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			req,
+			response,
+		); err != nil {
+			t.Errorf("For %s, error getting archive: %v", requestPath, err)
+		} else if response.Body.Len() == 0 {
+			t.Errorf("For %s, expected a non-empty archive", requestPath)
+		}
 	}
 }
 
-func TestHandleArchiveCommitTarballFromTree(t *testing.T) {
+func TestHandleArchiveObjectLimit(t *testing.T) {
+	log, _ := log15.New("info", false)
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	// The tree of 6d2439d2e920ba92d8e485e75d1b740ae51b609a has two blobs.
+	for limit, expectedErr := range map[int]bool{1: true, 2: false} {
+		protocol := NewGitProtocol(GitProtocolOpts{
+			ArchiveObjectLimit: limit,
+			Log:                log,
+		})
+		requestPath := "/+archive/6d2439d2e920ba92d8e485e75d1b740ae51b609a.zip"
+		req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		response := httptest.NewRecorder()
+		err = handleArchive(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			req,
+			response,
+		)
+		if !expectedErr {
+			if err != nil {
+				t.Errorf("With limit %d, error getting archive: %v", limit, err)
+			}
+			continue
+		}
+		if !base.HasErrorCategory(err, ErrBadRequest) {
+			t.Fatalf("With limit %d, expected ErrBadRequest, got %v", limit, err)
+		}
+		if !errors.Is(base.UnwrapCauseFromErrorCategory(err, ErrBadRequest), ErrObjectLimitExceeded) {
+			t.Errorf("With limit %d, expected ErrObjectLimitExceeded, got %v", limit, err)
+		}
+		if response.Body.Len() != 0 {
+			t.Errorf("With limit %d, expected nothing to be written, got %d bytes", limit, response.Body.Len())
+		}
+	}
+}
+
+func TestHandleArchiveCallback(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		ArchiveCallback: func(
+			ctx context.Context,
+			repository *git.Repository,
+			level AuthorizationLevel,
+		) bool {
+			return level != AuthorizationAllowedReadOnly
+		},
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	for _, testCase := range []struct {
+		level       AuthorizationLevel
+		requestPath string
+		forbidden   bool
+	}{
+		{AuthorizationAllowed, "/+archive/6d2439d2e920ba92d8e485e75d1b740ae51b609a.zip", false},
+		{AuthorizationAllowedReadOnly, "/+archive/6d2439d2e920ba92d8e485e75d1b740ae51b609a.zip", true},
+		{AuthorizationAllowedReadOnly, "/+/6d2439d2e920ba92d8e485e75d1b740ae51b609a", false},
+		{AuthorizationAllowedReadOnly, "/+log/6d2439d2e920ba92d8e485e75d1b740ae51b609a", false},
+	} {
+		req, err := http.NewRequest("GET", "http://test"+testCase.requestPath, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		err = handleBrowse(
+			context.Background(),
+			m,
+			"testdata/repo.git",
+			testCase.level,
+			protocol,
+			testCase.requestPath,
+			req,
+			httptest.NewRecorder(),
+		)
+		if testCase.forbidden {
+			if !base.HasErrorCategory(err, ErrForbidden) {
+				t.Errorf("For %s with level %v, expected ErrForbidden, got %v", testCase.requestPath, testCase.level, err)
+			}
+		} else if err != nil {
+			t.Errorf("For %s with level %v, unexpected error: %v", testCase.requestPath, testCase.level, err)
+		}
+	}
+}
+
+func TestHandleArchiveCommitTarball(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
 		Log: log,
@@ -256,12 +667,13 @@ func TestHandleArchiveCommitTarballFromTree(t *testing.T) {
 	}
 	defer repository.Free()
 
-	requestPath := "/+archive/417c01c8795a35b8e835113a85a5c0c1c77f67fb.tar.gz"
+	requestPath := "/+archive/88aa3454adb27c3c343ab57564d962a0a7f6a3c1.tar.gz"
 	req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
 	if err != nil {
 		t.Fatalf("failed to create request: %v", err)
 	}
 	req.Header.Add("Accept", "application/gzip")
+	req.Header.Add("If-Tree", "417c01c8795a35b8e835113a85a5c0c1c77f67fb")
 
 	response := httptest.NewRecorder()
 	if err := handleArchive(
@@ -312,7 +724,7 @@ func TestHandleArchiveCommitTarballFromTree(t *testing.T) {
 	}
 }
 
-func TestHandleLog(t *testing.T) {
+func TestHandleArchiveCommitTarballFormats(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
 		Log: log,
@@ -324,155 +736,2157 @@ func TestHandleLog(t *testing.T) {
 	}
 	defer repository.Free()
 
-	result, err := handleLog(
-		context.Background(),
-		repository,
-		AuthorizationAllowed,
-		protocol,
-		"/+log/",
-		"GET",
-	)
-	if err != nil {
-		t.Fatalf("Error getting the log: %v %v", err, result)
-	}
+	for _, testCase := range []struct {
+		extension           string
+		expectedContentType string
+		reader              func(io.Reader) io.Reader
+	}{
+		{".tar", "application/x-tar", func(r io.Reader) io.Reader { return r }},
+		{".tar.bz2", "application/x-bzip2", bzip2.NewReader},
+	} {
+		requestPath := "/+archive/88aa3454adb27c3c343ab57564d962a0a7f6a3c1" + testCase.extension
+		req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		response := httptest.NewRecorder()
+		if err := handleArchive(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			req,
+			response,
+		); err != nil {
+			t.Fatalf("Error getting archive %s: %v", requestPath, err)
+		}
+		if testCase.expectedContentType != response.Header().Get("Content-Type") {
+			t.Fatalf("Content-Type. Expected %s, got %s", testCase.expectedContentType, response.Header().Get("Content-Type"))
+		}
+		trailers := response.Result().Trailer
+		if "0" != trailers.Get("Omegaup-Uncompressed-Size") {
+			t.Errorf("Omegaup-Uncompressed-Size trailer. Expected 0, got %v", trailers.Get("Omegaup-Uncompressed-Size"))
+		}
+
+		a := tar.NewReader(testCase.reader(bytes.NewReader(response.Body.Bytes())))
+		hdr, err := a.Next()
+		if err != nil {
+			t.Fatalf("Tarball %s is empty: %v", requestPath, err)
+		}
+		if "empty" != hdr.Name {
+			t.Errorf("Expected %s, got %v", "empty", hdr.Name)
+		}
+		if _, err := io.Copy(io.Discard, a); err != nil {
+			t.Fatalf("Error reading tar file %s: %v", requestPath, err)
+		}
+		if hdr, err := a.Next(); err != io.EOF {
+			t.Fatalf("Tarball %s has unexpected extra files: %v %v", requestPath, hdr, err)
+		}
+	}
+}
+
+func TestHandleArchiveModes(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	treebuilder, err := repository.TreeBuilder()
+	if err != nil {
+		t.Fatalf("Failed to create tree builder: %v", err)
+	}
+	defer treebuilder.Free()
+	for _, entry := range []struct {
+		name     string
+		contents string
+		mode     git.Filemode
+	}{
+		{"README", "hello\n", git.FilemodeBlob},
+		{"run.sh", "#!/bin/sh\n", git.FilemodeBlobExecutable},
+		{"link", "README", git.FilemodeLink},
+	} {
+		blobID, err := repository.CreateBlobFromBuffer([]byte(entry.contents))
+		if err != nil {
+			t.Fatalf("Failed to create blob %s: %v", entry.name, err)
+		}
+		if err := treebuilder.Insert(entry.name, blobID, entry.mode); err != nil {
+			t.Fatalf("Failed to insert %s: %v", entry.name, err)
+		}
+	}
+	treeID, err := treebuilder.Write()
+	if err != nil {
+		t.Fatalf("Failed to write tree: %v", err)
+	}
+
+	requestPath := "/+archive/" + treeID.String() + ".tar"
+	response := httptest.NewRecorder()
+	if err := handleArchive(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		requestPath,
+		httptest.NewRequest("GET", "http://test"+requestPath, nil),
+		response,
+	); err != nil {
+		t.Fatalf("Error getting archive: %v", err)
+	}
+	tarEntries := make(map[string]*tar.Header)
+	a := tar.NewReader(bytes.NewReader(response.Body.Bytes()))
+	for {
+		hdr, err := a.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading tar file: %v", err)
+		}
+		tarEntries[hdr.Name] = hdr
+	}
+	for name, expected := range map[string]struct {
+		typeflag byte
+		mode     int64
+		linkname string
+	}{
+		"README": {tar.TypeReg, 0o644, ""},
+		"run.sh": {tar.TypeReg, 0o755, ""},
+		"link":   {tar.TypeSymlink, 0o777, "README"},
+	} {
+		hdr, ok := tarEntries[name]
+		if !ok {
+			t.Errorf("%s not found in the tarball: %v", name, tarEntries)
+			continue
+		}
+		if expected.typeflag != hdr.Typeflag || expected.mode != hdr.Mode || expected.linkname != hdr.Linkname {
+			t.Errorf("For %s, expected %v, got %v", name, expected, hdr)
+		}
+	}
+
+	requestPath = "/+archive/" + treeID.String() + ".zip"
+	response = httptest.NewRecorder()
+	if err := handleArchive(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		requestPath,
+		httptest.NewRequest("GET", "http://test"+requestPath, nil),
+		response,
+	); err != nil {
+		t.Fatalf("Error getting archive: %v", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+	if err != nil {
+		t.Fatalf("Error reading zip file: %v", err)
+	}
+	zipEntries := make(map[string]*zip.File)
+	for _, f := range z.File {
+		zipEntries[f.Name] = f
+	}
+	for name, expectedMode := range map[string]os.FileMode{
+		"README": 0o644,
+		"run.sh": 0o755,
+		"link":   os.ModeSymlink | 0o777,
+	} {
+		f, ok := zipEntries[name]
+		if !ok {
+			t.Errorf("%s not found in the zip file: %v", name, zipEntries)
+			continue
+		}
+		if expectedMode != f.Mode() {
+			t.Errorf("For %s, expected mode %v, got %v", name, expectedMode, f.Mode())
+		}
+	}
+	if f, ok := zipEntries["link"]; ok {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("Error opening the symlink: %v", err)
+		}
+		target, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || "README" != string(target) {
+			t.Errorf("Expected the symlink to point to README, got %q %v", target, err)
+		}
+	}
+}
+
+func TestHandleArchiveLongPaths(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	longDir := strings.Repeat("directory/", 12)
+	longPath := longDir + "a-file-whose-name-is-also-rather-long.txt"
+	if len(longPath) <= 100 {
+		t.Fatalf("Expected %q to be longer than 100 bytes", longPath)
+	}
+	createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{longPath: "contents\n"},
+		"Initial commit\n",
+	)
+
+	requestPath := "/+archive/master.tar"
+	response := httptest.NewRecorder()
+	if err := handleArchive(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		requestPath,
+		httptest.NewRequest("GET", "http://test"+requestPath, nil),
+		response,
+	); err != nil {
+		t.Fatalf("Error getting archive: %v", err)
+	}
+
+	var found bool
+	a := tar.NewReader(bytes.NewReader(response.Body.Bytes()))
+	for {
+		hdr, err := a.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading tar file: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			if !strings.HasPrefix(longDir, hdr.Name) {
+				t.Errorf("Unexpected directory %q", hdr.Name)
+			}
+			continue
+		}
+		if longPath != hdr.Name {
+			t.Errorf("Expected %q, got %q", longPath, hdr.Name)
+			continue
+		}
+		found = true
+		contents, err := ioutil.ReadAll(a)
+		if err != nil || "contents\n" != string(contents) {
+			t.Errorf("Expected %q, got %q %v", "contents\n", contents, err)
+		}
+	}
+	if !found {
+		t.Errorf("%q not found in the tarball", longPath)
+	}
+}
+
+func TestHandleArchiveHead(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{
+			"a":     "hello\n",
+			"dir/b": "abc",
+		},
+		"Initial commit\n",
+	)
+
+	requestPath := "/+archive/master.tar.gz"
+	response := httptest.NewRecorder()
+	if err := handleArchive(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		requestPath,
+		httptest.NewRequest("HEAD", "http://test"+requestPath, nil),
+		response,
+	); err != nil {
+		t.Fatalf("Error getting archive: %v", err)
+	}
+	if "application/gzip" != response.Header().Get("Content-Type") {
+		t.Errorf("Content-Type. Expected %s, got %s", "application/gzip", response.Header().Get("Content-Type"))
+	}
+	if "9" != response.Header().Get("Omegaup-Uncompressed-Size") {
+		t.Errorf("Omegaup-Uncompressed-Size header. Expected 9, got %q", response.Header().Get("Omegaup-Uncompressed-Size"))
+	}
+	if response.Body.Len() != 0 {
+		t.Errorf("Expected an empty body, got %q", response.Body.String())
+	}
+}
+
+func TestHandleArchiveCommitTarballFromTree(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	requestPath := "/+archive/417c01c8795a35b8e835113a85a5c0c1c77f67fb.tar.gz"
+	req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Add("Accept", "application/gzip")
+
+	response := httptest.NewRecorder()
+	if err := handleArchive(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		requestPath,
+		req,
+		response,
+	); err != nil {
+		t.Fatalf("Error getting archive: %v", err)
+	}
+	if "application/gzip" != response.Header().Get("Content-Type") {
+		t.Fatalf("Content-Type. Expected %s, got %s", "application/gzip", response.Header().Get("Content-Type"))
+	}
+	trailers := response.Result().Trailer
+	if _, ok := trailers["Omegaup-Uncompressed-Size"]; !ok {
+		t.Errorf("Omegaup-Uncompressed-Size was not present in the trailers: %v", trailers)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(response.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Error opening gzip from response: %v", err)
+	}
+
+	a := tar.NewReader(gz)
+	hdr, err := a.Next()
+	if err != nil {
+		t.Fatalf("Tarball is empty: %v", err)
+	}
+
+	if "empty" != hdr.Name {
+		t.Errorf("Expected %s, got %v", "empty", hdr.Name)
+	}
+	_, err = io.Copy(io.Discard, a)
+	if err != nil {
+		t.Fatalf("Error reading tar file: %v", err)
+	}
+	hdr, err = a.Next()
+	if err == nil {
+		t.Fatalf("Tarball has unexpected extra files: %v", hdr)
+	}
+	gz.Close()
+
+	if "0" != trailers.Get("Omegaup-Uncompressed-Size") {
+		t.Errorf("Omegaup-Uncompressed-Size trailer. Expected 0, got %v", trailers.Get("Omegaup-Uncompressed-Size"))
+	}
+}
+
+func TestParseTrailers(t *testing.T) {
+	for _, testCase := range []struct {
+		message  string
+		expected map[string][]string
+	}{
+		{"Subject\n", nil},
+		{"Key: not a trailer, since it is the subject\n", nil},
+		{
+			"Subject\n\nBody.\n\nReviewed-By: a <a@test.test>\nChange-Id: I1234\nReviewed-By: b <b@test.test>\n",
+			map[string][]string{
+				"Reviewed-By": {"a <a@test.test>", "b <b@test.test>"},
+				"Change-Id":   {"I1234"},
+			},
+		},
+		{
+			"Subject\nReviewed-In: http://localhost/review/1/",
+			map[string][]string{
+				"Reviewed-In": {"http://localhost/review/1/"},
+			},
+		},
+		{
+			"Subject\n\nBody that ends\nwith a trailer\nKey: a long\n  value\n",
+			map[string][]string{
+				"Key": {"a long value"},
+			},
+		},
+		{"Subject\n\nKey: value\n\nNot trailers anymore.\n", nil},
+	} {
+		if actual := parseTrailers(testCase.message); !reflect.DeepEqual(testCase.expected, actual) {
+			t.Errorf("For %q, expected %v, got %v", testCase.message, testCase.expected, actual)
+		}
+	}
+}
+
+func TestHandleLog(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	result, err := handleLog(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/",
+		"GET",
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v %v", err, result)
+	}
+
+	expected := &LogResult{
+		Log: []*CommitResult{
+			{
+				Commit:  "6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+				Tree:    "06f8815b4dc1ba5cabf619d8a8ef392d0f88a2f1",
+				Parents: []string{"88aa3454adb27c3c343ab57564d962a0a7f6a3c1"},
+				Author: &SignatureResult{
+					Name:  "lhchavez",
+					Email: "lhchavez@lhchavez.com",
+					Time:  "Sun, 10 Dec 2017 21:07:21 -0800",
+				},
+				Committer: &SignatureResult{
+					Name:  "lhchavez",
+					Email: "lhchavez@lhchavez.com",
+					Time:  "Sun, 10 Dec 2017 21:07:21 -0800",
+				},
+				Message: "Copy\n",
+			},
+			{
+				Commit:  "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+				Tree:    "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
+				Parents: []string{},
+				Author: &SignatureResult{
+					Name:  "lhchavez",
+					Email: "lhchavez@lhchavez.com",
+					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
+				},
+				Committer: &SignatureResult{
+					Name:  "lhchavez",
+					Email: "lhchavez@lhchavez.com",
+					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
+				},
+				Message: "Empty\n",
+			},
+		},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestHandleLogCommit(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	result, err := handleLog(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		"GET",
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v %v", err, result)
+	}
+
+	expected := &LogResult{
+		Log: []*CommitResult{
+			{
+				Commit:  "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+				Tree:    "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
+				Parents: []string{},
+				Author: &SignatureResult{
+					Name:  "lhchavez",
+					Email: "lhchavez@lhchavez.com",
+					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
+				},
+				Committer: &SignatureResult{
+					Name:  "lhchavez",
+					Email: "lhchavez@lhchavez.com",
+					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
+				},
+				Message: "Empty\n",
+			},
+		},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestHandleLogPagination(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+
+	firstPage, err := handleLog(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/master",
+		"GET",
+		url.Values{"limit": {"1"}},
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v", err)
+	}
+	if len(firstPage.Log) != 1 || firstPage.Log[0].Message != "Add b\n" {
+		t.Fatalf("Expected a log with only \"Add b\", got %v", firstPage)
+	}
+	if firstPage.Next == "" {
+		t.Fatalf("Expected a continuation token, got %v", firstPage)
+	}
+
+	secondPage, err := handleLog(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/master",
+		"GET",
+		url.Values{"limit": {"1"}, "start": {firstPage.Next}},
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v", err)
+	}
+	if len(secondPage.Log) != 1 || secondPage.Log[0].Commit != firstPage.Next {
+		t.Fatalf("Expected a log with only %s, got %v", firstPage.Next, secondPage)
+	}
+	if secondPage.Next != "" {
+		t.Errorf("Expected no continuation token, got %v", secondPage)
+	}
+
+	masterID, err := repository.RevparseSingle("master")
+	if err != nil {
+		t.Fatalf("Failed to parse master: %v", err)
+	}
+	defer masterID.Free()
+	topicID, err := repository.RevparseSingle("topic")
+	if err != nil {
+		t.Fatalf("Failed to parse topic: %v", err)
+	}
+	defer topicID.Free()
+	createTestCommit(
+		t, repository, log, "refs/heads/merge",
+		map[string]string{"a": "1\nx\n3\n4\n", "b": "b\n", "c": "c\n"},
+		"Merge\n",
+		masterID.Id(),
+		topicID.Id(),
+	)
+	for query, expectedCount := range map[string]int{
+		"":                   3,
+		"first_parent=true":  3,
+		"first_parent=false": 5,
+	} {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", query, err)
+		}
+		result, err := handleLog(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			"/+log/merge",
+			"GET",
+			values,
+		)
+		if err != nil {
+			t.Fatalf("For %q, error getting the log: %v", query, err)
+		}
+		if len(result.Log) != expectedCount {
+			t.Errorf("For %q, expected %d commits, got %v", query, expectedCount, result)
+		}
+	}
+}
+
+func TestHandleLogPath(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	var parentID *git.Oid
+	commitIDs := make(map[string]string)
+	for _, step := range []struct {
+		message string
+		files   map[string]string
+	}{
+		{"Add a\n", map[string]string{"dir/a": "1\n"}},
+		{"Add b\n", map[string]string{"dir/a": "1\n", "b": "1\n"}},
+		{"Change a\n", map[string]string{"dir/a": "2\n", "b": "1\n"}},
+		{"Change b\n", map[string]string{"dir/a": "2\n", "b": "2\n"}},
+	} {
+		var parents []*git.Oid
+		if parentID != nil {
+			parents = append(parents, parentID)
+		}
+		parentID = createTestCommit(t, repository, log, "refs/heads/master", step.files, step.message, parents...)
+		commitIDs[step.message] = parentID.String()
+	}
+	// Branches can also contain slashes.
+	ref, err := repository.References.Create("refs/heads/feature/x", parentID, false, "")
+	if err != nil {
+		t.Fatalf("Failed to create the branch: %v", err)
+	}
+	ref.Free()
+
+	for requestPath, expectedMessages := range map[string][]string{
+		"/+log/master/dir/a":            {"Change a\n", "Add a\n"},
+		"/+log/master/dir":              {"Change a\n", "Add a\n"},
+		"/+log/master/b":                {"Change b\n", "Add b\n"},
+		"/+log/refs/heads/master/b":     {"Change b\n", "Add b\n"},
+		"/+log/feature/x/dir/a":         {"Change a\n", "Add a\n"},
+		"/+log/feature/x/dir/":          {"Change a\n", "Add a\n"},
+		"/+log/master/nonexistent-file": {},
+	} {
+		result, err := handleLog(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			"GET",
+			nil,
+		)
+		if err != nil {
+			t.Fatalf("For %s, error getting the log: %v", requestPath, err)
+		}
+		messages := make([]string, 0)
+		for _, commit := range result.Log {
+			messages = append(messages, commit.Message)
+		}
+		if !reflect.DeepEqual(expectedMessages, messages) {
+			t.Errorf("For %s, expected %q, got %q", requestPath, expectedMessages, messages)
+		}
+	}
+
+	// Pagination skips over the commits that did not touch the path.
+	firstPage, err := handleLog(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/master/dir/a",
+		"GET",
+		url.Values{"limit": {"1"}},
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v", err)
+	}
+	if len(firstPage.Log) != 1 || firstPage.Log[0].Commit != commitIDs["Change a\n"] {
+		t.Fatalf("Expected a log with only %s, got %v", commitIDs["Change a\n"], firstPage)
+	}
+	if firstPage.Next != commitIDs["Add a\n"] {
+		t.Fatalf("Expected a continuation token of %s, got %v", commitIDs["Add a\n"], firstPage)
+	}
+	secondPage, err := handleLog(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/master/dir/a",
+		"GET",
+		url.Values{"limit": {"1"}, "start": {firstPage.Next}},
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v", err)
+	}
+	if len(secondPage.Log) != 1 || secondPage.Log[0].Commit != commitIDs["Add a\n"] || secondPage.Next != "" {
+		t.Errorf("Expected a log with only %s, got %v", commitIDs["Add a\n"], secondPage)
+	}
+}
+
+func TestHandleLogText(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	w := httptest.NewRecorder()
+	if err := handleLogText(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/",
+		"GET",
+		nil,
+		w,
+	); err != nil {
+		t.Fatalf("Error getting the log: %v", err)
+	}
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("Expected text/plain, got %q", contentType)
+	}
+	expected := "6d2439d Copy\n88aa345 Empty\n"
+	if expected != w.Body.String() {
+		t.Errorf("Expected %q, got %q", expected, w.Body.String())
+	}
+	if next := w.Header().Get("Omegaup-Log-Next"); next != "" {
+		t.Errorf("Expected no next commit, got %q", next)
+	}
+
+	// The pagination information is sent in the trailers.
+	w = httptest.NewRecorder()
+	if err := handleLogText(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+log/",
+		"GET",
+		url.Values{"limit": {"1"}},
+		w,
+	); err != nil {
+		t.Fatalf("Error getting the log: %v", err)
+	}
+	expected = "6d2439d Copy\n"
+	if expected != w.Body.String() {
+		t.Errorf("Expected %q, got %q", expected, w.Body.String())
+	}
+	if next := w.Header().Get("Omegaup-Log-Next"); next != "88aa3454adb27c3c343ab57564d962a0a7f6a3c1" {
+		t.Errorf("Expected the next commit to be 88aa3454, got %q", next)
+	}
+}
+
+func TestHandleContributors(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	for requestPath, expected := range map[string]*ContributorsResult{
+		"/+contributors/master/": {
+			Contributors: []*ContributorResult{
+				{Name: "lhchavez", Email: "lhchavez@lhchavez.com", Commits: 2},
+			},
+		},
+		"/+contributors/master/empty": {
+			Contributors: []*ContributorResult{
+				{Name: "lhchavez", Email: "lhchavez@lhchavez.com", Commits: 1},
+			},
+		},
+		"/+contributors/master/empty_copy": {
+			Contributors: []*ContributorResult{
+				{Name: "lhchavez", Email: "lhchavez@lhchavez.com", Commits: 1},
+			},
+		},
+		"/+contributors/master/missing": {
+			Contributors: []*ContributorResult{},
+		},
+	} {
+		result, err := handleContributors(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			"GET",
+		)
+		if err != nil {
+			t.Fatalf("Error getting the contributors for %s: %v", requestPath, err)
+		}
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("For %s, expected %v, got %v", requestPath, expected, result)
+		}
+	}
+}
+
+func TestHandleShowCommit(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	result, err := handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		"GET",
+		"",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the log: %v %v", err, result)
+	}
+
+	expected := &CommitResult{
+		Commit:  "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		Tree:    "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
+		Parents: []string{},
+		Author: &SignatureResult{
+			Name:  "lhchavez",
+			Email: "lhchavez@lhchavez.com",
+			Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
+		},
+		Committer: &SignatureResult{
+			Name:  "lhchavez",
+			Email: "lhchavez@lhchavez.com",
+			Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
+		},
+		Message: "Empty\n",
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestHandleShowCommitManyParents(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		MaxCommitParents: 3,
+		Log:              log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	var parentIDs []*git.Oid
+	for i := 0; i < 5; i++ {
+		parentIDs = append(parentIDs, createTestCommit(
+			t, repository, log, fmt.Sprintf("refs/heads/parent-%d", i),
+			map[string]string{"a": fmt.Sprintf("%d\n", i)},
+			fmt.Sprintf("Parent %d\n", i),
+		))
+	}
+	createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"a": "merged\n"},
+		"Octopus merge\n",
+		parentIDs...,
+	)
+
+	result, err := handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/master",
+		"GET",
+		"",
+	)
+	if err != nil {
+		t.Fatalf("Error showing the commit: %v", err)
+	}
+	commitResult, ok := result.(*CommitResult)
+	if !ok {
+		t.Fatalf("Expected a commit, got %v", result)
+	}
+	expectedParents := []string{
+		parentIDs[0].String(),
+		parentIDs[1].String(),
+		parentIDs[2].String(),
+	}
+	if !reflect.DeepEqual(expectedParents, commitResult.Parents) {
+		t.Errorf("Expected parents %v, got %v", expectedParents, commitResult.Parents)
+	}
+	if !commitResult.ParentsTruncated {
+		t.Errorf("Expected the parents to be truncated, got %v", commitResult)
+	}
+}
+
+func TestHandleShowTree(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	expected := &TreeResult{
+		ID: "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
+		Entries: []*TreeEntryResult{
+			{
+				ID:   "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
+				Mode: 0100644,
+				Type: "blob",
+				Name: "empty",
+				Size: 0,
+			},
+		},
+	}
+
+	for _, requestURL := range []string{
+		// Use commit+path.
+		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1/",
+		// A trailing slash after a named revision shows the commit's root tree.
+		"/+/master~1/",
+		// Use the object ID directly.
+		"/+/417c01c8795a35b8e835113a85a5c0c1c77f67fb",
+	} {
+		result, err := handleShow(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestURL,
+			"GET",
+			"",
+		)
+		if err != nil {
+			t.Fatalf("Error getting showing tree: %v %v", err, result)
+		}
+
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("Expected %s, got %s", expected, result)
+		}
+	}
+}
+
+func TestHandleShowRawTree(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	odb, err := repository.Odb()
+	if err != nil {
+		t.Fatalf("Error opening odb: %v", err)
+	}
+	defer odb.Free()
+
+	expectedID := "417c01c8795a35b8e835113a85a5c0c1c77f67fb"
+	result, err := handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/"+expectedID,
+		"GET",
+		"application/octet-stream",
+	)
+	if err != nil {
+		t.Fatalf("Error getting showing tree: %v %v", err, result)
+	}
+	contents, ok := result.([]byte)
+	if !ok {
+		t.Fatalf("Expected raw bytes, got %T", result)
+	}
+
+	id, err := odb.Hash(contents, git.ObjectTree)
+	if err != nil {
+		t.Fatalf("Error hashing the tree contents: %v", err)
+	}
+	if id.String() != expectedID {
+		t.Errorf("Expected %s, got %s", expectedID, id)
+	}
+}
+
+func TestHandleShowBlob(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	expected := &BlobResult{
+		ID:       "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
+		Size:     0,
+		Contents: "",
+	}
+
+	for _, requestURL := range []string{
+		// Use commit+path.
+		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1/empty",
+		// Use the object ID directly.
+		"/+/e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
+	} {
+		result, err := handleShow(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestURL,
+			"GET",
+			"",
+		)
+		if err != nil {
+			t.Fatalf("Error getting the blob: %v %v", err, result)
+		}
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("Expected %s, got %s", expected, result)
+		}
+	}
+}
+
+func TestHandleBrowseRawBlobContentType(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01"
+	createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{
+			"logo":       png,
+			"README":     "¡Hola, mundo!\n",
+			"index.html": "<html><body>hello</body></html>\n",
+		},
+		"Initial commit\n",
+	)
+
+	for _, testCase := range []struct {
+		requestPath         string
+		query               string
+		expectedContentType string
+		expectedContents    string
+	}{
+		{"/+/master/logo", "", "image/png", png},
+		{"/+/master/README", "", "text/plain; charset=utf-8", "¡Hola, mundo!\n"},
+		{"/+/master/index.html", "", "text/plain; charset=utf-8", "<html><body>hello</body></html>\n"},
+		{"/+/master/logo", "?octet_stream=1", "application/octet-stream", png},
+	} {
+		req, err := http.NewRequest("GET", "http://test"+testCase.requestPath+testCase.query, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Add("Accept", "application/octet-stream")
+
+		w := httptest.NewRecorder()
+		if err := handleBrowse(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			testCase.requestPath,
+			req,
+			w,
+		); err != nil {
+			t.Fatalf("Error browsing %s: %v", testCase.requestPath, err)
+		}
+
+		if contentType := w.Header().Get("Content-Type"); testCase.expectedContentType != contentType {
+			t.Errorf("For %s%s, expected content type %q, got %q", testCase.requestPath, testCase.query, testCase.expectedContentType, contentType)
+		}
+		if testCase.expectedContents != w.Body.String() {
+			t.Errorf("For %s%s, expected %q, got %q", testCase.requestPath, testCase.query, testCase.expectedContents, w.Body.String())
+		}
+	}
+}
+
+// A writeRecorder is an httptest.ResponseRecorder that also records the
+// size of the largest write.
+type writeRecorder struct {
+	*httptest.ResponseRecorder
+	maxWrite int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestHandleBrowseRawBlobStreaming(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	// The blob is loose, so it can be streamed.
+	contents := strings.Repeat("0123456789abcdef", 256*1024)
+	commitID := createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"big.bin": contents},
+		"Initial commit\n",
+	)
+	commit, err := repository.LookupCommit(commitID)
+	if err != nil {
+		t.Fatalf("Failed to look up the commit: %v", err)
+	}
+	defer commit.Free()
+	blobID, err := pathEntryID(commit, "big.bin")
+	if err != nil {
+		t.Fatalf("Failed to look up the blob: %v", err)
+	}
+
+	for _, requestPath := range []string{
+		"/+/master/big.bin",
+		"/+/" + blobID.String(),
+	} {
+		req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Add("Accept", "application/octet-stream")
+
+		w := &writeRecorder{ResponseRecorder: httptest.NewRecorder()}
+		if err := handleBrowse(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			req,
+			w,
+		); err != nil {
+			t.Fatalf("Error browsing %s: %v", requestPath, err)
+		}
+		if expected, actual := strconv.Itoa(len(contents)), w.Header().Get("Content-Length"); expected != actual {
+			t.Errorf("For %s, expected Content-Length %s, got %s", requestPath, expected, actual)
+		}
+		if w.Body.String() != contents {
+			t.Errorf("For %s, unexpected contents (%d bytes)", requestPath, w.Body.Len())
+		}
+		if w.maxWrite >= len(contents) {
+			t.Errorf("For %s, expected the blob to be streamed, got a write of %d bytes", requestPath, w.maxWrite)
+		}
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	offeredTypes := []string{"application/json", "application/octet-stream"}
+	for accept, expected := range map[string]string{
+		"":                         "application/json",
+		"*/*":                      "application/json",
+		"application/octet-stream": "application/octet-stream",
+		"application/json, application/octet-stream;q=0.9":  "application/json",
+		"application/json;q=0.5, application/octet-stream":  "application/octet-stream",
+		"application/*;q=0.2, application/octet-stream;q=1": "application/octet-stream",
+		"text/html, application/*;q=0.8":                    "application/json",
+		"*/*;q=0.1, application/json;q=0":                   "application/octet-stream",
+	} {
+		contentType, err := negotiateContentType(accept, offeredTypes...)
+		if err != nil {
+			t.Errorf("For %q, failed to negotiate the content type: %v", accept, err)
+		} else if expected != contentType {
+			t.Errorf("For %q, expected %q, got %q", accept, expected, contentType)
+		}
+	}
+
+	for _, accept := range []string{
+		"image/png",
+		"text/*, image/*",
+		"application/json;q=0, application/octet-stream;q=0",
+	} {
+		if _, err := negotiateContentType(accept, offeredTypes...); !base.HasErrorCategory(err, ErrNotAcceptable) {
+			t.Errorf("For %q, expected ErrNotAcceptable, got %v", accept, err)
+		}
+	}
+}
+
+func TestHandleShowHead(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	for _, testCase := range []struct {
+		oid    string
+		exists bool
+	}{
+		// Reachable commit.
+		{"6d2439d2e920ba92d8e485e75d1b740ae51b609a", true},
+		// Blob.
+		{"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", true},
+		// Commit only reachable from refs/meta/config, which is restricted.
+		{"d0c442210b72c207637a63e4eda991bc27abc0bd", false},
+		// Absent object.
+		{"1111111111111111111111111111111111111111", false},
+	} {
+		result, err := handleShow(
+			context.Background(),
+			repository,
+			AuthorizationAllowedRestricted,
+			protocol,
+			"/+/"+testCase.oid,
+			"HEAD",
+			"",
+		)
+		if result != nil {
+			t.Errorf("For %s, expected no result, got %v", testCase.oid, result)
+		}
+		if testCase.exists && err != nil {
+			t.Errorf("For %s, expected the object to exist, got %v", testCase.oid, err)
+		} else if !testCase.exists && !base.HasErrorCategory(err, ErrNotFound) {
+			t.Errorf("For %s, expected ErrNotFound, got %v", testCase.oid, err)
+		}
+	}
+}
+
+func TestHandleShowNotAcceptable(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	for requestPath, accept := range map[string]string{
+		// Blobs can be shown as JSON or raw bytes.
+		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1/empty": "text/html, image/*",
+		// Commits can only be shown as JSON.
+		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1": "application/octet-stream",
+	} {
+		_, err := handleShow(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			"GET",
+			accept,
+		)
+		if !base.HasErrorCategory(err, ErrNotAcceptable) {
+			t.Errorf("For %s, expected ErrNotAcceptable, got %v", requestPath, err)
+		}
+	}
+}
+
+func TestHandleDiffStat(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+
+	result, err := handleDiffStat(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+diffstat/master...topic",
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the diffstat: %v", err)
+	}
+
+	if 2 != result.Ahead {
+		t.Errorf("Ahead. Expected %d, got %d", 2, result.Ahead)
+	}
+	if 1 != result.Behind {
+		t.Errorf("Behind. Expected %d, got %d", 1, result.Behind)
+	}
+	expectedFiles := []*DiffStatEntryResult{
+		{Path: "a", Additions: 2, Deletions: 1},
+		{Path: "c", Additions: 1, Deletions: 0},
+	}
+	if !reflect.DeepEqual(expectedFiles, result.Files) {
+		t.Errorf("Expected %v, got %s", expectedFiles, result)
+	}
+}
+
+func TestHandleDiff(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := git.OpenRepository("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	expected := &DiffResult{
+		Old: "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		New: "6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+		Files: []*DiffFileResult{
+			{
+				Status:  "added",
+				OldPath: "empty_copy",
+				NewPath: "empty_copy",
+				OldMode: "000000",
+				NewMode: "100644",
+				Hunks:   []*DiffHunkResult{},
+			},
+		},
+	}
+	for _, requestPath := range []string{
+		"/+diff/6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+		"/+diff/88aa3454adb27c3c343ab57564d962a0a7f6a3c1..6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+		"/+diff/master~1..master",
+	} {
+		result, err := handleDiff(
+			context.Background(),
+			repository,
+			AuthorizationAllowedRestricted,
+			protocol,
+			requestPath,
+			"GET",
+		)
+		if err != nil {
+			t.Fatalf("For %s, error getting the diff: %v", requestPath, err)
+		}
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("For %s, expected %s, got %s", requestPath, expected, result)
+		}
+	}
+
+	for _, requestPath := range []string{
+		// Commit only reachable from refs/meta/config, which is restricted.
+		"/+diff/d0c442210b72c207637a63e4eda991bc27abc0bd",
+		"/+diff/d0c442210b72c207637a63e4eda991bc27abc0bd..6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+		"/+diff/6d2439d2e920ba92d8e485e75d1b740ae51b609a..d0c442210b72c207637a63e4eda991bc27abc0bd",
+		"/+diff/88aa3454adb27c3c343ab57564d962a0a7f6a3c1...6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+	} {
+		_, err := handleDiff(
+			context.Background(),
+			repository,
+			AuthorizationAllowedRestricted,
+			protocol,
+			requestPath,
+			"GET",
+		)
+		if !base.HasErrorCategory(err, ErrNotFound) {
+			t.Errorf("For %s, expected ErrNotFound, got %v", requestPath, err)
+		}
+	}
+}
+
+func TestHandleFiles(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	repository, err := openRepository(context.Background(), "testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Error opening git repository: %v", err)
+	}
+	defer repository.Free()
+
+	for requestPath, expected := range map[string]*FilesResult{
+		"/+files/6d2439d2e920ba92d8e485e75d1b740ae51b609a": {
+			Added:    []string{"empty_copy"},
+			Modified: []string{},
+			Deleted:  []string{},
+		},
+		// Root commits are compared against the empty tree.
+		"/+files/88aa3454adb27c3c343ab57564d962a0a7f6a3c1": {
+			Added:    []string{"empty"},
+			Modified: []string{},
+			Deleted:  []string{},
+		},
+		"/+files/refs/heads/master/": {
+			Added:    []string{"empty_copy"},
+			Modified: []string{},
+			Deleted:  []string{},
+		},
+	} {
+		result, err := handleFiles(
+			context.Background(),
+			repository,
+			AuthorizationAllowedRestricted,
+			protocol,
+			requestPath,
+			"GET",
+		)
+		if err != nil {
+			t.Fatalf("For %s, error getting the files: %v", requestPath, err)
+		}
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("For %s, expected %s, got %s", requestPath, expected, result)
+		}
+	}
+
+	for _, requestPath := range []string{
+		"/+files/",
+		// Commit only reachable from refs/meta/config, which is restricted.
+		"/+files/d0c442210b72c207637a63e4eda991bc27abc0bd",
+	} {
+		_, err := handleFiles(
+			context.Background(),
+			repository,
+			AuthorizationAllowedRestricted,
+			protocol,
+			requestPath,
+			"GET",
+		)
+		if !base.HasErrorCategory(err, ErrNotFound) {
+			t.Errorf("For %s, expected ErrNotFound, got %v", requestPath, err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tempRepository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer tempRepository.Free()
+	parentID := createTestCommit(
+		t, tempRepository, log, "refs/heads/master",
+		map[string]string{"a": "a\n", "b": "b\n", "dir/c": "c\n"},
+		"Initial\n",
+	)
+	createTestCommit(
+		t, tempRepository, log, "refs/heads/master",
+		map[string]string{"a": "a2\n", "dir/d": "d\n"},
+		"Second\n",
+		parentID,
+	)
+	result, err := handleFiles(
+		context.Background(),
+		tempRepository,
+		AuthorizationAllowed,
+		protocol,
+		"/+files/master",
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the files: %v", err)
+	}
+	expected := &FilesResult{
+		Added:    []string{"dir/d"},
+		Modified: []string{"a"},
+		Deleted:  []string{"b", "dir/c"},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestHandleDiffHunks(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+
+	result, err := handleDiff(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+diff/topic~1",
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the diff: %v", err)
+	}
+
+	expectedFiles := []*DiffFileResult{
+		{
+			Status:    "modified",
+			OldPath:   "a",
+			NewPath:   "a",
+			OldMode:   "100644",
+			NewMode:   "100644",
+			Additions: 2,
+			Deletions: 1,
+			Hunks: []*DiffHunkResult{
+				{
+					Header:   "@@ -1,3 +1,4 @@",
+					OldStart: 1,
+					OldLines: 3,
+					NewStart: 1,
+					NewLines: 4,
+					Lines:    []string{" 1", "-2", "+x", " 3", "+4"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(expectedFiles, result.Files) {
+		t.Errorf("Expected %v, got %s", expectedFiles, result)
+	}
+}
+
+func TestHandleDiffTruncated(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	files := make(map[string]string)
+	for i := 0; i <= maxDiffFiles; i++ {
+		files[fmt.Sprintf("%04d", i)] = "contents\n"
+	}
+	filesID := createTestCommit(t, repository, log, "refs/heads/files", files, "Many files\n")
+
+	// Changing every tenth line is enough for the changes to not be merged into
+	// a single hunk.
+	var oldLines, newLines strings.Builder
+	for i := 0; i <= maxDiffHunks*10; i++ {
+		fmt.Fprintf(&oldLines, "%d\n", i)
+		if i%10 == 0 {
+			fmt.Fprintf(&newLines, "changed %d\n", i)
+		} else {
+			fmt.Fprintf(&newLines, "%d\n", i)
+		}
+	}
+	oldID := createTestCommit(
+		t, repository, log, "refs/heads/hunks",
+		map[string]string{"a": oldLines.String()},
+		"Many lines\n",
+	)
+	newID := createTestCommit(
+		t, repository, log, "refs/heads/hunks",
+		map[string]string{"a": newLines.String()},
+		"Many hunks\n",
+		oldID,
+	)
+
+	result, err := handleDiff(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		fmt.Sprintf("/+diff/%s", filesID),
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the diff: %v", err)
+	}
+	if !result.Truncated {
+		t.Errorf("Expected the diff to be truncated")
+	}
+	if maxDiffFiles != len(result.Files) {
+		t.Errorf("Expected %d files, got %d", maxDiffFiles, len(result.Files))
+	}
+
+	w := httptest.NewRecorder()
+	if err := handleDiffText(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		fmt.Sprintf("/+diff/%s", filesID),
+		"GET",
+		w,
+	); err != nil {
+		t.Fatalf("Error getting the diff: %v", err)
+	}
+	if actual := w.Header().Get("Omegaup-Diff-Truncated"); actual != "true" {
+		t.Errorf("Expected the text diff to be truncated, got %q", actual)
+	}
+	if actual := strings.Count(w.Body.String(), "diff --git "); maxDiffFiles != actual {
+		t.Errorf("Expected %d files in the text diff, got %d", maxDiffFiles, actual)
+	}
+
+	changedFiles := make(map[string]string)
+	for name := range files {
+		changedFiles[name] = "changed\n"
+	}
+	changedFilesID := createTestCommit(
+		t, repository, log, "refs/heads/files",
+		changedFiles,
+		"Change many files\n",
+		filesID,
+	)
+	statResult, err := handleDiffStat(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		fmt.Sprintf("/+diffstat/%s...%s", filesID, changedFilesID),
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the diffstat: %v", err)
+	}
+	if !statResult.Truncated {
+		t.Errorf("Expected the diffstat to be truncated")
+	}
+	if maxDiffFiles != len(statResult.Files) {
+		t.Errorf("Expected %d files in the diffstat, got %d", maxDiffFiles, len(statResult.Files))
+	}
 
-	expected := &LogResult{
-		Log: []*CommitResult{
-			{
-				Commit:  "6d2439d2e920ba92d8e485e75d1b740ae51b609a",
-				Tree:    "06f8815b4dc1ba5cabf619d8a8ef392d0f88a2f1",
-				Parents: []string{"88aa3454adb27c3c343ab57564d962a0a7f6a3c1"},
-				Author: &SignatureResult{
-					Name:  "lhchavez",
-					Email: "lhchavez@lhchavez.com",
-					Time:  "Sun, 10 Dec 2017 21:07:21 -0800",
-				},
-				Committer: &SignatureResult{
-					Name:  "lhchavez",
-					Email: "lhchavez@lhchavez.com",
-					Time:  "Sun, 10 Dec 2017 21:07:21 -0800",
-				},
-				Message: "Copy\n",
-			},
-			{
-				Commit:  "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
-				Tree:    "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
-				Parents: []string{},
-				Author: &SignatureResult{
-					Name:  "lhchavez",
-					Email: "lhchavez@lhchavez.com",
-					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
-				},
-				Committer: &SignatureResult{
-					Name:  "lhchavez",
-					Email: "lhchavez@lhchavez.com",
-					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
-				},
-				Message: "Empty\n",
-			},
-		},
+	result, err = handleDiff(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		fmt.Sprintf("/+diff/%s", newID),
+		"GET",
+	)
+	if err != nil {
+		t.Fatalf("Error getting the diff: %v", err)
 	}
-	if !reflect.DeepEqual(expected, result) {
-		t.Errorf("Expected %s, got %s", expected, result)
+	if !result.Truncated {
+		t.Errorf("Expected the diff to be truncated")
+	}
+	if len(result.Files) != 1 {
+		t.Fatalf("Expected a single file, got %d", len(result.Files))
+	}
+	if maxDiffHunks != len(result.Files[0].Hunks) {
+		t.Errorf("Expected %d hunks, got %d", maxDiffHunks, len(result.Files[0].Hunks))
+	}
+
+	w = httptest.NewRecorder()
+	if err := handleDiffText(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		fmt.Sprintf("/+diff/%s", newID),
+		"GET",
+		w,
+	); err != nil {
+		t.Fatalf("Error getting the diff: %v", err)
+	}
+	if actual := w.Header().Get("Omegaup-Diff-Truncated"); actual != "true" {
+		t.Errorf("Expected the text diff to be truncated, got %q", actual)
+	}
+	if actual := strings.Count(w.Body.String(), "\n@@ "); maxDiffHunks != actual {
+		t.Errorf("Expected %d hunks in the text diff, got %d", maxDiffHunks, actual)
 	}
 }
 
-func TestHandleLogCommit(t *testing.T) {
+func TestTruncatePatchHunks(t *testing.T) {
+	patch := "diff --git a/a b/a\n--- a/a\n+++ b/a\n@@ -1 +1 @@\n-1\n+x\n@@ -10 +10 @@\n-10\n+y\n"
+	for _, testCase := range []struct {
+		maxHunks          int
+		expected          string
+		expectedHunks     int
+		expectedTruncated bool
+	}{
+		{2, patch, 2, false},
+		{1, "diff --git a/a b/a\n--- a/a\n+++ b/a\n@@ -1 +1 @@\n-1\n+x\n", 1, true},
+		{0, "diff --git a/a b/a\n--- a/a\n+++ b/a\n", 0, true},
+	} {
+		actual, hunks, truncated := truncatePatchHunks(patch, testCase.maxHunks)
+		if testCase.expected != actual || testCase.expectedHunks != hunks || testCase.expectedTruncated != truncated {
+			t.Errorf(
+				"For %d, expected %q, %d, %v, got %q, %d, %v",
+				testCase.maxHunks,
+				testCase.expected,
+				testCase.expectedHunks,
+				testCase.expectedTruncated,
+				actual,
+				hunks,
+				truncated,
+			)
+		}
+	}
+}
+
+func TestHandleDiffBinary(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
 		Log: log,
 	})
 
-	repository, err := git.OpenRepository("testdata/repo.git")
+	dir, err := ioutil.TempDir("", "browser_test")
 	if err != nil {
-		t.Fatalf("Error opening git repository: %v", err)
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
 	}
 	defer repository.Free()
 
-	result, err := handleLog(
+	oldPNG := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01"
+	newPNG := oldPNG + "\x08\x06\x00\x00\x00"
+	parentID := createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"logo.png": oldPNG},
+		"Add logo\n",
+	)
+	createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"logo.png": newPNG},
+		"Change logo\n",
+		parentID,
+	)
+
+	result, err := handleDiff(
 		context.Background(),
 		repository,
 		AuthorizationAllowed,
 		protocol,
-		"/+log/88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		"/+diff/master",
 		"GET",
 	)
 	if err != nil {
-		t.Fatalf("Error getting the log: %v %v", err, result)
+		t.Fatalf("Error getting the diff: %v", err)
 	}
-
-	expected := &LogResult{
-		Log: []*CommitResult{
-			{
-				Commit:  "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
-				Tree:    "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
-				Parents: []string{},
-				Author: &SignatureResult{
-					Name:  "lhchavez",
-					Email: "lhchavez@lhchavez.com",
-					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
-				},
-				Committer: &SignatureResult{
-					Name:  "lhchavez",
-					Email: "lhchavez@lhchavez.com",
-					Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
-				},
-				Message: "Empty\n",
-			},
+	expectedFiles := []*DiffFileResult{
+		{
+			Status:  "modified",
+			OldPath: "logo.png",
+			NewPath: "logo.png",
+			OldMode: "100644",
+			NewMode: "100644",
+			Hunks:   []*DiffHunkResult{},
+			Binary:  true,
+			OldSize: len(oldPNG),
+			NewSize: len(newPNG),
 		},
 	}
-	if !reflect.DeepEqual(expected, result) {
-		t.Errorf("Expected %s, got %s", expected, result)
+	if !reflect.DeepEqual(expectedFiles, result.Files) {
+		t.Errorf("Expected %v, got %s", expectedFiles, result)
+	}
+
+	w := httptest.NewRecorder()
+	if err := handleDiffText(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+diff/master",
+		"GET",
+		w,
+	); err != nil {
+		t.Fatalf("Error getting the diff: %v", err)
+	}
+	if expected := "Binary files a/logo.png and b/logo.png differ\n"; !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("Expected the diff to contain %q, got %q", expected, w.Body.String())
 	}
 }
 
-func TestHandleShowCommit(t *testing.T) {
+func TestHandleBlame(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
 		Log: log,
 	})
 
-	repository, err := git.OpenRepository("testdata/repo.git")
+	dir, err := ioutil.TempDir("", "browser_test")
 	if err != nil {
-		t.Fatalf("Error opening git repository: %v", err)
+		t.Fatalf("Failed to create directory: %v", err)
 	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
 	defer repository.Free()
 
-	result, err := handleShow(
+	resolve := func(rev string) string {
+		obj, err := repository.RevparseSingle(rev)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", rev, err)
+		}
+		defer obj.Free()
+		return obj.Id().String()
+	}
+	baseID := resolve("master~1")
+	changeID := resolve("topic~1")
+
+	result, err := handleBlame(
 		context.Background(),
 		repository,
 		AuthorizationAllowed,
 		protocol,
-		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		"/+blame/topic/a",
 		"GET",
-		"",
 	)
 	if err != nil {
-		t.Fatalf("Error getting the log: %v %v", err, result)
+		t.Fatalf("Error getting the blame: %v", err)
 	}
 
-	expected := &CommitResult{
-		Commit:  "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
-		Tree:    "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
-		Parents: []string{},
-		Author: &SignatureResult{
-			Name:  "lhchavez",
-			Email: "lhchavez@lhchavez.com",
-			Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
-		},
-		Committer: &SignatureResult{
-			Name:  "lhchavez",
-			Email: "lhchavez@lhchavez.com",
-			Time:  "Sun, 10 Dec 2017 11:51:32 -0800",
-		},
-		Message: "Empty\n",
+	// a is "1\nx\n3\n4\n", where "x" and "4" were introduced by "Change a".
+	expected := []struct {
+		commit    string
+		startLine int
+		lines     int
+	}{
+		{baseID, 1, 1},
+		{changeID, 2, 1},
+		{baseID, 3, 1},
+		{changeID, 4, 1},
 	}
-	if !reflect.DeepEqual(expected, result) {
-		t.Errorf("Expected %s, got %s", expected, result)
+	if len(expected) != len(result.Hunks) {
+		t.Fatalf("Expected %d hunks, got %s", len(expected), result)
+	}
+	for i, hunk := range result.Hunks {
+		if expected[i].commit != hunk.Commit || expected[i].startLine != hunk.StartLine || expected[i].lines != hunk.Lines {
+			t.Errorf("Hunk %d: expected %v, got %v", i, expected[i], hunk)
+		}
+		if hunk.OrigPath != "a" {
+			t.Errorf("Hunk %d: expected the original path to be a, got %q", i, hunk.OrigPath)
+		}
+	}
+
+	createTestCommit(
+		t, repository, log, "refs/heads/large",
+		map[string]string{"large": strings.Repeat("x\n", BlobDisplayMaxSize)},
+		"Large\n",
+	)
+	for requestPath, category := range map[string]error{
+		"/+blame/topic/nonexistent": ErrNotFound,
+		"/+blame/nonexistent/a":     ErrNotFound,
+		"/+blame/large/large":       ErrBadRequest,
+	} {
+		if _, err := handleBlame(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			"GET",
+		); !base.HasErrorCategory(err, category) {
+			t.Errorf("For %s, expected %v, got %v", requestPath, category, err)
+		}
+	}
+}
+
+func TestHandleAheadBehind(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+
+	for path, expected := range map[string]*AheadBehindResult{
+		"/+ahead-behind/master/topic":            {Ahead: 2, Behind: 1},
+		"/+ahead-behind/topic/master":            {Ahead: 1, Behind: 2},
+		"/+ahead-behind/master/refs/heads/topic": {Ahead: 2, Behind: 1},
+		"/+ahead-behind/master/master":           {Ahead: 0, Behind: 0},
+	} {
+		result, err := handleAheadBehind(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			path,
+			"GET",
+		)
+		if err != nil {
+			t.Fatalf("Error getting the ahead/behind counts for %s: %v", path, err)
+		}
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("For path %s, expected %s, got %s", path, expected, result)
+		}
+	}
+}
+
+func TestHandleIsAncestor(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+	createTestCommit(
+		t, repository, log, "refs/heads/orphan",
+		map[string]string{"d": "d\n"},
+		"Unrelated\n",
+	)
+
+	master, err := repository.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to look up master: %v", err)
+	}
+	defer master.Free()
+	masterCommit, err := repository.LookupCommit(master.Target())
+	if err != nil {
+		t.Fatalf("Failed to look up the master commit: %v", err)
+	}
+	defer masterCommit.Free()
+	parentID := masterCommit.ParentId(0).String()
+
+	for path, expected := range map[string]bool{
+		"/+is-ancestor/" + parentID + "/master":  true,
+		"/+is-ancestor/master/" + parentID:       false,
+		"/+is-ancestor/master/master":            true,
+		"/+is-ancestor/topic/master":             false,
+		"/+is-ancestor/orphan/refs/heads/master": false,
+	} {
+		result, err := handleIsAncestor(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			path,
+			"GET",
+		)
+		if err != nil {
+			t.Fatalf("Error checking ancestry for %s: %v", path, err)
+		}
+		if expected != result.IsAncestor {
+			t.Errorf("For path %s, expected %v, got %v", path, expected, result.IsAncestor)
+		}
+	}
+}
+
+func TestHandleMergeBase(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+	createTestCommit(
+		t, repository, log, "refs/heads/orphan",
+		map[string]string{"d": "d\n"},
+		"Unrelated\n",
+	)
+
+	master, err := repository.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to look up master: %v", err)
+	}
+	defer master.Free()
+	masterCommit, err := repository.LookupCommit(master.Target())
+	if err != nil {
+		t.Fatalf("Failed to look up the master commit: %v", err)
+	}
+	defer masterCommit.Free()
+	baseID := masterCommit.ParentId(0).String()
+
+	for _, path := range []string{
+		"/+merge-base/master/topic",
+		"/+merge-base/topic/refs/heads/master",
+	} {
+		result, err := handleMergeBase(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			path,
+			"GET",
+			nil,
+		)
+		if err != nil {
+			t.Fatalf("Error getting the merge base for %s: %v", path, err)
+		}
+		expected := &MergeBaseResult{Commit: baseID}
+		if !reflect.DeepEqual(expected, result) {
+			t.Errorf("For path %s, expected %v, got %v", path, expected, result)
+		}
+	}
+
+	result, err := handleMergeBase(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+merge-base/master/topic",
+		"GET",
+		url.Values{"all": []string{"true"}},
+	)
+	if err != nil {
+		t.Fatalf("Error getting the merge bases: %v", err)
+	}
+	expectedBases := &MergeBasesResult{{Commit: baseID}}
+	if !reflect.DeepEqual(expectedBases, result) {
+		t.Errorf("Expected %v, got %v", expectedBases, result)
+	}
+
+	_, err = handleMergeBase(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+merge-base/master/orphan",
+		"GET",
+		nil,
+	)
+	if !base.HasErrorCategory(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for unrelated histories, got %v", err)
 	}
 }
 
-func TestHandleShowTree(t *testing.T) {
+func TestHandleObject(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
 		Log: log,
@@ -484,82 +2898,227 @@ func TestHandleShowTree(t *testing.T) {
 	}
 	defer repository.Free()
 
-	expected := &TreeResult{
-		ID: "417c01c8795a35b8e835113a85a5c0c1c77f67fb",
-		Entries: []*TreeEntryResult{
-			{
-				ID:   "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
-				Mode: 0100644,
-				Type: "blob",
-				Name: "empty",
-				Size: 0,
-			},
-		},
+	odb, err := repository.Odb()
+	if err != nil {
+		t.Fatalf("Error opening odb: %v", err)
 	}
+	defer odb.Free()
 
-	for _, requestURL := range []string{
-		// Use commit+path.
-		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1/",
-		// Use the object ID directly.
-		"/+/417c01c8795a35b8e835113a85a5c0c1c77f67fb",
+	for _, testCase := range []struct {
+		id           string
+		objectType   git.ObjectType
+		expectedType string
+	}{
+		{"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", git.ObjectBlob, "blob"},
+		{"417c01c8795a35b8e835113a85a5c0c1c77f67fb", git.ObjectTree, "tree"},
+		{"6d2439d2e920ba92d8e485e75d1b740ae51b609a", git.ObjectCommit, "commit"},
 	} {
-		result, err := handleShow(
+		w := httptest.NewRecorder()
+		if err := handleObject(
 			context.Background(),
 			repository,
 			AuthorizationAllowed,
 			protocol,
-			requestURL,
+			"/+object/"+testCase.id,
 			"GET",
-			"",
-		)
+			w,
+		); err != nil {
+			t.Fatalf("Error getting object %s: %v", testCase.id, err)
+		}
+		if actual := w.Header().Get(ObjectTypeHeader); testCase.expectedType != actual {
+			t.Errorf("For %s, expected type %q, got %q", testCase.id, testCase.expectedType, actual)
+		}
+		id, err := odb.Hash(w.Body.Bytes(), testCase.objectType)
 		if err != nil {
-			t.Fatalf("Error getting showing tree: %v %v", err, result)
+			t.Fatalf("Error hashing the contents of %s: %v", testCase.id, err)
+		}
+		if testCase.id != id.String() {
+			t.Errorf("Expected %s, got %s", testCase.id, id)
 		}
+	}
 
-		if !reflect.DeepEqual(expected, result) {
-			t.Errorf("Expected %s, got %s", expected, result)
+	// The tree of refs/meta/config is only reachable from a restricted ref.
+	for level, expectedErr := range map[AuthorizationLevel]error{
+		AuthorizationAllowed:           nil,
+		AuthorizationAllowedRestricted: ErrNotFound,
+	} {
+		err := handleObject(
+			context.Background(),
+			repository,
+			level,
+			protocol,
+			"/+object/7ec9bc0c5d9e417f48f5d2d15b8743a762065a18",
+			"GET",
+			httptest.NewRecorder(),
+		)
+		if expectedErr == nil && err != nil {
+			t.Errorf("For level %v, expected no error, got %v", level, err)
+		} else if expectedErr != nil && !base.HasErrorCategory(err, expectedErr) {
+			t.Errorf("For level %v, expected %v, got %v", level, expectedErr, err)
 		}
 	}
 }
 
-func TestHandleShowBlob(t *testing.T) {
+func TestHandleShowTag(t *testing.T) {
 	log, _ := log15.New("info", false)
 	protocol := NewGitProtocol(GitProtocolOpts{
 		Log: log,
 	})
 
-	repository, err := git.OpenRepository("testdata/repo.git")
+	dir, err := ioutil.TempDir("", "browser_test")
 	if err != nil {
-		t.Fatalf("Error opening git repository: %v", err)
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
 	}
 	defer repository.Free()
 
-	expected := &BlobResult{
-		ID:       "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
-		Size:     0,
-		Contents: "",
+	commitID := createTestCommit(
+		t, repository, log, "refs/heads/master",
+		map[string]string{"a": "a\n"},
+		"Initial commit\n",
+	)
+	commit, err := repository.LookupCommit(commitID)
+	if err != nil {
+		t.Fatalf("Failed to look up commit: %v", err)
 	}
+	defer commit.Free()
 
-	for _, requestURL := range []string{
-		// Use commit+path.
-		"/+/88aa3454adb27c3c343ab57564d962a0a7f6a3c1/empty",
-		// Use the object ID directly.
-		"/+/e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
-	} {
+	tagger := &git.Signature{
+		Name:  "tagger",
+		Email: "tagger@test.test",
+		When:  time.Unix(0, 0).In(time.UTC),
+	}
+	tagID, err := repository.Tags.Create("v1.0", commit, tagger, "Release 1.0\n")
+	if err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+
+	result, err := handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/"+tagID.String(),
+		"GET",
+		"",
+	)
+	if err != nil {
+		t.Fatalf("Error showing the tag: %v %v", err, result)
+	}
+
+	expected := &TagResult{
+		ID:         tagID.String(),
+		Name:       "v1.0",
+		Target:     commitID.String(),
+		TargetType: "commit",
+		Tagger: &SignatureResult{
+			Name:  "tagger",
+			Email: "tagger@test.test",
+			Time:  "Thu, 01 Jan 1970 00:00:00 +0000",
+		},
+		Message: "Release 1.0\n",
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+	if _, err := handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/"+tagID.String(),
+		"HEAD",
+		"",
+	); err != nil {
+		t.Errorf("Expected the tag to exist, got %v", err)
+	}
+
+	// Named tags are peeled to the commit they point to.
+	for _, requestPath := range []string{"/+/v1.0", "/+/refs/tags/v1.0"} {
 		result, err := handleShow(
 			context.Background(),
 			repository,
 			AuthorizationAllowed,
 			protocol,
-			requestURL,
+			requestPath,
 			"GET",
 			"",
 		)
 		if err != nil {
-			t.Fatalf("Error getting the blob: %v %v", err, result)
+			t.Fatalf("For %s, error showing the tag: %v %v", requestPath, err, result)
 		}
-		if !reflect.DeepEqual(expected, result) {
-			t.Errorf("Expected %s, got %s", expected, result)
+		if commitResult, ok := result.(*CommitResult); !ok || commitResult.Commit != commitID.String() {
+			t.Errorf("For %s, expected commit %s, got %v", requestPath, commitID, result)
+		}
+	}
+	result, err = handleShow(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		"/+/v1.0/a",
+		"GET",
+		"",
+	)
+	if err != nil {
+		t.Fatalf("Error showing a blob through the tag: %v %v", err, result)
+	}
+	if blobResult, ok := result.(*BlobResult); !ok || blobResult.Size != 2 {
+		t.Errorf("Expected the blob a, got %v", result)
+	}
+
+	// Tag objects that are not the target of any of the viewable references
+	// are not shown, even by their object id.
+	for _, tc := range []struct {
+		protocol     *GitProtocol
+		deleteTagRef bool
+	}{
+		{
+			protocol: NewGitProtocol(GitProtocolOpts{
+				ReferenceDiscoveryCallback: func(
+					ctx context.Context,
+					repository *git.Repository,
+					referenceName string,
+				) bool {
+					return referenceName != "refs/tags/v1.0"
+				},
+				Log: log,
+			}),
+		},
+		{
+			protocol:     protocol,
+			deleteTagRef: true,
+		},
+	} {
+		if tc.deleteTagRef {
+			ref, err := repository.References.Lookup("refs/tags/v1.0")
+			if err != nil {
+				t.Fatalf("Failed to look up the tag: %v", err)
+			}
+			err = ref.Delete()
+			ref.Free()
+			if err != nil {
+				t.Fatalf("Failed to delete the tag: %v", err)
+			}
+		}
+		for _, method := range []string{"GET", "HEAD"} {
+			result, err := handleShow(
+				context.Background(),
+				repository,
+				AuthorizationAllowed,
+				tc.protocol,
+				"/+/"+tagID.String(),
+				method,
+				"",
+			)
+			if !base.HasErrorCategory(err, ErrNotFound) {
+				t.Errorf("%s: Expected ErrNotFound for an unreachable tag, got %v %v", method, err, result)
+			}
 		}
 	}
 }
@@ -602,6 +3161,14 @@ func TestHandleNotFound(t *testing.T) {
 		"/+log/master", // Valid ref, but is not viewable.
 		"/+log/6d2439d2e920ba92d8e485e75d1b740ae51b609a", // Valid ref, but is not viewable.
 		"/+log/e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", // Valid ref, but is not a commit.
+		"/+diffstat/master",            // Invalid range.
+		"/+diffstat/foo...master",      // Invalid ref.
+		"/+diffstat/master...master",   // Valid ref, but is not viewable.
+		"/+ahead-behind/master",        // Missing revision.
+		"/+ahead-behind/foo/master",    // Invalid ref.
+		"/+ahead-behind/master/master", // Valid ref, but is not viewable.
+		"/+contributors/foo/empty",     // Invalid ref.
+		"/+contributors/master/empty",  // Valid ref, but is not viewable.
 	}
 	for _, path := range paths {
 		w := httptest.NewRecorder()
@@ -627,3 +3194,344 @@ func TestHandleNotFound(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleReflog(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repository, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		// Bare repositories do not write reflogs by default.
+		config, err := repository.Config()
+		if err != nil {
+			t.Fatalf("Failed to open the repository config: %v", err)
+		}
+		if err := config.SetBool("core.logAllRefUpdates", true); err != nil {
+			t.Fatalf("Failed to enable reflogs: %v", err)
+		}
+		config.Free()
+		repository.Free()
+	}
+
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	for _, command := range []string{
+		"0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\n",
+		"88aa3454adb27c3c343ab57564d962a0a7f6a3c1 6d2439d2e920ba92d8e485e75d1b740ae51b609a refs/heads/master\n",
+	} {
+		var inBuf, outBuf bytes.Buffer
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(command))
+		pw.Flush()
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		_, err = io.Copy(&inBuf, f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+		if err := handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		); err != nil {
+			t.Fatalf("Failed to push %q: %v", command, err)
+		}
+	}
+
+	requestPath := "/+reflog/refs/heads/master"
+	req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	if err := handleBrowse(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		protocol,
+		requestPath,
+		req,
+		w,
+	); err != nil {
+		t.Fatalf("Error getting reflog: %v", err)
+	}
+
+	var result ReflogResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode the reflog: %v", err)
+	}
+	if len(result.Entries) != 2 {
+		t.Fatalf("Expected 2 reflog entries, got %v", result.Entries)
+	}
+	for i, expected := range []struct {
+		old, new, message string
+	}{
+		{"88aa3454adb27c3c343ab57564d962a0a7f6a3c1", "6d2439d2e920ba92d8e485e75d1b740ae51b609a", "Copy"},
+		{"0000000000000000000000000000000000000000", "88aa3454adb27c3c343ab57564d962a0a7f6a3c1", "Empty"},
+	} {
+		entry := result.Entries[i]
+		if expected.old != entry.Old || expected.new != entry.New || expected.message != entry.Message {
+			t.Errorf("Entry %d: expected %v, got %v", i, expected, entry)
+		}
+	}
+
+	if err := handleBrowse(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			HiddenRefs: []string{"refs/heads/*"},
+			Log:        log,
+		}),
+		requestPath,
+		req,
+		httptest.NewRecorder(),
+	); !base.HasErrorCategory(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a hidden ref, got %v", err)
+	}
+}
+
+func TestHandleBrowsePrettyJSON(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	for query, expected := range map[string]string{
+		"":          "{\"default_branch\":\"refs/heads/master\"}\n",
+		"?pretty=0": "{\"default_branch\":\"refs/heads/master\"}\n",
+		"?pretty=1": "{\n  \"default_branch\": \"refs/heads/master\"\n}\n",
+	} {
+		requestPath := "/+default-branch"
+		req, err := http.NewRequest("GET", "http://test"+requestPath+query, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		if err := handleBrowse(
+			context.Background(),
+			m,
+			"testdata/repo.git",
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			req,
+			w,
+		); err != nil {
+			t.Fatalf("Error getting the default branch: %v", err)
+		}
+		if actual := w.Body.String(); expected != actual {
+			t.Errorf("For query %q, expected %q, got %q", query, expected, actual)
+		}
+	}
+}
+
+func TestHandleCommits(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	newRequest := func(method, query, contentType, body string) *http.Request {
+		req, err := http.NewRequest(method, "http://test/+commits"+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return req
+	}
+
+	for name, req := range map[string]*http.Request{
+		"GET": newRequest(
+			"GET",
+			"?rev=6d2439d2e920ba92d8e485e75d1b740ae51b609a&rev=88aa3454adb27c3c343ab57564d962a0a7f6a3c1&rev=missing",
+			"",
+			"",
+		),
+		"POST form": newRequest(
+			"POST",
+			"",
+			"application/x-www-form-urlencoded",
+			"rev=6d2439d2e920ba92d8e485e75d1b740ae51b609a&rev=88aa3454adb27c3c343ab57564d962a0a7f6a3c1&rev=missing",
+		),
+		"POST JSON": newRequest(
+			"POST",
+			"",
+			"application/json",
+			`["6d2439d2e920ba92d8e485e75d1b740ae51b609a", "88aa3454adb27c3c343ab57564d962a0a7f6a3c1", "missing"]`,
+		),
+	} {
+		w := httptest.NewRecorder()
+		if err := handleBrowse(
+			context.Background(),
+			m,
+			"testdata/repo.git",
+			AuthorizationAllowed,
+			protocol,
+			"/+commits",
+			req,
+			w,
+		); err != nil {
+			t.Fatalf("%s: Error getting the commits: %v", name, err)
+		}
+
+		var result CommitsResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: Failed to decode the commits: %v", name, err)
+		}
+		if len(result) != 3 {
+			t.Fatalf("%s: Expected 3 commits, got %v", name, result)
+		}
+		for i, expected := range []string{
+			"6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+			"88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		} {
+			if result[i] == nil || expected != result[i].Commit {
+				t.Errorf("%s: Entry %d: expected %s, got %v", name, i, expected, result[i])
+			}
+		}
+		if result[2] != nil {
+			t.Errorf("%s: Expected a nil entry for a missing revision, got %v", name, result[2])
+		}
+	}
+
+	revs := make(url.Values)
+	for i := 0; i <= maxCommitsBatchSize; i++ {
+		revs.Add("rev", "master")
+	}
+	if err := handleBrowse(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		protocol,
+		"/+commits",
+		newRequest("GET", "?"+revs.Encode(), "", ""),
+		httptest.NewRecorder(),
+	); !base.HasErrorCategory(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for too many revisions, got %v", err)
+	}
+}
+
+func TestHandleShowCommitNonUTF8(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	dir, err := ioutil.TempDir("", "browser_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+	odb, err := repository.Odb()
+	if err != nil {
+		t.Fatalf("Failed to get the odb: %v", err)
+	}
+	defer odb.Free()
+	treeID, err := odb.Write([]byte{}, git.ObjectTree)
+	if err != nil {
+		t.Fatalf("Failed to write the empty tree: %v", err)
+	}
+
+	for name, testCase := range map[string]struct {
+		header          string
+		expectedAuthor  string
+		expectedMessage string
+	}{
+		"latin1":  {"encoding ISO-8859-1\n", "José", "Café\n"},
+		"invalid": {"", "Jos\uFFFD", "Caf\uFFFD\n"},
+	} {
+		// libgit2 does not allow creating commits with an encoding header, so
+		// they are written directly into the odb.
+		commitID, err := odb.Write(
+			[]byte(
+				"tree "+treeID.String()+"\n"+
+					"author Jos\xe9 <jose@test.test> 0 +0000\n"+
+					"committer Jos\xe9 <jose@test.test> 0 +0000\n"+
+					testCase.header+
+					"\n"+
+					"Caf\xe9\n",
+			),
+			git.ObjectCommit,
+		)
+		if err != nil {
+			t.Fatalf("%s: Failed to write the commit: %v", name, err)
+		}
+		ref, err := repository.References.Create("refs/heads/"+name, commitID, true, "")
+		if err != nil {
+			t.Fatalf("%s: Failed to create the reference: %v", name, err)
+		}
+		ref.Free()
+
+		requestPath := "/+/" + commitID.String()
+		req, err := http.NewRequest("GET", "http://test"+requestPath, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		if err := handleBrowse(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			requestPath,
+			req,
+			w,
+		); err != nil {
+			t.Fatalf("%s: Error getting the commit: %v", name, err)
+		}
+		if !utf8.Valid(w.Body.Bytes()) {
+			t.Fatalf("%s: Expected a valid UTF-8 response, got %q", name, w.Body.String())
+		}
+
+		var result CommitResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: Failed to decode the commit: %v", name, err)
+		}
+		if testCase.expectedMessage != result.Message {
+			t.Errorf("%s: Expected message %q, got %q", name, testCase.expectedMessage, result.Message)
+		}
+		for _, signature := range []*SignatureResult{result.Author, result.Committer} {
+			if testCase.expectedAuthor != signature.Name {
+				t.Errorf("%s: Expected name %q, got %q", name, testCase.expectedAuthor, signature.Name)
+			}
+		}
+	}
+}
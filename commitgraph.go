@@ -0,0 +1,380 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	git "github.com/libgit2/git2go/v33"
+	"github.com/omegaup/go-base/v3/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	commitGraphSignature     = "CGPH"
+	commitGraphVersion       = 1
+	commitGraphHashVersion   = 1
+	commitGraphChunkOIDF     = 0x4f494446
+	commitGraphChunkOIDL     = 0x4f49444c
+	commitGraphChunkCDAT     = 0x43444154
+	commitGraphChunkEDGE     = 0x45444745
+	commitGraphParentNone    = 0x70000000
+	commitGraphExtraEdges    = 0x80000000
+	commitGraphLastEdge      = 0x80000000
+	commitGraphMaxGeneration = 0x3fffffff
+)
+
+// A commitGraphEntry is the information of a single commit that is stored in
+// the commit-graph file.
+type commitGraphEntry struct {
+	id         git.Oid
+	treeID     git.Oid
+	parents    []git.Oid
+	time       uint64
+	generation uint32
+}
+
+// commitGraphPath returns the path of the commit-graph file of the repository.
+func commitGraphPath(repository *git.Repository) string {
+	return path.Join(repository.Path(), "objects/info/commit-graph")
+}
+
+// WriteCommitGraph writes git's commit-graph file for all the commits that
+// are reachable from the references in the repository. libgit2 uses this file
+// to speed up revwalks and reachability queries. The file is replaced
+// atomically, so it is safe to call this while the repository is being read.
+// This is intended to be called periodically as part of the repository
+// maintenance.
+//
+// The format of the file is documented in
+// https://github.com/git/git/blob/master/Documentation/technical/commit-graph-format.txt
+func WriteCommitGraph(repository *git.Repository) error {
+	entries, err := listCommitGraphEntries(repository)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	contents, err := encodeCommitGraph(entries)
+	if err != nil {
+		return err
+	}
+
+	infoDir := path.Dir(commitGraphPath(repository))
+	if err := os.MkdirAll(infoDir, 0o755); err != nil {
+		return errors.Wrap(err, "failed to create the objects/info directory")
+	}
+	f, err := ioutil.TempFile(infoDir, "commit-graph-*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create the temporary commit-graph")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write the commit-graph")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close the commit-graph")
+	}
+	if err := os.Chmod(f.Name(), 0o444); err != nil {
+		return errors.Wrap(err, "failed to change the mode of the commit-graph")
+	}
+	if err := os.Rename(f.Name(), commitGraphPath(repository)); err != nil {
+		return errors.Wrap(err, "failed to replace the commit-graph")
+	}
+	return nil
+}
+
+// maybeWriteCommitGraph writes the commit-graph file of the repository unless
+// it was written less than interval ago.
+func maybeWriteCommitGraph(repository *git.Repository, interval time.Duration) error {
+	if stat, err := os.Stat(commitGraphPath(repository)); err == nil {
+		if time.Since(stat.ModTime()) < interval {
+			return nil
+		}
+	}
+	return WriteCommitGraph(repository)
+}
+
+// A commitGraphWriter writes the commit-graph files of repositories in the
+// background, so that pushes do not need to walk the whole history while
+// holding the repository lock. Only one write per repository is in flight at
+// any given time.
+type commitGraphWriter struct {
+	interval time.Duration
+	log      logging.Logger
+
+	// mu protects pending and the additions to writers.
+	mu      sync.Mutex
+	closed  bool
+	pending map[string]struct{}
+	writers sync.WaitGroup
+}
+
+func newCommitGraphWriter(
+	interval time.Duration,
+	log logging.Logger,
+) *commitGraphWriter {
+	return &commitGraphWriter{
+		interval: interval,
+		log:      log,
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// write writes the commit-graph file of the repository in the background,
+// unless it was written less than interval ago or there is already a write in
+// flight for it. The file is written from the references that are present when
+// the walk starts, and it only references objects that are never removed by
+// pushes, so this does not need the repository lock.
+func (w *commitGraphWriter) write(ctx context.Context, repositoryPath string) {
+	w.mu.Lock()
+	if _, ok := w.pending[repositoryPath]; ok || w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.pending[repositoryPath] = struct{}{}
+	w.writers.Add(1)
+	w.mu.Unlock()
+
+	go func() {
+		defer w.writers.Done()
+		defer func() {
+			w.mu.Lock()
+			delete(w.pending, repositoryPath)
+			w.mu.Unlock()
+		}()
+
+		repository, err := openRepository(detachedContext{parent: ctx}, repositoryPath)
+		if err != nil {
+			w.log.Error(
+				"Failed to open git repository to write the commit-graph",
+				map[string]any{
+					"repository": repositoryPath,
+					"err":        err,
+				},
+			)
+			return
+		}
+		defer repository.Free()
+
+		if err := maybeWriteCommitGraph(repository, w.interval); err != nil {
+			w.log.Error(
+				"Failed to write the commit-graph",
+				map[string]any{
+					"repository": repositoryPath,
+					"err":        err,
+				},
+			)
+		}
+	}()
+}
+
+// close waits for all the writes in flight to finish. No writes are started
+// after calling this.
+func (w *commitGraphWriter) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.writers.Wait()
+}
+
+// listCommitGraphEntries returns the commits reachable from the references in
+// the repository, sorted by id and with their generation numbers computed.
+func listCommitGraphEntries(repository *git.Repository) ([]*commitGraphEntry, error) {
+	it, err := repository.NewReferenceIterator()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to create a reference iterator",
+		)
+	}
+	defer it.Free()
+
+	walk, err := repository.Walk()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to create the repository revwalk",
+		)
+	}
+	defer walk.Free()
+	walk.Sorting(git.SortTopological)
+
+	for {
+		ref, err := it.Next()
+		if err != nil {
+			if git.IsErrorCode(err, git.ErrorCodeIterOver) {
+				break
+			}
+			return nil, errors.Wrap(
+				err,
+				"failed to get an entry from the reference iterator",
+			)
+		}
+		obj, err := ref.Peel(git.ObjectCommit)
+		ref.Free()
+		if err != nil {
+			// References that do not point to commits are not part of the graph.
+			continue
+		}
+		err = walk.Push(obj.Id())
+		obj.Free()
+		if err != nil {
+			return nil, errors.Wrap(
+				err,
+				"failed to add the reference to the revwalk",
+			)
+		}
+	}
+
+	// The topological walk visits children before their parents.
+	var entries []*commitGraphEntry
+	if err := walk.Iterate(func(commit *git.Commit) bool {
+		defer commit.Free()
+		entry := &commitGraphEntry{
+			id:     *commit.Id(),
+			treeID: *commit.TreeId(),
+		}
+		for i := uint(0); i < commit.ParentCount(); i++ {
+			entry.parents = append(entry.parents, *commit.ParentId(i))
+		}
+		if when := commit.Committer().When.Unix(); when > 0 {
+			entry.time = uint64(when)
+		}
+		entries = append(entries, entry)
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to walk the repository",
+		)
+	}
+
+	generations := make(map[git.Oid]uint32, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		entry.generation = 1
+		for _, parentID := range entry.parents {
+			if generation := generations[parentID] + 1; generation > entry.generation {
+				entry.generation = generation
+			}
+		}
+		if entry.generation > commitGraphMaxGeneration {
+			entry.generation = commitGraphMaxGeneration
+		}
+		generations[entry.id] = entry.generation
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].id[:], entries[j].id[:]) < 0
+	})
+	return entries, nil
+}
+
+// encodeCommitGraph returns the contents of a commit-graph file with the
+// provided entries, which must be sorted by id. All the parents of the entries
+// must also be part of the entries, since the file cannot reference commits
+// outside of it. This is not the case in shallow repositories, for instance.
+func encodeCommitGraph(entries []*commitGraphEntry) ([]byte, error) {
+	positions := make(map[git.Oid]uint32, len(entries))
+	for i, entry := range entries {
+		positions[entry.id] = uint32(i)
+	}
+	for _, entry := range entries {
+		for _, parentID := range entry.parents {
+			if _, ok := positions[parentID]; !ok {
+				return nil, errors.Errorf(
+					"parent %s of commit %s is not part of the commit-graph",
+					parentID.String(),
+					entry.id.String(),
+				)
+			}
+		}
+	}
+
+	var fanout, oidLookup, commitData, extraEdges bytes.Buffer
+	var fanoutCounts [256]uint32
+	for _, entry := range entries {
+		fanoutCounts[entry.id[0]]++
+	}
+	count := uint32(0)
+	for _, fanoutCount := range fanoutCounts {
+		count += fanoutCount
+		binary.Write(&fanout, binary.BigEndian, count)
+	}
+	for _, entry := range entries {
+		oidLookup.Write(entry.id[:])
+
+		commitData.Write(entry.treeID[:])
+		parentPositions := [2]uint32{commitGraphParentNone, commitGraphParentNone}
+		if len(entry.parents) > 0 {
+			parentPositions[0] = positions[entry.parents[0]]
+		}
+		if len(entry.parents) == 2 {
+			parentPositions[1] = positions[entry.parents[1]]
+		} else if len(entry.parents) > 2 {
+			parentPositions[1] = commitGraphExtraEdges | uint32(extraEdges.Len()/4)
+			for i, parentID := range entry.parents[1:] {
+				position := positions[parentID]
+				if i == len(entry.parents)-2 {
+					position |= commitGraphLastEdge
+				}
+				binary.Write(&extraEdges, binary.BigEndian, position)
+			}
+		}
+		binary.Write(&commitData, binary.BigEndian, parentPositions)
+		binary.Write(
+			&commitData,
+			binary.BigEndian,
+			entry.generation<<2|uint32(entry.time>>32)&0x3,
+		)
+		binary.Write(&commitData, binary.BigEndian, uint32(entry.time))
+	}
+
+	chunks := []struct {
+		id   uint32
+		data []byte
+	}{
+		{commitGraphChunkOIDF, fanout.Bytes()},
+		{commitGraphChunkOIDL, oidLookup.Bytes()},
+		{commitGraphChunkCDAT, commitData.Bytes()},
+	}
+	if extraEdges.Len() > 0 {
+		chunks = append(chunks, struct {
+			id   uint32
+			data []byte
+		}{commitGraphChunkEDGE, extraEdges.Bytes()})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(commitGraphSignature)
+	buf.Write([]byte{commitGraphVersion, commitGraphHashVersion, byte(len(chunks)), 0})
+
+	// The table of contents has one entry per chunk, plus a terminating entry
+	// that marks the end of the last chunk.
+	offset := uint64(buf.Len() + (len(chunks)+1)*12)
+	for _, chunk := range chunks {
+		binary.Write(&buf, binary.BigEndian, chunk.id)
+		binary.Write(&buf, binary.BigEndian, offset)
+		offset += uint64(len(chunk.data))
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	binary.Write(&buf, binary.BigEndian, offset)
+	for _, chunk := range chunks {
+		buf.Write(chunk.data)
+	}
+
+	checksum := sha1.Sum(buf.Bytes())
+	buf.Write(checksum[:])
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,137 @@
+package githttp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/omegaup/go-base/logging/log15/v3"
+
+	git "github.com/libgit2/git2go/v33"
+)
+
+func TestWriteCommitGraph(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "commitgraph_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	{
+		repository := createDivergedRepository(t, dir, log)
+		masterRef, err := repository.References.Lookup("refs/heads/master")
+		if err != nil {
+			t.Fatalf("Failed to look up refs/heads/master: %v", err)
+		}
+		topicRef, err := repository.References.Lookup("refs/heads/topic")
+		if err != nil {
+			t.Fatalf("Failed to look up refs/heads/topic: %v", err)
+		}
+		createTestCommit(
+			t, repository, log, "refs/heads/merge",
+			map[string]string{"a": "merged\n"},
+			"Merge\n",
+			masterRef.Target(),
+			topicRef.Target(),
+		)
+		masterRef.Free()
+		topicRef.Free()
+		repository.Free()
+	}
+
+	reachability := func() map[string]bool {
+		repository, err := git.OpenRepository(dir)
+		if err != nil {
+			t.Fatalf("Failed to open git repository: %v", err)
+		}
+		defer repository.Free()
+
+		entries, err := listCommitGraphEntries(repository)
+		if err != nil {
+			t.Fatalf("Failed to list commits: %v", err)
+		}
+		if len(entries) != 5 {
+			t.Fatalf("Expected 5 commits, got %d", len(entries))
+		}
+		result := make(map[string]bool)
+		for _, from := range entries {
+			for _, to := range entries {
+				reachable, err := repository.ReachableFromAny(&to.id, []*git.Oid{&from.id})
+				if err != nil {
+					t.Fatalf("Failed to check reachability: %v", err)
+				}
+				result[from.id.String()+".."+to.id.String()] = reachable
+			}
+		}
+		return result
+	}
+
+	expected := reachability()
+
+	repository, err := git.OpenRepository(dir)
+	if err != nil {
+		t.Fatalf("Failed to open git repository: %v", err)
+	}
+	if err := WriteCommitGraph(repository); err != nil {
+		t.Fatalf("Failed to write the commit-graph: %v", err)
+	}
+	contents, err := ioutil.ReadFile(commitGraphPath(repository))
+	repository.Free()
+	if err != nil {
+		t.Fatalf("Failed to read the commit-graph: %v", err)
+	}
+	if !bytes.HasPrefix(contents, []byte(commitGraphSignature)) {
+		t.Errorf("Expected the commit-graph to start with %q, got %q", commitGraphSignature, contents[:4])
+	}
+
+	// libgit2 only uses the commit-graph when core.commitGraph is set.
+	{
+		repository, err := git.OpenRepository(dir)
+		if err != nil {
+			t.Fatalf("Failed to open git repository: %v", err)
+		}
+		config, err := repository.Config()
+		if err != nil {
+			t.Fatalf("Failed to open the repository config: %v", err)
+		}
+		if err := config.SetBool("core.commitGraph", true); err != nil {
+			t.Fatalf("Failed to enable the commit-graph: %v", err)
+		}
+		config.Free()
+		repository.Free()
+	}
+
+	if actual := reachability(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+
+	gitcmd, err := exec.LookPath("git")
+	if err != nil {
+		t.Skipf("git not found: %v", err)
+	}
+	cmd := exec.Command(gitcmd, "commit-graph", "verify")
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Failed to verify the commit-graph: %v, %s", err, output)
+	}
+}
+
+func TestEncodeCommitGraphMissingParent(t *testing.T) {
+	var id, parentID git.Oid
+	id[0] = 1
+	parentID[0] = 2
+	_, err := encodeCommitGraph([]*commitGraphEntry{
+		{
+			id:         id,
+			parents:    []git.Oid{parentID},
+			generation: 1,
+		},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for a commit whose parent is not in the commit-graph")
+	}
+}
@@ -125,6 +125,21 @@ func MergeTrees(
 	return repository.LookupTree(mergedTreeID)
 }
 
+// verifyObjectID returns an error if the id of an object that was copied into
+// a repository does not match the id of the original object. This can only
+// happen if the odb is corrupted or there is a libgit2 version mismatch.
+func verifyObjectID(kind string, expected, actual *git.Oid) error {
+	if expected.Equal(actual) {
+		return nil
+	}
+	return errors.Errorf(
+		"%s id mismatch: expected %s, got %s",
+		kind,
+		expected,
+		actual,
+	)
+}
+
 func copyBlob(
 	originalRepository *git.Repository,
 	blobID *git.Oid,
@@ -140,10 +155,7 @@ func copyBlob(
 	if err != nil {
 		return errors.Wrapf(err, "failed to create blob from original %s", blobID)
 	}
-	if !blobID.Equal(oid) {
-		return errors.Wrapf(err, "blob id mismatch: expected %s, got %s", blobID, oid)
-	}
-	return nil
+	return verifyObjectID("blob", blobID, oid)
 }
 
 func copyTree(
@@ -185,10 +197,7 @@ func copyTree(
 	if err != nil {
 		return errors.Wrapf(err, "failed to create tree from original %s", treeID)
 	}
-	if !treeID.Equal(oid) {
-		return errors.Wrapf(err, "tree id mismatch: expected %s, got %s", treeID, oid)
-	}
-	return nil
+	return verifyObjectID("tree", treeID, oid)
 }
 
 // SplitTree extracts a tree from another, potentially in a different
@@ -779,5 +788,38 @@ func BuildTree(
 
 func openRepository(ctx context.Context, repositoryPath string) (*git.Repository, error) {
 	defer tracing.FromContext(ctx).StartSegment("openRepository").End()
-	return git.OpenRepository(repositoryPath)
+	repository, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		return nil, err
+	}
+	factory, _ := ctx.Value(odbBackendFactoryContextKey{}).(OdbBackendFactory)
+	if factory == nil {
+		return repository, nil
+	}
+	if err := addOdbBackend(repository, factory); err != nil {
+		repository.Free()
+		return nil, err
+	}
+	return repository, nil
+}
+
+// addOdbBackend adds a backend created by factory to the object database of
+// the repository, with the lowest priority.
+func addOdbBackend(repository *git.Repository, factory OdbBackendFactory) error {
+	backend, err := factory(repository.Path())
+	if err != nil {
+		return errors.Wrap(err, "failed to create odb backend")
+	}
+	odb, err := repository.Odb()
+	if err != nil {
+		backend.Free()
+		return errors.Wrap(err, "failed to open git odb")
+	}
+	defer odb.Free()
+	// Once added, the backend is owned by the odb. AddBackend already frees it
+	// if it fails.
+	if err := odb.AddBackend(backend, 0); err != nil {
+		return errors.Wrap(err, "failed to add odb backend")
+	}
+	return nil
 }
@@ -350,4 +350,52 @@ func TestSpliceCommit(t *testing.T) {
 			"newCommands": newCommands,
 		},
 	)
+
+	odb, err := repository.Odb()
+	if err != nil {
+		t.Fatalf("Failed to open git odb: %v", err)
+	}
+	defer odb.Free()
+	writepack, err := odb.NewWritePack(nil)
+	if err != nil {
+		t.Fatalf("Failed to create writepack: %v", err)
+	}
+	defer writepack.Free()
+	if err := commitPackfile(newPackPath, writepack); err != nil {
+		t.Fatalf("Failed to commit the spliced packfile: %v", err)
+	}
+
+	splicedCommand := newCommands[len(newCommands)-1]
+	if splicedCommand.ReferenceName != "refs/heads/master" {
+		t.Fatalf("Expected the last command to update refs/heads/master, got %v", splicedCommand)
+	}
+	splicedCommit, err := repository.LookupCommit(splicedCommand.New)
+	if err != nil {
+		t.Fatalf("Failed to lookup the spliced commit: %v", err)
+	}
+	defer splicedCommit.Free()
+	expectedTrailers := map[string][]string{
+		"Reviewed-In": {"http://localhost/review/1/"},
+	}
+	if trailers := formatCommit(splicedCommit, defaultMaxCommitParents).Trailers; !reflect.DeepEqual(expectedTrailers, trailers) {
+		t.Errorf("Expected trailers %v, got %v", expectedTrailers, trailers)
+	}
+}
+
+func TestVerifyObjectID(t *testing.T) {
+	expected := gitOid("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	actual := gitOid("417c01c8795a35b8e835113a85a5c0c1c77f67fb")
+
+	if err := verifyObjectID("blob", &expected, &expected); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	err := verifyObjectID("tree", &expected, &actual)
+	if err == nil {
+		t.Fatalf("Expected an error, got nil")
+	}
+	expectedMessage := "tree id mismatch: expected e69de29bb2d1d6434b8b29ae775ad8c2e48c5391, got 417c01c8795a35b8e835113a85a5c0c1c77f67fb"
+	if expectedMessage != err.Error() {
+		t.Errorf("Expected %q, got %q", expectedMessage, err.Error())
+	}
 }
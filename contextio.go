@@ -0,0 +1,91 @@
+package githttp
+
+import (
+	"context"
+	"io"
+
+	base "github.com/omegaup/go-base/v3"
+	"github.com/pkg/errors"
+)
+
+type contextReadResult struct {
+	n   int
+	err error
+}
+
+// A contextReader is an io.Reader that stops reading once its context is done,
+// even if a Read of the underlying reader is blocked, so that a stuck client
+// cannot hold the repository's lockfile indefinitely. A blocked Read is
+// abandoned and its result is discarded. Since the context cannot be undone,
+// no further Reads of the underlying reader are made after that.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+	buf []byte
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		// The context can never be cancelled.
+		return r
+	}
+	return &contextReader{
+		ctx: ctx,
+		r:   r,
+	}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, errors.Wrap(err, "context cancelled")
+	}
+	// The underlying reader reads into a buffer that is owned by the
+	// contextReader, since an abandoned Read could otherwise write into p after
+	// this function returned.
+	if cap(r.buf) < len(p) {
+		r.buf = make([]byte, len(p))
+	}
+	buf := r.buf[:len(p)]
+	result := make(chan contextReadResult, 1)
+	go func() {
+		n, err := r.r.Read(buf)
+		result <- contextReadResult{n: n, err: err}
+	}()
+	select {
+	case res := <-result:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-r.ctx.Done():
+		return 0, errors.Wrap(r.ctx.Err(), "context cancelled")
+	}
+}
+
+// A contextWriter is an io.Writer that fails once its context is done. This
+// aborts long-running writes, like the ones of packfiles, between chunks.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, errors.Wrap(err, "context cancelled")
+	}
+	return w.w.Write(p)
+}
+
+// requestReadError returns the error for a failure to read a request. If the
+// context is done, the request was abandoned rather than malformed, so the
+// cancellation is returned instead.
+func requestReadError(ctx context.Context, err error, message string) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.Wrap(ctxErr, "context cancelled")
+	}
+	return base.ErrorWithCategory(
+		ErrBadRequest,
+		errors.Wrap(
+			err,
+			message,
+		),
+	)
+}
@@ -0,0 +1,111 @@
+package githttp
+
+import (
+	"strconv"
+	"strings"
+
+	git "github.com/libgit2/git2go/v33"
+	"github.com/pkg/errors"
+)
+
+// An objectFilter describes the objects that are omitted from the packfile of
+// a partial clone, as requested by the client with a `filter` pkt-line. See
+// the --filter option in git-rev-list(1).
+type objectFilter struct {
+	// blobLimit is the size, in bytes, from which blobs are omitted. Zero
+	// omits all blobs.
+	blobLimit uint64
+
+	// omitTrees omits all trees (and therefore all blobs), so that only the
+	// commits are sent.
+	omitTrees bool
+}
+
+// parseObjectFilter parses the supported filter specs: `blob:none`,
+// `blob:limit=<n>[kmg]`, and `tree:0`.
+func parseObjectFilter(spec string) (*objectFilter, error) {
+	if spec == "blob:none" {
+		return &objectFilter{}, nil
+	}
+	if spec == "tree:0" {
+		return &objectFilter{omitTrees: true}, nil
+	}
+	if !strings.HasPrefix(spec, "blob:limit=") {
+		return nil, errors.Errorf("unsupported filter %q", spec)
+	}
+	limit := strings.TrimPrefix(spec, "blob:limit=")
+	multiplier := uint64(1)
+	if limit != "" {
+		switch strings.ToLower(limit[len(limit)-1:]) {
+		case "k":
+			multiplier = 1024
+		case "m":
+			multiplier = 1024 * 1024
+		case "g":
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier != 1 {
+			limit = limit[:len(limit)-1]
+		}
+	}
+	blobLimit, err := strconv.ParseUint(limit, 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid filter %q", spec)
+	}
+	return &objectFilter{blobLimit: blobLimit * multiplier}, nil
+}
+
+// insertFilteredTree inserts the tree with the provided id into the
+// packbuilder, along with all its subtrees and the blobs that are not omitted
+// by the filter. Trees that are in seen are skipped, since their contents
+// were already inserted. If the filter omits trees, only the tree itself is
+// inserted, since it was explicitly wanted.
+func insertFilteredTree(
+	repository *git.Repository,
+	odb *git.Odb,
+	pb *git.Packbuilder,
+	filter *objectFilter,
+	treeID *git.Oid,
+	seen map[git.Oid]struct{},
+) error {
+	if _, ok := seen[*treeID]; ok {
+		return nil
+	}
+	seen[*treeID] = struct{}{}
+	if err := pb.Insert(treeID, ""); err != nil {
+		return errors.Wrapf(err, "failed to insert tree %s", treeID)
+	}
+	if filter.omitTrees {
+		return nil
+	}
+
+	tree, err := repository.LookupTree(treeID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up tree %s", treeID)
+	}
+	defer tree.Free()
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		entry := tree.EntryByIndex(i)
+		switch entry.Type {
+		case git.ObjectTree:
+			if err := insertFilteredTree(repository, odb, pb, filter, entry.Id, seen); err != nil {
+				return err
+			}
+		case git.ObjectBlob:
+			if filter.blobLimit == 0 {
+				continue
+			}
+			size, _, err := odb.ReadHeader(entry.Id)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read the header of %s", entry.Id)
+			}
+			if size >= filter.blobLimit {
+				continue
+			}
+			if err := pb.Insert(entry.Id, entry.Name); err != nil {
+				return errors.Wrapf(err, "failed to insert blob %s", entry.Id)
+			}
+		}
+	}
+	return nil
+}
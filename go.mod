@@ -3,10 +3,12 @@ module github.com/omegaup/githttp/v2
 go 1.18
 
 require (
+	github.com/dsnet/compress v0.0.1
 	github.com/libgit2/git2go/v33 v33.0.4
 	github.com/omegaup/go-base/logging/log15/v3 v3.3.7
 	github.com/omegaup/go-base/v3 v3.3.7
 	github.com/pkg/errors v0.9.1
+	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f
 )
 
 require (
@@ -17,6 +19,5 @@ require (
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	golang.org/x/crypto v0.0.0-20201203163018-be400aefbc4c // indirect
 	golang.org/x/exp v0.0.0-20220916125017-b168a2c6b86b // indirect
-	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
 )
@@ -0,0 +1,127 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// lfsPointerMaxSize is the maximum size of a Git LFS pointer file.
+	lfsPointerMaxSize = 1024
+
+	lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+)
+
+var (
+	lfsOIDRegexp = regexp.MustCompile(`^sha256:([0-9a-f]{64})$`)
+)
+
+// An LFSStore provides the contents of Git LFS objects, so that blobs that
+// are LFS pointers can be browsed as the files they represent.
+type LFSStore interface {
+	// Open returns a reader with the contents of the LFS object with the
+	// provided SHA-256 hex-encoded id and size.
+	Open(ctx context.Context, oid string, size int64) (io.ReadCloser, error)
+}
+
+// An LFSPointer is the parsed contents of a Git LFS pointer file.
+type LFSPointer struct {
+	OID  string
+	Size int64
+}
+
+// parseLFSPointer returns the parsed LFS pointer, or nil if the contents are
+// not a valid LFS pointer file. The format is documented in
+// https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md
+func parseLFSPointer(contents []byte) *LFSPointer {
+	if len(contents) > lfsPointerMaxSize || !bytes.HasSuffix(contents, []byte("\n")) {
+		return nil
+	}
+	lines := bytes.Split(contents[:len(contents)-1], []byte("\n"))
+	if len(lines) < 3 {
+		return nil
+	}
+	pointer := &LFSPointer{Size: -1}
+	lastKey := ""
+	for i, line := range lines {
+		fields := bytes.SplitN(line, []byte(" "), 2)
+		if len(fields) != 2 {
+			return nil
+		}
+		key, value := string(fields[0]), string(fields[1])
+		if i == 0 {
+			if key != "version" || value != lfsPointerVersion {
+				return nil
+			}
+			continue
+		}
+		// All keys other than the version must be sorted and unique.
+		if key <= lastKey {
+			return nil
+		}
+		lastKey = key
+		switch key {
+		case "oid":
+			match := lfsOIDRegexp.FindStringSubmatch(value)
+			if match == nil {
+				return nil
+			}
+			pointer.OID = match[1]
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil
+			}
+			pointer.Size = size
+		}
+	}
+	if pointer.OID == "" || pointer.Size < 0 {
+		return nil
+	}
+	return pointer
+}
+
+// lfsObject is the result of resolving an LFS pointer. The caller must close
+// the reader once the contents have been read.
+type lfsObject struct {
+	pointer *LFSPointer
+	r       io.ReadCloser
+}
+
+// resolveLFSPointer returns the contents of the LFS object that the blob
+// contents point to. nil is returned if there is no LFS store configured, the
+// contents are not an LFS pointer, or the object is larger than the maximum
+// allowed size.
+func resolveLFSPointer(
+	ctx context.Context,
+	protocol *GitProtocol,
+	contents []byte,
+) (*lfsObject, error) {
+	if protocol.LFSStore == nil {
+		return nil, nil
+	}
+	pointer := parseLFSPointer(contents)
+	if pointer == nil {
+		return nil, nil
+	}
+	if protocol.MaxLFSObjectSize != 0 && pointer.Size > protocol.MaxLFSObjectSize {
+		return nil, nil
+	}
+	r, err := protocol.LFSStore.Open(ctx, pointer.OID, pointer.Size)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to open LFS object %s",
+			pointer.OID,
+		)
+	}
+	return &lfsObject{
+		pointer: pointer,
+		r:       r,
+	}, nil
+}
@@ -0,0 +1,171 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/omegaup/go-base/logging/log15/v3"
+)
+
+type testLFSStore map[string][]byte
+
+func (s testLFSStore) Open(ctx context.Context, oid string, size int64) (io.ReadCloser, error) {
+	contents, ok := s[oid]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", oid)
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	oid := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	for _, testCase := range []struct {
+		contents string
+		expected *LFSPointer
+	}{
+		{
+			contents: "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 12345\n",
+			expected: &LFSPointer{OID: oid, Size: 12345},
+		},
+		{
+			contents: "version https://git-lfs.github.com/spec/v1\next-0-foo sha256:" + oid + "\noid sha256:" + oid + "\nsize 1\n",
+			expected: &LFSPointer{OID: oid, Size: 1},
+		},
+		// Missing trailing newline.
+		{contents: "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 12345"},
+		// Unsorted keys.
+		{contents: "version https://git-lfs.github.com/spec/v1\nsize 12345\noid sha256:" + oid + "\n"},
+		// Unknown version.
+		{contents: "version https://example.com/v2\noid sha256:" + oid + "\nsize 12345\n"},
+		// Invalid oid.
+		{contents: "version https://git-lfs.github.com/spec/v1\noid sha256:1234\nsize 12345\n"},
+		// Not a pointer at all.
+		{contents: "hello, world!\n"},
+	} {
+		actual := parseLFSPointer([]byte(testCase.contents))
+		if testCase.expected == nil {
+			if actual != nil {
+				t.Errorf("For %q, expected nil, got %v", testCase.contents, actual)
+			}
+		} else if actual == nil || *testCase.expected != *actual {
+			t.Errorf("For %q, expected %v, got %v", testCase.contents, testCase.expected, actual)
+		}
+	}
+}
+
+func TestHandleShowLFSPointer(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := []byte("the actual large file contents\n")
+	sum := sha256.Sum256(contents)
+	oid := hex.EncodeToString(sum[:])
+	pointer := fmt.Sprintf(
+		"version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n",
+		oid,
+		len(contents),
+	)
+
+	repository := createDivergedRepository(t, dir, log)
+	createTestCommit(
+		t, repository, log, "refs/heads/lfs",
+		map[string]string{
+			"large.bin": pointer,
+			"small.txt": "small\n",
+		},
+		"Add an LFS file\n",
+	)
+	repository.Free()
+
+	lockfileManager := NewLockfileManager()
+	defer lockfileManager.Clear()
+
+	for _, testCase := range []struct {
+		name             string
+		store            LFSStore
+		maxSize          int64
+		path             string
+		expectedContents string
+		expectedOID      string
+	}{
+		{"resolved", testLFSStore{oid: contents}, 0, "/+/lfs/large.bin", string(contents), oid},
+		{"not a pointer", testLFSStore{oid: contents}, 0, "/+/lfs/small.txt", "small\n", ""},
+		{"no store", nil, 0, "/+/lfs/large.bin", pointer, ""},
+		{"too large", testLFSStore{oid: contents}, 1, "/+/lfs/large.bin", pointer, ""},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			protocol := NewGitProtocol(GitProtocolOpts{
+				LFSStore:         testCase.store,
+				MaxLFSObjectSize: testCase.maxSize,
+				Log:              log,
+			})
+
+			req, err := http.NewRequest("GET", "http://test"+testCase.path, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Add("Accept", "application/octet-stream")
+
+			w := httptest.NewRecorder()
+			if err := handleBrowse(
+				context.Background(),
+				lockfileManager,
+				dir,
+				AuthorizationAllowed,
+				protocol,
+				testCase.path,
+				req,
+				w,
+			); err != nil {
+				t.Fatalf("Error browsing %s: %v", testCase.path, err)
+			}
+
+			if actual := w.Body.String(); testCase.expectedContents != actual {
+				t.Errorf("Expected %q, got %q", testCase.expectedContents, actual)
+			}
+			if actual := w.Header().Get("Omegaup-LFS-OID"); testCase.expectedOID != actual {
+				t.Errorf("Expected LFS oid %q, got %q", testCase.expectedOID, actual)
+			}
+			if expected, actual := strconv.Itoa(len(testCase.expectedContents)), w.Header().Get("Content-Length"); expected != actual {
+				t.Errorf("Expected Content-Length %s, got %s", expected, actual)
+			}
+		})
+	}
+
+	// An LFS object that is shorter than the size in the pointer cannot be
+	// served, since the Content-Length was already sent.
+	req, err := http.NewRequest("GET", "http://test/+/lfs/large.bin", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Add("Accept", "application/octet-stream")
+	if err := handleBrowse(
+		context.Background(),
+		lockfileManager,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			LFSStore: testLFSStore{oid: contents[:5]},
+			Log:      log,
+		}),
+		"/+/lfs/large.bin",
+		req,
+		httptest.NewRecorder(),
+	); err == nil {
+		t.Errorf("Expected an error serving a truncated LFS object")
+	}
+}
@@ -1,10 +1,12 @@
 package githttp
 
 import (
+	"context"
 	"path/filepath"
 	"syscall"
 
 	"github.com/omegaup/go-base/v3"
+	"github.com/pkg/errors"
 )
 
 // LockfileState represents the stat of the lockfile.
@@ -77,19 +79,98 @@ func (l *Lockfile) open() error {
 	if err != nil {
 		return err
 	}
+	for isStaleFD(fd, l.path) {
+		// The lockfile was deleted or replaced (e.g. because the repository was
+		// re-created) after the fd was cached, so locking it would not exclude
+		// anyone that opens the current one.
+		syscall.Close(fd)
+		fd, err = l.fdCache.Get(l.path)
+		if err != nil {
+			return err
+		}
+	}
 	l.fd = fd
 
 	return nil
 }
 
+// flock acquires a lock of the provided type on the Lockfile's fd, unless ctx
+// is done first. The fd is opened before it is locked, so the lockfile can be
+// replaced in between (e.g. because the repository was re-created while this
+// was waiting for the lock). Since locking the previous file would not exclude anyone that opens
+// the current one, the lock is acquired again on the current file in that
+// case.
+func (l *Lockfile) flock(ctx context.Context, how int) error {
+	for {
+		if err := l.open(); err != nil {
+			return err
+		}
+		if err := l.flockFD(ctx, how); err != nil {
+			return err
+		}
+		if !isStaleFD(l.fd, l.path) {
+			return nil
+		}
+		// The stale fd is not returned to the cache.
+		syscall.Flock(l.fd, syscall.LOCK_UN)
+		syscall.Close(l.fd)
+		l.fd = invalidFD
+	}
+}
+
+// flockFD calls flock(2) on the Lockfile's fd. Since flock(2) cannot be
+// interrupted, a blocking lock is requested in a goroutine if ctx can be done.
+// If ctx is done while it is still blocked, the fd is abandoned: the goroutine
+// releases the lock (in case it was eventually acquired) and closes the fd,
+// and the Lockfile is left unlocked. Converting a shared lock into an
+// exclusive one is not atomic, so a Lockfile that was read-locked is also left
+// unlocked.
+func (l *Lockfile) flockFD(ctx context.Context, how int) error {
+	if ctx.Done() == nil || how&syscall.LOCK_NB != 0 {
+		return syscall.Flock(l.fd, how)
+	}
+	if err := syscall.Flock(l.fd, how|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		return err
+	}
+
+	fd := l.fd
+	result := make(chan error, 1)
+	go func() {
+		result <- syscall.Flock(fd, how)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		go func() {
+			if err := <-result; err == nil {
+				syscall.Flock(fd, syscall.LOCK_UN)
+			}
+			syscall.Close(fd)
+		}()
+		l.fd = invalidFD
+		l.state = LockfileStateUnlocked
+		return errors.Wrap(ctx.Err(), "context cancelled")
+	}
+}
+
+// isStaleFD returns whether fd no longer refers to the file at path.
+func isStaleFD(fd int, path string) bool {
+	var fdStat, pathStat syscall.Stat_t
+	if err := syscall.Fstat(fd, &fdStat); err != nil {
+		return true
+	}
+	if err := syscall.Stat(path, &pathStat); err != nil {
+		return true
+	}
+	return fdStat.Dev != pathStat.Dev || fdStat.Ino != pathStat.Ino
+}
+
 // TryRLock attempts to acquires a shared lock for the Lockfile's path. More
 // than one process / goroutine may hold a shared lock for this Lockfile's path
 // at any given time.
 func (l *Lockfile) TryRLock() (bool, error) {
-	if err := l.open(); err != nil {
-		return false, err
-	}
-	if err := syscall.Flock(l.fd, syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+	if err := l.flock(context.Background(), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
 		if err == syscall.EWOULDBLOCK {
 			return false, nil
 		}
@@ -103,10 +184,13 @@ func (l *Lockfile) TryRLock() (bool, error) {
 // / goroutine may hold a shared lock for this Lockfile's path at any given
 // time.
 func (l *Lockfile) RLock() error {
-	if err := l.open(); err != nil {
-		return err
-	}
-	if err := syscall.Flock(l.fd, syscall.LOCK_SH); err != nil {
+	return l.RLockContext(context.Background())
+}
+
+// RLockContext acquires a shared lock for the Lockfile's path, like RLock, but
+// gives up once ctx is done.
+func (l *Lockfile) RLockContext(ctx context.Context) error {
+	if err := l.flock(ctx, syscall.LOCK_SH); err != nil {
 		return err
 	}
 	l.state = LockfileStateReadLocked
@@ -117,10 +201,7 @@ func (l *Lockfile) RLock() error {
 // returns whether it was able to do so. Only one process / goroutine may hold
 // an exclusive lock for this Lockfile's path at any given time.
 func (l *Lockfile) TryLock() (bool, error) {
-	if err := l.open(); err != nil {
-		return false, err
-	}
-	if err := syscall.Flock(l.fd, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+	if err := l.flock(context.Background(), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
 		if err == syscall.EWOULDBLOCK {
 			return false, nil
 		}
@@ -134,10 +215,13 @@ func (l *Lockfile) TryLock() (bool, error) {
 // goroutine may hold an exclusive lock for this Lockfile's path at any given
 // time.
 func (l *Lockfile) Lock() error {
-	if err := l.open(); err != nil {
-		return err
-	}
-	if err := syscall.Flock(l.fd, syscall.LOCK_EX); err != nil {
+	return l.LockContext(context.Background())
+}
+
+// LockContext acquires an exclusive lock for the Lockfile's path, like Lock,
+// but gives up once ctx is done.
+func (l *Lockfile) LockContext(ctx context.Context) error {
+	if err := l.flock(ctx, syscall.LOCK_EX); err != nil {
 		return err
 	}
 	l.state = LockfileStateLocked
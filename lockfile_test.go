@@ -1,12 +1,17 @@
 package githttp
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestUpgradeLock(t *testing.T) {
@@ -126,3 +131,106 @@ func TestSingleWriterLock(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestRecreatedLockfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockfile_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	// Cache the fd of the original lockfile.
+	l := m.NewLockfile(dir)
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Failed to lock git repository for writing: %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock git repository: %v", err)
+	}
+
+	// Re-create the repository directory underneath the cached fd.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("Failed to re-create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "githttp.lock"), nil, 0o600); err != nil {
+		t.Fatalf("Failed to re-create the lockfile: %v", err)
+	}
+
+	l = m.NewLockfile(dir)
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Failed to lock git repository for writing: %v", err)
+	}
+	defer l.Unlock()
+
+	// Another process that opens the current lockfile must be excluded.
+	fd, err := syscall.Open(filepath.Join(dir, "githttp.lock"), syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open the lockfile: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("Expected the lockfile to be locked, got %v", err)
+	}
+}
+
+func TestLockContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockfile_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	writer := m.NewLockfile(dir)
+	if err := writer.Lock(); err != nil {
+		t.Fatalf("Failed to lock git repository for writing: %v", err)
+	}
+
+	for name, lock := range map[string]func(l *Lockfile, ctx context.Context) error{
+		"read":  (*Lockfile).RLockContext,
+		"write": (*Lockfile).LockContext,
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		l := m.NewLockfile(dir)
+		start := time.Now()
+		err := lock(l, ctx)
+		elapsed := time.Since(start)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: Expected %v, got %v", name, context.DeadlineExceeded, err)
+		}
+		if elapsed > 5*time.Second {
+			t.Errorf("%s: Expected the lock to be abandoned promptly, took %v", name, elapsed)
+		}
+		if l.State() != LockfileStateUnlocked {
+			t.Errorf("%s: Expected the lockfile to be unlocked, got %v", name, l.State())
+		}
+		if err := l.Unlock(); err != nil {
+			t.Errorf("%s: Failed to unlock the abandoned lockfile: %v", name, err)
+		}
+	}
+
+	if err := writer.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock git repository: %v", err)
+	}
+
+	// The abandoned attempts eventually get (and release) the lock, so it can
+	// be acquired again.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l := m.NewLockfile(dir)
+	if err := l.LockContext(ctx); err != nil {
+		t.Fatalf("Failed to lock git repository for writing: %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock git repository: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package githttp
+
+import (
+	"context"
+	"strings"
+
+	base "github.com/omegaup/go-base/v3"
+
+	git "github.com/libgit2/git2go/v33"
+	"github.com/pkg/errors"
+)
+
+type namespaceContextKey struct{}
+
+// WithNamespace returns a copy of ctx that restricts all the git operations
+// performed with it to the git ref namespace with the provided name (see
+// gitnamespaces(7)). References are transparently stored under
+// `refs/namespaces/<namespace>/`, and are presented without that prefix. This
+// is typically called from the ContextCallback.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceContextKey{}, namespace)
+}
+
+// NamespaceFromContext returns the git ref namespace that was set with
+// WithNamespace, or an empty string if the default namespace is used.
+func NamespaceFromContext(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceContextKey{}).(string)
+	return namespace
+}
+
+// namespacePrefix returns the prefix of all the references that are stored in
+// the namespace. Nested namespaces (separated by slashes) are supported.
+func namespacePrefix(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	var prefix strings.Builder
+	for _, component := range strings.Split(strings.Trim(namespace, "/"), "/") {
+		prefix.WriteString("refs/namespaces/")
+		prefix.WriteString(component)
+		prefix.WriteString("/")
+	}
+	return prefix.String()
+}
+
+// namespacedReferenceName returns the name under which the reference is stored
+// in the repository.
+func namespacedReferenceName(namespace, name string) string {
+	return namespacePrefix(namespace) + name
+}
+
+// stripNamespace returns the name of a stored reference as it is presented to
+// clients, and whether the reference belongs to the namespace at all.
+func stripNamespace(namespace, name string) (string, bool) {
+	prefix := namespacePrefix(namespace)
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	return name[len(prefix):], true
+}
+
+// namespacedRevision rewrites the reference name at the beginning of rev (if
+// any) so that it refers to a reference in the namespace, following the same
+// disambiguation rules as gitrevisions(7). Outside of the default namespace,
+// revisions that start with neither the name of a reference in the namespace
+// nor a full object id fail with ErrNotFound, so that they are never resolved
+// with the references of the default namespace.
+func namespacedRevision(repository *git.Repository, namespace, rev string) (string, error) {
+	if namespace == "" {
+		return rev, nil
+	}
+	nameEnd := strings.IndexAny(rev, "~^:@")
+	if nameEnd == -1 {
+		nameEnd = len(rev)
+	}
+	name := rev[:nameEnd]
+	if name != "" {
+		for _, candidate := range []string{
+			name,
+			"refs/" + name,
+			"refs/tags/" + name,
+			"refs/heads/" + name,
+			"refs/remotes/" + name,
+		} {
+			ref, err := repository.References.Lookup(namespacedReferenceName(namespace, candidate))
+			if err != nil {
+				continue
+			}
+			ref.Free()
+			return namespacedReferenceName(namespace, candidate) + rev[nameEnd:], nil
+		}
+		if isGitObjectID(name) {
+			return rev, nil
+		}
+	}
+	return "", base.ErrorWithCategory(
+		ErrNotFound,
+		errors.Errorf("revision %s not found in namespace %s", rev, namespace),
+	)
+}
+
+// revparseSingle is like git.Repository.RevparseSingle, but resolves rev in
+// the namespace of ctx.
+func revparseSingle(
+	ctx context.Context,
+	repository *git.Repository,
+	rev string,
+) (*git.Object, error) {
+	rev, err := namespacedRevision(repository, NamespaceFromContext(ctx), rev)
+	if err != nil {
+		return nil, err
+	}
+	return repository.RevparseSingle(rev)
+}
+
+// lookupHead returns the resolved HEAD reference of the namespace. In the
+// default namespace this is git.Repository.Head. In any other namespace, a
+// missing or unborn HEAD is returned as a nil reference with no error.
+func lookupHead(repository *git.Repository, namespace string) (*git.Reference, error) {
+	if namespace == "" {
+		return repository.Head()
+	}
+	head, err := repository.References.Lookup(namespacedReferenceName(namespace, "HEAD"))
+	if err != nil {
+		return nil, nil
+	}
+	defer head.Free()
+	resolved, err := head.Resolve()
+	if err != nil {
+		return nil, nil
+	}
+	return resolved, nil
+}
+
+// unbornHeadTarget returns the name of the branch that HEAD of the namespace
+// points to, relative to the namespace, if HEAD is a symbolic reference. This
+// can be used when the branch has no commits yet, and therefore lookupHead
+// cannot resolve it.
+func unbornHeadTarget(repository *git.Repository, namespace string) (string, bool) {
+	head, err := repository.References.Lookup(namespacedReferenceName(namespace, "HEAD"))
+	if err != nil {
+		return "", false
+	}
+	defer head.Free()
+	if head.Type() != git.ReferenceSymbolic {
+		return "", false
+	}
+	return stripNamespace(namespace, head.SymbolicTarget())
+}
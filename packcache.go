@@ -0,0 +1,140 @@
+package githttp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdempotencyTokenHeader is the name of the header that clients can provide
+// in pushes to identify retries of the same push. See
+// GitProtocolOpts.UnpackedPackfileTTL.
+const IdempotencyTokenHeader = "Idempotency-Key"
+
+type idempotencyTokenContextKey struct{}
+
+// WithIdempotencyToken returns a copy of ctx that carries the idempotency
+// token of a push. GitServer does this with the value of the
+// IdempotencyTokenHeader header.
+func WithIdempotencyToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, idempotencyTokenContextKey{}, token)
+}
+
+// IdempotencyTokenFromContext returns the idempotency token that was set with
+// WithIdempotencyToken, or an empty string if there is none.
+func IdempotencyTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(idempotencyTokenContextKey{}).(string)
+	return token
+}
+
+// packfileCacheKey returns the key of the packfile of a push to the provided
+// repository. Besides the idempotency token, it includes everything that
+// identifies who is pushing, so that a packfile can only be reused by retries
+// from the same user with the same authorization.
+func packfileCacheKey(
+	ctx context.Context,
+	repositoryPath string,
+	level AuthorizationLevel,
+	token string,
+) string {
+	return fmt.Sprintf(
+		"%s\x00%d\x00%s\x00%s\x00%s",
+		repositoryPath,
+		level,
+		NamespaceFromContext(ctx),
+		UsernameFromContext(ctx),
+		token,
+	)
+}
+
+// A cachedPackfile is a packfile that was already unpacked (and indexed) in
+// a temporary directory.
+type cachedPackfile struct {
+	dir        string
+	packPath   string
+	expiration time.Time
+}
+
+func (c *cachedPackfile) indexPath() string {
+	return strings.TrimSuffix(c.packPath, ".pack") + ".idx"
+}
+
+// complete returns whether both the packfile and its index were completely
+// written.
+func (c *cachedPackfile) complete() bool {
+	if err := validatePackfile(c.packPath); err != nil {
+		return false
+	}
+	_, err := os.Stat(c.indexPath())
+	return err == nil
+}
+
+// A packfileCache retains the packfiles of pushes that failed after they were
+// unpacked, so that retries of the same push can skip unpacking them again.
+// Entries are removed from the cache while they are being used, so that two
+// concurrent retries cannot use the same directory.
+type packfileCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*cachedPackfile
+}
+
+func newPackfileCache(ttl time.Duration) *packfileCache {
+	return &packfileCache{
+		ttl:     ttl,
+		entries: make(map[string]*cachedPackfile),
+	}
+}
+
+// take removes the packfile with the provided key from the cache and returns
+// it, or nil if there is none.
+func (c *packfileCache) take(key string) *cachedPackfile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expireLocked(time.Now())
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, key)
+	return entry
+}
+
+// put adds the packfile to the cache with the provided key. The cache takes
+// ownership of its directory, which is removed once the entry expires.
+func (c *packfileCache) put(key string, entry *cachedPackfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expireLocked(now)
+	if previous, ok := c.entries[key]; ok {
+		os.RemoveAll(previous.dir)
+	}
+	entry.expiration = now.Add(c.ttl)
+	c.entries[key] = entry
+}
+
+// clear removes all the entries in the cache.
+func (c *packfileCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		os.RemoveAll(entry.dir)
+		delete(c.entries, key)
+	}
+}
+
+func (c *packfileCache) expireLocked(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expiration) {
+			os.RemoveAll(entry.dir)
+			delete(c.entries, key)
+		}
+	}
+}
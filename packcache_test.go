@@ -0,0 +1,110 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/omegaup/go-base/logging/log15/v3"
+
+	git "github.com/libgit2/git2go/v33"
+)
+
+func TestPushPackfileIdempotencyToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packcache_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	packContents, err := ioutil.ReadFile(packFilename)
+	if err != nil {
+		t.Fatalf("Failed to read the packfile: %v", err)
+	}
+
+	log, _ := log15.New("info", false)
+	attempts := 0
+	protocol := NewGitProtocol(GitProtocolOpts{
+		UpdateCallback: func(
+			ctx context.Context,
+			repository *git.Repository,
+			level AuthorizationLevel,
+			command *GitCommand,
+			oldCommit, newCommit *git.Commit,
+		) error {
+			attempts++
+			if attempts == 1 {
+				return errors.New("transient failure")
+			}
+			return nil
+		},
+		UnpackedPackfileTTL: time.Minute,
+		Log:                 log,
+	})
+	defer protocol.Close()
+
+	newOid := gitOid("88aa3454adb27c3c343ab57564d962a0a7f6a3c1")
+	push := func(ctx context.Context, packfile []byte) error {
+		commands := []*GitCommand{
+			{
+				Old:           &git.Oid{},
+				New:           &newOid,
+				ReferenceName: "refs/heads/master",
+			},
+		}
+		_, err, _ := protocol.PushPackfile(
+			ctx,
+			repository,
+			m.NewLockfile(repository.Path()),
+			AuthorizationAllowed,
+			commands,
+			bytes.NewReader(packfile),
+		)
+		return err
+	}
+
+	ctx := WithIdempotencyToken(context.Background(), "token")
+	if err := push(ctx, packContents); err == nil {
+		t.Fatalf("Expected the first push to fail")
+	}
+
+	// The retries do not send the packfile, so they can only succeed if the
+	// previously-unpacked one is reused.
+	if err := push(WithIdempotencyToken(context.Background(), "other-token"), nil); err == nil {
+		t.Fatalf("Expected the push with a different token to fail")
+	}
+	if err := push(WithUsername(ctx, "other-user"), nil); err == nil {
+		t.Fatalf("Expected the push from a different user to fail")
+	}
+	if err := push(ctx, nil); err != nil {
+		t.Fatalf("Failed to retry the push: %v", err)
+	}
+
+	ref, err := repository.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to look up the reference: %v", err)
+	}
+	defer ref.Free()
+	if expected, actual := "88aa3454adb27c3c343ab57564d962a0a7f6a3c1", ref.Target().String(); expected != actual {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+
+	// Successful pushes do not retain their packfile.
+	if entry := protocol.packfileCache.take(
+		packfileCacheKey(ctx, repository.Path(), AuthorizationAllowed, "token"),
+	); entry != nil {
+		t.Errorf("Expected the packfile to not be retained, got %v", entry)
+	}
+}
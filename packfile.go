@@ -1,6 +1,10 @@
 package githttp
 
 import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
 	stderrors "errors"
 	"fmt"
 	"io"
@@ -12,8 +16,14 @@ import (
 
 const (
 	indexFileMagic  = 0xff744f63
+	packFileMagic   = 0x5041434b
 	packFileVersion = 2
 	msb32           = 0x80000000
+
+	// The types of the deltified objects in packfiles, which are not exposed
+	// by git2go.
+	packObjectOfsDelta = 6
+	packObjectRefDelta = 7
 )
 
 var (
@@ -34,11 +44,92 @@ var (
 	// expected version (2).
 	ErrInvalidVersion = stderrors.New("bad pack version")
 
+	// ErrInvalidChecksum is returned when the packfile trailer does not match
+	// the checksum of its contents.
+	ErrInvalidChecksum = stderrors.New("bad pack checksum")
+
 	// ErrLargePackfile is returned when an offset in a packfile would overflow a
 	// 32-bit signed integer.
 	ErrLargePackfile = stderrors.New("packfile too large")
+
+	// ErrObjectTooLarge is returned when an object in a packfile is larger than
+	// the configured PackfileLimits.MaxObjectSize.
+	ErrObjectTooLarge = stderrors.New("object too large")
+
+	// ErrObjectExpansionRatioExceeded is returned when an object in a packfile
+	// inflates to more than PackfileLimits.MaxObjectExpansionRatio times its
+	// compressed size.
+	ErrObjectExpansionRatioExceeded = stderrors.New("object expansion ratio exceeded")
+
+	// ErrTooManyObjects is returned when a packfile contains more objects than
+	// the maxObjects argument of UnpackPackfile or PackfileLimits.MaxObjects.
+	ErrTooManyObjects = stderrors.New("too many objects")
+
+	// ErrObjectHashMismatch is returned when the contents of an object in a
+	// packfile do not hash to its object id.
+	ErrObjectHashMismatch = stderrors.New("object hash mismatch")
+
+	// ErrObjectCollision is returned when an object in a packfile has the same
+	// object id as an object that already exists, but different contents.
+	ErrObjectCollision = stderrors.New("object collision")
 )
 
+// PackfileLimits are optional limits that are enforced on the objects of a
+// packfile when it is unpacked. Zero values disable the corresponding limit.
+type PackfileLimits struct {
+	// MaxObjectSize is the maximum uncompressed size, in bytes, of any object.
+	MaxObjectSize uint64
+
+	// MaxObjectExpansionRatio is the maximum ratio between the inflated and the
+	// compressed sizes of any object as stored in the packfile. Deltified
+	// objects are measured by the size of their delta, so that small changes to
+	// large files are not rejected. Objects are checked as they are received,
+	// so the packfile is rejected without reading the rest of it.
+	MaxObjectExpansionRatio float64
+
+	// MaxObjects is the maximum number of objects in the packfile. The object
+	// count in the packfile header is checked before the packfile is indexed,
+	// so that packfiles with millions of tiny objects are rejected early.
+	MaxObjects int
+
+	// VerifyObjects re-hashes every object of the packfile to check that it
+	// matches its object id, and compares the objects that already exist in
+	// the odb byte-by-byte with the ones in the packfile, like git's
+	// index-pack does to detect SHA-1 collisions. This requires reading every
+	// object, so it is expensive for large packfiles.
+	VerifyObjects bool
+}
+
+func (l *PackfileLimits) enabled() bool {
+	return l.MaxObjectSize != 0 || l.MaxObjectExpansionRatio != 0
+}
+
+// A packfileSizeLimitReader is an io.Reader that fails with
+// ErrPackfileTooLarge once more than limit bytes have been read, so that
+// oversized packfiles are rejected while they are being streamed.
+type packfileSizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (r *packfileSizeLimitReader) Read(p []byte) (int, error) {
+	if r.read > r.limit {
+		return 0, errors.Wrapf(ErrPackfileTooLarge, "limit %d", r.limit)
+	}
+	// One byte past the limit is allowed to be read, to be able to tell
+	// whether the packfile is exactly at the limit or exceeds it.
+	if remaining := r.limit - r.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return 0, errors.Wrapf(ErrPackfileTooLarge, "limit %d", r.limit)
+	}
+	return n, err
+}
+
 // A PackfileIndex represents the contents of an .idx file.
 type PackfileIndex struct {
 	Fanout  [256]uint32
@@ -68,6 +159,46 @@ func readUInt32(r io.Reader) (uint32, error) {
 	return result, nil
 }
 
+// validatePackfile checks that the packfile located at the supplied filename
+// exists and has a valid header and trailer, without parsing the objects.
+func validatePackfile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", filename)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", filename)
+	}
+	if info.Size() < int64(len(EmptyPackfile)) {
+		return ErrInvalidMagic
+	}
+
+	hash := sha1.New()
+	r := io.TeeReader(io.LimitReader(f, info.Size()-sha1.Size), hash)
+	if magic, err := readUInt32(r); err != nil || magic != packFileMagic {
+		return ErrInvalidMagic
+	}
+	// git can also read version 3 packfiles, which have the same format.
+	if version, err := readUInt32(r); err != nil || (version != 2 && version != 3) {
+		return ErrInvalidVersion
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return errors.Wrapf(err, "failed to read %s", filename)
+	}
+
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return errors.Wrapf(err, "failed to read the trailer of %s", filename)
+	}
+	if !bytes.Equal(trailer, hash.Sum(nil)) {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
 // ParseIndex parses the index located at the supplied filename and returns its
 // contents as a PackfileIndex. The format for this file is documented in
 // https://github.com/git/git/blob/master/Documentation/technical/pack-format.txt
@@ -139,10 +270,31 @@ func ParseIndex(filename string, odb *git.Odb) (*PackfileIndex, error) {
 
 // UnpackPackfile parses the packfile, ensures that the it is valid, creates an
 // index file in the specified directory, and returns the path of the packfile.
+// If maxObjects is not zero, packfiles with more objects than that are
+// rejected with ErrTooManyObjects.
 func UnpackPackfile(
 	odb *git.Odb,
 	r io.Reader,
 	dir string,
+	maxObjects int,
+	progressCallback func(git.TransferProgress) error,
+) (*PackfileIndex, string, error) {
+	return UnpackPackfileWithLimits(
+		odb,
+		r,
+		dir,
+		PackfileLimits{MaxObjects: maxObjects},
+		progressCallback,
+	)
+}
+
+// UnpackPackfileWithLimits is like UnpackPackfile, but additionally rejects
+// packfiles that contain objects that exceed the provided limits.
+func UnpackPackfileWithLimits(
+	odb *git.Odb,
+	r io.Reader,
+	dir string,
+	limits PackfileLimits,
 	progressCallback func(git.TransferProgress) error,
 ) (*PackfileIndex, string, error) {
 	if progressCallback == nil {
@@ -161,8 +313,34 @@ func UnpackPackfile(
 		return nil, "", errors.Wrap(err, "failed to create a new indexer")
 	}
 	defer indexer.Free()
-	_, err = io.Copy(indexer, r)
+	if limits.MaxObjects != 0 {
+		header := make([]byte, 12)
+		n, _ := io.ReadFull(r, header)
+		if n == len(header) {
+			objectCount, _ := readUInt32(bytes.NewReader(header[8:]))
+			if uint64(objectCount) > uint64(limits.MaxObjects) {
+				return nil, "", errors.Wrapf(
+					ErrTooManyObjects,
+					"packfile has %d objects, limit %d",
+					objectCount,
+					limits.MaxObjects,
+				)
+			}
+		}
+		// Truncated headers are left for the indexer to reject.
+		r = io.MultiReader(bytes.NewReader(header[:n]), r)
+	}
+	if limits.enabled() {
+		err = copyPackfileWithLimits(indexer, r, limits)
+	} else {
+		_, err = io.Copy(indexer, r)
+	}
 	if err != nil {
+		if errors.Is(err, ErrPackfileTooLarge) ||
+			errors.Is(err, ErrObjectTooLarge) ||
+			errors.Is(err, ErrObjectExpansionRatioExceeded) {
+			return nil, "", err
+		}
 		return nil, "", stderrors.New("eof")
 	}
 	hash, err := indexer.Commit()
@@ -172,18 +350,30 @@ func UnpackPackfile(
 
 	// With the index file, we can inspect the contents of the packfile.
 	indexPath := fmt.Sprintf("%s/pack-%s.idx", dir, hash)
-	backend, err := git.NewOdbBackendOnePack(indexPath)
-	if err != nil {
-		return nil, "", errors.Wrap(err, "failed to create a onepack backend")
+	if limits.VerifyObjects {
+		// This needs to happen before the packfile is added to the odb, so
+		// that the existing objects can be read without getting the ones in
+		// the packfile instead.
+		if err := verifyPackfileObjects(odb, indexPath); err != nil {
+			return nil, "", err
+		}
 	}
-	if err := odb.AddAlternate(backend, 1); err != nil {
-		backend.Free()
-		return nil, "", errors.Wrap(err, "failed to add an alternate backend")
+	if err := addPackfileAlternate(odb, indexPath); err != nil {
+		return nil, "", err
 	}
 	index, err := ParseIndex(indexPath, odb)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "failed to parse index")
 	}
+	// Thin packfiles can gain objects when they are fixed by the indexer.
+	if limits.MaxObjects != 0 && len(index.Entries) > limits.MaxObjects {
+		return nil, "", errors.Wrapf(
+			ErrTooManyObjects,
+			"packfile has %d objects, limit %d",
+			len(index.Entries),
+			limits.MaxObjects,
+		)
+	}
 	for _, entry := range index.Entries {
 		switch entry.Type {
 		case git.ObjectCommit:
@@ -195,5 +385,267 @@ func UnpackPackfile(
 		}
 	}
 
-	return index, fmt.Sprintf("%s/pack-%s.pack", dir, hash), nil
+	// The sizes of deltified objects are only known once they are resolved.
+	if limits.MaxObjectSize != 0 {
+		if err := checkObjectSizes(index, limits.MaxObjectSize); err != nil {
+			return nil, "", err
+		}
+	}
+
+	packPath := fmt.Sprintf("%s/pack-%s.pack", dir, hash)
+
+	return index, packPath, nil
+}
+
+// addPackfileAlternate makes the objects of the packfile with the provided
+// index available through the odb.
+func addPackfileAlternate(odb *git.Odb, indexPath string) error {
+	backend, err := git.NewOdbBackendOnePack(indexPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create a onepack backend")
+	}
+	if err := odb.AddAlternate(backend, 1); err != nil {
+		backend.Free()
+		return errors.Wrap(err, "failed to add an alternate backend")
+	}
+	return nil
+}
+
+// verifyPackfileObjects checks that every object of the packfile with the
+// provided index hashes to its object id, and that it is identical to the
+// object with the same id in the odb, if there is one.
+func verifyPackfileObjects(odb *git.Odb, indexPath string) error {
+	packOdb, err := git.NewOdb()
+	if err != nil {
+		return errors.Wrap(err, "failed to create odb")
+	}
+	defer packOdb.Free()
+	backend, err := git.NewOdbBackendOnePack(indexPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create a onepack backend")
+	}
+	if err := packOdb.AddBackend(backend, 1); err != nil {
+		backend.Free()
+		return errors.Wrap(err, "failed to add a backend")
+	}
+
+	return packOdb.ForEach(func(id *git.Oid) error {
+		object, err := packOdb.Read(id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read object %s", id)
+		}
+		defer object.Free()
+		if err := verifyObjectHash(id, object.Type(), object.Data()); err != nil {
+			return err
+		}
+
+		if !odb.Exists(id) {
+			return nil
+		}
+		existing, err := odb.Read(id)
+		if err != nil {
+			// libgit2 fails to read objects whose contents do not match their
+			// id, so there is nothing to compare against.
+			return errors.Wrapf(
+				ErrObjectCollision,
+				"failed to read existing object %s: %v",
+				id,
+				err,
+			)
+		}
+		defer existing.Free()
+		if existing.Type() != object.Type() || !bytes.Equal(existing.Data(), object.Data()) {
+			return errors.Wrapf(
+				ErrObjectCollision,
+				"object %s differs from the existing one",
+				id,
+			)
+		}
+		return nil
+	})
+}
+
+// verifyObjectHash checks that the object with the provided type and contents
+// hashes to id.
+func verifyObjectHash(id *git.Oid, objectType git.ObjectType, data []byte) error {
+	var typeName string
+	switch objectType {
+	case git.ObjectCommit:
+		typeName = "commit"
+	case git.ObjectTree:
+		typeName = "tree"
+	case git.ObjectBlob:
+		typeName = "blob"
+	case git.ObjectTag:
+		typeName = "tag"
+	default:
+		return errors.Errorf("unexpected type %v for object %s", objectType, id)
+	}
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s %d\x00", typeName, len(data))
+	hash.Write(data)
+	if !bytes.Equal(hash.Sum(nil), id[:]) {
+		return errors.Wrapf(
+			ErrObjectHashMismatch,
+			"object %s hashes to %x",
+			id,
+			hash.Sum(nil),
+		)
+	}
+	return nil
+}
+
+// A countingByteReader is an io.ByteReader that keeps track of the number of
+// bytes read, and of the first error of the underlying reader.
+type countingByteReader struct {
+	r   *bufio.Reader
+	n   uint64
+	err error
+}
+
+func (r *countingByteReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += uint64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *countingByteReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	} else if err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return c, err
+}
+
+// copyPackfileWithLimits copies the packfile from r into w (the indexer),
+// parsing its objects along the way so that the ones that exceed the limits
+// are rejected as soon as they are received, before the rest of the packfile
+// is read and before the indexer resolves any deltas. Packfiles that cannot
+// be parsed are copied as-is, so that the indexer rejects them.
+func copyPackfileWithLimits(w io.Writer, r io.Reader, limits PackfileLimits) error {
+	br := &countingByteReader{r: bufio.NewReader(io.TeeReader(r, w))}
+	err := checkPackfileObjects(br, limits)
+	if errors.Is(err, ErrObjectTooLarge) || errors.Is(err, ErrObjectExpansionRatioExceeded) {
+		return err
+	}
+	if br.err != nil {
+		// Either the packfile could not be read, or the indexer failed.
+		return br.err
+	}
+	_, err = io.Copy(io.Discard, br)
+	return err
+}
+
+// checkPackfileObjects reads the objects of the packfile and ensures that
+// none of them exceed the provided limits. The compressed size of each object
+// includes its header, and the inflated size of deltified objects is the size
+// of their delta, so that small changes to large files are not rejected.
+func checkPackfileObjects(r *countingByteReader, limits PackfileLimits) error {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if magic, _ := readUInt32(bytes.NewReader(header)); magic != packFileMagic {
+		return ErrInvalidMagic
+	}
+	objectCount, _ := readUInt32(bytes.NewReader(header[8:]))
+
+	for i := uint32(0); i < objectCount; i++ {
+		offset := r.n
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		objectType := (c >> 4) & 0x07
+		size := uint64(c & 0x0f)
+		for shift := uint(4); c&0x80 != 0; shift += 7 {
+			if c, err = r.ReadByte(); err != nil {
+				return err
+			}
+			size |= uint64(c&0x7f) << shift
+		}
+
+		switch objectType {
+		case packObjectOfsDelta:
+			for c = 0x80; c&0x80 != 0; {
+				if c, err = r.ReadByte(); err != nil {
+					return err
+				}
+			}
+		case packObjectRefDelta:
+			if _, err := io.CopyN(io.Discard, r, sha1.Size); err != nil {
+				return err
+			}
+		default:
+			if limits.MaxObjectSize != 0 && size > limits.MaxObjectSize {
+				return errors.Wrapf(
+					ErrObjectTooLarge,
+					"object at offset %d has size %d, limit %d",
+					offset,
+					size,
+					limits.MaxObjectSize,
+				)
+			}
+		}
+
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return err
+		}
+		// The data cannot inflate to more than the declared size, which bounds
+		// the amount of work done for each object.
+		inflatedSize, err := io.Copy(io.Discard, io.LimitReader(zr, int64(size)+1))
+		zr.Close()
+		if err != nil {
+			return err
+		}
+		if uint64(inflatedSize) != size {
+			return errors.Errorf(
+				"object at offset %d inflates to %d bytes, expected %d",
+				offset,
+				inflatedSize,
+				size,
+			)
+		}
+
+		if limits.MaxObjectExpansionRatio == 0 {
+			continue
+		}
+		compressedSize := r.n - offset
+		ratio := float64(size) / float64(compressedSize)
+		if ratio > limits.MaxObjectExpansionRatio {
+			return errors.Wrapf(
+				ErrObjectExpansionRatioExceeded,
+				"object at offset %d expands from %d to %d bytes, limit ratio %g",
+				offset,
+				compressedSize,
+				size,
+				limits.MaxObjectExpansionRatio,
+			)
+		}
+	}
+
+	return nil
+}
+
+// checkObjectSizes ensures that none of the objects in the index are larger
+// than maxObjectSize.
+func checkObjectSizes(index *PackfileIndex, maxObjectSize uint64) error {
+	for _, entry := range index.Entries {
+		if entry.Size > maxObjectSize {
+			return errors.Wrapf(
+				ErrObjectTooLarge,
+				"object %s has size %d, limit %d",
+				entry.Oid.String(),
+				entry.Size,
+				maxObjectSize,
+			)
+		}
+	}
+	return nil
 }
@@ -1,9 +1,15 @@
 package githttp
 
 import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
+	"testing/iotest"
 
 	git "github.com/libgit2/git2go/v33"
 )
@@ -83,10 +89,220 @@ func TestUnpackPackfile(t *testing.T) {
 	}
 	defer f.Close()
 
-	idx, _, err := UnpackPackfile(odb, f, dir, nil)
+	idx, _, err := UnpackPackfile(odb, f, dir, 0, nil)
 	if err != nil {
 		t.Fatalf("Failed to unpack packfile: %v", err)
 	}
 
 	testParsedIndex(t, idx)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Failed to rewind the packfile: %v", err)
+	}
+	if _, _, err := UnpackPackfile(odb, f, dir, len(idx.Entries)-1, nil); !errors.Is(err, ErrTooManyObjects) {
+		t.Errorf("Expected %v, got %v", ErrTooManyObjects, err)
+	}
+}
+
+func TestUnpackPackfileWithLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packfile_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	// One MiB of zeros compresses down to about one KiB.
+	blobID, err := repository.CreateBlobFromBuffer(make([]byte, 1024*1024))
+	if err != nil {
+		t.Fatalf("Failed to create blob: %v", err)
+	}
+	pb, err := repository.NewPackbuilder()
+	if err != nil {
+		t.Fatalf("Failed to create packbuilder: %v", err)
+	}
+	defer pb.Free()
+	if err := pb.Insert(blobID, ""); err != nil {
+		t.Fatalf("Failed to insert blob into packbuilder: %v", err)
+	}
+	var packBuf bytes.Buffer
+	if err := pb.Write(&packBuf); err != nil {
+		t.Fatalf("Failed to write packfile: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		limits      PackfileLimits
+		expectedErr error
+	}{
+		"no limits": {
+			limits: PackfileLimits{},
+		},
+		"object size": {
+			limits:      PackfileLimits{MaxObjectSize: 1024},
+			expectedErr: ErrObjectTooLarge,
+		},
+		"expansion ratio": {
+			limits:      PackfileLimits{MaxObjectExpansionRatio: 100},
+			expectedErr: ErrObjectExpansionRatioExceeded,
+		},
+		"within limits": {
+			limits: PackfileLimits{
+				MaxObjectSize:           2 * 1024 * 1024,
+				MaxObjectExpansionRatio: 10000,
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			unpackDir, err := ioutil.TempDir("", "packfile_test")
+			if err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			defer os.RemoveAll(unpackDir)
+
+			odb, err := git.NewOdb()
+			if err != nil {
+				t.Fatalf("Failed to create odb: %v", err)
+			}
+			defer odb.Free()
+
+			_, _, err = UnpackPackfileWithLimits(
+				odb,
+				bytes.NewReader(packBuf.Bytes()),
+				unpackDir,
+				tc.limits,
+				nil,
+			)
+			if tc.expectedErr == nil {
+				if err != nil {
+					t.Fatalf("Failed to unpack packfile: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+
+	// The objects are checked as soon as they are received, so the packfile is
+	// rejected without reading its trailer.
+	unpackDir, err := ioutil.TempDir("", "packfile_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(unpackDir)
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+	_, _, err = UnpackPackfileWithLimits(
+		odb,
+		io.MultiReader(
+			bytes.NewReader(packBuf.Bytes()[:packBuf.Len()-20]),
+			iotest.ErrReader(errors.New("trailer read")),
+		),
+		unpackDir,
+		PackfileLimits{MaxObjectExpansionRatio: 100},
+		nil,
+	)
+	if !errors.Is(err, ErrObjectExpansionRatioExceeded) {
+		t.Fatalf("Expected %v, got %v", ErrObjectExpansionRatioExceeded, err)
+	}
+}
+
+func TestVerifyObjectHash(t *testing.T) {
+	emptyBlob := gitOid("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	if err := verifyObjectHash(&emptyBlob, git.ObjectBlob, []byte{}); err != nil {
+		t.Errorf("Failed to verify the empty blob: %v", err)
+	}
+	if err := verifyObjectHash(&emptyBlob, git.ObjectTree, []byte{}); !errors.Is(err, ErrObjectHashMismatch) {
+		t.Errorf("Expected ErrObjectHashMismatch for the wrong type, got %v", err)
+	}
+	if err := verifyObjectHash(&emptyBlob, git.ObjectBlob, []byte("tampered")); !errors.Is(err, ErrObjectHashMismatch) {
+		t.Errorf("Expected ErrObjectHashMismatch for the wrong contents, got %v", err)
+	}
+}
+
+func TestUnpackPackfileVerifyObjects(t *testing.T) {
+	for name, tc := range map[string]struct {
+		tamperedObject string
+		expectedErr    error
+	}{
+		"new objects": {},
+		"collision": {
+			tamperedObject: "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+			expectedErr:    ErrObjectCollision,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "packfile_test")
+			if err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			odb, err := git.NewOdb()
+			if err != nil {
+				t.Fatalf("Failed to create odb: %v", err)
+			}
+			defer odb.Free()
+
+			if tc.tamperedObject != "" {
+				// The object that already exists has the same id as one of the
+				// objects in the packfile, but different contents.
+				objectsDir := path.Join(dir, "objects")
+				objectDir := path.Join(objectsDir, tc.tamperedObject[:2])
+				if err := os.MkdirAll(objectDir, 0755); err != nil {
+					t.Fatalf("Failed to create the objects directory: %v", err)
+				}
+				var objectBuf bytes.Buffer
+				z := zlib.NewWriter(&objectBuf)
+				z.Write([]byte("commit 8\x00tampered"))
+				z.Close()
+				if err := ioutil.WriteFile(
+					path.Join(objectDir, tc.tamperedObject[2:]),
+					objectBuf.Bytes(),
+					0644,
+				); err != nil {
+					t.Fatalf("Failed to write the tampered object: %v", err)
+				}
+				backend, err := git.NewOdbBackendLoose(objectsDir, -1, false, 0, 0)
+				if err != nil {
+					t.Fatalf("Failed to create the loose backend: %v", err)
+				}
+				if err := odb.AddBackend(backend, 1); err != nil {
+					t.Fatalf("Failed to add the loose backend: %v", err)
+				}
+			}
+
+			f, err := os.Open(packFilename)
+			if err != nil {
+				t.Fatalf("Failed to open the packfile: %v", err)
+			}
+			defer f.Close()
+
+			_, _, err = UnpackPackfileWithLimits(
+				odb,
+				f,
+				dir,
+				PackfileLimits{VerifyObjects: true},
+				nil,
+			)
+			if tc.expectedErr == nil {
+				if err != nil {
+					t.Fatalf("Failed to unpack packfile: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
 }
@@ -5,15 +5,31 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
 )
 
 var (
 	// ErrFlush is returned whtn the client sends an explicit flush packet.
 	ErrFlush = errors.New("flush")
+
+	// ErrDelim is returned when the client sends a delim-pkt, which separates
+	// the sections of a protocol v2 request.
+	ErrDelim = errors.New("delim")
+
+	// ErrMalformedPktLine is returned when the length header of a pkt-line is
+	// not a valid hexadecimal length.
+	ErrMalformedPktLine = errors.New("malformed pkt-line")
 )
 
 const (
 	pktLineHeaderLength = 4
+
+	// sideBandMaxPacketLength is the maximum length of a pkt-line, including
+	// its header, when side-band-64k is used.
+	sideBandMaxPacketLength = 65520
+
+	sideBandData     = 1
+	sideBandProgress = 2
 )
 
 // A PktLineWriter implements git pkt-line protocol on top of an io.Writer. The
@@ -36,6 +52,13 @@ func (w *PktLineWriter) Flush() error {
 	return err
 }
 
+// Delim sends a delim-pkt, which separates the sections of a protocol v2
+// message.
+func (w *PktLineWriter) Delim() error {
+	_, err := w.w.Write([]byte("0001"))
+	return err
+}
+
 // Close sends a flush-pkt.
 func (w *PktLineWriter) Close() error {
 	return w.Flush()
@@ -53,6 +76,64 @@ func (w *PktLineWriter) WritePktLine(data []byte) error {
 	return err
 }
 
+// A SideBandWriter implements git's side-band-64k multiplexing on top of an
+// io.Writer. Data written to it is sent in band 1 and progress messages are
+// sent in band 2. The documentation for the protocol can be found in
+// https://github.com/git/git/blob/master/Documentation/technical/protocol-capabilities.txt
+// It is safe to use from multiple goroutines, since each pkt-line is written
+// atomically.
+type SideBandWriter struct {
+	mu sync.Mutex
+	pw *PktLineWriter
+}
+
+// NewSideBandWriter creates a new side-band writer based on the supplied
+// Writer.
+func NewSideBandWriter(w io.Writer) *SideBandWriter {
+	return &SideBandWriter{
+		pw: NewPktLineWriter(w),
+	}
+}
+
+// Write sends the data in band 1, split in as many pkt-lines as needed.
+func (w *SideBandWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > sideBandMaxPacketLength-pktLineHeaderLength-1 {
+			chunk = chunk[:sideBandMaxPacketLength-pktLineHeaderLength-1]
+		}
+		if err := w.writeBand(sideBandData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Progress sends a progress message in band 2. The message should end in
+// either '\r' or '\n' so that the client displays it correctly.
+func (w *SideBandWriter) Progress(message string) error {
+	return w.writeBand(sideBandProgress, []byte(message))
+}
+
+// Flush sends a flush-pkt, which signals the end of the multiplexed stream.
+func (w *SideBandWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pw.Flush()
+}
+
+func (w *SideBandWriter) writeBand(band byte, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	packet := make([]byte, 0, len(data)+1)
+	packet = append(packet, band)
+	packet = append(packet, data...)
+	return w.pw.WritePktLine(packet)
+}
+
 // A PktLineReader implements git pkt-line protocol on top of an io.Reader. The
 // documentation for the protocol can be found in
 // https://github.com/git/git/blob/master/Documentation/technical/protocol-common.txt
@@ -68,7 +149,8 @@ func NewPktLineReader(r io.Reader) *PktLineReader {
 }
 
 // ReadPktLine returns the next pkt-line. The special value of pkt-flush is
-// represented by ErrFlush, to distinguish it from the empty pkt-line.
+// represented by ErrFlush, to distinguish it from the empty pkt-line, and the
+// one of pkt-delim is represented by ErrDelim.
 func (r *PktLineReader) ReadPktLine() ([]byte, error) {
 	hexLength := make([]byte, pktLineHeaderLength)
 	if _, err := io.ReadFull(r.r, hexLength); err != nil {
@@ -76,11 +158,14 @@ func (r *PktLineReader) ReadPktLine() ([]byte, error) {
 	}
 	length, err := strconv.ParseUint(string(hexLength), 16, 16)
 	if err != nil {
-		return nil, err
+		return nil, ErrMalformedPktLine
 	}
 	if length == 0 {
 		return nil, ErrFlush
 	}
+	if length == 1 {
+		return nil, ErrDelim
+	}
 	if length < pktLineHeaderLength {
 		return nil, io.ErrUnexpectedEOF
 	}
@@ -42,3 +42,53 @@ func TestPktLineReader(t *testing.T) {
 		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
 	}
 }
+
+func TestPktLineReaderMalformed(t *testing.T) {
+	for _, header := range []string{"zzzz", "00x9", "-009"} {
+		reader := NewPktLineReader(bytes.NewBufferString(header + "hello"))
+		if _, err := reader.ReadPktLine(); err != ErrMalformedPktLine {
+			t.Errorf("For %q, expected ErrMalformedPktLine, got %v", header, err)
+		}
+	}
+}
+
+func TestSideBandWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	writer := NewSideBandWriter(&buf)
+	writer.Progress("Counting objects: 1\r")
+	data := bytes.Repeat([]byte("x"), sideBandMaxPacketLength)
+	if n, err := writer.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Failed to write data: %d, %v", n, err)
+	}
+	writer.Flush()
+
+	reader := NewPktLineReader(&buf)
+	var progress string
+	var actual []byte
+	for {
+		line, err := reader.ReadPktLine()
+		if err == ErrFlush {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read pkt-line: %v", err)
+		}
+		if len(line)+pktLineHeaderLength > sideBandMaxPacketLength {
+			t.Errorf("pkt-line too long: %d", len(line))
+		}
+		switch line[0] {
+		case sideBandData:
+			actual = append(actual, line[1:]...)
+		case sideBandProgress:
+			progress += string(line[1:])
+		default:
+			t.Errorf("Unexpected band %d", line[0])
+		}
+	}
+	if !bytes.Equal(data, actual) {
+		t.Errorf("Expected %d bytes of data, got %d", len(data), len(actual))
+	}
+	if expected := "Counting objects: 1\r"; expected != progress {
+		t.Errorf("Expected progress %q, got %q", expected, progress)
+	}
+}
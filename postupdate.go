@@ -0,0 +1,171 @@
+package githttp
+
+import (
+	"context"
+	stderrors "errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// errPostUpdateQueueClosed is returned when a callback is enqueued after
+	// the queue was closed.
+	errPostUpdateQueueClosed = stderrors.New("post-update queue closed")
+
+	// errPostUpdateQueueFull is returned when a callback is dropped because
+	// the queue was full for longer than the enqueue timeout.
+	errPostUpdateQueueFull = stderrors.New("post-update queue full")
+)
+
+// detachedContext is a context.Context that keeps the values of its parent,
+// but is never canceled. This allows the asynchronous post-update callbacks to
+// outlive the request that triggered them.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}       { return nil }
+func (c detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key any) any           { return c.parent.Value(key) }
+
+// A postUpdateTask is a pending invocation of the PostUpdateCallback.
+type postUpdateTask struct {
+	ctx            context.Context
+	repositoryPath string
+	modifiedFiles  []string
+}
+
+// A postUpdateQueue runs the PostUpdateCallback in a background worker, so
+// that pushes do not need to wait for it while holding the repository lock.
+// Since there is a single worker, the callbacks run in the same order in which
+// they were enqueued.
+type postUpdateQueue struct {
+	callback       PostUpdateCallback
+	enqueueTimeout time.Duration
+	tasks          chan *postUpdateTask
+	done           chan struct{}
+	dropped        uint64
+	log            logging.Logger
+
+	// mu protects closed and the additions to senders. Sends happen outside
+	// of it, and the tasks channel is only closed once all the senders that
+	// were registered before the queue was closed have finished, so that
+	// nothing is ever sent on a closed channel.
+	mu      sync.Mutex
+	closed  bool
+	senders sync.WaitGroup
+}
+
+func newPostUpdateQueue(
+	callback PostUpdateCallback,
+	size int,
+	enqueueTimeout time.Duration,
+	log logging.Logger,
+) *postUpdateQueue {
+	q := &postUpdateQueue{
+		callback:       callback,
+		enqueueTimeout: enqueueTimeout,
+		tasks:          make(chan *postUpdateTask, size),
+		done:           make(chan struct{}),
+		log:            log,
+	}
+	go q.run()
+	return q
+}
+
+// enqueue adds an invocation of the callback to the queue. If the queue is
+// full and enqueueTimeout is not zero, the invocation is dropped after waiting
+// that long for space. Invocations enqueued after the queue is closed fail
+// with errPostUpdateQueueClosed.
+func (q *postUpdateQueue) enqueue(
+	ctx context.Context,
+	repositoryPath string,
+	modifiedFiles []string,
+) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errPostUpdateQueueClosed
+	}
+	q.senders.Add(1)
+	q.mu.Unlock()
+	defer q.senders.Done()
+
+	task := &postUpdateTask{
+		ctx:            detachedContext{parent: ctx},
+		repositoryPath: repositoryPath,
+		modifiedFiles:  modifiedFiles,
+	}
+	if q.enqueueTimeout == 0 {
+		q.tasks <- task
+		return nil
+	}
+
+	timer := time.NewTimer(q.enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case q.tasks <- task:
+		return nil
+	case <-timer.C:
+		return errors.Wrapf(
+			errPostUpdateQueueFull,
+			"%d callbacks dropped",
+			atomic.AddUint64(&q.dropped, 1),
+		)
+	}
+}
+
+func (q *postUpdateQueue) run() {
+	defer close(q.done)
+	for task := range q.tasks {
+		q.runTask(task)
+	}
+}
+
+func (q *postUpdateQueue) runTask(task *postUpdateTask) {
+	repository, err := openRepository(task.ctx, task.repositoryPath)
+	if err != nil {
+		q.log.Error(
+			"Failed to open git repository for the post-update callback",
+			map[string]any{
+				"repository": task.repositoryPath,
+				"err":        err,
+			},
+		)
+		return
+	}
+	defer repository.Free()
+
+	if err := q.callback(task.ctx, repository, task.modifiedFiles); err != nil {
+		q.log.Error(
+			"Post-update callback failed",
+			map[string]any{
+				"repository": task.repositoryPath,
+				"err":        err,
+			},
+		)
+	}
+}
+
+// close waits for all the pending callbacks to run and stops the worker. The
+// callbacks that are still waiting for space in the queue are also run.
+func (q *postUpdateQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	// The worker keeps draining the queue, so the blocked senders eventually
+	// finish.
+	q.senders.Wait()
+	close(q.tasks)
+	<-q.done
+}
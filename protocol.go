@@ -1,13 +1,17 @@
 package githttp
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"math"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -30,11 +34,50 @@ const (
 	// revWalkLimit is the maximum number of commits that will be considered to
 	// determine whether this is a fast-forward push.
 	revWalkLimit = 10000
+
+	// defaultMaxNegotiationHaves is the default maximum number of 'have' lines
+	// that will be processed during a single pull negotiation.
+	defaultMaxNegotiationHaves = 10000
+
+	// defaultMaxWants is the default maximum number of 'want' lines that will
+	// be accepted in a single pull request.
+	defaultMaxWants = 2000
+
+	// defaultMaxShallows is the default maximum number of distinct 'shallow'
+	// lines that will be accepted in a single pull request.
+	defaultMaxShallows = 2000
+
+	// defaultMaxCommitParents is the default maximum number of parents of a
+	// commit that are shown in the browse API.
+	defaultMaxCommitParents = 100
+
+	// defaultMaxBufferedBlobSize is the default maximum size of a blob that
+	// can be loaded in memory to be served in the browse API.
+	defaultMaxBufferedBlobSize = 128 * 1024 * 1024
+
+	// symbolicRefNestingLimit is the maximum number of symbolic references that
+	// will be followed when resolving the target of a push.
+	symbolicRefNestingLimit = 5
+
+	// progressInterval is the number of commits that are inserted into the
+	// packfile between progress messages sent through side-band-64k.
+	progressInterval = 100
+
+	// maxPushOptions is the maximum number of push options that will be
+	// accepted in a single push.
+	maxPushOptions = 100
+
+	// defaultUserAgent is the default agent that is advertised in the
+	// capabilities.
+	defaultUserAgent = "gohttp"
 )
 
 var (
-	pullCapabilities = Capabilities{"agent=gohttp", "allow-tip-sha1-in-want", "ofs-delta", "shallow", "thin-pack"}
-	pushCapabilities = Capabilities{"agent=gohttp", "atomic", "ofs-delta", "report-status"}
+	// pullCapabilities and pushCapabilities are the capabilities that every
+	// GitProtocol starts with, before adding its agent and removing the
+	// disabled ones.
+	pullCapabilities = Capabilities{"allow-reachable-sha1-in-want", "allow-tip-sha1-in-want", "deepen-not", "deepen-since", "ofs-delta", "shallow", "side-band-64k", "thin-pack"}
+	pushCapabilities = Capabilities{"atomic", "ofs-delta", "push-options", "report-status", "report-status-v2"}
 )
 
 // A Capabilities represents a set of git protocol capabilities.
@@ -51,6 +94,27 @@ func (c *Capabilities) Contains(capability string) bool {
 	return false
 }
 
+// without returns a copy of the Capabilities set without the provided
+// capability names. Capabilities with values (e.g. `agent=gohttp`) are matched
+// by their name.
+func (c Capabilities) without(names []string) Capabilities {
+	result := make(Capabilities, 0, len(c))
+	for _, cap := range c {
+		name := strings.SplitN(cap, "=", 2)[0]
+		disabled := false
+		for _, disabledName := range names {
+			if name == disabledName {
+				disabled = true
+				break
+			}
+		}
+		if !disabled {
+			result = append(result, cap)
+		}
+	}
+	return result
+}
+
 // Equal returns true if both capability sets are equal.
 func (c *Capabilities) Equal(other Capabilities) bool {
 	if len(*c) != len(other) {
@@ -72,6 +136,15 @@ type GitCommand struct {
 	Reference        *git.Reference
 	err              error
 	logMessage       string
+
+	// ExpectedOld, if not nil, is the object id that the reference must point
+	// to once the repository's write lock is held for the update to proceed. A
+	// zero oid means that the reference must not exist.
+	ExpectedOld *git.Oid
+
+	// requestedReferenceName is the name of the symbolic reference that the
+	// client requested to update, if ReferenceName was resolved from it.
+	requestedReferenceName string
 }
 
 // An UpdatedRef describes a reference that was updated.
@@ -100,14 +173,33 @@ func (c *GitCommand) IsDelete() bool {
 
 // IsStaleRequest returns whether the command is requesting a stale operation:
 // if this is a create command but the reference does exist, or it's not
-// replacing the current branch's HEAD.
+// replacing the current branch's HEAD (including a reference that no longer
+// exists).
 func (c *GitCommand) IsStaleRequest() bool {
 	if c.IsCreate() {
 		return c.Reference != nil
 	}
+	if c.Reference == nil {
+		return true
+	}
 	return !c.Old.Equal(c.Reference.Target())
 }
 
+// LogMessage returns the default reflog message for the update, which is the
+// summary of the new commit.
+func (c *GitCommand) LogMessage() string {
+	return c.logMessage
+}
+
+// reportedReferenceName returns the name of the reference as it was sent by
+// the client, which might be a symbolic reference.
+func (c *GitCommand) reportedReferenceName() string {
+	if c.requestedReferenceName != "" {
+		return c.requestedReferenceName
+	}
+	return c.ReferenceName
+}
+
 func (c *GitCommand) String() string {
 	return fmt.Sprintf(
 		"{old: %s, oldTree: %s, new: %s, newTree: %s, reference: %s}",
@@ -128,6 +220,39 @@ type GitProtocol struct {
 	PreprocessCallback         PreprocessCallback
 	PostUpdateCallback         PostUpdateCallback
 	AllowNonFastForward        bool
+	MaxNegotiationHaves        int
+	MaxWants                   int
+	MaxShallows                int
+	PackfileLimits             PackfileLimits
+	MaxPackObjects             int
+	CommitGraphWriteInterval   time.Duration
+	DisabledCapabilities       []string
+	pullCapabilities           Capabilities
+	pushCapabilities           Capabilities
+	LFSStore                   LFSStore
+	MaxLFSObjectSize           int64
+	SortAdvertisedRefs         bool
+	PackStatistics             bool
+	ArchiveObjectLimit         int
+	HiddenRefs                 []string
+	RejectEmptyPushes          bool
+	ArchiveCallback            ArchiveCallback
+	ReflogMessageCallback      ReflogMessageCallback
+	StrictFirstParent          bool
+	PushPolicyCallback         PushPolicyCallback
+	AdvertiseUnbornHead        bool
+	AllowFilter                bool
+	MaxCommitParents           int
+	KeepaliveInterval          time.Duration
+	MaxBufferedBlobSize        int64
+	UserAgent                  string
+	AllowDeletes               bool
+	MaxPackfileSize            int64
+	postUpdateQueue            *postUpdateQueue
+	commitGraphWriter          *commitGraphWriter
+	packfileCache              *packfileCache
+	reachabilityCache          *reachabilityCache
+	advertisementCache         *advertisementCache
 	log                        logging.Logger
 }
 
@@ -142,6 +267,189 @@ type GitProtocolOpts struct {
 	PostUpdateCallback         PostUpdateCallback
 	AllowNonFastForward        bool
 	Log                        logging.Logger
+
+	// MaxNegotiationHaves is the maximum number of 'have' lines that will be
+	// processed during a pull negotiation. Once exceeded, the server stops
+	// negotiating and sends the packfile with the common commits found so far.
+	// If zero, a default of 10000 is used.
+	MaxNegotiationHaves int
+
+	// MaxWants is the maximum number of 'want' lines that a pull request can
+	// contain. Requests with more are rejected with ErrBadRequest. If zero, a
+	// default of 2000 is used.
+	MaxWants int
+
+	// MaxShallows is the maximum number of distinct 'shallow' lines that a
+	// pull request can contain. Requests with more are rejected with
+	// ErrBadRequest. If zero, a default of 2000 is used.
+	MaxShallows int
+
+	// MaxPackObjects is the maximum number of objects in pushed packfiles.
+	// Pushes with more are rejected with ErrTooManyObjects before any reference
+	// is updated. If not zero, it takes precedence over
+	// PackfileLimits.MaxObjects.
+	MaxPackObjects int
+
+	// PackfileLimits are the limits enforced on the objects of pushed
+	// packfiles. By default no limits are enforced.
+	PackfileLimits PackfileLimits
+
+	// CommitGraphWriteInterval is the minimum amount of time between rewrites
+	// of the commit-graph file after successful pushes. The commit-graph is
+	// written in the background, without holding the repository lock. If
+	// zero, the commit-graph is not written after pushes.
+	CommitGraphWriteInterval time.Duration
+
+	// DisabledCapabilities is the list of capability names that will not be
+	// advertised to clients. Requests that use any of them are rejected.
+	DisabledCapabilities []string
+
+	// AsyncPostUpdateQueueSize is the maximum number of PostUpdateCallback
+	// invocations that can be pending. If not zero, the callback is run in a
+	// background worker, in the order in which the pushes enqueue them (after
+	// releasing the repository lock), so that pushes do not hold the lock while
+	// it runs or while waiting for space in the queue. Otherwise it is run
+	// synchronously while the lock is held. Close must be called to wait for
+	// the pending callbacks.
+	AsyncPostUpdateQueueSize int
+
+	// AsyncPostUpdateEnqueueTimeout is the maximum amount of time a push waits
+	// for space in a full post-update queue. Once exceeded, the callback is
+	// dropped and logged. If zero, pushes wait until there is space.
+	AsyncPostUpdateEnqueueTimeout time.Duration
+
+	// LFSStore, if set, is used to resolve blobs that are Git LFS pointers when
+	// they are requested in raw form through the browse API. Otherwise, the
+	// pointer file is returned.
+	LFSStore LFSStore
+
+	// MaxLFSObjectSize is the maximum size of an LFS object that will be
+	// resolved. Pointers to larger objects are returned unresolved. If zero,
+	// there is no limit.
+	MaxLFSObjectSize int64
+
+	// SortAdvertisedRefs makes the reference advertisement list HEAD first and
+	// then the rest of the references sorted by name, instead of the order in
+	// which they are stored. This makes the advertisement deterministic, which
+	// is useful for caching. The browse API always returns sorted references.
+	SortAdvertisedRefs bool
+
+	// PackStatistics makes pulls send the number of objects and bytes of the
+	// packfile in the Omegaup-Pack-Objects and Omegaup-Pack-Bytes HTTP
+	// trailers. These are sent as trailers because the packfile is streamed
+	// after the headers have been sent.
+	PackStatistics bool
+
+	// ArchiveObjectLimit is the maximum number of objects (blobs and trees) a
+	// tree can contain for an archive of it to be served. If zero, the same
+	// limit that is used when splitting commits is used.
+	ArchiveObjectLimit int
+
+	// HiddenRefs is a list of glob patterns (as in path.Match) of references
+	// that will not be advertised nor listed in the browse API, similar to
+	// git's uploadpack.hideRefs. A reference is hidden if the pattern matches
+	// its name or any of its leading components, so "refs/pull/*" hides
+	// "refs/pull/1/head". The objects they point to can still be fetched by id.
+	HiddenRefs []string
+
+	// RejectEmptyPushes makes pushes that contain no commands fail with
+	// ErrBadRequest. Otherwise, they succeed without modifying the repository.
+	RejectEmptyPushes bool
+
+	// ArchiveCallback decides whether archives can be downloaded through the
+	// browse API, which can be used to prevent some authorization levels from
+	// downloading whole trees while still letting them browse. By default,
+	// archives are allowed for everyone that can browse.
+	ArchiveCallback ArchiveCallback
+
+	// ReflogMessageCallback returns the reflog message for each reference that
+	// is updated by a push, and is given the username that was returned by the
+	// AuthCallback. By default, the summary of the new commit is used.
+	ReflogMessageCallback ReflogMessageCallback
+
+	// StrictFirstParent makes pushes be considered fast-forwards only if the
+	// previous tip of the reference can be reached through first parents, as
+	// ValidateFastForward does. Otherwise, pushes whose new tip reaches the
+	// previous one through any parent (e.g. the second parent of a merge) are
+	// also accepted.
+	StrictFirstParent bool
+
+	// UnpackedPackfileTTL is the amount of time that the packfiles of failed
+	// pushes that have an idempotency token (see IdempotencyTokenHeader) are
+	// retained after they were unpacked. Retries of the push with the same
+	// token (by the same user, with the same authorization level) reuse the
+	// packfile instead of unpacking it again. If zero, packfiles are not
+	// retained.
+	UnpackedPackfileTTL time.Duration
+
+	// PushPolicyCallback decides whether each reference in a push can be
+	// updated, and is invoked before the UpdateCallback. Rejected references
+	// fail with the returned error. RequireStagedPushPolicy can be used to
+	// require commits to be pushed to a review namespace before they can be
+	// pushed to the branches. By default, all updates are allowed.
+	PushPolicyCallback PushPolicyCallback
+
+	// ReachabilityCacheSize is the maximum number of results of checking
+	// whether a commit is reachable from the references that are viewable by
+	// the requestor in the browse API that are cached. The results are keyed by
+	// the state of the references, so they are never stale. If zero, results
+	// are not cached.
+	ReachabilityCacheSize int
+
+	// AdvertisementCacheSize is the maximum number of reference advertisements
+	// returned by Advertisement that are cached. The advertisements of a
+	// repository are evicted after every push to it through PushPackfile, and
+	// with EvictAdvertisements. If zero, advertisements are not cached.
+	AdvertisementCacheSize int
+
+	// AdvertiseUnbornHead makes the reference advertisement of pulls include
+	// the branch that HEAD points to even if it has no commits yet (with the
+	// zero object id), so that clones of empty repositories check out the
+	// server's default branch instead of the one configured in the client.
+	AdvertiseUnbornHead bool
+
+	// AllowFilter advertises the filter capability, which allows clients to
+	// make partial clones by omitting blobs or trees from the packfile (see
+	// git-rev-list(1)'s --filter). Filtering is more expensive than sending
+	// the existing packfiles, so it is disabled by default, and filter
+	// requests are rejected.
+	AllowFilter bool
+
+	// MaxCommitParents is the maximum number of parents of a commit that are
+	// shown in the browse API. Octopus merges with more parents have the rest
+	// omitted, and their parents_truncated field set. If zero, a default of
+	// 100 is used.
+	MaxCommitParents int
+
+	// KeepaliveInterval is how often an empty progress message is sent to
+	// pulls that negotiated side-band-64k while the packfile is being written,
+	// so that proxies do not close connections that are idle while the objects
+	// are being compressed. If zero, no keepalives are sent.
+	KeepaliveInterval time.Duration
+
+	// MaxBufferedBlobSize is the maximum size of a raw blob that is served by
+	// the browse API if it cannot be streamed, which is the case for packed
+	// objects: those have to be loaded in memory. Larger blobs are rejected.
+	// If zero, a default of 128 MiB is used.
+	MaxBufferedBlobSize int64
+
+	// UserAgent is the value of the agent capability that is advertised to
+	// clients (e.g. `gitserver/1.2.3`), which lets deployments be told apart
+	// in client-side traces. Whitespace and non-printable characters are
+	// replaced with dots. If empty, `gohttp` is used.
+	UserAgent string
+
+	// AllowDeletes advertises the delete-refs capability, which allows pushes
+	// to delete references. The UpdateCallback is invoked for deletes with a
+	// nil newCommit, but the PushPolicyCallback is not. If false, deletes are
+	// rejected with ErrDeleteUnallowed.
+	AllowDeletes bool
+
+	// MaxPackfileSize is the maximum size, in bytes, of the packfile of a
+	// push. Larger packfiles are rejected with ErrPackfileTooLarge as soon as
+	// the limit is exceeded, while they are still being received. If zero, no
+	// limit is enforced.
+	MaxPackfileSize int64
 }
 
 // NewGitProtocol returns a new instance of GitProtocol.
@@ -161,6 +469,77 @@ func NewGitProtocol(opts GitProtocolOpts) *GitProtocol {
 	if opts.PostUpdateCallback == nil {
 		opts.PostUpdateCallback = noopPostUpdateCallback
 	}
+	if opts.MaxNegotiationHaves == 0 {
+		opts.MaxNegotiationHaves = defaultMaxNegotiationHaves
+	}
+	if opts.MaxWants == 0 {
+		opts.MaxWants = defaultMaxWants
+	}
+	if opts.MaxShallows == 0 {
+		opts.MaxShallows = defaultMaxShallows
+	}
+	if opts.MaxCommitParents == 0 {
+		opts.MaxCommitParents = defaultMaxCommitParents
+	}
+	if opts.MaxBufferedBlobSize == 0 {
+		opts.MaxBufferedBlobSize = defaultMaxBufferedBlobSize
+	}
+	if opts.ArchiveCallback == nil {
+		opts.ArchiveCallback = noopArchiveCallback
+	}
+	if opts.ReflogMessageCallback == nil {
+		opts.ReflogMessageCallback = noopReflogMessageCallback
+	}
+	if opts.PushPolicyCallback == nil {
+		opts.PushPolicyCallback = noopPushPolicyCallback
+	}
+	if opts.MaxPackObjects != 0 {
+		opts.PackfileLimits.MaxObjects = opts.MaxPackObjects
+	}
+
+	var queue *postUpdateQueue
+	if opts.AsyncPostUpdateQueueSize > 0 {
+		queue = newPostUpdateQueue(
+			opts.PostUpdateCallback,
+			opts.AsyncPostUpdateQueueSize,
+			opts.AsyncPostUpdateEnqueueTimeout,
+			opts.Log,
+		)
+	}
+
+	var commitGraph *commitGraphWriter
+	if opts.CommitGraphWriteInterval != 0 {
+		commitGraph = newCommitGraphWriter(opts.CommitGraphWriteInterval, opts.Log)
+	}
+
+	var cache *packfileCache
+	if opts.UnpackedPackfileTTL > 0 {
+		cache = newPackfileCache(opts.UnpackedPackfileTTL)
+	}
+
+	opts.UserAgent = sanitizeUserAgent(opts.UserAgent)
+	if opts.UserAgent == "" {
+		opts.UserAgent = defaultUserAgent
+	}
+	agent := "agent=" + opts.UserAgent
+	protocolPullCapabilities := append(Capabilities{agent}, pullCapabilities...)
+	if opts.AllowFilter {
+		protocolPullCapabilities = append(protocolPullCapabilities, "filter")
+	}
+	protocolPushCapabilities := append(Capabilities{agent}, pushCapabilities...)
+	if opts.AllowDeletes {
+		protocolPushCapabilities = append(protocolPushCapabilities, "delete-refs")
+	}
+
+	var reachability *reachabilityCache
+	if opts.ReachabilityCacheSize > 0 {
+		reachability = newReachabilityCache(opts.ReachabilityCacheSize)
+	}
+
+	var advertisements *advertisementCache
+	if opts.AdvertisementCacheSize > 0 {
+		advertisements = newAdvertisementCache(opts.AdvertisementCacheSize)
+	}
 
 	return &GitProtocol{
 		AuthCallback:               opts.AuthCallback,
@@ -169,12 +548,82 @@ func NewGitProtocol(opts GitProtocolOpts) *GitProtocol {
 		PreprocessCallback:         opts.PreprocessCallback,
 		PostUpdateCallback:         opts.PostUpdateCallback,
 		AllowNonFastForward:        opts.AllowNonFastForward,
+		MaxNegotiationHaves:        opts.MaxNegotiationHaves,
+		MaxWants:                   opts.MaxWants,
+		MaxShallows:                opts.MaxShallows,
+		PackfileLimits:             opts.PackfileLimits,
+		MaxPackObjects:             opts.MaxPackObjects,
+		CommitGraphWriteInterval:   opts.CommitGraphWriteInterval,
+		DisabledCapabilities:       opts.DisabledCapabilities,
+		pullCapabilities:           protocolPullCapabilities.without(opts.DisabledCapabilities),
+		pushCapabilities:           protocolPushCapabilities.without(opts.DisabledCapabilities),
+		LFSStore:                   opts.LFSStore,
+		MaxLFSObjectSize:           opts.MaxLFSObjectSize,
+		SortAdvertisedRefs:         opts.SortAdvertisedRefs,
+		PackStatistics:             opts.PackStatistics,
+		ArchiveObjectLimit:         opts.ArchiveObjectLimit,
+		HiddenRefs:                 opts.HiddenRefs,
+		RejectEmptyPushes:          opts.RejectEmptyPushes,
+		ArchiveCallback:            opts.ArchiveCallback,
+		ReflogMessageCallback:      opts.ReflogMessageCallback,
+		StrictFirstParent:          opts.StrictFirstParent,
+		PushPolicyCallback:         opts.PushPolicyCallback,
+		AdvertiseUnbornHead:        opts.AdvertiseUnbornHead,
+		AllowFilter:                opts.AllowFilter,
+		MaxCommitParents:           opts.MaxCommitParents,
+		KeepaliveInterval:          opts.KeepaliveInterval,
+		MaxBufferedBlobSize:        opts.MaxBufferedBlobSize,
+		UserAgent:                  opts.UserAgent,
+		AllowDeletes:               opts.AllowDeletes,
+		MaxPackfileSize:            opts.MaxPackfileSize,
+		postUpdateQueue:            queue,
+		commitGraphWriter:          commitGraph,
+		packfileCache:              cache,
+		reachabilityCache:          reachability,
+		advertisementCache:         advertisements,
 		log:                        opts.Log,
 	}
 }
 
+// sanitizeUserAgent returns the agent with the characters that cannot be part
+// of a capability (whitespace and non-printable ones) replaced with dots.
+func sanitizeUserAgent(agent string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '.'
+		}
+		return r
+	}, agent)
+}
+
+// Close waits for all the pending asynchronous PostUpdateCallback invocations
+// and commit-graph writes to finish and removes all the retained packfiles. No
+// pushes can be performed after calling this.
+func (p *GitProtocol) Close() {
+	if p.postUpdateQueue != nil {
+		p.postUpdateQueue.close()
+	}
+	if p.commitGraphWriter != nil {
+		p.commitGraphWriter.close()
+	}
+	if p.packfileCache != nil {
+		p.packfileCache.clear()
+	}
+}
+
+// EvictAdvertisements removes the cached reference advertisements of the
+// provided repository. This needs to be called whenever its references are
+// updated by anything other than PushPackfile.
+func (p *GitProtocol) EvictAdvertisements(repositoryPath string) {
+	if p.advertisementCache != nil {
+		p.advertisementCache.evict(repositoryPath)
+	}
+}
+
 // PushPackfile unpacks the provided packfile (provided as an io.Reader), and
-// updates the refs provided as commands into the repository.
+// updates the refs provided as commands into the repository. If the
+// PostUpdateCallback is run asynchronously, the lockfile is released before
+// the callback is enqueued.
 func (p *GitProtocol) PushPackfile(
 	ctx context.Context,
 	repository *git.Repository,
@@ -182,9 +631,25 @@ func (p *GitProtocol) PushPackfile(
 	level AuthorizationLevel,
 	commands []*GitCommand,
 	r io.Reader,
+) (updatedRefs []UpdatedRef, err, unpackErr error) {
+	return p.pushPackfile(ctx, repository, lockfile, level, commands, r, nil)
+}
+
+// pushPackfile is the implementation of PushPackfile. If unpackedCallback is
+// not nil, it is invoked as soon as the packfile has been successfully
+// unpacked, before any of the commands are validated.
+func (p *GitProtocol) pushPackfile(
+	ctx context.Context,
+	repository *git.Repository,
+	lockfile *Lockfile,
+	level AuthorizationLevel,
+	commands []*GitCommand,
+	r io.Reader,
+	unpackedCallback func(),
 ) (updatedRefs []UpdatedRef, err, unpackErr error) {
 	txn := tracing.FromContext(ctx)
 	defer txn.StartSegment("PushPackfile").End()
+	namespace := NamespaceFromContext(ctx)
 	odb, err := repository.Odb()
 	if err != nil {
 		err = errors.Wrap(err, "failed to open git odb")
@@ -199,22 +664,72 @@ func (p *GitProtocol) PushPackfile(
 	}
 	defer writepack.Free()
 
-	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("packfile_%s", path.Base(repository.Path())))
-	if err != nil {
-		err = errors.Wrap(err, "failed to create temporary directory")
-		return nil, err, err
+	// If the client provided an idempotency token, the packfile of a previous
+	// attempt of this push might have already been unpacked.
+	var cachedPack *cachedPackfile
+	cacheKey := ""
+	if token := IdempotencyTokenFromContext(ctx); token != "" && p.packfileCache != nil {
+		cacheKey = packfileCacheKey(ctx, repository.Path(), level, token)
+		cachedPack = p.packfileCache.take(cacheKey)
 	}
-	defer os.RemoveAll(tmpDir)
 
-	_, packPath, err := UnpackPackfile(odb, r, tmpDir, nil)
+	var tmpDir, packPath string
+	if cachedPack != nil {
+		p.log.Info(
+			"Reusing unpacked packfile",
+			map[string]any{
+				"path": cachedPack.packPath,
+			},
+		)
+		if err = addPackfileAlternate(odb, cachedPack.indexPath()); err != nil {
+			os.RemoveAll(cachedPack.dir)
+			return nil, err, err
+		}
+		tmpDir = cachedPack.dir
+		packPath = cachedPack.packPath
+	} else {
+		tmpDir, err = ioutil.TempDir("", fmt.Sprintf("packfile_%s", path.Base(repository.Path())))
+		if err != nil {
+			err = errors.Wrap(err, "failed to create temporary directory")
+			return nil, err, err
+		}
 
-	if err != nil {
-		err = errors.Wrap(err, "failed to unpack")
-		return nil, err, err
+		if p.MaxPackfileSize > 0 {
+			r = &packfileSizeLimitReader{
+				r:     r,
+				limit: p.MaxPackfileSize,
+			}
+		}
+		_, packPath, err = UnpackPackfileWithLimits(odb, r, tmpDir, p.PackfileLimits, nil)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			err = errors.Wrap(err, "failed to unpack")
+			return nil, err, err
+		}
+	}
+	unpackedPackPath := packPath
+	defer func() {
+		// Once unpacked, the packfile is retained for retries of failed pushes,
+		// but only if it is still complete: the PreprocessCallback gets access to
+		// the temporary directory and could have modified it.
+		entry := &cachedPackfile{
+			dir:      tmpDir,
+			packPath: unpackedPackPath,
+		}
+		if cacheKey != "" && err != nil && entry.complete() {
+			p.packfileCache.put(cacheKey, entry)
+			return
+		}
+		os.RemoveAll(tmpDir)
+	}()
+	if unpackedCallback != nil {
+		unpackedCallback()
 	}
 
 	for _, command := range commands {
-		if command.err == nil {
+		if command.err == nil && command.IsDelete() {
+			command.err = p.validateDelete(ctx, repository, level, command)
+		} else if command.err == nil {
 			commit, err := repository.LookupCommit(command.New)
 			if err != nil {
 				command.err = ErrUnknownCommit
@@ -223,7 +738,7 @@ func (p *GitProtocol) PushPackfile(
 				command.logMessage = commit.Summary()
 				// These error don't need wrapping since they are presented in the
 				// context of the ref they refer to.
-				if !ValidateFastForward(repository, commit, command.Reference) && !p.AllowNonFastForward {
+				if !validateFastForward(repository, commit, command.Reference, p.StrictFirstParent) && !p.AllowNonFastForward {
 					command.err = ErrNonFastForward
 				} else if level == AuthorizationAllowedRestricted && isRestrictedRef(command.ReferenceName) {
 					p.log.Info(
@@ -241,6 +756,21 @@ func (p *GitProtocol) PushPackfile(
 						},
 					)
 					command.err = ErrRestrictedRef
+				} else if err := p.PushPolicyCallback(
+					ctx,
+					repository,
+					level,
+					command,
+					commit,
+				); err != nil {
+					p.log.Info(
+						"push rejected by policy",
+						map[string]any{
+							"ref": command.ReferenceName,
+							"err": err,
+						},
+					)
+					command.err = err
 				} else {
 					parentCommit := commit.Parent(0)
 					if err = p.UpdateCallback(
@@ -261,11 +791,15 @@ func (p *GitProtocol) PushPackfile(
 			}
 		}
 		if command.err != nil {
+			if base.HasErrorCategory(command.err, ErrForbidden) {
+				return nil, base.ErrorWithCategory(ErrForbidden, command.err), nil
+			}
 			return nil, base.ErrorWithCategory(ErrBadRequest, command.err), nil
 		}
 	}
 
 	originalCommands := commands
+	originalPackPath := packPath
 	packPath, commands, err = p.PreprocessCallback(
 		ctx,
 		repository,
@@ -276,6 +810,17 @@ func (p *GitProtocol) PushPackfile(
 	if err != nil {
 		return nil, base.ErrorWithCategory(ErrBadRequest, err), nil
 	}
+	// The original packfile was already validated when it was unpacked, but the
+	// one returned by the callback needs to be checked before anything is
+	// committed into the repository.
+	if packPath != originalPackPath {
+		if err := validatePackfile(packPath); err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Wrapf(err, "invalid preprocessed packfile %s", packPath),
+			), nil
+		}
+	}
 
 	acquireLockSegment := txn.StartSegment("acquire lock")
 	if ok, err := lockfile.TryLock(); !ok {
@@ -285,7 +830,7 @@ func (p *GitProtocol) PushPackfile(
 				"err": err,
 			},
 		)
-		err = lockfile.Lock()
+		err = lockfile.LockContext(ctx)
 		acquireLockSegment.End()
 		if err != nil {
 			return nil, errors.Wrap(
@@ -297,6 +842,15 @@ func (p *GitProtocol) PushPackfile(
 		acquireLockSegment.End()
 	}
 
+	// The references might have moved since the commands were created, so any
+	// expectations need to be re-checked now that the write lock is held.
+	for _, command := range originalCommands {
+		if err := checkExpectedOld(repository, namespace, command); err != nil {
+			command.err = ErrPreconditionFailed
+			return nil, base.ErrorWithCategory(ErrPreconditionFailed, err), nil
+		}
+	}
+
 	oldFileMap, err := listFilesRecursively(repository.Path())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to list files"), nil
@@ -316,13 +870,39 @@ func (p *GitProtocol) PushPackfile(
 		return nil, errors.Wrap(err, "failed to write multi-pack-index"), nil
 	}
 
+	// The cached advertisements are evicted once the references start being
+	// updated, even if only some of them end up being updated. This happens
+	// after all the references are updated, so any advertisement generated
+	// before that is discarded.
+	defer p.EvictAdvertisements(repository.Path())
+
 	updatedRefs = make([]UpdatedRef, 0)
 	for _, command := range commands {
+		if command.IsDelete() {
+			if err := deleteReference(repository, namespace, command); err != nil {
+				command.err = err
+				return nil, base.ErrorWithCategory(ErrBadRequest, err), nil
+			}
+			updatedRefs = append(updatedRefs, UpdatedRef{
+				Name:     command.ReferenceName,
+				From:     command.Old.String(),
+				To:       command.New.String(),
+				FromTree: command.OldTree.String(),
+				ToTree:   (&git.Oid{}).String(),
+			})
+			p.log.Info(
+				"Ref successfully deleted",
+				map[string]any{
+					"command": command,
+				},
+			)
+			continue
+		}
 		ref, err := repository.References.Create(
-			command.ReferenceName,
+			namespacedReferenceName(namespace, command.ReferenceName),
 			command.New,
 			true,
-			command.logMessage,
+			p.ReflogMessageCallback(ctx, command, UsernameFromContext(ctx)),
 		)
 		if err != nil {
 			command.err = err
@@ -356,6 +936,10 @@ func (p *GitProtocol) PushPackfile(
 		)
 	}
 
+	if p.commitGraphWriter != nil {
+		p.commitGraphWriter.write(ctx, repository.Path())
+	}
+
 	newFileMap, err := listFilesRecursively(repository.Path())
 	if err != nil {
 		p.log.Error(
@@ -375,8 +959,21 @@ func (p *GitProtocol) PushPackfile(
 		}
 		sort.Strings(modifiedFiles)
 
-		err := p.PostUpdateCallback(ctx, repository, modifiedFiles)
-		if err != nil {
+		if p.postUpdateQueue != nil {
+			// Enqueueing can block until there is space in the queue, which only
+			// happens once the callbacks that are ahead of this one finish. Since
+			// they could need the lock of this repository, it is released first.
+			lockfile.Unlock()
+			if err := p.postUpdateQueue.enqueue(ctx, repository.Path(), modifiedFiles); err != nil {
+				p.log.Error(
+					"Failed to enqueue the post-update callback",
+					map[string]any{
+						"repository": repository.Path(),
+						"err":        err,
+					},
+				)
+			}
+		} else if err := p.PostUpdateCallback(ctx, repository, modifiedFiles); err != nil {
 			p.log.Error(
 				"Failed to get updated list of files",
 				map[string]any{
@@ -389,6 +986,75 @@ func (p *GitProtocol) PushPackfile(
 	return updatedRefs, nil, nil
 }
 
+// validateDelete checks whether the reference of a delete command can be
+// deleted, and invokes the UpdateCallback with a nil newCommit.
+func (p *GitProtocol) validateDelete(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	command *GitCommand,
+) error {
+	if level == AuthorizationAllowedRestricted && isRestrictedRef(command.ReferenceName) {
+		p.log.Info(
+			"restricted ref",
+			map[string]any{
+				"ref": command.ReferenceName,
+			},
+		)
+		return ErrRestrictedRef
+	}
+	if !p.ReferenceDiscoveryCallback(ctx, repository, command.ReferenceName) {
+		p.log.Info(
+			"user does not have access",
+			map[string]any{
+				"ref": command.ReferenceName,
+			},
+		)
+		return ErrRestrictedRef
+	}
+	oldCommit, err := repository.LookupCommit(command.Old)
+	if err != nil {
+		return ErrUnknownCommit
+	}
+	defer oldCommit.Free()
+	command.OldTree = oldCommit.TreeId()
+	command.logMessage = "delete"
+	return p.UpdateCallback(
+		ctx,
+		repository,
+		level,
+		command,
+		oldCommit,
+		nil,
+	)
+}
+
+// deleteReference removes the reference of a delete command from the
+// repository.
+func deleteReference(
+	repository *git.Repository,
+	namespace string,
+	command *GitCommand,
+) error {
+	ref, err := repository.References.Lookup(namespacedReferenceName(namespace, command.ReferenceName))
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"failed to look up reference %s",
+			command.ReferenceName,
+		)
+	}
+	defer ref.Free()
+	if err := ref.Delete(); err != nil {
+		return errors.Wrapf(
+			err,
+			"failed to delete reference %s",
+			command.ReferenceName,
+		)
+	}
+	return nil
+}
+
 func listFilesRecursively(dir string) (map[string]time.Time, error) {
 	result := make(map[string]time.Time)
 	prefix := strings.TrimSuffix(dir, "/") + "/"
@@ -413,6 +1079,27 @@ func listFilesRecursively(dir string) (map[string]time.Time, error) {
 	return result, nil
 }
 
+// An UploadPackError is returned when the server replies with an "ERR"
+// pkt-line instead of the expected response.
+type UploadPackError struct {
+	Message string
+}
+
+func (e *UploadPackError) Error() string {
+	return e.Message
+}
+
+// parseUploadPackError returns an *UploadPackError if the provided pkt-line is
+// an "ERR" pkt-line, and nil otherwise.
+func parseUploadPackError(line []byte) error {
+	if !bytes.HasPrefix(line, []byte("ERR ")) {
+		return nil
+	}
+	return &UploadPackError{
+		Message: strings.TrimRight(string(line[len("ERR "):]), "\n"),
+	}
+}
+
 // A ReferenceDiscovery represents the result of the reference discovery
 // negotiation in git's pack protocol.
 type ReferenceDiscovery struct {
@@ -438,6 +1125,9 @@ func DiscoverReferences(r io.Reader) (*ReferenceDiscovery, error) {
 			}
 			return nil, err
 		}
+		if err := parseUploadPackError(line); err != nil {
+			return nil, err
+		}
 		if bytes.HasPrefix(line, []byte("# service=")) {
 			// This is most likely the first line of the reference discovery. Skip
 			// this line and the next one, which _must_ be a flush.
@@ -485,6 +1175,34 @@ func ValidateFastForward(
 	repository *git.Repository,
 	commit *git.Commit,
 	ref *git.Reference,
+) bool {
+	return validateFastForward(repository, commit, ref, true)
+}
+
+// validateFastForward is the implementation of ValidateFastForward. If
+// strictFirstParent is false and there is no chain of left parent commits, it
+// also accepts commits that reach the target of the reference through any of
+// their parents, like those created by merging into a topic branch.
+func validateFastForward(
+	repository *git.Repository,
+	commit *git.Commit,
+	ref *git.Reference,
+	strictFirstParent bool,
+) bool {
+	if validateFirstParentFastForward(repository, commit, ref) {
+		return true
+	}
+	if strictFirstParent || ref == nil {
+		return false
+	}
+	descendant, err := repository.DescendantOf(commit.Id(), ref.Target())
+	return err == nil && descendant
+}
+
+func validateFirstParentFastForward(
+	repository *git.Repository,
+	commit *git.Commit,
+	ref *git.Reference,
 ) bool {
 	if ref == nil {
 		// This is an unborn branch.
@@ -524,6 +1242,66 @@ func isRestrictedRef(name string) bool {
 	return name == "refs/meta/config"
 }
 
+// isHiddenRef returns whether the reference matches any of the HiddenRefs
+// patterns.
+func (p *GitProtocol) isHiddenRef(name string) bool {
+	for _, pattern := range p.HiddenRefs {
+		for prefix := name; prefix != "."; prefix = path.Dir(prefix) {
+			if matched, _ := path.Match(pattern, prefix); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveSymbolicReferenceName follows the chain of symbolic references
+// starting at name and returns the name of the direct reference it ultimately
+// points to, which might not exist yet. If name is not a symbolic reference, it
+// is returned unchanged.
+func resolveSymbolicReferenceName(
+	repository *git.Repository,
+	name string,
+) (string, error) {
+	for i := 0; i < symbolicRefNestingLimit; i++ {
+		ref, err := repository.References.Lookup(name)
+		if err != nil {
+			return name, nil
+		}
+		isSymbolic := ref.Type() == git.ReferenceSymbolic
+		target := ref.SymbolicTarget()
+		ref.Free()
+		if !isSymbolic {
+			return name, nil
+		}
+		name = target
+	}
+	return "", ErrInvalidRef
+}
+
+// checkExpectedOld returns an error if the command has an ExpectedOld oid and
+// the reference it updates does not currently point to it.
+func checkExpectedOld(repository *git.Repository, namespace string, command *GitCommand) error {
+	if command.ExpectedOld == nil {
+		return nil
+	}
+	current := &git.Oid{}
+	ref, err := repository.References.Lookup(namespacedReferenceName(namespace, command.ReferenceName))
+	if err == nil {
+		current = ref.Target()
+		ref.Free()
+	}
+	if !command.ExpectedOld.Equal(current) {
+		return errors.Errorf(
+			"reference %s expected to be at %s, but is at %s",
+			command.ReferenceName,
+			command.ExpectedOld,
+			current,
+		)
+	}
+	return nil
+}
+
 // commitPackfile commits the packfile into the repository.
 func commitPackfile(packPath string, writepack *git.OdbWritepack) error {
 	f, err := os.Open(packPath)
@@ -539,6 +1317,74 @@ func commitPackfile(packPath string, writepack *git.OdbWritepack) error {
 	return writepack.Commit()
 }
 
+// An advertisedRef is a reference that is sent during reference discovery.
+type advertisedRef struct {
+	id   string
+	name string
+}
+
+// advertisedReferences returns the references of the repository (other than
+// HEAD) that are advertised to the client, with the namespace stripped from
+// their names.
+func advertisedReferences(
+	ctx context.Context,
+	repository *git.Repository,
+	namespace string,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	log logging.Logger,
+) ([]advertisedRef, error) {
+	it, err := repository.NewReferenceIterator()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to read references",
+		)
+	}
+	defer it.Free()
+
+	var advertisedRefs []advertisedRef
+	for {
+		ref, err := it.Next()
+		if err != nil {
+			if !git.IsErrorCode(err, git.ErrorCodeIterOver) {
+				log.Error(
+					"Error getting reference",
+					map[string]interface{}{
+						"err": err,
+					},
+				)
+			}
+			break
+		}
+		refName, ok := stripNamespace(namespace, ref.Name())
+		target := ref.Target()
+		ref.Free()
+		if !ok || refName == "HEAD" || target == nil {
+			continue
+		}
+		if level == AuthorizationAllowedRestricted && isRestrictedRef(refName) {
+			continue
+		}
+		if protocol.isHiddenRef(refName) {
+			continue
+		}
+		if !protocol.ReferenceDiscoveryCallback(ctx, repository, refName) {
+			continue
+		}
+		advertisedRefs = append(advertisedRefs, advertisedRef{
+			id:   target.String(),
+			name: refName,
+		})
+	}
+	if protocol.SortAdvertisedRefs {
+		sort.Slice(advertisedRefs, func(i, j int) bool {
+			return advertisedRefs[i].name < advertisedRefs[j].name
+		})
+	}
+	return advertisedRefs, nil
+}
+
 // handleInfoRefs handles git's pack-protocol reference discovery (or the
 // '/info/refs' URL). This tells the client what references the server knows
 // aboutells the client what references the server knows about so it can choose
@@ -556,6 +1402,10 @@ func handleInfoRefs(
 	log logging.Logger,
 	w io.Writer,
 ) error {
+	if serviceName == "git-upload-pack" && ProtocolVersionFromContext(ctx) == 2 {
+		return handleInfoRefsV2(protocol, w)
+	}
+
 	repository, err := openRepository(ctx, repositoryPath)
 	if err != nil {
 		return errors.Wrap(
@@ -573,7 +1423,7 @@ func handleInfoRefs(
 				"err": err,
 			},
 		)
-		if err := lockfile.RLock(); err != nil {
+		if err := lockfile.RLockContext(ctx); err != nil {
 			return errors.Wrap(
 				err,
 				"failed to acquire the lockfile",
@@ -582,16 +1432,12 @@ func handleInfoRefs(
 	}
 	defer lockfile.Unlock()
 
-	it, err := repository.NewReferenceIterator()
+	namespace := NamespaceFromContext(ctx)
+	advertisedRefs, err := advertisedReferences(ctx, repository, namespace, level, protocol, log)
 	if err != nil {
-		return errors.Wrap(
-			err,
-			"failed to read references",
-		)
+		return err
 	}
-	defer it.Free()
-
-	head, err := repository.Head()
+	head, err := lookupHead(repository, namespace)
 	if err != nil && !git.IsErrorCode(err, git.ErrorCodeUnbornBranch) {
 		return errors.Wrap(
 			err,
@@ -612,46 +1458,39 @@ func handleInfoRefs(
 
 	sentCapabilities := false
 	if sendSymref && head != nil {
+		headName, _ := stripNamespace(namespace, head.Name())
 		p.WritePktLine([]byte(fmt.Sprintf(
 			"%s HEAD\x00%s %s%s\n",
 			head.Target().String(),
 			strings.Join(capabilities, " "),
 			symrefHeadPrefix,
-			head.Name(),
+			headName,
 		)))
 		sentCapabilities = true
-	}
-	for {
-		ref, err := it.Next()
-		if err != nil {
-			if !git.IsErrorCode(err, git.ErrorCodeIterOver) {
-				log.Error(
-					"Error getting reference",
-					map[string]interface{}{
-						"err": err,
-					},
-				)
-			}
-			break
-		}
-		defer ref.Free()
-		if level == AuthorizationAllowedRestricted && isRestrictedRef(ref.Name()) {
-			continue
-		}
-		if !protocol.ReferenceDiscoveryCallback(ctx, repository, ref.Name()) {
-			continue
+	} else if sendSymref && protocol.AdvertiseUnbornHead {
+		if headName, ok := unbornHeadTarget(repository, namespace); ok {
+			p.WritePktLine([]byte(fmt.Sprintf(
+				"%s HEAD\x00%s %s%s\n",
+				(&git.Oid{}).String(),
+				strings.Join(capabilities, " "),
+				symrefHeadPrefix,
+				headName,
+			)))
+			sentCapabilities = true
 		}
+	}
+	for _, ref := range advertisedRefs {
 		if sentCapabilities {
 			p.WritePktLine([]byte(fmt.Sprintf(
 				"%s %s\n",
-				ref.Target().String(),
-				ref.Name(),
+				ref.id,
+				ref.name,
 			)))
 		} else {
 			p.WritePktLine([]byte(fmt.Sprintf(
 				"%s %s\x00%s\n",
-				ref.Target().String(),
-				ref.Name(),
+				ref.id,
+				ref.name,
 				strings.Join(capabilities, " "),
 			)))
 			sentCapabilities = true
@@ -667,6 +1506,69 @@ func handleInfoRefs(
 	return nil
 }
 
+// Advertisement returns the complete reference advertisement that is sent in
+// response to an info/refs request for the provided service
+// ("git-upload-pack" or "git-receive-pack"), so that callers can cache it.
+// The advertisement changes whenever the references of the repository change,
+// so any cached copy must be discarded after a push. If
+// AdvertisementCacheSize is set, the advertisement is also cached here, and
+// the returned slice must not be modified.
+func Advertisement(
+	ctx context.Context,
+	m *LockfileManager,
+	repositoryPath string,
+	serviceName string,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	log logging.Logger,
+) ([]byte, error) {
+	cacheKey := ""
+	var generation uint64
+	if protocol.advertisementCache != nil {
+		cacheKey = advertisementCacheKey(
+			repositoryPath,
+			serviceName,
+			ProtocolVersionFromContext(ctx),
+			level,
+			NamespaceFromContext(ctx),
+			UsernameFromContext(ctx),
+		)
+		advertisement, currentGeneration, ok := protocol.advertisementCache.get(cacheKey)
+		if ok {
+			return advertisement, nil
+		}
+		generation = currentGeneration
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch serviceName {
+	case "git-upload-pack":
+		err = handlePrePull(ctx, m, repositoryPath, level, protocol, log, &buf)
+	case "git-receive-pack":
+		err = handlePrePush(ctx, m, repositoryPath, level, protocol, log, &buf)
+	default:
+		err = base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("unknown service %s", serviceName),
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cacheKey != "" {
+		protocol.advertisementCache.put(cacheKey, generation, buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// advertisementETag returns the value of the ETag header for the provided
+// reference advertisement.
+func advertisementETag(advertisement []byte) string {
+	sum := sha256.Sum256(advertisement)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+}
+
 // handlePrePull handles git's pack-protocol pre-pull (or 'git-upload-pack'
 // service with /info/refs URL). This performs the server-side reference
 // discovery.
@@ -684,7 +1586,7 @@ func handlePrePull(
 		m,
 		repositoryPath,
 		"git-upload-pack",
-		pullCapabilities,
+		protocol.pullCapabilities,
 		true,
 		false,
 		level,
@@ -703,10 +1605,15 @@ func handlePull(
 	m *LockfileManager,
 	repositoryPath string,
 	level AuthorizationLevel,
+	protocol *GitProtocol,
 	log logging.Logger,
 	r io.Reader,
 	w io.Writer,
 ) error {
+	if ProtocolVersionFromContext(ctx) == 2 {
+		return handlePullV2(ctx, m, repositoryPath, level, protocol, log, r, w)
+	}
+
 	repository, err := openRepository(ctx, repositoryPath)
 	if err != nil {
 		return errors.Wrap(
@@ -724,7 +1631,7 @@ func handlePull(
 				"err": err,
 			},
 		)
-		if err := lockfile.RLock(); err != nil {
+		if err := lockfile.RLockContext(ctx); err != nil {
 			return errors.Wrap(
 				err,
 				"failed to acquire the lockfile",
@@ -742,26 +1649,55 @@ func handlePull(
 	}
 	defer pb.Free()
 
+	odb, err := repository.Odb()
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"failed to open git odb",
+		)
+	}
+	defer odb.Free()
+
+	// The trailers need to be declared before anything is written.
+	rw, sendStatistics := w.(http.ResponseWriter)
+	sendStatistics = sendStatistics && protocol.PackStatistics
+	if sendStatistics {
+		rw.Header().Add("Trailer", "Omegaup-Pack-Objects")
+		rw.Header().Add("Trailer", "Omegaup-Pack-Bytes")
+	}
+
+	// The client can take arbitrarily long to send the request, so reads stop
+	// once the context is done.
+	r = newContextReader(ctx, r)
 	pr := NewPktLineReader(r)
 	wantMap := make(map[string]*git.Commit)
+	defer func() {
+		for _, commit := range wantMap {
+			if commit != nil {
+				commit.Free()
+			}
+		}
+	}()
+	// Blobs and trees can also be wanted by partial clones that need to fetch
+	// objects that were previously omitted.
+	wantObjects := make(map[string]*git.Oid)
+	var filter *objectFilter
+	wantCount := 0
 	commonSet := make(map[string]struct{})
 	haveSet := make(map[string]struct{})
 	shallowSet := make(map[string]struct{})
 	acked := false
 	done := false
+	haveCount := 0
+	sideBand := false
 	maxDepth := uint64(0)
+	var cutoff *shallowCutoff
 	for {
 		line, err := pr.ReadPktLine()
 		if err == ErrFlush {
 			break
 		} else if err != nil {
-			return base.ErrorWithCategory(
-				ErrBadRequest,
-				errors.Wrap(
-					err,
-					"failed to read the request",
-				),
-			)
+			return requestReadError(ctx, err, "failed to read the request")
 		}
 		log.Debug(
 			"pktline",
@@ -780,7 +1716,10 @@ func handlePull(
 				if strings.Contains(cap, "=") {
 					continue
 				}
-				if !pullCapabilities.Contains(cap) {
+				if cap == "side-band-64k" {
+					sideBand = true
+				}
+				if !protocol.pullCapabilities.Contains(cap) {
 					return base.ErrorWithCategory(
 						ErrBadRequest,
 						errors.Errorf(
@@ -797,6 +1736,27 @@ func handlePull(
 				},
 			)
 		}
+		if (tokens[0] == "shallow" || tokens[0] == "deepen") &&
+			!protocol.pullCapabilities.Contains("shallow") {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf(
+					"'%s' requires the disabled shallow capability",
+					tokens[0],
+				),
+			)
+		}
+		if (tokens[0] == "deepen-since" || tokens[0] == "deepen-not") &&
+			!protocol.pullCapabilities.Contains(tokens[0]) {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf(
+					"'%s' requires the disabled %s capability",
+					tokens[0],
+					tokens[0],
+				),
+			)
+		}
 		if tokens[0] == "want" {
 			if len(tokens) < 2 {
 				return base.ErrorWithCategory(
@@ -804,6 +1764,16 @@ func handlePull(
 					errors.New("malformed 'want' pkt-line"),
 				)
 			}
+			wantCount++
+			if wantCount > protocol.MaxWants {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf(
+						"too many 'want' lines, the limit is %d",
+						protocol.MaxWants,
+					),
+				)
+			}
 			oid, err := git.NewOid(tokens[1])
 			if err != nil {
 				return base.ErrorWithCategory(
@@ -811,8 +1781,19 @@ func handlePull(
 					errors.Errorf("invalid OID: %s", tokens[1]),
 				)
 			}
+			if _, ok := wantMap[tokens[1]]; ok {
+				continue
+			}
+			if _, ok := wantObjects[tokens[1]]; ok {
+				continue
+			}
 			commit, err := repository.LookupCommit(oid)
 			if err != nil {
+				if _, objectType, err := odb.ReadHeader(oid); err == nil &&
+					(objectType == git.ObjectBlob || objectType == git.ObjectTree) {
+					wantObjects[tokens[1]] = oid
+					continue
+				}
 				log.Debug(
 					"Unknown commit requested",
 					map[string]any{
@@ -823,7 +1804,6 @@ func handlePull(
 				pw.WritePktLine([]byte(fmt.Sprintf("ERR upload-pack: not our ref %s", oid.String())))
 				return nil
 			}
-			defer commit.Free()
 			wantMap[tokens[1]] = commit
 		} else if tokens[0] == "shallow" {
 			if len(tokens) < 2 {
@@ -832,7 +1812,26 @@ func handlePull(
 					errors.New("malformed 'shallow' pkt-line"),
 				)
 			}
-			shallowSet[tokens[1]] = struct{}{}
+			if err := addShallow(shallowSet, tokens[1], protocol.MaxShallows); err != nil {
+				return err
+			}
+		} else if tokens[0] == "filter" {
+			if !protocol.pullCapabilities.Contains("filter") {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("'filter' requires the filter capability, which is not allowed"),
+				)
+			}
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("malformed 'filter' pkt-line"),
+				)
+			}
+			filter, err = parseObjectFilter(tokens[1])
+			if err != nil {
+				return base.ErrorWithCategory(ErrBadRequest, err)
+			}
 		} else if tokens[0] == "deepen" {
 			if len(tokens) < 2 {
 				return base.ErrorWithCategory(
@@ -847,6 +1846,24 @@ func handlePull(
 					errors.Errorf("invalid depth %s", tokens[1]),
 				)
 			}
+		} else if tokens[0] == "deepen-since" || tokens[0] == "deepen-not" {
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf("malformed '%s' pkt-line", tokens[0]),
+				)
+			}
+			if cutoff == nil {
+				cutoff = &shallowCutoff{}
+			}
+			if tokens[0] == "deepen-since" {
+				err = cutoff.parseDeepenSince(tokens[1])
+			} else {
+				err = cutoff.parseDeepenNot(ctx, repository, level, protocol, tokens[1])
+			}
+			if err != nil {
+				return err
+			}
 		} else {
 			log.Debug(
 				"unknown command",
@@ -859,25 +1876,12 @@ func handlePull(
 
 	// TODO(lhchavez): Move this after we commit to sending a successful reply.
 	pw := NewPktLineWriter(w)
+	deepen := maxDepth != 0 || cutoff != nil
 	if maxDepth == 0 {
 		maxDepth = uint64(math.MaxUint64)
-	} else {
-		for _, want := range wantMap {
-			depth := maxDepth
-			for current := want; current != nil && depth > 0; current = current.Parent(0) {
-				if current != want {
-					defer current.Free()
-				}
-				depth--
-				if depth == 0 && current.ParentCount() != 0 {
-					pw.WritePktLine([]byte(fmt.Sprintf("shallow %s\n", current.Id().String())))
-					break
-				}
-				if _, ok := shallowSet[current.Id().String()]; ok {
-					pw.WritePktLine([]byte(fmt.Sprintf("unshallow %s\n", current.Id().String())))
-				}
-			}
-		}
+	}
+	if deepen {
+		writeShallowUpdates(repository, pw, wantMap, shallowSet, maxDepth, cutoff)
 		pw.Flush()
 	}
 
@@ -886,13 +1890,7 @@ func handlePull(
 		if err == ErrFlush || err == io.EOF {
 			break
 		} else if err != nil {
-			return base.ErrorWithCategory(
-				ErrBadRequest,
-				errors.Wrap(
-					err,
-					"failed to read request",
-				),
-			)
+			return requestReadError(ctx, err, "failed to read request")
 		}
 		log.Debug(
 			"pktline",
@@ -916,6 +1914,19 @@ func handlePull(
 					errors.New("malformed 'have' pkt-line"),
 				)
 			}
+			haveCount++
+			if haveCount > protocol.MaxNegotiationHaves {
+				// Bail out, the negotiation was too expensive. Send the packfile
+				// with whatever common commits have been found so far.
+				log.Info(
+					"negotiation budget exceeded",
+					map[string]any{
+						"limit": protocol.MaxNegotiationHaves,
+					},
+				)
+				done = true
+				break
+			}
 			oid, err := git.NewOid(tokens[1])
 			if err != nil {
 				return base.ErrorWithCategory(
@@ -940,9 +1951,10 @@ func handlePull(
 	log.Debug(
 		"Negotiation",
 		map[string]any{
-			"want":   wantMap,
-			"have":   haveSet,
-			"common": commonSet,
+			"want":      wantMap,
+			"have":      haveSet,
+			"common":    commonSet,
+			"side-band": sideBand,
 		},
 	)
 
@@ -951,13 +1963,168 @@ func handlePull(
 		return nil
 	}
 
+	// The NAK ends the negotiation, so it needs to be sent before any of the
+	// progress messages.
+	if !acked {
+		pw.WritePktLine([]byte("NAK\n"))
+	}
+
+	// With side-band-64k, the packfile and the progress messages are
+	// multiplexed after the negotiation is over.
+	var sw *SideBandWriter
+	if sideBand {
+		sw = NewSideBandWriter(w)
+	}
+	if err := insertPullObjects(
+		ctx,
+		repository,
+		odb,
+		pb,
+		wantMap,
+		wantObjects,
+		commonSet,
+		shallowSet,
+		filter,
+		maxDepth,
+		cutoff,
+		sw,
+		log,
+	); err != nil {
+		return err
+	}
+	// The wanted commits are not needed to write the packfile, which can take
+	// a while, so they are released now. Only the keys of wantMap are used
+	// from here on.
+	for name, commit := range wantMap {
+		commit.Free()
+		wantMap[name] = nil
+	}
+
+	var packWriter io.Writer = w
+	if sw != nil {
+		sw.Progress(fmt.Sprintf("Counting objects: %d, done.\n", pb.ObjectCount()))
+		packWriter = sw
+	}
+
+	// A full clone of a repository that has a single packfile with exactly the
+	// needed objects can be served from that packfile, which avoids building
+	// (and compressing) a new one.
+	reuseExistingPackfile := len(commonSet) == 0 && len(shallowSet) == 0 &&
+		maxDepth == math.MaxUint64 && cutoff == nil && filter == nil &&
+		len(wantObjects) == 0 && wantsAllReferences(repository, wantMap)
+	packBytes := writePullPackfile(
+		ctx,
+		repository,
+		pb,
+		reuseExistingPackfile,
+		protocol,
+		log,
+		packWriter,
+		sw,
+	)
+	if sendStatistics {
+		rw.Header().Set("Omegaup-Pack-Objects", strconv.FormatUint(uint64(pb.ObjectCount()), 10))
+		rw.Header().Set("Omegaup-Pack-Bytes", strconv.FormatInt(packBytes, 10))
+	}
+
+	return nil
+}
+
+// addShallow adds the id of a 'shallow' line to the set of commits that the
+// client has as shallow. Requests with more than maxShallows distinct ids are
+// rejected with ErrBadRequest.
+func addShallow(shallowSet map[string]struct{}, id string, maxShallows int) error {
+	if _, ok := shallowSet[id]; ok {
+		return nil
+	}
+	if len(shallowSet) >= maxShallows {
+		return base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Errorf(
+				"too many 'shallow' lines, the limit is %d",
+				maxShallows,
+			),
+		)
+	}
+	shallowSet[id] = struct{}{}
+	return nil
+}
+
+// writeShallowUpdates tells the client which commits become the new shallow
+// boundary of its history once it has the wanted commits up to maxDepth (or
+// up to the cutoff, if any), and which of its current shallow commits stop
+// being so.
+func writeShallowUpdates(
+	repository *git.Repository,
+	pw *PktLineWriter,
+	wantMap map[string]*git.Commit,
+	shallowSet map[string]struct{},
+	maxDepth uint64,
+	cutoff *shallowCutoff,
+) {
 	for _, want := range wantMap {
-		depth := maxDepth
-		for current := want; current != nil && depth > 0; current = current.Parent(0) {
-			if current != want {
-				defer current.Free()
+		walkFirstParents(want, maxDepth, func(current *git.Commit, depth uint64) (bool, error) {
+			if current.ParentCount() != 0 && (depth == 0 || cutoff.cutsParent(repository, current)) {
+				pw.WritePktLine([]byte(fmt.Sprintf("shallow %s\n", current.Id().String())))
+				return false, nil
+			}
+			if _, ok := shallowSet[current.Id().String()]; ok {
+				pw.WritePktLine([]byte(fmt.Sprintf("unshallow %s\n", current.Id().String())))
 			}
-			depth--
+			return true, nil
+		})
+	}
+}
+
+// insertPullObjects inserts the objects that were negotiated in a pull into
+// the packbuilder: the wanted blobs and trees, and the wanted commits along
+// with their history up to maxDepth (or up to the cutoff, if any), stopping
+// at the commits that the client already has. If sw is not nil, progress
+// messages are sent through it.
+func insertPullObjects(
+	ctx context.Context,
+	repository *git.Repository,
+	odb *git.Odb,
+	pb *git.Packbuilder,
+	wantMap map[string]*git.Commit,
+	wantObjects map[string]*git.Oid,
+	commonSet map[string]struct{},
+	shallowSet map[string]struct{},
+	filter *objectFilter,
+	maxDepth uint64,
+	cutoff *shallowCutoff,
+	sw *SideBandWriter,
+	log logging.Logger,
+) error {
+	// Objects that are explicitly wanted are always sent, even if the filter
+	// would omit them.
+	filteredTrees := make(map[git.Oid]struct{})
+	for _, oid := range wantObjects {
+		_, objectType, err := odb.ReadHeader(oid)
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to read the header of %s",
+				oid,
+			)
+		}
+		if objectType == git.ObjectBlob {
+			err = pb.Insert(oid, "")
+		} else if filter != nil {
+			err = insertFilteredTree(repository, odb, pb, filter, oid, filteredTrees)
+		} else {
+			err = pb.InsertTree(oid)
+		}
+		if err != nil {
+			return errors.Wrap(
+				err,
+				"failed to build packfile",
+			)
+		}
+	}
+	insertedCommits := 0
+	for _, want := range wantMap {
+		err := walkFirstParents(want, maxDepth, func(current *git.Commit, depth uint64) (bool, error) {
 			if _, ok := shallowSet[current.Id().String()]; ok {
 				log.Debug(
 					"Skipping commit",
@@ -965,10 +2132,10 @@ func handlePull(
 						"commit": current.Id().String(),
 					},
 				)
-				continue
+				return true, nil
 			}
 			if _, ok := commonSet[current.Id().String()]; ok {
-				break
+				return false, nil
 			}
 			log.Debug(
 				"Adding commit",
@@ -976,19 +2143,91 @@ func handlePull(
 					"commit": current.Id().String(),
 				},
 			)
-			if err := pb.InsertCommit(current.Id()); err != nil {
-				return errors.Wrap(
+			if filter != nil {
+				if err := pb.Insert(current.Id(), ""); err != nil {
+					return false, errors.Wrap(
+						err,
+						"failed to build packfile",
+					)
+				}
+				if !filter.omitTrees {
+					if err := insertFilteredTree(repository, odb, pb, filter, current.TreeId(), filteredTrees); err != nil {
+						return false, errors.Wrap(
+							err,
+							"failed to build packfile",
+						)
+					}
+				}
+			} else if err := pb.InsertCommit(current.Id()); err != nil {
+				return false, errors.Wrap(
 					err,
 					"failed to build packfile",
 				)
 			}
+			insertedCommits++
+			if err := ctx.Err(); err != nil {
+				return false, errors.Wrap(
+					err,
+					"context cancelled",
+				)
+			}
+			if sw != nil && insertedCommits%progressInterval == 0 {
+				sw.Progress(fmt.Sprintf("Counting objects: %d\r", pb.ObjectCount()))
+			}
+			return !cutoff.cutsParent(repository, current), nil
+		})
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	if !acked {
-		pw.WritePktLine([]byte("NAK\n"))
+// writePullPackfile writes the packfile with the objects in pb to packWriter
+// and returns the number of bytes that were written. If reuseExistingPackfile
+// is true and the repository has a single packfile with exactly the same
+// number of objects, that packfile is sent instead. If sw is not nil, it is
+// flushed once the packfile is written.
+func writePullPackfile(
+	ctx context.Context,
+	repository *git.Repository,
+	pb *git.Packbuilder,
+	reuseExistingPackfile bool,
+	protocol *GitProtocol,
+	log logging.Logger,
+	packWriter io.Writer,
+	sw *SideBandWriter,
+) int64 {
+	existingPackPath := ""
+	if reuseExistingPackfile {
+		existingPackPath, _ = existingPackfile(repository.Path(), pb.ObjectCount())
+	}
+	// libgit2's packbuilder only uses objects within the same packfile as delta
+	// bases and cannot produce thin packs, so the packfile is always
+	// self-contained regardless of whether thin-pack was negotiated. This is
+	// what clients that did not negotiate it require, and is still valid (if
+	// larger) for the clients that did.
+	cw := &countingWriter{w: &contextWriter{ctx: ctx, w: packWriter}}
+	stopKeepalive := func() {}
+	if sw != nil && protocol.KeepaliveInterval > 0 {
+		stopKeepalive = startKeepalive(sw, protocol.KeepaliveInterval)
 	}
-	if err := pb.Write(w); err != nil {
+	if existingPackPath != "" {
+		log.Debug(
+			"Sending existing pack",
+			map[string]any{
+				"path": existingPackPath,
+			},
+		)
+		if err := copyFile(cw, existingPackPath); err != nil {
+			log.Error(
+				"Error writing pack",
+				map[string]any{
+					"err": err,
+				},
+			)
+		}
+	} else if err := pb.Write(cw); err != nil {
 		log.Error(
 			"Error writing pack",
 			map[string]any{
@@ -996,10 +2235,167 @@ func handlePull(
 			},
 		)
 	}
+	stopKeepalive()
+	if sw != nil {
+		sw.Flush()
+	}
+	return cw.n
+}
 
+// walkFirstParents calls fn with want and its first-parent ancestors, up to
+// maxDepth commits in total, along with the remaining depth. The walk stops
+// early if fn returns false or an error. Every ancestor is freed as soon as fn
+// returns, so that deep walks only hold onto a couple of commits at a time.
+func walkFirstParents(
+	want *git.Commit,
+	maxDepth uint64,
+	fn func(current *git.Commit, depth uint64) (bool, error),
+) error {
+	current := want
+	for depth := maxDepth; current != nil && depth > 0; {
+		depth--
+		ok, err := fn(current, depth)
+		var parent *git.Commit
+		if ok && err == nil {
+			parent = current.Parent(0)
+		}
+		if current != want {
+			current.Free()
+		}
+		if !ok || err != nil {
+			return err
+		}
+		current = parent
+	}
 	return nil
 }
 
+// startKeepalive sends an empty progress message through sw every interval,
+// until the returned function is called. The function waits for the
+// keepalives to stop, so that none are sent after it returns.
+func startKeepalive(sw *SideBandWriter, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := sw.Progress(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// A countingWriter is an io.Writer that counts the number of bytes written
+// through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// wantsAllReferences returns whether every reference in the repository points
+// to one of the wanted commits.
+func wantsAllReferences(repository *git.Repository, wantMap map[string]*git.Commit) bool {
+	it, err := repository.NewReferenceIterator()
+	if err != nil {
+		return false
+	}
+	defer it.Free()
+
+	for {
+		ref, err := it.Next()
+		if err != nil {
+			return git.IsErrorCode(err, git.ErrorCodeIterOver)
+		}
+		target, err := ref.Resolve()
+		ref.Free()
+		if err != nil {
+			return false
+		}
+		_, ok := wantMap[target.Target().String()]
+		target.Free()
+		if !ok {
+			return false
+		}
+	}
+}
+
+// existingPackfile returns the path of the packfile of the repository if it
+// contains all of its objects and has exactly objectCount objects. Since the
+// objects being sent are a subset of the repository's objects, this means that
+// the packfile has exactly those objects and nothing else.
+func existingPackfile(repositoryPath string, objectCount uint32) (string, bool) {
+	objectsPath := path.Join(repositoryPath, "objects")
+	if _, err := os.Stat(path.Join(objectsPath, "info", "alternates")); err == nil {
+		return "", false
+	}
+	entries, err := os.ReadDir(objectsPath)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		// Loose objects are stored in directories named after the first two
+		// hex digits of their ids.
+		if !entry.IsDir() || len(entry.Name()) != 2 {
+			continue
+		}
+		looseObjects, err := os.ReadDir(path.Join(objectsPath, entry.Name()))
+		if err != nil || len(looseObjects) != 0 {
+			return "", false
+		}
+	}
+
+	packPaths, err := filepath.Glob(path.Join(objectsPath, "pack", "*.pack"))
+	if err != nil || len(packPaths) != 1 {
+		return "", false
+	}
+	f, err := os.Open(packPaths[0])
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", false
+	}
+	if !bytes.Equal(header[:4], EmptyPackfile[:4]) {
+		return "", false
+	}
+	if count, err := readUInt32(bytes.NewReader(header[8:])); err != nil || count != objectCount {
+		return "", false
+	}
+	return packPaths[0], true
+}
+
+// copyFile writes the contents of the file at the provided path into w.
+func copyFile(w io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", filename)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
 // handlePrePush handles git's pack-protocol pre-push (or 'git-receive-pack'
 // with the '/info/refs' URL). This performs the negotiation of commits that
 // will be sent to the server and replies to the client with the list of
@@ -1018,7 +2414,7 @@ func handlePrePush(
 		m,
 		repositoryPath,
 		"git-receive-pack",
-		pushCapabilities,
+		protocol.pushCapabilities,
 		false,
 		true,
 		level,
@@ -1030,13 +2426,16 @@ func handlePrePush(
 
 // handlePush handles git's pack-protocol push (or 'git-receive-pack' with the
 // '/git-receive-pack' URL). This performs validations on the uploaded packfile
-// and commits the change if it is allowed.
+// and commits the change if it is allowed. expectedOldOids optionally maps
+// reference names to the object ids they must point to for the update to
+// proceed.
 func handlePush(
 	ctx context.Context,
 	m *LockfileManager,
 	repositoryPath string,
 	level AuthorizationLevel,
 	protocol *GitProtocol,
+	expectedOldOids map[string]*git.Oid,
 	log logging.Logger,
 	r io.Reader,
 	w io.Writer,
@@ -1058,7 +2457,7 @@ func handlePush(
 				"err": err,
 			},
 		)
-		if err := lockfile.RLock(); err != nil {
+		if err := lockfile.RLockContext(ctx); err != nil {
 			return errors.Wrap(
 				err,
 				"failed to acquire the lockfile",
@@ -1067,8 +2466,15 @@ func handlePush(
 	}
 	defer lockfile.Unlock()
 
+	namespace := NamespaceFromContext(ctx)
+	// The client can take arbitrarily long to send the request (and the
+	// packfile), so reads stop once the context is done.
+	r = newContextReader(ctx, r)
 	pr := NewPktLineReader(r)
 	reportStatus := false
+	reportStatusV2 := false
+	atomic := false
+	pushOptions := false
 	commands := make([]*GitCommand, 0)
 	references := make(map[string]*git.Reference)
 	for {
@@ -1076,13 +2482,7 @@ func handlePush(
 		if err == ErrFlush {
 			break
 		} else if err != nil {
-			return base.ErrorWithCategory(
-				ErrBadRequest,
-				errors.Wrap(
-					err,
-					"failed to read the request",
-				),
-			)
+			return requestReadError(ctx, err, "failed to read the request")
 		}
 		tokens := strings.FieldsFunc(
 			strings.Trim(string(line), "\n"),
@@ -1104,17 +2504,49 @@ func handlePush(
 				},
 			)
 			for _, token := range tokens[3:] {
+				if len(Capabilities{token}.without(protocol.DisabledCapabilities)) == 0 {
+					return base.ErrorWithCategory(
+						ErrBadRequest,
+						errors.Errorf(
+							"unsupported capability %s",
+							token,
+						),
+					)
+				}
 				if token == "report-status" {
 					reportStatus = true
-					break
+				} else if token == "report-status-v2" {
+					reportStatus = true
+					reportStatusV2 = true
+				} else if token == "atomic" {
+					atomic = true
+				} else if token == "push-options" {
+					pushOptions = true
 				}
 			}
 		}
 		command := &GitCommand{
 			ReferenceName: tokens[2],
+			ExpectedOld:   expectedOldOids[tokens[2]],
+		}
+		// Pushes to symbolic references (e.g. HEAD) update the reference they
+		// point to.
+		referenceName, resolveErr := resolveSymbolicReferenceName(
+			repository,
+			namespacedReferenceName(namespace, command.ReferenceName),
+		)
+		if resolveErr == nil {
+			// Symbolic references cannot point outside of the namespace.
+			var ok bool
+			if referenceName, ok = stripNamespace(namespace, referenceName); !ok {
+				resolveErr = ErrInvalidRef
+			} else if referenceName != command.ReferenceName {
+				command.requestedReferenceName = command.ReferenceName
+				command.ReferenceName = referenceName
+			}
 		}
 		if _, ok := references[command.ReferenceName]; !ok {
-			ref, err := repository.References.Lookup(command.ReferenceName)
+			ref, err := repository.References.Lookup(namespacedReferenceName(namespace, command.ReferenceName))
 			if err == nil {
 				defer ref.Free()
 			}
@@ -1122,13 +2554,19 @@ func handlePush(
 		}
 		command.Reference = references[command.ReferenceName]
 		commands = append(commands, command)
-		if command.Old, err = git.NewOid(tokens[0]); err != nil {
+		if resolveErr != nil {
+			command.err = resolveErr
+		} else if command.Old, err = git.NewOid(tokens[0]); err != nil {
 			command.err = ErrInvalidOldOid
 		} else if command.New, err = git.NewOid(tokens[1]); err != nil {
 			command.err = ErrInvalidNewOid
+		} else if command.IsCreate() && command.Reference != nil {
+			// Creates are only allowed if the reference does not exist, so
+			// this is reported separately from other stale requests.
+			command.err = ErrRefExists
 		} else if command.IsStaleRequest() {
 			command.err = ErrStaleInfo
-		} else if command.IsDelete() {
+		} else if command.IsDelete() && !protocol.AllowDeletes {
 			command.err = ErrDeleteUnallowed
 		}
 	}
@@ -1140,51 +2578,212 @@ func handlePush(
 		},
 	)
 
-	_, err, unpackErr := protocol.PushPackfile(
+	// An empty push has no packfile, so there is nothing to unpack. The
+	// capabilities are sent along with the first command, so report-status
+	// cannot have been negotiated and there is no status to report either.
+	if len(commands) == 0 {
+		if protocol.RejectEmptyPushes {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.New("push contained no commands"),
+			)
+		}
+		return nil
+	}
+
+	// With push-options, the commands are followed by the options, which are
+	// also terminated by a flush-pkt.
+	if pushOptions {
+		var options []string
+		for {
+			line, err := pr.ReadPktLine()
+			if err == ErrFlush {
+				break
+			} else if err != nil {
+				return requestReadError(ctx, err, "failed to read the push options")
+			}
+			if len(options) == maxPushOptions {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf(
+						"too many push options, the limit is %d",
+						maxPushOptions,
+					),
+				)
+			}
+			options = append(options, strings.TrimSuffix(string(line), "\n"))
+		}
+		log.Debug(
+			"Push options",
+			map[string]any{
+				"options": options,
+			},
+		)
+		ctx = WithPushOptions(ctx, options)
+	}
+
+	// The commands are followed by the packfile, which must start with its
+	// signature. Anything else (like an extra pkt-line) is rejected here
+	// instead of letting the indexer fail opaquely. Clients do not send a
+	// packfile if all the commands are deletes, since no objects are needed.
+	var packReader io.Reader
+	if onlyDeletes(commands) {
+		packReader = bytes.NewReader(EmptyPackfile)
+	} else {
+		br := bufio.NewReader(r)
+		if signature, err := br.Peek(4); err != nil || !bytes.Equal(signature, EmptyPackfile[:4]) {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.New("expected PACK header"),
+			)
+		}
+		packReader = br
+	}
+
+	// With report-status, the unpack status line is sent as soon as the
+	// packfile is unpacked so that the client can see progress while the
+	// references are being validated and updated.
+	var pw *PktLineWriter
+	var unpackedCallback func()
+	if reportStatus {
+		pw = NewPktLineWriter(w)
+		unpackedCallback = func() {
+			pw.WritePktLine([]byte("unpack ok\n"))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+
+	updatedRefs, err, unpackErr := protocol.pushPackfile(
 		ctx,
 		repository,
 		lockfile,
 		level,
 		commands,
-		r,
+		packReader,
+		unpackedCallback,
 	)
+	if errors.Is(unpackErr, ErrPackfileTooLarge) {
+		// Nothing has been written to the client yet, so this can still be
+		// reported with an HTTP status.
+		return base.ErrorWithCategory(ErrPackfileTooLarge, unpackErr)
+	}
 	if !reportStatus {
 		return err
 	}
-
-	pw := NewPktLineWriter(w)
 	defer pw.Flush()
 
-	if unpackErr == nil {
-		pw.WritePktLine([]byte("unpack ok\n"))
-	} else {
+	var optionLines map[*GitCommand][][]string
+	if reportStatusV2 && err == nil && unpackErr == nil {
+		optionLines = reportStatusV2Options(commands, updatedRefs)
+	}
+
+	if unpackErr != nil {
 		pw.WritePktLine([]byte(fmt.Sprintf("unpack %s\n", unpackErr.Error())))
 	}
+	// In an atomic push, the references that were not at fault are reported as
+	// collateral failures of the ones that were.
+	atomicFailed := false
+	if atomic {
+		for _, command := range commands {
+			if command.err != nil {
+				atomicFailed = true
+				break
+			}
+		}
+	}
 	for _, command := range commands {
 		if command.err != nil {
 			pw.WritePktLine([]byte(fmt.Sprintf(
 				"ng %s %s\n",
-				command.ReferenceName,
+				command.reportedReferenceName(),
 				command.err.Error(),
 			)))
+		} else if atomicFailed {
+			pw.WritePktLine([]byte(fmt.Sprintf(
+				"ng %s %s\n",
+				command.reportedReferenceName(),
+				ErrAtomicPushFailed.Error(),
+			)))
 		} else if unpackErr != nil {
 			pw.WritePktLine([]byte(fmt.Sprintf(
 				"ng %s unpack-failed\n",
-				command.ReferenceName,
+				command.reportedReferenceName(),
 			)))
 		} else if err != nil {
 			pw.WritePktLine([]byte(fmt.Sprintf(
 				"ng %s %s\n",
-				command.ReferenceName,
+				command.reportedReferenceName(),
 				err.Error(),
 			)))
+		} else if reports, ok := optionLines[command]; ok {
+			for _, options := range reports {
+				pw.WritePktLine([]byte(fmt.Sprintf(
+					"ok %s\n",
+					command.reportedReferenceName(),
+				)))
+				for _, option := range options {
+					pw.WritePktLine([]byte(option))
+				}
+			}
 		} else {
 			pw.WritePktLine([]byte(fmt.Sprintf(
 				"ok %s\n",
-				command.ReferenceName,
+				command.reportedReferenceName(),
 			)))
 		}
 	}
 
 	return nil
 }
+
+// onlyDeletes returns whether all the commands delete references. Commands
+// that could not be parsed are not considered deletes.
+func onlyDeletes(commands []*GitCommand) bool {
+	for _, command := range commands {
+		if command.New == nil || !command.IsDelete() {
+			return false
+		}
+	}
+	return true
+}
+
+// reportStatusV2Options returns the option lines of report-status-v2 for the
+// commands of a successful push, which tell the client how its commands were
+// rewritten by the PreprocessCallback. Each command can have several reports,
+// each of which is sent as an `ok` line followed by its options. A command
+// whose reference was updated to a different commit reports its new object
+// id, and the references that were updated without being part of any of the
+// commands are reported as part of the first one.
+func reportStatusV2Options(
+	commands []*GitCommand,
+	updatedRefs []UpdatedRef,
+) map[*GitCommand][][]string {
+	result := make(map[*GitCommand][][]string)
+	commandsByName := make(map[string]*GitCommand)
+	for _, command := range commands {
+		commandsByName[command.ReferenceName] = command
+		result[command] = [][]string{nil}
+	}
+	for _, updatedRef := range updatedRefs {
+		if command, ok := commandsByName[updatedRef.Name]; ok {
+			if command.New == nil || command.New.String() != updatedRef.To {
+				result[command][0] = append(
+					result[command][0],
+					fmt.Sprintf("option new-oid %s\n", updatedRef.To),
+				)
+			}
+			continue
+		}
+		if len(commands) == 0 {
+			continue
+		}
+		result[commands[0]] = append(result[commands[0]], []string{
+			fmt.Sprintf("option refname %s\n", updatedRef.Name),
+			fmt.Sprintf("option old-oid %s\n", updatedRef.From),
+			fmt.Sprintf("option new-oid %s\n", updatedRef.To),
+		})
+	}
+	return result
+}
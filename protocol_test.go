@@ -1,19 +1,32 @@
 package githttp
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/omegaup/go-base/logging/log15/v3"
+	"github.com/omegaup/go-base/v3"
+	"github.com/omegaup/go-base/v3/logging"
 
 	git "github.com/libgit2/git2go/v33"
 )
@@ -132,6 +145,283 @@ func TestHandlePrePull(t *testing.T) {
 	}
 }
 
+func TestHandlePrePullUserAgent(t *testing.T) {
+	log, _ := log15.New("info", false)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	for userAgent, expectedAgent := range map[string]string{
+		"":                        "agent=gohttp",
+		"gitserver/1.2.3":         "agent=gitserver/1.2.3",
+		"gitserver 1.2.3 (linux)": "agent=gitserver.1.2.3.(linux)",
+	} {
+		var buf bytes.Buffer
+		err := handlePrePull(
+			context.Background(),
+			m,
+			"testdata/repo.git",
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				UserAgent: userAgent,
+				Log:       log,
+			}),
+			log,
+			&buf,
+		)
+		if err != nil {
+			t.Fatalf("Failed to get pre-pull: %v", err)
+		}
+		discovery, err := DiscoverReferences(&buf)
+		if err != nil {
+			t.Fatalf("Failed to parse the reference discovery: %v", err)
+		}
+		if !discovery.Capabilities.Contains(expectedAgent) {
+			t.Errorf("For %q, expected %q in %v", userAgent, expectedAgent, discovery.Capabilities)
+		}
+		if discovery.Capabilities.Contains("agent=gohttp") != (expectedAgent == "agent=gohttp") {
+			t.Errorf("For %q, unexpected default agent in %v", userAgent, discovery.Capabilities)
+		}
+	}
+}
+
+func TestHandlePrePullSortedRefs(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repository := createDivergedRepository(t, dir, log)
+		head, err := repository.Head()
+		if err != nil {
+			t.Fatalf("Failed to read HEAD: %v", err)
+		}
+		// Some references are packed and some are loose, so the storage order
+		// is not the sorted order.
+		if err := ioutil.WriteFile(
+			path.Join(dir, "packed-refs"),
+			[]byte(fmt.Sprintf(
+				"# pack-refs with: peeled fully-peeled sorted \n%s refs/heads/aaa\n%s refs/tags/v1\n",
+				head.Target(),
+				head.Target(),
+			)),
+			0o644,
+		); err != nil {
+			t.Fatalf("Failed to write packed-refs: %v", err)
+		}
+		head.Free()
+		repository.Free()
+	}
+
+	var buf bytes.Buffer
+	err = handlePrePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			SortAdvertisedRefs: true,
+			Log:                log,
+		}),
+		log,
+		&buf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
+	}
+
+	pr := NewPktLineReader(&buf)
+	var refNames []string
+	for {
+		line, err := pr.ReadPktLine()
+		if err == ErrFlush {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read pkt-line: %v", err)
+		}
+		if bytes.HasPrefix(line, []byte("# service=")) {
+			continue
+		}
+		tokens := strings.FieldsFunc(
+			strings.Trim(string(line), "\n"),
+			func(r rune) bool {
+				return r == ' ' || r == '\x00'
+			},
+		)
+		refNames = append(refNames, tokens[1])
+	}
+
+	expectedRefNames := []string{
+		"HEAD",
+		"refs/heads/aaa",
+		"refs/heads/master",
+		"refs/heads/topic",
+		"refs/tags/v1",
+	}
+	if !reflect.DeepEqual(expectedRefNames, refNames) {
+		t.Errorf("Expected %v, got %v", expectedRefNames, refNames)
+	}
+}
+
+func TestAdvertisement(t *testing.T) {
+	log, _ := log15.New("info", false)
+	m := NewLockfileManager()
+	defer m.Clear()
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	advertisement, err := Advertisement(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		"git-upload-pack",
+		AuthorizationAllowed,
+		protocol,
+		log,
+	)
+	if err != nil {
+		t.Fatalf("Failed to get the advertisement: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := handlePrePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		protocol,
+		log,
+		&buf,
+	); err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), advertisement) {
+		t.Errorf("Expected %q, got %q", buf.String(), advertisement)
+	}
+
+	if _, err := Advertisement(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		"git-foo-pack",
+		AuthorizationAllowed,
+		protocol,
+		log,
+	); !base.HasErrorCategory(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown service, got %v", err)
+	}
+}
+
+func TestHandlePrePullHiddenRefs(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	var changeID *git.Oid
+	{
+		repository := createDivergedRepository(t, dir, log)
+		changeID = createTestCommit(
+			t, repository, log, "refs/changes/01/1/1",
+			map[string]string{"a": "change\n"},
+			"Change\n",
+		)
+		repository.Free()
+	}
+
+	protocol := NewGitProtocol(GitProtocolOpts{
+		HiddenRefs: []string{"refs/changes/*"},
+		Log:        log,
+	})
+
+	var buf bytes.Buffer
+	if err := handlePrePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		protocol,
+		log,
+		&buf,
+	); err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
+	}
+	discovery, err := DiscoverReferences(&buf)
+	if err != nil {
+		t.Fatalf("Failed to parse the reference discovery: %v", err)
+	}
+	for name := range discovery.References {
+		if strings.HasPrefix(name, "refs/changes/") {
+			t.Errorf("Expected %s to be hidden", name)
+		}
+	}
+	if _, ok := discovery.References["refs/heads/master"]; !ok {
+		t.Errorf("Expected refs/heads/master to be advertised, got %v", discovery.References)
+	}
+
+	var inBuf, outBuf bytes.Buffer
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(fmt.Sprintf("want %s ofs-delta agent=git/2.14.1\n", changeID)))
+		pw.Flush()
+		pw.WritePktLine([]byte("done"))
+	}
+	if err := handlePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		protocol,
+		log,
+		&inBuf,
+		&outBuf,
+	); err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"NAK\n", nil},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+	found := false
+	for _, entry := range idx.Entries {
+		if changeID.String() == entry.Oid.String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the packfile to contain the hidden commit %s", changeID)
+	}
+}
+
 func TestHandlePrePush(t *testing.T) {
 	var buf bytes.Buffer
 	log, _ := log15.New("info", false)
@@ -203,6 +493,61 @@ func TestHandleEmptyPrePull(t *testing.T) {
 	}
 }
 
+func TestHandleEmptyPrePullUnbornHead(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repository, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		head, err := repository.References.CreateSymbolic("HEAD", "refs/heads/main", true, "")
+		if err != nil {
+			t.Fatalf("Failed to update HEAD: %v", err)
+		}
+		head.Free()
+		repository.Free()
+	}
+
+	var buf bytes.Buffer
+	err = handlePrePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			AdvertiseUnbornHead: true,
+			Log:                 log,
+		}),
+		log,
+		&buf,
+	)
+	if err != nil {
+		t.Errorf("Failed to get pre-pull: %v", err)
+	}
+	discovery, err := DiscoverReferences(&buf)
+	if err != nil {
+		t.Errorf("Failed to parse the reference discovery: %v", err)
+	}
+	expectedSymref := "refs/heads/main"
+	if expectedSymref != discovery.HeadSymref {
+		t.Errorf("Expected %v, got %v", expectedSymref, discovery.HeadSymref)
+	}
+	expectedReferences := map[string]git.Oid{
+		"HEAD": {},
+	}
+	if !reflect.DeepEqual(expectedReferences, discovery.References) {
+		t.Errorf("Expected %v, got %v", expectedReferences, discovery.References)
+	}
+}
+
 func TestHandleEmptyPrePush(t *testing.T) {
 	var buf bytes.Buffer
 	log, _ := log15.New("info", false)
@@ -264,6 +609,9 @@ func TestHandlePullUnknownRef(t *testing.T) {
 		m,
 		"testdata/repo.git",
 		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
 		log,
 		&inBuf,
 		&outBuf,
@@ -283,6 +631,48 @@ func TestHandlePullUnknownRef(t *testing.T) {
 	}
 }
 
+func TestHandlePullUnknownRefUploadPackError(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 0000000000000000000000000000000000000000 thin-pack ofs-delta agent=git/2.14.1\n"))
+		pw.Flush()
+		pw.WritePktLine([]byte("done"))
+	}
+
+	log, _ := log15.New("info", false)
+	err := handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	_, err = DiscoverReferences(&outBuf)
+	var uploadPackErr *UploadPackError
+	if !errors.As(err, &uploadPackErr) {
+		t.Fatalf("Expected *UploadPackError, got %v", err)
+	}
+	expectedMessage := "upload-pack: not our ref 0000000000000000000000000000000000000000"
+	if expectedMessage != uploadPackErr.Message {
+		t.Errorf("Expected %q, got %q", expectedMessage, uploadPackErr.Message)
+	}
+}
+
 func TestHandleClone(t *testing.T) {
 	var inBuf, outBuf bytes.Buffer
 
@@ -308,6 +698,9 @@ func TestHandleClone(t *testing.T) {
 		m,
 		"testdata/repo.git",
 		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
 		log,
 		&inBuf,
 		&outBuf,
@@ -332,7 +725,7 @@ func TestHandleClone(t *testing.T) {
 	}
 	defer odb.Free()
 
-	idx, _, err := UnpackPackfile(odb, &outBuf, dir, nil)
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
 	if err != nil {
 		t.Fatalf("Failed to unpack packfile: %v", err)
 	}
@@ -361,9 +754,7 @@ func TestHandleClone(t *testing.T) {
 	}
 }
 
-func TestHandlePull(t *testing.T) {
-	var inBuf, outBuf bytes.Buffer
-
+func TestHandleCloneExistingPack(t *testing.T) {
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
 		t.Fatalf("Failed to create directory: %v", err)
@@ -373,116 +764,114 @@ func TestHandlePull(t *testing.T) {
 	defer m.Clear()
 
 	{
-		// Taken from git 2.14.1
-		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
-		pw.Flush()
-		pw.WritePktLine([]byte("have 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n"))
-		pw.WritePktLine([]byte("done"))
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
 	}
 
 	log, _ := log15.New("info", false)
-	err = handlePull(
-		context.Background(),
-		m,
-		"testdata/repo.git",
-		AuthorizationAllowed,
-		log,
-		&inBuf,
-		&outBuf,
-	)
-	if err != nil {
-		t.Fatalf("Failed to clone: %v", err)
-	}
-
-	expected := []PktLineResponse{
-		{"ACK 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n", nil},
-	}
-	if actual, ok := ComparePktLineResponse(
-		&outBuf,
-		expected,
-	); !ok {
-		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
-	}
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
 
-	odb, err := git.NewOdb()
-	if err != nil {
-		t.Fatalf("Failed to create odb: %v", err)
-	}
-	defer odb.Free()
-
-	idx, _, err := UnpackPackfile(odb, &outBuf, dir, nil)
-	if err != nil {
-		t.Fatalf("Failed to unpack packfile: %v", err)
-	}
+	// After this push, the repository has a single packfile with all of its
+	// objects.
+	{
+		var inBuf, outBuf bytes.Buffer
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 6d2439d2e920ba92d8e485e75d1b740ae51b609a refs/heads/master\x00report-status\n"))
+		pw.Flush()
 
-	entries := []struct {
-		hash       string
-		size       uint64
-		objectType git.ObjectType
-	}{
-		{"06f8815b4dc1ba5cabf619d8a8ef392d0f88a2f1", 71, git.ObjectTree},
-		{"6d2439d2e920ba92d8e485e75d1b740ae51b609a", 217, git.ObjectCommit},
-	}
-	for i, entry := range entries {
-		if entry.hash != idx.Entries[i].Oid.String() {
-			t.Errorf("Entry %d hash mismatch: expected %v, got %v", i, entry.hash, idx.Entries[i].Oid)
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
 		}
-		if entry.size != idx.Entries[i].Size {
-			t.Errorf("Entry %d size mismatch: expected %v, got %v", i, entry.size, idx.Entries[i].Size)
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
 		}
-		if entry.objectType != idx.Entries[i].Type {
-			t.Errorf("Entry %d type mismatch: expected %v, got %v", i, entry.objectType, idx.Entries[i].Type)
+
+		if err := handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		); err != nil {
+			t.Fatalf("Failed to push: %v", err)
 		}
 	}
-}
-
-func TestHandleCloneShallowNegotiation(t *testing.T) {
-	var inBuf, outBuf bytes.Buffer
-	dir, err := ioutil.TempDir("", "protocol_test")
+	packPaths, err := filepath.Glob(path.Join(dir, "objects/pack/*.pack"))
+	if err != nil || len(packPaths) != 1 {
+		t.Fatalf("Expected a single packfile, got %v, %v", packPaths, err)
+	}
+	existingPack, err := ioutil.ReadFile(packPaths[0])
 	if err != nil {
-		t.Fatalf("Failed to create directory: %v", err)
+		t.Fatalf("Failed to read the packfile: %v", err)
 	}
-	defer os.RemoveAll(dir)
-	m := NewLockfileManager()
-	defer m.Clear()
 
+	var inBuf, outBuf bytes.Buffer
 	{
-		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
-		pw.WritePktLine([]byte("deepen 1"))
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a ofs-delta agent=git/2.14.1\n"))
 		pw.Flush()
+		pw.WritePktLine([]byte("done"))
 	}
-
-	log, _ := log15.New("info", false)
-	err = handlePull(
+	if err := handlePull(
 		context.Background(),
 		m,
-		"testdata/repo.git",
+		dir,
 		AuthorizationAllowed,
+		protocol,
 		log,
 		&inBuf,
 		&outBuf,
-	)
-	if err != nil {
+	); err != nil {
 		t.Fatalf("Failed to clone: %v", err)
 	}
 
 	expected := []PktLineResponse{
-		{"shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
-		{"", ErrFlush},
+		{"NAK\n", nil},
 	}
 	if actual, ok := ComparePktLineResponse(
 		&outBuf,
 		expected,
 	); !ok {
-		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+	if !bytes.Equal(existingPack, outBuf.Bytes()) {
+		t.Errorf("Expected the existing packfile to be sent")
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	unpackDir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(unpackDir)
+	idx, _, err := UnpackPackfile(odb, &outBuf, unpackDir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+	if len(idx.Entries) != 5 {
+		t.Errorf("Expected 5 objects, got %d", len(idx.Entries))
 	}
 }
 
-func TestHandleCloneShallowClone(t *testing.T) {
+func TestHandlePull(t *testing.T) {
 	var inBuf, outBuf bytes.Buffer
+
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
 		t.Fatalf("Failed to create directory: %v", err)
@@ -495,8 +884,8 @@ func TestHandleCloneShallowClone(t *testing.T) {
 		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
 		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
-		pw.WritePktLine([]byte("deepen 1"))
 		pw.Flush()
+		pw.WritePktLine([]byte("have 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n"))
 		pw.WritePktLine([]byte("done"))
 	}
 
@@ -506,6 +895,9 @@ func TestHandleCloneShallowClone(t *testing.T) {
 		m,
 		"testdata/repo.git",
 		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
 		log,
 		&inBuf,
 		&outBuf,
@@ -515,9 +907,7 @@ func TestHandleCloneShallowClone(t *testing.T) {
 	}
 
 	expected := []PktLineResponse{
-		{"shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
-		{"", ErrFlush},
-		{"NAK\n", nil},
+		{"ACK 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n", nil},
 	}
 	if actual, ok := ComparePktLineResponse(
 		&outBuf,
@@ -532,7 +922,7 @@ func TestHandleCloneShallowClone(t *testing.T) {
 	}
 	defer odb.Free()
 
-	idx, _, err := UnpackPackfile(odb, &outBuf, dir, nil)
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
 	if err != nil {
 		t.Fatalf("Failed to unpack packfile: %v", err)
 	}
@@ -544,7 +934,6 @@ func TestHandleCloneShallowClone(t *testing.T) {
 	}{
 		{"06f8815b4dc1ba5cabf619d8a8ef392d0f88a2f1", 71, git.ObjectTree},
 		{"6d2439d2e920ba92d8e485e75d1b740ae51b609a", 217, git.ObjectCommit},
-		{"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", 0, git.ObjectBlob},
 	}
 	for i, entry := range entries {
 		if entry.hash != idx.Entries[i].Oid.String() {
@@ -559,8 +948,9 @@ func TestHandleCloneShallowClone(t *testing.T) {
 	}
 }
 
-func TestHandleCloneShallowUnshallow(t *testing.T) {
+func TestHandlePullWithoutThinPack(t *testing.T) {
 	var inBuf, outBuf bytes.Buffer
+
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
 		t.Fatalf("Failed to create directory: %v", err)
@@ -570,13 +960,10 @@ func TestHandleCloneShallowUnshallow(t *testing.T) {
 	defer m.Clear()
 
 	{
-		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
-		pw.WritePktLine([]byte("shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n"))
-		pw.WritePktLine([]byte("deepen 2147483647"))
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a ofs-delta agent=git/2.14.1\n"))
 		pw.Flush()
-		pw.WritePktLine([]byte("have 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n"))
+		pw.WritePktLine([]byte("have 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n"))
 		pw.WritePktLine([]byte("done"))
 	}
 
@@ -586,6 +973,9 @@ func TestHandleCloneShallowUnshallow(t *testing.T) {
 		m,
 		"testdata/repo.git",
 		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
 		log,
 		&inBuf,
 		&outBuf,
@@ -595,9 +985,7 @@ func TestHandleCloneShallowUnshallow(t *testing.T) {
 	}
 
 	expected := []PktLineResponse{
-		{"unshallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
-		{"", ErrFlush},
-		{"ACK 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+		{"ACK 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n", nil},
 	}
 	if actual, ok := ComparePktLineResponse(
 		&outBuf,
@@ -606,41 +994,94 @@ func TestHandleCloneShallowUnshallow(t *testing.T) {
 		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
 	}
 
+	packfile := outBuf.Bytes()
+
+	// The odb is empty, so the indexer would not be able to resolve any deltas
+	// against objects that are not in the packfile.
 	odb, err := git.NewOdb()
 	if err != nil {
 		t.Fatalf("Failed to create odb: %v", err)
 	}
 	defer odb.Free()
 
-	idx, _, err := UnpackPackfile(odb, &outBuf, dir, nil)
+	idx, _, err := UnpackPackfile(odb, bytes.NewReader(packfile), dir, 0, nil)
 	if err != nil {
-		t.Fatalf("Failed to unpack packfile: %v", err)
+		t.Fatalf("Failed to unpack a self-contained packfile: %v", err)
+	}
+	packedObjects := make(map[string]struct{})
+	for _, entry := range idx.Entries {
+		if "88aa3454adb27c3c343ab57564d962a0a7f6a3c1" == entry.Oid.String() {
+			t.Errorf("Expected the packfile to not contain the common commit")
+		}
+		packedObjects[entry.Oid.String()] = struct{}{}
 	}
 
-	entries := []struct {
-		hash       string
-		size       uint64
-		objectType git.ObjectType
-	}{
-		{"417c01c8795a35b8e835113a85a5c0c1c77f67fb", 33, git.ObjectTree},
-		{"88aa3454adb27c3c343ab57564d962a0a7f6a3c1", 170, git.ObjectCommit},
-		{"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", 0, git.ObjectBlob},
+	deltaBases, err := packfileRefDeltaBases(bytes.NewReader(packfile))
+	if err != nil {
+		t.Fatalf("Failed to parse the packfile: %v", err)
 	}
-	for i, entry := range entries {
-		if entry.hash != idx.Entries[i].Oid.String() {
-			t.Errorf("Entry %d hash mismatch: expected %v, got %v", i, entry.hash, idx.Entries[i].Oid)
+	for _, deltaBase := range deltaBases {
+		if _, ok := packedObjects[deltaBase]; !ok {
+			t.Errorf("Expected the packfile to not have external delta base %s", deltaBase)
 		}
-		if entry.size != idx.Entries[i].Size {
-			t.Errorf("Entry %d size mismatch: expected %v, got %v", i, entry.size, idx.Entries[i].Size)
+	}
+}
+
+// packfileRefDeltaBases returns the ids of the delta bases of all the
+// REF_DELTA objects in the packfile. OFS_DELTA objects always have their base
+// within the same packfile, so they are skipped.
+func packfileRefDeltaBases(r io.Reader) ([]string, error) {
+	br := &countingByteReader{r: bufio.NewReader(r)}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	objectCount, _ := readUInt32(bytes.NewReader(header[8:]))
+
+	var deltaBases []string
+	for i := uint32(0); i < objectCount; i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
 		}
-		if entry.objectType != idx.Entries[i].Type {
-			t.Errorf("Entry %d type mismatch: expected %v, got %v", i, entry.objectType, idx.Entries[i].Type)
+		objectType := (c >> 4) & 0x07
+		for c&0x80 != 0 {
+			if c, err = br.ReadByte(); err != nil {
+				return nil, err
+			}
+		}
+
+		switch objectType {
+		case packObjectOfsDelta:
+			for c = 0x80; c&0x80 != 0; {
+				if c, err = br.ReadByte(); err != nil {
+					return nil, err
+				}
+			}
+		case packObjectRefDelta:
+			deltaBase := make([]byte, sha1.Size)
+			if _, err := io.ReadFull(br, deltaBase); err != nil {
+				return nil, err
+			}
+			deltaBases = append(deltaBases, hex.EncodeToString(deltaBase))
+		}
+
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(io.Discard, zr)
+		zr.Close()
+		if err != nil {
+			return nil, err
 		}
 	}
+	return deltaBases, nil
 }
 
-func TestHandlePushUnborn(t *testing.T) {
-	var inBuf, outBuf bytes.Buffer
+func TestHandlePullPackStatistics(t *testing.T) {
+	var inBuf bytes.Buffer
+
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
 		t.Fatalf("Failed to create directory: %v", err)
@@ -650,117 +1091,2584 @@ func TestHandlePushUnborn(t *testing.T) {
 	defer m.Clear()
 
 	{
-		repo, err := git.InitRepository(dir, true)
-		if err != nil {
-			t.Fatalf("Failed to initialize git repository: %v", err)
-		}
-		repo.Free()
-	}
-
-	{
-		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a ofs-delta agent=git/2.14.1\n"))
 		pw.Flush()
-	}
-
-	f, err := os.Open(packFilename)
-	if err != nil {
-		t.Fatalf("Failed to open the packfile: %v", err)
-	}
-	defer f.Close()
-	if _, err = io.Copy(&inBuf, f); err != nil {
-		t.Fatalf("Failed to copy the packfile: %v", err)
+		pw.WritePktLine([]byte("done"))
 	}
 
 	log, _ := log15.New("info", false)
-	err = handlePush(
+	w := httptest.NewRecorder()
+	err = handlePull(
 		context.Background(),
 		m,
-		dir,
+		"testdata/repo.git",
 		AuthorizationAllowed,
 		NewGitProtocol(GitProtocolOpts{
-			Log: log,
+			PackStatistics: true,
+			Log:            log,
 		}),
 		log,
 		&inBuf,
-		&outBuf,
+		w,
 	)
 	if err != nil {
-		t.Fatalf("Failed to push: %v", err)
+		t.Fatalf("Failed to clone: %v", err)
 	}
 
 	expected := []PktLineResponse{
-		{"unpack ok\n", nil},
-		{"ok refs/heads/master\n", nil},
-		{"", ErrFlush},
+		{"NAK\n", nil},
 	}
 	if actual, ok := ComparePktLineResponse(
-		&outBuf,
+		w.Body,
 		expected,
 	); !ok {
 		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
 	}
+	packBytes := w.Body.Len()
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	idx, _, err := UnpackPackfile(odb, w.Body, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+
+	trailer := w.Result().Trailer
+	if expected, actual := strconv.Itoa(len(idx.Entries)), trailer.Get("Omegaup-Pack-Objects"); expected != actual {
+		t.Errorf("Expected %s objects, got %s", expected, actual)
+	}
+	if expected, actual := strconv.Itoa(packBytes), trailer.Get("Omegaup-Pack-Bytes"); expected != actual {
+		t.Errorf("Expected %s bytes, got %s", expected, actual)
+	}
+}
+
+func TestHandlePullFilterNotAllowed(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
 
 	var buf bytes.Buffer
-	err = handlePrePull(
+	if err := handlePrePull(
 		context.Background(),
 		m,
-		dir,
+		"testdata/repo.git",
 		AuthorizationAllowed,
-		NewGitProtocol(GitProtocolOpts{
-			Log: log,
-		}),
+		protocol,
 		log,
 		&buf,
-	)
-	if err != nil {
-		t.Errorf("Failed to get pre-pull: %v", err)
+	); err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
 	}
 	discovery, err := DiscoverReferences(&buf)
 	if err != nil {
-		t.Errorf("Failed to parse the reference discovery: %v", err)
-	}
-	expectedSymref := "refs/heads/master"
-	if expectedSymref != discovery.HeadSymref {
-		t.Errorf("Expected %v, got %v", expectedSymref, discovery.HeadSymref)
+		t.Fatalf("Failed to parse the reference discovery: %v", err)
 	}
-	expectedReferences := map[string]git.Oid{
-		"HEAD":              gitOid("88aa3454adb27c3c343ab57564d962a0a7f6a3c1"),
-		"refs/heads/master": gitOid("88aa3454adb27c3c343ab57564d962a0a7f6a3c1"),
+	for _, capability := range discovery.Capabilities {
+		if capability == "filter" {
+			t.Errorf("Expected the filter capability to not be advertised, got %v", discovery.Capabilities)
+		}
 	}
-	if !reflect.DeepEqual(expectedReferences, discovery.References) {
-		t.Errorf("Expected %v, got %v", expectedReferences, discovery.References)
+
+	for _, capabilities := range []string{"ofs-delta filter", "ofs-delta"} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte(fmt.Sprintf("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a %s agent=git/2.14.1\n", capabilities)))
+			pw.WritePktLine([]byte("filter blob:none\n"))
+			pw.Flush()
+			pw.WritePktLine([]byte("done"))
+		}
+
+		err := handlePull(
+			context.Background(),
+			m,
+			"testdata/repo.git",
+			AuthorizationAllowed,
+			protocol,
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if !base.HasErrorCategory(err, ErrBadRequest) {
+			t.Errorf("For %q, expected ErrBadRequest, got %v", capabilities, err)
+		}
 	}
 }
 
-func TestHandlePushPreprocess(t *testing.T) {
-	var inBuf, outBuf bytes.Buffer
-	dir, err := ioutil.TempDir("", "protocol_test")
-	if err != nil {
-		t.Fatalf("Failed to create directory: %v", err)
-	}
-	if os.Getenv("PRESERVE") == "" {
-		defer os.RemoveAll(dir)
-	}
+func TestHandlePullFilter(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		AllowFilter: true,
+		Log:         log,
+	})
 	m := NewLockfileManager()
 	defer m.Clear()
 
-	{
-		repo, err := git.InitRepository(dir, true)
-		if err != nil {
-			t.Fatalf("Failed to initialize git repository: %v", err)
-		}
-		repo.Free()
-	}
+	for _, testCase := range []struct {
+		name          string
+		filter        string
+		want          string
+		expectedTypes map[git.ObjectType]int
+	}{
+		{
+			// The commits and their trees, but not the blob.
+			name:   "clone",
+			filter: "blob:none",
+			want:   "6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+			expectedTypes: map[git.ObjectType]int{
+				git.ObjectCommit: 2,
+				git.ObjectTree:   2,
+			},
+		},
+		{
+			// Explicitly-wanted blobs are sent despite the filter.
+			name:   "omitted blob",
+			filter: "blob:none",
+			want:   "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
+			expectedTypes: map[git.ObjectType]int{
+				git.ObjectBlob: 1,
+			},
+		},
+		{
+			// The empty blob is smaller than the limit.
+			name:   "blob limit",
+			filter: "blob:limit=1k",
+			want:   "6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+			expectedTypes: map[git.ObjectType]int{
+				git.ObjectCommit: 2,
+				git.ObjectTree:   2,
+				git.ObjectBlob:   1,
+			},
+		},
+		{
+			// Only the commits.
+			name:   "treeless clone",
+			filter: "tree:0",
+			want:   "6d2439d2e920ba92d8e485e75d1b740ae51b609a",
+			expectedTypes: map[git.ObjectType]int{
+				git.ObjectCommit: 2,
+			},
+		},
+		{
+			// Explicitly-wanted trees are sent despite the filter, but not
+			// their contents.
+			name:   "omitted tree",
+			filter: "tree:0",
+			want:   "06f8815b4dc1ba5cabf619d8a8ef392d0f88a2f1",
+			expectedTypes: map[git.ObjectType]int{
+				git.ObjectTree: 1,
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "protocol_test")
+			if err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			var inBuf, outBuf bytes.Buffer
+			{
+				pw := NewPktLineWriter(&inBuf)
+				pw.WritePktLine([]byte(fmt.Sprintf("want %s ofs-delta filter agent=git/2.14.1\n", testCase.want)))
+				pw.WritePktLine([]byte(fmt.Sprintf("filter %s\n", testCase.filter)))
+				pw.Flush()
+				pw.WritePktLine([]byte("done"))
+			}
+
+			if err := handlePull(
+				context.Background(),
+				m,
+				"testdata/repo.git",
+				AuthorizationAllowed,
+				protocol,
+				log,
+				&inBuf,
+				&outBuf,
+			); err != nil {
+				t.Fatalf("Failed to fetch: %v", err)
+			}
+
+			expected := []PktLineResponse{
+				{"NAK\n", nil},
+			}
+			if actual, ok := ComparePktLineResponse(
+				&outBuf,
+				expected,
+			); !ok {
+				t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+			}
+
+			odb, err := git.NewOdb()
+			if err != nil {
+				t.Fatalf("Failed to create odb: %v", err)
+			}
+			defer odb.Free()
+			idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
+			if err != nil {
+				t.Fatalf("Failed to unpack the packfile: %v", err)
+			}
+			actualTypes := make(map[git.ObjectType]int)
+			for _, entry := range idx.Entries {
+				actualTypes[entry.Type]++
+			}
+			if !reflect.DeepEqual(testCase.expectedTypes, actualTypes) {
+				t.Errorf("Expected %v, got %v", testCase.expectedTypes, actualTypes)
+			}
+		})
+	}
+}
+
+func TestParseObjectFilter(t *testing.T) {
+	for spec, expected := range map[string]*objectFilter{
+		"blob:none":       {blobLimit: 0},
+		"blob:limit=0":    {blobLimit: 0},
+		"blob:limit=100":  {blobLimit: 100},
+		"blob:limit=2k":   {blobLimit: 2 * 1024},
+		"blob:limit=1M":   {blobLimit: 1024 * 1024},
+		"tree:0":          {omitTrees: true},
+		"tree:1":          nil,
+		"blob:limit=":     nil,
+		"blob:limit=1x":   nil,
+		"sparse:oid=HEAD": nil,
+	} {
+		actual, err := parseObjectFilter(spec)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("For %q, expected an error, got %v", spec, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("For %q, unexpected error: %v", spec, err)
+		} else if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("For %q, expected %v, got %v", spec, expected, actual)
+		}
+	}
+}
+
+func TestHandlePullSideBand(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a side-band-64k ofs-delta agent=git/2.14.1\n"))
+		pw.Flush()
+		pw.WritePktLine([]byte("done"))
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	pr := NewPktLineReader(&outBuf)
+	if line, err := pr.ReadPktLine(); err != nil || string(line) != "NAK\n" {
+		t.Fatalf("Expected NAK, got %q, %v", line, err)
+	}
+	var pack bytes.Buffer
+	var progress string
+	for {
+		line, err := pr.ReadPktLine()
+		if err == ErrFlush {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read the side-band stream: %v", err)
+		}
+		switch line[0] {
+		case sideBandData:
+			pack.Write(line[1:])
+		case sideBandProgress:
+			progress += string(line[1:])
+		default:
+			t.Fatalf("Unexpected band %d: %q", line[0], line[1:])
+		}
+	}
+	if outBuf.Len() != 0 {
+		t.Errorf("Unexpected data after the flush: %q", outBuf.Bytes())
+	}
+	if !strings.Contains(progress, "Counting objects: 5, done.\n") {
+		t.Errorf("Unexpected progress %q", progress)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	idx, _, err := UnpackPackfile(odb, &pack, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+	if len(idx.Entries) != 5 {
+		t.Errorf("Expected 5 objects, got %d", len(idx.Entries))
+	}
+}
+
+func TestHandlePullSideBandLongHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	// Enough commits for progress messages to be sent while the objects are
+	// being counted.
+	const historyLength = 2*progressInterval + 1
+	var head *git.Oid
+	for i := 0; i < historyLength; i++ {
+		var parents []*git.Oid
+		if head != nil {
+			parents = append(parents, head)
+		}
+		head = createTestCommit(
+			t, repository, log, "refs/heads/master",
+			map[string]string{"a": fmt.Sprintf("%d\n", i)},
+			fmt.Sprintf("Commit %d\n", i),
+			parents...,
+		)
+	}
+
+	var inBuf, outBuf bytes.Buffer
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(fmt.Sprintf("want %s side-band-64k ofs-delta agent=git/2.14.1\n", head)))
+		pw.Flush()
+		pw.WritePktLine([]byte("done"))
+	}
+	err = handlePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	// The NAK needs to be sent before any of the side-band messages.
+	pr := NewPktLineReader(&outBuf)
+	if line, err := pr.ReadPktLine(); err != nil || string(line) != "NAK\n" {
+		t.Fatalf("Expected NAK, got %q, %v", line, err)
+	}
+	var progress string
+	for {
+		line, err := pr.ReadPktLine()
+		if err == ErrFlush {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read the side-band stream: %v", err)
+		}
+		if line[0] == sideBandProgress {
+			progress += string(line[1:])
+		}
+	}
+	if !strings.Contains(progress, "\r") {
+		t.Errorf("Expected intermediate progress messages, got %q", progress)
+	}
+}
+
+// A slowWriter is an io.Writer that takes some time to complete each write.
+type slowWriter struct {
+	w     io.Writer
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.w.Write(p)
+}
+
+func TestHandlePullKeepalive(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a side-band-64k ofs-delta agent=git/2.14.1\n"))
+		pw.Flush()
+		pw.WritePktLine([]byte("done"))
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			KeepaliveInterval: 5 * time.Millisecond,
+			Log:               log,
+		}),
+		log,
+		&inBuf,
+		&slowWriter{w: &outBuf, delay: 20 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	pr := NewPktLineReader(&outBuf)
+	if line, err := pr.ReadPktLine(); err != nil || string(line) != "NAK\n" {
+		t.Fatalf("Expected NAK, got %q, %v", line, err)
+	}
+	var pack bytes.Buffer
+	keepalives := 0
+	for {
+		line, err := pr.ReadPktLine()
+		if err == ErrFlush {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read the side-band stream: %v", err)
+		}
+		switch line[0] {
+		case sideBandData:
+			pack.Write(line[1:])
+		case sideBandProgress:
+			if len(line) == 1 {
+				keepalives++
+			}
+		default:
+			t.Fatalf("Unexpected band %d: %q", line[0], line[1:])
+		}
+	}
+	if keepalives == 0 {
+		t.Errorf("Expected keepalives to be sent while writing the packfile")
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	idx, _, err := UnpackPackfile(odb, &pack, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+	if len(idx.Entries) != 5 {
+		t.Errorf("Expected 5 objects, got %d", len(idx.Entries))
+	}
+}
+
+func TestHandlePullMalformedPktLine(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	err := handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		bytes.NewBufferString("zzzzwant 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n"),
+		&bytes.Buffer{},
+	)
+	if !base.HasErrorCategory(err, ErrBadRequest) {
+		t.Fatalf("Expected ErrBadRequest, got %v", err)
+	}
+	if !errors.Is(base.UnwrapCauseFromErrorCategory(err, ErrBadRequest), ErrMalformedPktLine) {
+		t.Errorf("Expected ErrMalformedPktLine, got %v", err)
+	}
+}
+
+func TestHandlePullMaxWants(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	for limit, expectedErr := range map[int]bool{2: true, 3: false} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a ofs-delta agent=git/2.14.1\n"))
+			pw.WritePktLine([]byte("want 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n"))
+			pw.WritePktLine([]byte("want d0c442210b72c207637a63e4eda991bc27abc0bd\n"))
+			pw.Flush()
+			pw.WritePktLine([]byte("done"))
+		}
+
+		err := handlePull(
+			context.Background(),
+			m,
+			"testdata/repo.git",
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				MaxWants: limit,
+				Log:      log,
+			}),
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if !expectedErr {
+			if err != nil {
+				t.Errorf("With limit %d, failed to clone: %v", limit, err)
+			}
+			continue
+		}
+		if !base.HasErrorCategory(err, ErrBadRequest) {
+			t.Errorf("With limit %d, expected ErrBadRequest, got %v", limit, err)
+		}
+		if outBuf.Len() != 0 {
+			t.Errorf("With limit %d, expected nothing to be written, got %q", limit, outBuf.Bytes())
+		}
+	}
+}
+
+func TestHandlePullMaxShallows(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	for limit, expectedErr := range map[int]bool{2: true, 3: false} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a ofs-delta shallow agent=git/2.14.1\n"))
+			pw.WritePktLine([]byte("shallow 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n"))
+			pw.WritePktLine([]byte("shallow d0c442210b72c207637a63e4eda991bc27abc0bd\n"))
+			// Repeated ids are only counted once.
+			pw.WritePktLine([]byte("shallow d0c442210b72c207637a63e4eda991bc27abc0bd\n"))
+			pw.WritePktLine([]byte("shallow 1111111111111111111111111111111111111111\n"))
+			pw.Flush()
+			pw.WritePktLine([]byte("done"))
+		}
+
+		err := handlePull(
+			context.Background(),
+			m,
+			"testdata/repo.git",
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				MaxShallows: limit,
+				Log:         log,
+			}),
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if !expectedErr {
+			if err != nil {
+				t.Errorf("With limit %d, failed to clone: %v", limit, err)
+			}
+			continue
+		}
+		if !base.HasErrorCategory(err, ErrBadRequest) {
+			t.Errorf("With limit %d, expected ErrBadRequest, got %v", limit, err)
+		}
+		if outBuf.Len() != 0 {
+			t.Errorf("With limit %d, expected nothing to be written, got %q", limit, outBuf.Bytes())
+		}
+	}
+}
+
+func TestHandlePullNegotiationBudget(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
+		pw.Flush()
+		pw.WritePktLine([]byte("have 1111111111111111111111111111111111111111\n"))
+		pw.WritePktLine([]byte("have 2222222222222222222222222222222222222222\n"))
+		// This 'have' is past the budget, so it should not be acknowledged.
+		pw.WritePktLine([]byte("have 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n"))
+		pw.WritePktLine([]byte("done"))
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log:                 log,
+			MaxNegotiationHaves: 2,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"NAK\n", nil},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack packfile: %v", err)
+	}
+	if 5 != len(idx.Entries) {
+		t.Errorf("Expected a full packfile with 5 entries, got %d", len(idx.Entries))
+	}
+}
+
+func TestHandlePullDisabledShallowCapability(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		DisabledCapabilities: []string{"shallow"},
+		Log:                  log,
+	})
+
+	var prePullBuf bytes.Buffer
+	if err := handlePrePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		protocol,
+		log,
+		&prePullBuf,
+	); err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
+	}
+	discovery, err := DiscoverReferences(&prePullBuf)
+	if err != nil {
+		t.Fatalf("Failed to parse the reference discovery: %v", err)
+	}
+	if discovery.Capabilities.Contains("shallow") {
+		t.Errorf("Expected the shallow capability to not be advertised, got %v", discovery.Capabilities)
+	}
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a ofs-delta agent=git/2.14.1\n"))
+		pw.WritePktLine([]byte("deepen 1"))
+		pw.Flush()
+	}
+
+	err = handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		protocol,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if !base.HasErrorCategory(err, ErrBadRequest) {
+		t.Fatalf("Expected ErrBadRequest, got %v", err)
+	}
+}
+
+func TestHandleCloneShallowNegotiation(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
+		pw.WritePktLine([]byte("deepen 1"))
+		pw.Flush()
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandleCloneShallowNegotiationSince(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	for _, testCase := range []struct {
+		name     string
+		deepen   []string
+		expected []PktLineResponse
+	}{
+		{
+			// 88aa345 was committed before the cutoff.
+			name:   "since",
+			deepen: []string{"deepen-since 1512950000"},
+			expected: []PktLineResponse{
+				{"shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+				{"", ErrFlush},
+			},
+		},
+		{
+			// Both commits are newer than the cutoff.
+			name:   "since before history",
+			deepen: []string{"deepen-since 1512900000"},
+			expected: []PktLineResponse{
+				{"", ErrFlush},
+			},
+		},
+		{
+			// The depth cutoff coexists with the time cutoff.
+			name:   "since and depth",
+			deepen: []string{"deepen 1", "deepen-since 1512900000"},
+			expected: []PktLineResponse{
+				{"shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+				{"", ErrFlush},
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var inBuf, outBuf bytes.Buffer
+			{
+				pw := NewPktLineWriter(&inBuf)
+				pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta deepen-since agent=git/2.34.1\n"))
+				for _, line := range testCase.deepen {
+					pw.WritePktLine([]byte(line))
+				}
+				pw.Flush()
+			}
+
+			err := handlePull(
+				context.Background(),
+				m,
+				"testdata/repo.git",
+				AuthorizationAllowed,
+				NewGitProtocol(GitProtocolOpts{
+					Log: log,
+				}),
+				log,
+				&inBuf,
+				&outBuf,
+			)
+			if err != nil {
+				t.Fatalf("Failed to clone: %v", err)
+			}
+
+			if actual, ok := ComparePktLineResponse(
+				&outBuf,
+				testCase.expected,
+			); !ok {
+				t.Errorf("pkt-reader expected %q, got %q", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleCloneShallowNegotiationNot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+
+	ref, err := repository.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to look up the reference: %v", err)
+	}
+	masterID := ref.Target()
+	ref.Free()
+
+	for _, testCase := range []struct {
+		name               string
+		deepen             string
+		referenceDiscovery ReferenceDiscoveryCallback
+		expected           []PktLineResponse
+		err                error
+	}{
+		{
+			// The parent of master is reachable from topic.
+			name:   "excluded branch",
+			deepen: "deepen-not topic",
+			expected: []PktLineResponse{
+				{fmt.Sprintf("shallow %s\n", masterID), nil},
+				{"", ErrFlush},
+			},
+		},
+		{
+			name:   "unknown ref",
+			deepen: "deepen-not refs/heads/unknown",
+			err:    ErrBadRequest,
+		},
+		{
+			// References that are not advertised cannot be excluded either.
+			name:   "undiscoverable ref",
+			deepen: "deepen-not topic",
+			referenceDiscovery: func(
+				ctx context.Context,
+				repository *git.Repository,
+				referenceName string,
+			) bool {
+				return referenceName != "refs/heads/topic"
+			},
+			err: ErrBadRequest,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var inBuf, outBuf bytes.Buffer
+			{
+				pw := NewPktLineWriter(&inBuf)
+				pw.WritePktLine([]byte(fmt.Sprintf("want %s thin-pack ofs-delta deepen-not agent=git/2.34.1\n", masterID)))
+				pw.WritePktLine([]byte(testCase.deepen))
+				pw.Flush()
+			}
+
+			err := handlePull(
+				context.Background(),
+				m,
+				dir,
+				AuthorizationAllowed,
+				NewGitProtocol(GitProtocolOpts{
+					ReferenceDiscoveryCallback: testCase.referenceDiscovery,
+					Log:                        log,
+				}),
+				log,
+				&inBuf,
+				&outBuf,
+			)
+			if testCase.err != nil {
+				if !base.HasErrorCategory(err, testCase.err) {
+					t.Fatalf("Expected %v, got %v", testCase.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to clone: %v", err)
+			}
+
+			if actual, ok := ComparePktLineResponse(
+				&outBuf,
+				testCase.expected,
+			); !ok {
+				t.Errorf("pkt-reader expected %q, got %q", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleCloneShallowNegotiationDeepHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	repository, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	const historyLength = 500
+	commitIDs := make([]*git.Oid, 0, historyLength)
+	for i := 0; i < historyLength; i++ {
+		var parents []*git.Oid
+		if i > 0 {
+			parents = append(parents, commitIDs[i-1])
+		}
+		commitIDs = append(commitIDs, createTestCommit(
+			t, repository, log, "refs/heads/master",
+			map[string]string{"a": fmt.Sprintf("%d\n", i)},
+			fmt.Sprintf("Commit %d\n", i),
+			parents...,
+		))
+	}
+	head := commitIDs[historyLength-1]
+
+	headCommit, err := repository.LookupCommit(head)
+	if err != nil {
+		t.Fatalf("Failed to look up the head commit: %v", err)
+	}
+	defer headCommit.Free()
+	for _, testCase := range []struct {
+		maxDepth, stopAt, expectedVisited uint64
+	}{
+		{math.MaxUint64, 0, historyLength},
+		{historyLength - 100, 0, historyLength - 100},
+		{math.MaxUint64, 10, 10},
+	} {
+		visited := uint64(0)
+		if err := walkFirstParents(headCommit, testCase.maxDepth, func(current *git.Commit, depth uint64) (bool, error) {
+			if expected := commitIDs[historyLength-1-int(visited)]; !expected.Equal(current.Id()) {
+				t.Errorf("%v: Expected commit %d to be %s, got %s", testCase, visited, expected, current.Id())
+			}
+			visited++
+			return visited != testCase.stopAt, nil
+		}); err != nil {
+			t.Fatalf("%v: Failed to walk the history: %v", testCase, err)
+		}
+		if testCase.expectedVisited != visited {
+			t.Errorf("%v: Expected %d commits to be visited, got %d", testCase, testCase.expectedVisited, visited)
+		}
+	}
+
+	var inBuf, outBuf bytes.Buffer
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(fmt.Sprintf("want %s thin-pack ofs-delta agent=git/2.14.1\n", head)))
+		pw.WritePktLine([]byte(fmt.Sprintf("deepen %d", historyLength-1)))
+		pw.Flush()
+	}
+	err = handlePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{fmt.Sprintf("shallow %s\n", commitIDs[1]), nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandleCloneManyWants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	repositoryPath := filepath.Join(dir, "repo.git")
+	repository, err := git.InitRepository(repositoryPath, true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	// Each branch has its own history, and every commit has its own tree and
+	// blob, so all of them need to be walked.
+	const branchCount = 50
+	const historyLength = 20
+	var inBuf, outBuf bytes.Buffer
+	pw := NewPktLineWriter(&inBuf)
+	for branch := 0; branch < branchCount; branch++ {
+		var parents []*git.Oid
+		for i := 0; i < historyLength; i++ {
+			commitID := createTestCommit(
+				t, repository, log, fmt.Sprintf("refs/heads/branch-%d", branch),
+				map[string]string{"a": fmt.Sprintf("%d-%d\n", branch, i)},
+				fmt.Sprintf("Commit %d-%d\n", branch, i),
+				parents...,
+			)
+			parents = []*git.Oid{commitID}
+		}
+		if branch == 0 {
+			pw.WritePktLine([]byte(fmt.Sprintf("want %s ofs-delta agent=git/2.14.1\n", parents[0])))
+		} else {
+			pw.WritePktLine([]byte(fmt.Sprintf("want %s\n", parents[0])))
+		}
+	}
+	pw.Flush()
+	pw.WritePktLine([]byte("done"))
+
+	err = handlePull(
+		context.Background(),
+		m,
+		repositoryPath,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	pr := NewPktLineReader(&outBuf)
+	if line, err := pr.ReadPktLine(); err != nil || string(line) != "NAK\n" {
+		t.Fatalf("Expected NAK, got %q, %v", line, err)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+	if expected := branchCount * historyLength * 3; len(idx.Entries) != expected {
+		t.Errorf("Expected %d objects, got %d", expected, len(idx.Entries))
+	}
+}
+
+func TestHandleCloneShallowClone(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
+		pw.WritePktLine([]byte("deepen 1"))
+		pw.Flush()
+		pw.WritePktLine([]byte("done"))
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+		{"", ErrFlush},
+		{"NAK\n", nil},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack packfile: %v", err)
+	}
+
+	entries := []struct {
+		hash       string
+		size       uint64
+		objectType git.ObjectType
+	}{
+		{"06f8815b4dc1ba5cabf619d8a8ef392d0f88a2f1", 71, git.ObjectTree},
+		{"6d2439d2e920ba92d8e485e75d1b740ae51b609a", 217, git.ObjectCommit},
+		{"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", 0, git.ObjectBlob},
+	}
+	for i, entry := range entries {
+		if entry.hash != idx.Entries[i].Oid.String() {
+			t.Errorf("Entry %d hash mismatch: expected %v, got %v", i, entry.hash, idx.Entries[i].Oid)
+		}
+		if entry.size != idx.Entries[i].Size {
+			t.Errorf("Entry %d size mismatch: expected %v, got %v", i, entry.size, idx.Entries[i].Size)
+		}
+		if entry.objectType != idx.Entries[i].Type {
+			t.Errorf("Entry %d type mismatch: expected %v, got %v", i, entry.objectType, idx.Entries[i].Type)
+		}
+	}
+}
+
+func TestHandleCloneShallowUnshallow(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a thin-pack ofs-delta agent=git/2.14.1\n"))
+		pw.WritePktLine([]byte("shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n"))
+		pw.WritePktLine([]byte("deepen 2147483647"))
+		pw.Flush()
+		pw.WritePktLine([]byte("have 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n"))
+		pw.WritePktLine([]byte("done"))
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePull(
+		context.Background(),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unshallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+		{"", ErrFlush},
+		{"ACK 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack packfile: %v", err)
+	}
+
+	entries := []struct {
+		hash       string
+		size       uint64
+		objectType git.ObjectType
+	}{
+		{"417c01c8795a35b8e835113a85a5c0c1c77f67fb", 33, git.ObjectTree},
+		{"88aa3454adb27c3c343ab57564d962a0a7f6a3c1", 170, git.ObjectCommit},
+		{"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", 0, git.ObjectBlob},
+	}
+	for i, entry := range entries {
+		if entry.hash != idx.Entries[i].Oid.String() {
+			t.Errorf("Entry %d hash mismatch: expected %v, got %v", i, entry.hash, idx.Entries[i].Oid)
+		}
+		if entry.size != idx.Entries[i].Size {
+			t.Errorf("Entry %d size mismatch: expected %v, got %v", i, entry.size, idx.Entries[i].Size)
+		}
+		if entry.objectType != idx.Entries[i].Type {
+			t.Errorf("Entry %d type mismatch: expected %v, got %v", i, entry.objectType, idx.Entries[i].Type)
+		}
+	}
+}
+
+func TestHandlePushUnborn(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+	}
+
+	f, err := os.Open(packFilename)
+	if err != nil {
+		t.Fatalf("Failed to open the packfile: %v", err)
+	}
+	defer f.Close()
+	if _, err = io.Copy(&inBuf, f); err != nil {
+		t.Fatalf("Failed to copy the packfile: %v", err)
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	var buf bytes.Buffer
+	err = handlePrePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&buf,
+	)
+	if err != nil {
+		t.Errorf("Failed to get pre-pull: %v", err)
+	}
+	discovery, err := DiscoverReferences(&buf)
+	if err != nil {
+		t.Errorf("Failed to parse the reference discovery: %v", err)
+	}
+	expectedSymref := "refs/heads/master"
+	if expectedSymref != discovery.HeadSymref {
+		t.Errorf("Expected %v, got %v", expectedSymref, discovery.HeadSymref)
+	}
+	expectedReferences := map[string]git.Oid{
+		"HEAD":              gitOid("88aa3454adb27c3c343ab57564d962a0a7f6a3c1"),
+		"refs/heads/master": gitOid("88aa3454adb27c3c343ab57564d962a0a7f6a3c1"),
+	}
+	if !reflect.DeepEqual(expectedReferences, discovery.References) {
+		t.Errorf("Expected %v, got %v", expectedReferences, discovery.References)
+	}
+}
+
+func TestHandlePushEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	log, _ := log15.New("info", false)
+	for _, reject := range []bool{false, true} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			pw := NewPktLineWriter(&inBuf)
+			pw.Flush()
+		}
+
+		err = handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				RejectEmptyPushes: reject,
+				Log:               log,
+			}),
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if reject {
+			if !base.HasErrorCategory(err, ErrBadRequest) {
+				t.Errorf("Expected ErrBadRequest, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed to push: %v", err)
+		}
+
+		// report-status could not have been negotiated without any commands.
+		if outBuf.Len() != 0 {
+			t.Errorf("Expected no response, got %q", outBuf.String())
+		}
+	}
+}
+
+func TestHandlePushReportsUnpackStatusEarly(t *testing.T) {
+	var inBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+	}
+
+	f, err := os.Open(packFilename)
+	if err != nil {
+		t.Fatalf("Failed to open the packfile: %v", err)
+	}
+	defer f.Close()
+	if _, err = io.Copy(&inBuf, f); err != nil {
+		t.Fatalf("Failed to copy the packfile: %v", err)
+	}
+
+	updateStarted := make(chan struct{})
+	releaseUpdate := make(chan struct{})
+	pr, pw := io.Pipe()
+	pushErr := make(chan error, 1)
+	log, _ := log15.New("info", false)
+	go func() {
+		err := handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				UpdateCallback: func(
+					ctx context.Context,
+					repository *git.Repository,
+					level AuthorizationLevel,
+					command *GitCommand,
+					oldCommit, newCommit *git.Commit,
+				) error {
+					close(updateStarted)
+					<-releaseUpdate
+					return nil
+				},
+				Log: log,
+			}),
+			nil,
+			log,
+			&inBuf,
+			pw,
+		)
+		pw.CloseWithError(err)
+		pushErr <- err
+	}()
+
+	reader := NewPktLineReader(pr)
+	line, err := reader.ReadPktLine()
+	if err != nil {
+		t.Fatalf("Failed to read the unpack status: %v", err)
+	}
+	if "unpack ok\n" != string(line) {
+		t.Fatalf("Expected %q, got %q", "unpack ok\n", string(line))
+	}
+	select {
+	case <-updateStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the update callback")
+	}
+	close(releaseUpdate)
+
+	expected := []PktLineResponse{
+		{"ok refs/heads/master\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		pr,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+	if err := <-pushErr; err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+}
+
+func TestHandlePushNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	namespaceCtx := WithNamespace(context.Background(), "tenant")
+
+	push := func(ctx context.Context, referenceName string) {
+		var inBuf, outBuf bytes.Buffer
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(fmt.Sprintf(
+			"0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 %s\x00report-status\n",
+			referenceName,
+		)))
+		pw.Flush()
+
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+
+		if err := handlePush(
+			ctx,
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		); err != nil {
+			t.Fatalf("Failed to push: %v", err)
+		}
+
+		expected := []PktLineResponse{
+			{"unpack ok\n", nil},
+			{fmt.Sprintf("ok %s\n", referenceName), nil},
+			{"", ErrFlush},
+		}
+		if actual, ok := ComparePktLineResponse(
+			&outBuf,
+			expected,
+		); !ok {
+			t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+		}
+	}
+	discover := func(ctx context.Context) map[string]git.Oid {
+		var buf bytes.Buffer
+		if err := handlePrePull(
+			ctx,
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			log,
+			&buf,
+		); err != nil {
+			t.Fatalf("Failed to get pre-pull: %v", err)
+		}
+		discovery, err := DiscoverReferences(&buf)
+		if err != nil {
+			t.Fatalf("Failed to parse the reference discovery: %v", err)
+		}
+		return discovery.References
+	}
+
+	push(context.Background(), "refs/heads/other")
+	push(namespaceCtx, "refs/heads/master")
+
+	expectedReferences := map[string]git.Oid{
+		"refs/heads/master": gitOid("88aa3454adb27c3c343ab57564d962a0a7f6a3c1"),
+	}
+	if references := discover(namespaceCtx); !reflect.DeepEqual(expectedReferences, references) {
+		t.Errorf("Expected %v, got %v", expectedReferences, references)
+	}
+	if _, ok := discover(context.Background())["refs/heads/master"]; ok {
+		t.Errorf("Expected refs/heads/master to not exist in the default namespace")
+	}
+
+	repo, err := git.OpenRepository(dir)
+	if err != nil {
+		t.Fatalf("Failed to open git repository: %v", err)
+	}
+	defer repo.Free()
+
+	ref, err := repo.References.Lookup("refs/namespaces/tenant/refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to look up the namespaced reference: %v", err)
+	}
+	defer ref.Free()
+	if "88aa3454adb27c3c343ab57564d962a0a7f6a3c1" != ref.Target().String() {
+		t.Errorf("Expected %v, got %v", "88aa3454adb27c3c343ab57564d962a0a7f6a3c1", ref.Target())
+	}
+	if _, err := repo.References.Lookup("refs/namespaces/tenant/refs/heads/other"); err == nil {
+		t.Errorf("Expected refs/heads/other to not exist in the namespace")
+	}
+
+	// Revisions are only resolved with the references of the namespace.
+	if rev, err := namespacedRevision(repo, "tenant", "master~0"); err != nil {
+		t.Errorf("Failed to resolve master in the namespace: %v", err)
+	} else if rev != "refs/namespaces/tenant/refs/heads/master~0" {
+		t.Errorf("Expected %v, got %v", "refs/namespaces/tenant/refs/heads/master~0", rev)
+	}
+	if _, err := namespacedRevision(repo, "tenant", "other"); !base.HasErrorCategory(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a reference outside of the namespace, got %v", err)
+	}
+}
+
+func TestHandlePushSymbolicRef(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		if err := repo.SetHead("refs/heads/master"); err != nil {
+			t.Fatalf("Failed to point HEAD to refs/heads/master: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 HEAD\x00report-status\n"))
+		pw.Flush()
+	}
+
+	f, err := os.Open(packFilename)
+	if err != nil {
+		t.Fatalf("Failed to open the packfile: %v", err)
+	}
+	defer f.Close()
+	if _, err = io.Copy(&inBuf, f); err != nil {
+		t.Fatalf("Failed to copy the packfile: %v", err)
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ok HEAD\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	repo, err := git.OpenRepository(dir)
+	if err != nil {
+		t.Fatalf("Failed to open git repository: %v", err)
+	}
+	defer repo.Free()
+
+	ref, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to look up refs/heads/master: %v", err)
+	}
+	defer ref.Free()
+	if "88aa3454adb27c3c343ab57564d962a0a7f6a3c1" != ref.Target().String() {
+		t.Errorf("Expected %v, got %v", "88aa3454adb27c3c343ab57564d962a0a7f6a3c1", ref.Target())
+	}
+
+	head, err := repo.References.Lookup("HEAD")
+	if err != nil {
+		t.Fatalf("Failed to look up HEAD: %v", err)
+	}
+	defer head.Free()
+	if git.ReferenceSymbolic != head.Type() || "refs/heads/master" != head.SymbolicTarget() {
+		t.Errorf("Expected HEAD to still point to refs/heads/master, got %v", head.SymbolicTarget())
+	}
+}
+
+// splicePreprocessCallback returns a PreprocessCallback that splices the
+// single pushed commit of testdata/sumas.pack into refs/heads/private and
+// refs/heads/public.
+func splicePreprocessCallback(t *testing.T, log logging.Logger) PreprocessCallback {
+	return func(
+		ctx context.Context,
+		originalRepository *git.Repository,
+		tmpDir string,
+		originalPackPath string,
+		originalCommands []*GitCommand,
+	) (string, []*GitCommand, error) {
+		if len(originalCommands) != 1 {
+			t.Fatalf("More than one command unsupported")
+		}
+
+		originalCommit, err := originalRepository.LookupCommit(originalCommands[0].New)
+		if err != nil {
+			log.Error(
+				"Error looking up commit",
+				map[string]any{
+					"err": err,
+				},
+			)
+			return originalPackPath, originalCommands, err
+		}
+		defer originalCommit.Free()
+
+		newPackPath := path.Join(tmpDir, "new.pack")
+		newCommands, err := SpliceCommit(
+			originalRepository,
+			originalCommit,
+			nil,
+			map[string]io.Reader{},
+			[]SplitCommitDescription{
+				{
+					PathRegexps: []*regexp.Regexp{
+						regexp.MustCompile("^cases$"),
+					},
+					ReferenceName: "refs/heads/private",
+				},
+				{
+					PathRegexps: []*regexp.Regexp{
+						regexp.MustCompile("^statements$"),
+					},
+					ReferenceName: "refs/heads/public",
+				},
+			},
+			&git.Signature{
+				Name:  "author",
+				Email: "author@test.test",
+				When:  time.Unix(0, 0).In(time.UTC),
+			},
+			&git.Signature{
+				Name:  "committer",
+				Email: "committer@test.test",
+				When:  time.Unix(0, 0).In(time.UTC),
+			},
+			"refs/heads/master",
+			nil,
+			"Reviewed-In: http://localhost/review/1/",
+			newPackPath,
+			log,
+		)
+		if err != nil {
+			log.Error(
+				"Error splicing commit",
+				map[string]any{
+					"err": err,
+				},
+			)
+			return originalPackPath, originalCommands, err
+		}
+
+		log.Debug(
+			"Commands changed",
+			map[string]any{
+				"old commands": originalCommands,
+				"newCommands":  newCommands,
+			},
+		)
+
+		return newPackPath, newCommands, nil
+	}
+}
+
+func TestHandlePushPreprocess(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(dir)
+	}
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 f460ceba1a6ac94a074efe17011866b93fd51d39 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+
+		f, err := os.Open("testdata/sumas.pack")
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			PreprocessCallback: splicePreprocessCallback(t, log),
+			Log:                log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	var buf bytes.Buffer
+	err = handlePrePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&buf,
+	)
+	if err != nil {
+		t.Errorf("Failed to get pre-pull: %v", err)
+	}
+	discovery, err := DiscoverReferences(&buf)
+	if err != nil {
+		t.Errorf("Failed to parse the reference discovery: %v", err)
+	}
+	expectedSymref := "refs/heads/master"
+	if expectedSymref != discovery.HeadSymref {
+		t.Errorf("Expected %v, got %v", expectedSymref, discovery.HeadSymref)
+	}
+	expectedReferences := map[string]git.Oid{
+		"HEAD":               gitOid("8f3e429bd47a1a3e2f41739dfd58b946f367a071"),
+		"refs/heads/master":  gitOid("8f3e429bd47a1a3e2f41739dfd58b946f367a071"),
+		"refs/heads/public":  gitOid("e9b04df7b2fe682b35ae7e33841e480fcaa7ffec"),
+		"refs/heads/private": gitOid("5a6e286aa91c51b1624d58651c5b6914d041c759"),
+	}
+	if !reflect.DeepEqual(expectedReferences, discovery.References) {
+		t.Errorf("Expected %v, got %v", expectedReferences, discovery.References)
+	}
+}
+
+func TestHandlePushPreprocessReportStatusV2(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 f460ceba1a6ac94a074efe17011866b93fd51d39 refs/heads/master\x00report-status-v2\n"))
+		pw.Flush()
+
+		f, err := os.Open("testdata/sumas.pack")
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			PreprocessCallback: splicePreprocessCallback(t, log),
+			Log:                log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	// The pushed commit was rewritten, and the split commits were pushed to
+	// two other references.
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"option new-oid 8f3e429bd47a1a3e2f41739dfd58b946f367a071\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"option refname refs/heads/private\n", nil},
+		{"option old-oid 0000000000000000000000000000000000000000\n", nil},
+		{"option new-oid 5a6e286aa91c51b1624d58651c5b6914d041c759\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"option refname refs/heads/public\n", nil},
+		{"option old-oid 0000000000000000000000000000000000000000\n", nil},
+		{"option new-oid e9b04df7b2fe682b35ae7e33841e480fcaa7ffec\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandlePushPreprocessInvalidPackfile(t *testing.T) {
+	log, _ := log15.New("info", false)
+	for _, testCase := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"missing", nil},
+		{"bad header", []byte("this is not a packfile, just some text\n")},
+		{"bad checksum", append(append([]byte{}, EmptyPackfile[:len(EmptyPackfile)-1]...), 0)},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var inBuf, outBuf bytes.Buffer
+			dir, err := ioutil.TempDir("", "protocol_test")
+			if err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			m := NewLockfileManager()
+			defer m.Clear()
+
+			{
+				repo, err := git.InitRepository(dir, true)
+				if err != nil {
+					t.Fatalf("Failed to initialize git repository: %v", err)
+				}
+				repo.Free()
+			}
+
+			{
+				pw := NewPktLineWriter(&inBuf)
+				pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\n"))
+				pw.Flush()
+
+				f, err := os.Open(packFilename)
+				if err != nil {
+					t.Fatalf("Failed to open the packfile: %v", err)
+				}
+				defer f.Close()
+				if _, err = io.Copy(&inBuf, f); err != nil {
+					t.Fatalf("Failed to copy the packfile: %v", err)
+				}
+			}
+
+			err = handlePush(
+				context.Background(),
+				m,
+				dir,
+				AuthorizationAllowed,
+				NewGitProtocol(GitProtocolOpts{
+					PreprocessCallback: func(
+						ctx context.Context,
+						originalRepository *git.Repository,
+						tmpDir string,
+						originalPackPath string,
+						originalCommands []*GitCommand,
+					) (string, []*GitCommand, error) {
+						newPackPath := path.Join(tmpDir, "new.pack")
+						if testCase.contents != nil {
+							if err := ioutil.WriteFile(newPackPath, testCase.contents, 0644); err != nil {
+								return originalPackPath, originalCommands, err
+							}
+						}
+						return newPackPath, originalCommands, nil
+					},
+					Log: log,
+				}),
+				nil,
+				log,
+				&inBuf,
+				&outBuf,
+			)
+			if !base.HasErrorCategory(err, ErrBadRequest) {
+				t.Fatalf("Expected ErrBadRequest, got %v", err)
+			}
+
+			repo, err := git.OpenRepository(dir)
+			if err != nil {
+				t.Fatalf("Failed to open the repository: %v", err)
+			}
+			defer repo.Free()
+			if _, err := repo.References.Lookup("refs/heads/master"); err == nil {
+				t.Errorf("Expected refs/heads/master to not be created")
+			}
+		})
+	}
+}
+
+func TestHandlePushCallback(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			UpdateCallback: func(
+				ctx context.Context,
+				repository *git.Repository,
+				level AuthorizationLevel,
+				command *GitCommand,
+				oldCommit, newCommit *git.Commit,
+			) error {
+				return errors.New("go away")
+			},
+			Log: log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ng refs/heads/master go away\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandlePushOptions(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status push-options\n"))
+		pw.Flush()
+		pw.WritePktLine([]byte("reviewer=foo\n"))
+		pw.WritePktLine([]byte("ci.skip=true\n"))
+		pw.Flush()
+
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	expectedOptions := []string{"reviewer=foo", "ci.skip=true"}
+	var updateOptions, preprocessOptions []string
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			UpdateCallback: func(
+				ctx context.Context,
+				repository *git.Repository,
+				level AuthorizationLevel,
+				command *GitCommand,
+				oldCommit, newCommit *git.Commit,
+			) error {
+				updateOptions = PushOptionsFromContext(ctx)
+				return nil
+			},
+			PreprocessCallback: func(
+				ctx context.Context,
+				repository *git.Repository,
+				tmpDir string,
+				packPath string,
+				commands []*GitCommand,
+			) (string, []*GitCommand, error) {
+				preprocessOptions = PushOptionsFromContext(ctx)
+				return packPath, commands, nil
+			},
+			Log: log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+	if !reflect.DeepEqual(expectedOptions, updateOptions) {
+		t.Errorf("Expected the update callback to get %q, got %q", expectedOptions, updateOptions)
+	}
+	if !reflect.DeepEqual(expectedOptions, preprocessOptions) {
+		t.Errorf("Expected the preprocess callback to get %q, got %q", expectedOptions, preprocessOptions)
+	}
+}
+
+func TestHandlePushReflogMessageCallback(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		config, err := repo.Config()
+		if err != nil {
+			t.Fatalf("Failed to open the repository config: %v", err)
+		}
+		if err := config.SetBool("core.logAllRefUpdates", true); err != nil {
+			t.Fatalf("Failed to enable reflogs: %v", err)
+		}
+		config.Free()
+		repo.Free()
+	}
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		WithUsername(context.Background(), "alice"),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			ReflogMessageCallback: func(
+				ctx context.Context,
+				command *GitCommand,
+				username string,
+			) string {
+				return fmt.Sprintf("push by %s: %s", username, command.LogMessage())
+			},
+			Log: log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	repo, err := git.OpenRepository(dir)
+	if err != nil {
+		t.Fatalf("Failed to open the repository: %v", err)
+	}
+	defer repo.Free()
+	reflog, err := repo.ReflogRead("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to read the reflog: %v", err)
+	}
+	defer reflog.Free()
+	if reflog.EntryCount() != 1 {
+		t.Fatalf("Expected one reflog entry, got %d", reflog.EntryCount())
+	}
+	if expected, actual := "push by alice: Empty", reflog.EntryByIndex(0).Message; expected != actual {
+		t.Errorf("Expected reflog message %q, got %q", expected, actual)
+	}
+}
+
+func TestHandlePushExpectedOldOid(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	log, _ := log15.New("info", false)
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			UpdateCallback: func(
+				ctx context.Context,
+				repository *git.Repository,
+				level AuthorizationLevel,
+				command *GitCommand,
+				oldCommit, newCommit *git.Commit,
+			) error {
+				// Simulate another push that creates the reference after the
+				// negotiation, but before the write lock is acquired.
+				ref, err := repository.References.Create(
+					command.ReferenceName,
+					newCommit.Id(),
+					true,
+					"concurrent push",
+				)
+				if err != nil {
+					return err
+				}
+				ref.Free()
+				return nil
+			},
+			Log: log,
+		}),
+		map[string]*git.Oid{
+			"refs/heads/master": {},
+		},
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ng refs/heads/master precondition-failed\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandlePushPostUpdateCallback(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	log, _ := log15.New("info", false)
+	var modifiedFiles []string
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			PostUpdateCallback: func(
+				ctx context.Context,
+				repository *git.Repository,
+				callbackModifiedFiles []string,
+			) error {
+				modifiedFiles = callbackModifiedFiles
+				return nil
+			},
+			Log: log,
+		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+	equal := false
+	expectedModifiedFiles := []string{
+		"objects/pack/multi-pack-index",
+		"objects/pack/pack-3915156951f90b8239a1d1933cbe85ae1bc7457f.idx",
+		"objects/pack/pack-3915156951f90b8239a1d1933cbe85ae1bc7457f.pack",
+		"refs/heads/master",
+	}
+	if len(expectedModifiedFiles) == len(modifiedFiles) {
+		equal = true
+		for i := range expectedModifiedFiles {
+			if expectedModifiedFiles[i] != modifiedFiles[i] {
+				equal = false
+				break
+			}
+		}
+	}
+	if !equal {
+		t.Errorf("modified files expected %q, got %q", expectedModifiedFiles, modifiedFiles)
+	}
+}
+
+func TestHandlePushAsyncPostUpdateCallback(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
 
 	{
 		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 f460ceba1a6ac94a074efe17011866b93fd51d39 refs/heads/master\x00report-status\n"))
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
 		pw.Flush()
 
-		f, err := os.Open("testdata/sumas.pack")
+		f, err := os.Open(packFilename)
 		if err != nil {
 			t.Fatalf("Failed to open the packfile: %v", err)
 		}
@@ -771,93 +3679,30 @@ func TestHandlePushPreprocess(t *testing.T) {
 	}
 
 	log, _ := log15.New("info", false)
+	callbackStarted := make(chan struct{})
+	releaseCallback := make(chan struct{})
+	var modifiedFiles []string
+	protocol := NewGitProtocol(GitProtocolOpts{
+		PostUpdateCallback: func(
+			ctx context.Context,
+			repository *git.Repository,
+			callbackModifiedFiles []string,
+		) error {
+			close(callbackStarted)
+			<-releaseCallback
+			modifiedFiles = callbackModifiedFiles
+			return nil
+		},
+		AsyncPostUpdateQueueSize: 1,
+		Log:                      log,
+	})
 	err = handlePush(
 		context.Background(),
 		m,
 		dir,
 		AuthorizationAllowed,
-		NewGitProtocol(GitProtocolOpts{
-			PreprocessCallback: func(
-				ctx context.Context,
-				originalRepository *git.Repository,
-				tmpDir string,
-				originalPackPath string,
-				originalCommands []*GitCommand,
-			) (string, []*GitCommand, error) {
-				if len(originalCommands) != 1 {
-					t.Fatalf("More than one command unsupported")
-				}
-
-				originalCommit, err := originalRepository.LookupCommit(originalCommands[0].New)
-				if err != nil {
-					log.Error(
-						"Error looking up commit",
-						map[string]any{
-							"err": err,
-						},
-					)
-					return originalPackPath, originalCommands, err
-				}
-				defer originalCommit.Free()
-
-				newPackPath := path.Join(tmpDir, "new.pack")
-				newCommands, err := SpliceCommit(
-					originalRepository,
-					originalCommit,
-					nil,
-					map[string]io.Reader{},
-					[]SplitCommitDescription{
-						{
-							PathRegexps: []*regexp.Regexp{
-								regexp.MustCompile("^cases$"),
-							},
-							ReferenceName: "refs/heads/private",
-						},
-						{
-							PathRegexps: []*regexp.Regexp{
-								regexp.MustCompile("^statements$"),
-							},
-							ReferenceName: "refs/heads/public",
-						},
-					},
-					&git.Signature{
-						Name:  "author",
-						Email: "author@test.test",
-						When:  time.Unix(0, 0).In(time.UTC),
-					},
-					&git.Signature{
-						Name:  "committer",
-						Email: "committer@test.test",
-						When:  time.Unix(0, 0).In(time.UTC),
-					},
-					"refs/heads/master",
-					nil,
-					"Reviewed-In: http://localhost/review/1/",
-					newPackPath,
-					log,
-				)
-				if err != nil {
-					log.Error(
-						"Error splicing commit",
-						map[string]any{
-							"err": err,
-						},
-					)
-					return originalPackPath, originalCommands, err
-				}
-
-				log.Debug(
-					"Commands changed",
-					map[string]any{
-						"old commands": originalCommands,
-						"newCommands":  newCommands,
-					},
-				)
-
-				return newPackPath, newCommands, nil
-			},
-			Log: log,
-		}),
+		protocol,
+		nil,
 		log,
 		&inBuf,
 		&outBuf,
@@ -866,53 +3711,195 @@ func TestHandlePushPreprocess(t *testing.T) {
 		t.Fatalf("Failed to push: %v", err)
 	}
 
-	expected := []PktLineResponse{
-		{"unpack ok\n", nil},
-		{"ok refs/heads/master\n", nil},
-		{"", ErrFlush},
+	// The push has finished while the callback is still running, so the lock
+	// must be available.
+	<-callbackStarted
+	lockfile := m.NewLockfile(dir)
+	if ok, err := lockfile.TryLock(); !ok {
+		t.Errorf("Expected the lock to be released, got %v", err)
+	} else {
+		lockfile.Unlock()
 	}
-	if actual, ok := ComparePktLineResponse(
-		&outBuf,
-		expected,
-	); !ok {
-		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+
+	close(releaseCallback)
+	protocol.Close()
+
+	expectedModifiedFiles := []string{
+		"objects/pack/multi-pack-index",
+		"objects/pack/pack-3915156951f90b8239a1d1933cbe85ae1bc7457f.idx",
+		"objects/pack/pack-3915156951f90b8239a1d1933cbe85ae1bc7457f.pack",
+		"refs/heads/master",
+	}
+	if !reflect.DeepEqual(expectedModifiedFiles, modifiedFiles) {
+		t.Errorf("modified files expected %q, got %q", expectedModifiedFiles, modifiedFiles)
 	}
+}
 
-	var buf bytes.Buffer
-	err = handlePrePull(
-		context.Background(),
-		m,
-		dir,
-		AuthorizationAllowed,
-		NewGitProtocol(GitProtocolOpts{
-			Log: log,
-		}),
-		log,
-		&buf,
-	)
+func TestHandlePushAsyncPostUpdateQueueFull(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
-		t.Errorf("Failed to get pre-pull: %v", err)
+		t.Fatalf("Failed to create directory: %v", err)
 	}
-	discovery, err := DiscoverReferences(&buf)
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	{
+		// Taken from git 2.14.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+	}
+
+	log, _ := log15.New("info", false)
+	callbackStarted := make(chan struct{}, 3)
+	releaseCallback := make(chan struct{})
+	protocol := NewGitProtocol(GitProtocolOpts{
+		PostUpdateCallback: func(
+			ctx context.Context,
+			repository *git.Repository,
+			modifiedFiles []string,
+		) error {
+			callbackStarted <- struct{}{}
+			<-releaseCallback
+			return nil
+		},
+		AsyncPostUpdateQueueSize: 1,
+		Log:                      log,
+	})
+
+	// One callback is running and another one is waiting, so the queue is full.
+	if err := protocol.postUpdateQueue.enqueue(context.Background(), dir, nil); err != nil {
+		t.Fatalf("Failed to enqueue the callback: %v", err)
+	}
+	<-callbackStarted
+	if err := protocol.postUpdateQueue.enqueue(context.Background(), dir, nil); err != nil {
+		t.Fatalf("Failed to enqueue the callback: %v", err)
+	}
+
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		)
+	}()
+
+	// The push updates the reference and then waits for space in the queue,
+	// which must not be done while holding the lock, since the callbacks could
+	// need it.
+	repository, err := git.OpenRepository(dir)
 	if err != nil {
-		t.Errorf("Failed to parse the reference discovery: %v", err)
+		t.Fatalf("Failed to open git repository: %v", err)
+	}
+	defer repository.Free()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ref, err := repository.References.Lookup("refs/heads/master"); err == nil {
+			ref.Free()
+			lockfile := m.NewLockfile(dir)
+			if ok, _ := lockfile.TryLock(); ok {
+				lockfile.Unlock()
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the lock to be released while waiting for space in the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	expectedSymref := "refs/heads/master"
-	if expectedSymref != discovery.HeadSymref {
-		t.Errorf("Expected %v, got %v", expectedSymref, discovery.HeadSymref)
+	select {
+	case err := <-pushed:
+		t.Fatalf("Expected the push to wait for space in the queue, got %v", err)
+	default:
 	}
-	expectedReferences := map[string]git.Oid{
-		"HEAD":               gitOid("8f3e429bd47a1a3e2f41739dfd58b946f367a071"),
-		"refs/heads/master":  gitOid("8f3e429bd47a1a3e2f41739dfd58b946f367a071"),
-		"refs/heads/public":  gitOid("e9b04df7b2fe682b35ae7e33841e480fcaa7ffec"),
-		"refs/heads/private": gitOid("5a6e286aa91c51b1624d58651c5b6914d041c759"),
+
+	close(releaseCallback)
+	if err := <-pushed; err != nil {
+		t.Fatalf("Failed to push: %v", err)
 	}
-	if !reflect.DeepEqual(expectedReferences, discovery.References) {
-		t.Errorf("Expected %v, got %v", expectedReferences, discovery.References)
+	protocol.Close()
+}
+
+func TestPostUpdateQueueClose(t *testing.T) {
+	log, _ := log15.New("info", false)
+	releaseCallback := make(chan struct{})
+	var calls int32
+	q := newPostUpdateQueue(
+		func(
+			ctx context.Context,
+			repository *git.Repository,
+			modifiedFiles []string,
+		) error {
+			<-releaseCallback
+			atomic.AddInt32(&calls, 1)
+			return nil
+		},
+		1,
+		0,
+		log,
+	)
+
+	// Some of these fill the queue and block, and closing the queue must not
+	// make them send on a closed channel.
+	results := make(chan error, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			results <- q.enqueue(context.Background(), "testdata/repo.git", nil)
+		}()
+	}
+	closed := make(chan struct{})
+	go func() {
+		q.close()
+		close(closed)
+	}()
+	close(releaseCallback)
+	<-closed
+
+	enqueued := int32(0)
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			enqueued++
+		} else if err != errPostUpdateQueueClosed {
+			t.Errorf("Expected %v, got %v", errPostUpdateQueueClosed, err)
+		}
 	}
+	if enqueued != atomic.LoadInt32(&calls) {
+		t.Errorf("Expected %d callbacks to run, got %d", enqueued, atomic.LoadInt32(&calls))
+	}
+
+	if err := q.enqueue(context.Background(), "testdata/repo.git", nil); err != errPostUpdateQueueClosed {
+		t.Errorf("Expected %v after closing the queue, got %v", errPostUpdateQueueClosed, err)
+	}
+	q.close()
 }
 
-func TestHandlePushCallback(t *testing.T) {
+func TestHandlePushUnknownCommit(t *testing.T) {
 	var inBuf, outBuf bytes.Buffer
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
@@ -933,7 +3920,7 @@ func TestHandlePushCallback(t *testing.T) {
 	{
 		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 0101010101010101010101010101010101010101 refs/heads/master\x00report-status\n"))
 		pw.Flush()
 
 		f, err := os.Open(packFilename)
@@ -953,40 +3940,264 @@ func TestHandlePushCallback(t *testing.T) {
 		dir,
 		AuthorizationAllowed,
 		NewGitProtocol(GitProtocolOpts{
-			UpdateCallback: func(
-				ctx context.Context,
-				repository *git.Repository,
-				level AuthorizationLevel,
-				command *GitCommand,
-				oldCommit, newCommit *git.Commit,
-			) error {
-				return errors.New("go away")
-			},
 			Log: log,
 		}),
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ng refs/heads/master unknown-commit\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandlePushCreateExistingRef(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	for i, expectedStatus := range []string{
+		"ok refs/heads/master\n",
+		// The second push tries to create the reference again.
+		"ng refs/heads/master already-exists\n",
+	} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			// Taken from git 2.14.1
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+			pw.Flush()
+
+			f, err := os.Open(packFilename)
+			if err != nil {
+				t.Fatalf("Failed to open the packfile: %v", err)
+			}
+			defer f.Close()
+			if _, err = io.Copy(&inBuf, f); err != nil {
+				t.Fatalf("Failed to copy the packfile: %v", err)
+			}
+		}
+
+		err = handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if err != nil {
+			t.Fatalf("%d: Failed to push: %v", i, err)
+		}
+
+		expected := []PktLineResponse{
+			{"unpack ok\n", nil},
+			{expectedStatus, nil},
+			{"", ErrFlush},
+		}
+		if actual, ok := ComparePktLineResponse(
+			&outBuf,
+			expected,
+		); !ok {
+			t.Errorf("%d: pkt-reader expected %q, got %q", i, expected, actual)
+		}
+	}
+}
+
+func TestHandlePushDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	{
+		var inBuf, outBuf bytes.Buffer
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		defer repo.Free()
+
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+		f, err := os.Open(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to open the packfile: %v", err)
+		}
+		defer f.Close()
+		if _, err = io.Copy(&inBuf, f); err != nil {
+			t.Fatalf("Failed to copy the packfile: %v", err)
+		}
+		if err := handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				Log: log,
+			}),
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		); err != nil {
+			t.Fatalf("Failed to push: %v", err)
+		}
+
+		oid := gitOid("88aa3454adb27c3c343ab57564d962a0a7f6a3c1")
+		for _, name := range []string{"refs/changes/1", "refs/meta/config"} {
+			ref, err := repo.References.Create(
+				name,
+				&oid,
+				false,
+				"",
+			)
+			if err != nil {
+				t.Fatalf("Failed to create %s: %v", name, err)
+			}
+			ref.Free()
+		}
+	}
+
+	var deletedRefs []string
+	protocol := NewGitProtocol(GitProtocolOpts{
+		AllowDeletes: true,
+		UpdateCallback: func(
+			ctx context.Context,
+			repository *git.Repository,
+			level AuthorizationLevel,
+			command *GitCommand,
+			oldCommit, newCommit *git.Commit,
+		) error {
+			if newCommit != nil {
+				t.Errorf("Expected a nil newCommit for %s, got %s", command.ReferenceName, newCommit.Id())
+			}
+			deletedRefs = append(deletedRefs, command.ReferenceName)
+			return nil
+		},
+		Log: log,
+	})
+	for _, testCase := range []struct {
+		protocol       *GitProtocol
+		ref            string
+		expectedStatus string
+	}{
+		{
+			NewGitProtocol(GitProtocolOpts{
+				Log: log,
+			}),
+			"refs/changes/1",
+			"ng refs/changes/1 delete-unallowed\n",
+		},
+		{protocol, "refs/meta/config", "ng refs/meta/config restricted-ref\n"},
+		{protocol, "refs/changes/1", "ok refs/changes/1\n"},
+	} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			// Deletes are not followed by a packfile.
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte(fmt.Sprintf(
+				"88aa3454adb27c3c343ab57564d962a0a7f6a3c1 0000000000000000000000000000000000000000 %s\x00report-status delete-refs\n",
+				testCase.ref,
+			)))
+			pw.Flush()
+		}
+
+		err = handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowedRestricted,
+			testCase.protocol,
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if err != nil {
+			t.Fatalf("Failed to push the delete of %s: %v", testCase.ref, err)
+		}
+
+		expected := []PktLineResponse{
+			{"unpack ok\n", nil},
+			{testCase.expectedStatus, nil},
+			{"", ErrFlush},
+		}
+		if actual, ok := ComparePktLineResponse(
+			&outBuf,
+			expected,
+		); !ok {
+			t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+		}
+	}
+	if !reflect.DeepEqual([]string{"refs/changes/1"}, deletedRefs) {
+		t.Errorf("Expected the UpdateCallback to be invoked for refs/changes/1, got %v", deletedRefs)
+	}
+
+	var buf bytes.Buffer
+	if err := handlePrePull(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		protocol,
 		log,
-		&inBuf,
-		&outBuf,
-	)
+		&buf,
+	); err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
+	}
+	discovery, err := DiscoverReferences(&buf)
 	if err != nil {
-		t.Fatalf("Failed to push: %v", err)
+		t.Fatalf("Failed to parse the reference discovery: %v", err)
 	}
-
-	expected := []PktLineResponse{
-		{"unpack ok\n", nil},
-		{"ng refs/heads/master go away\n", nil},
-		{"", ErrFlush},
+	if _, ok := discovery.References["refs/changes/1"]; ok {
+		t.Errorf("Expected refs/changes/1 to be deleted, got %v", discovery.References)
 	}
-	if actual, ok := ComparePktLineResponse(
-		&outBuf,
-		expected,
-	); !ok {
-		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	for _, name := range []string{"refs/heads/master", "refs/meta/config"} {
+		if _, ok := discovery.References[name]; !ok {
+			t.Errorf("Expected %s to not be deleted, got %v", name, discovery.References)
+		}
 	}
 }
 
-func TestHandlePushPostUpdateCallback(t *testing.T) {
-	var inBuf, outBuf bytes.Buffer
+func TestHandlePushMissingPackHeader(t *testing.T) {
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
 		t.Fatalf("Failed to create directory: %v", err)
@@ -1003,81 +4214,128 @@ func TestHandlePushPostUpdateCallback(t *testing.T) {
 		repo.Free()
 	}
 
-	{
-		// Taken from git 2.14.1
-		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
-		pw.Flush()
-
-		f, err := os.Open(packFilename)
-		if err != nil {
-			t.Fatalf("Failed to open the packfile: %v", err)
+	log, _ := log15.New("info", false)
+	for name, packfile := range map[string]string{
+		"extra pkt-line": "0004PACK",
+		"garbage":        "this is not a packfile",
+		"missing":        "",
+	} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+			pw.Flush()
+			inBuf.WriteString(packfile)
 		}
-		defer f.Close()
-		if _, err = io.Copy(&inBuf, f); err != nil {
-			t.Fatalf("Failed to copy the packfile: %v", err)
+
+		err = handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				Log: log,
+			}),
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if !base.HasErrorCategory(err, ErrBadRequest) {
+			t.Errorf("For %s, expected ErrBadRequest, got %v", name, err)
+		} else if !strings.Contains(err.Error(), "expected PACK header") {
+			t.Errorf("For %s, unexpected error %v", name, err)
 		}
 	}
+}
 
-	log, _ := log15.New("info", false)
-	var modifiedFiles []string
-	err = handlePush(
-		context.Background(),
-		m,
-		dir,
-		AuthorizationAllowed,
-		NewGitProtocol(GitProtocolOpts{
-			PostUpdateCallback: func(
-				ctx context.Context,
-				repository *git.Repository,
-				callbackModifiedFiles []string,
-			) error {
-				modifiedFiles = callbackModifiedFiles
-				return nil
-			},
-			Log: log,
-		}),
-		log,
-		&inBuf,
-		&outBuf,
-	)
+func TestHandlePushPackfileTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
-		t.Fatalf("Failed to push: %v", err)
+		t.Fatalf("Failed to create directory: %v", err)
 	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
 
-	expected := []PktLineResponse{
-		{"unpack ok\n", nil},
-		{"ok refs/heads/master\n", nil},
-		{"", ErrFlush},
-	}
-	if actual, ok := ComparePktLineResponse(
-		&outBuf,
-		expected,
-	); !ok {
-		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
-	}
-	equal := false
-	expectedModifiedFiles := []string{
-		"objects/pack/multi-pack-index",
-		"objects/pack/pack-3915156951f90b8239a1d1933cbe85ae1bc7457f.idx",
-		"objects/pack/pack-3915156951f90b8239a1d1933cbe85ae1bc7457f.pack",
-		"refs/heads/master",
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
 	}
-	if len(expectedModifiedFiles) == len(modifiedFiles) {
-		equal = true
-		for i := range expectedModifiedFiles {
-			if expectedModifiedFiles[i] != modifiedFiles[i] {
-				equal = false
-				break
+
+	log, _ := log15.New("info", false)
+	for _, testCase := range []struct {
+		maxPackfileSize int64
+		expectedErr     error
+	}{
+		{64, ErrPackfileTooLarge},
+		// The packfile is exactly 199 bytes long.
+		{199, nil},
+	} {
+		var inBuf, outBuf bytes.Buffer
+		{
+			// Taken from git 2.14.1
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+			pw.Flush()
+
+			f, err := os.Open(packFilename)
+			if err != nil {
+				t.Fatalf("Failed to open the packfile: %v", err)
+			}
+			defer f.Close()
+			if _, err = io.Copy(&inBuf, f); err != nil {
+				t.Fatalf("Failed to copy the packfile: %v", err)
 			}
 		}
-	}
-	if !equal {
-		t.Errorf("modified files expected %q, got %q", expectedModifiedFiles, modifiedFiles)
+
+		err = handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			NewGitProtocol(GitProtocolOpts{
+				MaxPackfileSize: testCase.maxPackfileSize,
+				Log:             log,
+			}),
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		)
+		if testCase.expectedErr == nil {
+			if err != nil {
+				t.Errorf("For %d, failed to push: %v", testCase.maxPackfileSize, err)
+			}
+			continue
+		}
+		if !base.HasErrorCategory(err, ErrPackfileTooLarge) {
+			t.Fatalf("For %d, expected ErrPackfileTooLarge, got %v", testCase.maxPackfileSize, err)
+		}
+		if outBuf.Len() != 0 {
+			t.Errorf("For %d, unexpected response %q", testCase.maxPackfileSize, outBuf.Bytes())
+		}
+		rec := httptest.NewRecorder()
+		WriteHeader(rec, err, false)
+		if rec.Code != 413 {
+			t.Errorf("For %d, expected HTTP 413, got %d", testCase.maxPackfileSize, rec.Code)
+		}
+
+		// The partially-received packfile is not left behind.
+		leftovers, err := filepath.Glob(filepath.Join(os.TempDir(), fmt.Sprintf("packfile_%s*", path.Base(dir))))
+		if err != nil {
+			t.Fatalf("Failed to list the temporary directories: %v", err)
+		}
+		if len(leftovers) != 0 {
+			t.Errorf("For %d, expected the temporary directory to be removed, got %v", testCase.maxPackfileSize, leftovers)
+		}
 	}
 }
 
-func TestHandlePushUnknownCommit(t *testing.T) {
+func TestHandlePushRestrictedRef(t *testing.T) {
 	var inBuf, outBuf bytes.Buffer
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
@@ -1098,7 +4356,7 @@ func TestHandlePushUnknownCommit(t *testing.T) {
 	{
 		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 0101010101010101010101010101010101010101 refs/heads/master\x00report-status\n"))
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/meta/config\x00report-status\n"))
 		pw.Flush()
 
 		f, err := os.Open(packFilename)
@@ -1116,10 +4374,11 @@ func TestHandlePushUnknownCommit(t *testing.T) {
 		context.Background(),
 		m,
 		dir,
-		AuthorizationAllowed,
+		AuthorizationAllowedRestricted,
 		NewGitProtocol(GitProtocolOpts{
 			Log: log,
 		}),
+		nil,
 		log,
 		&inBuf,
 		&outBuf,
@@ -1130,7 +4389,7 @@ func TestHandlePushUnknownCommit(t *testing.T) {
 
 	expected := []PktLineResponse{
 		{"unpack ok\n", nil},
-		{"ng refs/heads/master unknown-commit\n", nil},
+		{"ng refs/meta/config restricted-ref\n", nil},
 		{"", ErrFlush},
 	}
 	if actual, ok := ComparePktLineResponse(
@@ -1141,7 +4400,7 @@ func TestHandlePushUnknownCommit(t *testing.T) {
 	}
 }
 
-func TestHandlePushRestrictedRef(t *testing.T) {
+func TestHandlePushAtomicRestrictedRef(t *testing.T) {
 	var inBuf, outBuf bytes.Buffer
 	dir, err := ioutil.TempDir("", "protocol_test")
 	if err != nil {
@@ -1160,9 +4419,9 @@ func TestHandlePushRestrictedRef(t *testing.T) {
 	}
 
 	{
-		// Taken from git 2.14.1
 		pw := NewPktLineWriter(&inBuf)
-		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/meta/config\x00report-status\n"))
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status atomic\n"))
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/meta/config\n"))
 		pw.Flush()
 
 		f, err := os.Open(packFilename)
@@ -1184,6 +4443,7 @@ func TestHandlePushRestrictedRef(t *testing.T) {
 		NewGitProtocol(GitProtocolOpts{
 			Log: log,
 		}),
+		nil,
 		log,
 		&inBuf,
 		&outBuf,
@@ -1194,6 +4454,7 @@ func TestHandlePushRestrictedRef(t *testing.T) {
 
 	expected := []PktLineResponse{
 		{"unpack ok\n", nil},
+		{"ng refs/heads/master atomic-push-failed\n", nil},
 		{"ng refs/meta/config restricted-ref\n", nil},
 		{"", ErrFlush},
 	}
@@ -1248,6 +4509,7 @@ func TestHandlePushMerge(t *testing.T) {
 		NewGitProtocol(GitProtocolOpts{
 			Log: log,
 		}),
+		nil,
 		log,
 		&inBuf,
 		&outBuf,
@@ -1269,6 +4531,99 @@ func TestHandlePushMerge(t *testing.T) {
 	}
 }
 
+func TestHandlePushMergeSecondParent(t *testing.T) {
+	log, _ := log15.New("info", false)
+	for _, strictFirstParent := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "protocol_test")
+		if err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		m := NewLockfileManager()
+		defer m.Clear()
+
+		{
+			repo, err := git.InitRepository(dir, true)
+			if err != nil {
+				t.Fatalf("Failed to initialize git repository: %v", err)
+			}
+			repo.Free()
+		}
+
+		protocol := NewGitProtocol(GitProtocolOpts{
+			StrictFirstParent: strictFirstParent,
+			Log:               log,
+		})
+
+		// 6d4fad66 is a merge whose first parent is 2b0074d8 and whose second
+		// parent is afb23b63. Both are children of 6d2439d2.
+		for _, push := range []struct {
+			command  string
+			packfile string
+			expected string
+		}{
+			{
+				"0000000000000000000000000000000000000000 6d2439d2e920ba92d8e485e75d1b740ae51b609a refs/heads/base\x00report-status\n",
+				packFilename,
+				"ok refs/heads/base\n",
+			},
+			{
+				"0000000000000000000000000000000000000000 afb23b637ca3af09a36bd50e65d593dc0d5bc0eb refs/heads/master\x00report-status\n",
+				"testdata/pack-merge-commit.pack",
+				"ok refs/heads/master\n",
+			},
+			{
+				"afb23b637ca3af09a36bd50e65d593dc0d5bc0eb 6d4fad66ff6271a19aee1bfab1172b34ee05f43f refs/heads/master\x00report-status\n",
+				"testdata/pack-merge-commit.pack",
+				map[bool]string{
+					false: "ok refs/heads/master\n",
+					true:  "ng refs/heads/master non-fast-forward\n",
+				}[strictFirstParent],
+			},
+		} {
+			var inBuf, outBuf bytes.Buffer
+			pw := NewPktLineWriter(&inBuf)
+			pw.WritePktLine([]byte(push.command))
+			pw.Flush()
+			f, err := os.Open(push.packfile)
+			if err != nil {
+				t.Fatalf("Failed to open the packfile: %v", err)
+			}
+			_, err = io.Copy(&inBuf, f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("Failed to copy the packfile: %v", err)
+			}
+
+			if err := handlePush(
+				context.Background(),
+				m,
+				dir,
+				AuthorizationAllowed,
+				protocol,
+				nil,
+				log,
+				&inBuf,
+				&outBuf,
+			); err != nil {
+				t.Fatalf("Failed to push: %v", err)
+			}
+
+			expected := []PktLineResponse{
+				{"unpack ok\n", nil},
+				{push.expected, nil},
+				{"", ErrFlush},
+			}
+			if actual, ok := ComparePktLineResponse(
+				&outBuf,
+				expected,
+			); !ok {
+				t.Errorf("With StrictFirstParent=%v, pkt-reader expected %q, got %q", strictFirstParent, expected, actual)
+			}
+		}
+	}
+}
+
 func TestHandlePushMultipleCommits(t *testing.T) {
 	var inBuf, outBuf bytes.Buffer
 	dir, err := ioutil.TempDir("", "protocol_test")
@@ -1312,6 +4667,7 @@ func TestHandlePushMultipleCommits(t *testing.T) {
 		NewGitProtocol(GitProtocolOpts{
 			Log: log,
 		}),
+		nil,
 		log,
 		&inBuf,
 		&outBuf,
@@ -1376,6 +4732,7 @@ func TestHandleNonFastForward(t *testing.T) {
 		NewGitProtocol(GitProtocolOpts{
 			Log: log,
 		}),
+		nil,
 		log,
 		&inBuf,
 		&outBuf,
@@ -1421,6 +4778,7 @@ func TestHandleNonFastForward(t *testing.T) {
 		NewGitProtocol(GitProtocolOpts{
 			Log: log,
 		}),
+		nil,
 		log,
 		&inBuf,
 		&outBuf,
@@ -1440,3 +4798,271 @@ func TestHandleNonFastForward(t *testing.T) {
 		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
 	}
 }
+
+func TestPushPackfileTooManyObjects(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	// A commit with a tree and 100 blobs.
+	var packBuf bytes.Buffer
+	var commitID *git.Oid
+	{
+		sourceRepository, err := git.InitRepository(path.Join(dir, "source.git"), true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		defer sourceRepository.Free()
+		files := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			files[fmt.Sprintf("file%03d", i)] = fmt.Sprintf("%d\n", i)
+		}
+		commitID = createTestCommit(t, sourceRepository, log, "refs/heads/master", files, "Many files\n")
+
+		pb, err := sourceRepository.NewPackbuilder()
+		if err != nil {
+			t.Fatalf("Failed to create packbuilder: %v", err)
+		}
+		defer pb.Free()
+		if err := pb.InsertCommit(commitID); err != nil {
+			t.Fatalf("Failed to insert commit into packbuilder: %v", err)
+		}
+		if err := pb.Write(&packBuf); err != nil {
+			t.Fatalf("Failed to write packfile: %v", err)
+		}
+	}
+
+	repository, err := git.InitRepository(path.Join(dir, "target.git"), true)
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repository.Free()
+
+	protocol := NewGitProtocol(GitProtocolOpts{
+		MaxPackObjects: 50,
+		Log:            log,
+	})
+	defer protocol.Close()
+	_, err, unpackErr := protocol.PushPackfile(
+		context.Background(),
+		repository,
+		m.NewLockfile(repository.Path()),
+		AuthorizationAllowed,
+		[]*GitCommand{
+			{
+				Old:           &git.Oid{},
+				New:           commitID,
+				ReferenceName: "refs/heads/master",
+			},
+		},
+		bytes.NewReader(packBuf.Bytes()),
+	)
+	if !errors.Is(unpackErr, ErrTooManyObjects) {
+		t.Fatalf("Expected ErrTooManyObjects, got %v", unpackErr)
+	}
+	if err == nil {
+		t.Errorf("Expected the push to fail")
+	}
+	if _, err := repository.References.Lookup("refs/heads/master"); err == nil {
+		t.Errorf("Expected refs/heads/master to not be created")
+	}
+}
+
+func TestHandlePushRequireStagedPushPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	packContents, err := ioutil.ReadFile(packFilename)
+	if err != nil {
+		t.Fatalf("Failed to read the packfile: %v", err)
+	}
+
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		PushPolicyCallback: RequireStagedPushPolicy("refs/changes/", "refs/heads/"),
+		Log:                log,
+	})
+	for _, step := range []struct {
+		referenceName string
+		expected      string
+	}{
+		{"refs/heads/master", "ng refs/heads/master forbidden\n"},
+		{"refs/changes/initial", "ok refs/changes/initial\n"},
+		{"refs/heads/master", "ok refs/heads/master\n"},
+	} {
+		var inBuf, outBuf bytes.Buffer
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(fmt.Sprintf(
+			"0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 %s\x00report-status\n",
+			step.referenceName,
+		)))
+		pw.Flush()
+		inBuf.Write(packContents)
+
+		if err := handlePush(
+			context.Background(),
+			m,
+			dir,
+			AuthorizationAllowed,
+			protocol,
+			nil,
+			log,
+			&inBuf,
+			&outBuf,
+		); err != nil {
+			t.Fatalf("Failed to push %s: %v", step.referenceName, err)
+		}
+
+		expected := []PktLineResponse{
+			{"unpack ok\n", nil},
+			{step.expected, nil},
+			{"", ErrFlush},
+		}
+		if actual, ok := ComparePktLineResponse(
+			&outBuf,
+			expected,
+		); !ok {
+			t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+		}
+	}
+}
+
+func TestHandlePushPolicyForbiddenCategory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(dir, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	packContents, err := ioutil.ReadFile(packFilename)
+	if err != nil {
+		t.Fatalf("Failed to read the packfile: %v", err)
+	}
+
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		PushPolicyCallback: func(
+			ctx context.Context,
+			repository *git.Repository,
+			level AuthorizationLevel,
+			command *GitCommand,
+			newCommit *git.Commit,
+		) error {
+			return base.ErrorWithCategory(ErrForbidden, errors.New("not allowed"))
+		},
+		Log: log,
+	})
+
+	// Without report-status, the error is returned to the caller, and it must
+	// keep the category of the error returned by the callback.
+	var inBuf, outBuf bytes.Buffer
+	pw := NewPktLineWriter(&inBuf)
+	pw.WritePktLine([]byte(
+		"0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\n",
+	))
+	pw.Flush()
+	inBuf.Write(packContents)
+
+	err = handlePush(
+		context.Background(),
+		m,
+		dir,
+		AuthorizationAllowed,
+		protocol,
+		nil,
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if !base.HasErrorCategory(err, ErrForbidden) {
+		t.Errorf("Expected an ErrForbidden error, got %v", err)
+	}
+}
+
+func TestHandlePullPushContextDeadline(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	for _, name := range []string{"pull", "push"} {
+		// The reader never produces any data, so the request can only finish
+		// because of the deadline.
+		pr, pw := io.Pipe()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		var err error
+		var outBuf bytes.Buffer
+		if name == "pull" {
+			err = handlePull(
+				ctx,
+				m,
+				"testdata/repo.git",
+				AuthorizationAllowed,
+				protocol,
+				log,
+				pr,
+				&outBuf,
+			)
+		} else {
+			err = handlePush(
+				ctx,
+				m,
+				"testdata/repo.git",
+				AuthorizationAllowed,
+				protocol,
+				nil,
+				log,
+				pr,
+				&outBuf,
+			)
+		}
+		elapsed := time.Since(start)
+		cancel()
+		pw.Close()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: Expected %v, got %v", name, context.DeadlineExceeded, err)
+		}
+		if elapsed > 5*time.Second {
+			t.Errorf("%s: Expected the request to be aborted promptly, took %v", name, elapsed)
+		}
+
+		lockfile := m.NewLockfile("testdata/repo.git")
+		if ok, err := lockfile.TryLock(); !ok {
+			t.Errorf("%s: Expected the lockfile to be released: %v", name, err)
+		} else {
+			lockfile.Unlock()
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package githttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	git "github.com/libgit2/git2go/v33"
+	base "github.com/omegaup/go-base/v3"
+	"github.com/omegaup/go-base/v3/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxRefPrefixes is the maximum number of 'ref-prefix' arguments of an
+	// ls-refs command. Like git, past this limit the prefixes are ignored and
+	// all references are sent instead.
+	maxRefPrefixes = 65536
+)
+
+// protocolV2Capabilities returns the capability advertisement that is sent to
+// clients that use protocol v2, which is derived from the pull capabilities.
+// The documentation for the protocol can be found in
+// https://github.com/git/git/blob/master/Documentation/technical/protocol-v2.txt
+func protocolV2Capabilities(protocol *GitProtocol) []string {
+	capabilities := []string{"version 2"}
+	for _, capability := range protocol.pullCapabilities {
+		if strings.HasPrefix(capability, "agent=") {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	if protocol.AdvertiseUnbornHead {
+		capabilities = append(capabilities, "ls-refs=unborn")
+	} else {
+		capabilities = append(capabilities, "ls-refs")
+	}
+	var fetchFeatures []string
+	for _, feature := range []string{"shallow", "filter"} {
+		if protocol.pullCapabilities.Contains(feature) {
+			fetchFeatures = append(fetchFeatures, feature)
+		}
+	}
+	if len(fetchFeatures) == 0 {
+		capabilities = append(capabilities, "fetch")
+	} else {
+		capabilities = append(capabilities, "fetch="+strings.Join(fetchFeatures, " "))
+	}
+	return append(capabilities, "object-format=sha1")
+}
+
+// handleInfoRefsV2 handles the reference discovery of protocol v2, which only
+// advertises the capabilities of the server. The references themselves are
+// sent in response to the ls-refs command. Unlike protocol v0, the response
+// is not preceded by the '# service=' comment.
+func handleInfoRefsV2(protocol *GitProtocol, w io.Writer) error {
+	p := NewPktLineWriter(w)
+	for _, capability := range protocolV2Capabilities(protocol) {
+		if err := p.WritePktLine([]byte(capability + "\n")); err != nil {
+			return err
+		}
+	}
+	return p.Flush()
+}
+
+// handlePullV2 handles a protocol v2 request sent to the '/git-upload-pack'
+// URL. Each request contains a single command, followed by its capabilities
+// and (after a delim-pkt) its arguments.
+func handlePullV2(
+	ctx context.Context,
+	m *LockfileManager,
+	repositoryPath string,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	log logging.Logger,
+	r io.Reader,
+	w io.Writer,
+) error {
+	// The client can take arbitrarily long to send the request, so reads stop
+	// once the context is done.
+	pr := NewPktLineReader(newContextReader(ctx, r))
+	command := ""
+	hasArguments := false
+	for {
+		line, err := pr.ReadPktLine()
+		if err == ErrFlush {
+			break
+		} else if err == ErrDelim {
+			hasArguments = true
+			break
+		} else if err == io.EOF && command == "" {
+			// The client can close the connection without sending a command.
+			return nil
+		} else if err != nil {
+			return requestReadError(ctx, err, "failed to read the request")
+		}
+		capability := strings.TrimSuffix(string(line), "\n")
+		if strings.HasPrefix(capability, "command=") {
+			command = strings.TrimPrefix(capability, "command=")
+		} else if strings.HasPrefix(capability, "object-format=") &&
+			capability != "object-format=sha1" {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf("unsupported %s", capability),
+			)
+		}
+	}
+	if command == "" {
+		return nil
+	}
+	if command != "ls-refs" && command != "fetch" {
+		return base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Errorf("unsupported command %s", command),
+		)
+	}
+
+	repository, err := openRepository(ctx, repositoryPath)
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"failed to open git repository",
+		)
+	}
+	defer repository.Free()
+
+	lockfile := m.NewLockfile(repository.Path())
+	if ok, err := lockfile.TryRLock(); !ok {
+		log.Info(
+			"Waiting for the lockfile",
+			map[string]interface{}{
+				"err": err,
+			},
+		)
+		if err := lockfile.RLockContext(ctx); err != nil {
+			return errors.Wrap(
+				err,
+				"failed to acquire the lockfile",
+			)
+		}
+	}
+	defer lockfile.Unlock()
+
+	if command == "ls-refs" {
+		return handleLsRefs(ctx, repository, level, protocol, log, pr, hasArguments, w)
+	}
+	return handleFetch(ctx, repository, level, protocol, log, pr, hasArguments, w)
+}
+
+// readArgumentsV2 calls fn with each of the arguments of a protocol v2
+// command, without the trailing newline, until the flush-pkt that ends the
+// request.
+func readArgumentsV2(
+	ctx context.Context,
+	pr *PktLineReader,
+	hasArguments bool,
+	fn func(argument string) error,
+) error {
+	for hasArguments {
+		line, err := pr.ReadPktLine()
+		if err == ErrFlush {
+			break
+		} else if err != nil {
+			return requestReadError(ctx, err, "failed to read the request")
+		}
+		if err := fn(strings.TrimSuffix(string(line), "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleLsRefs handles the ls-refs command of protocol v2, which sends the
+// references of the repository that match any of the requested prefixes.
+func handleLsRefs(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	log logging.Logger,
+	pr *PktLineReader,
+	hasArguments bool,
+	w io.Writer,
+) error {
+	symrefs := false
+	peel := false
+	unborn := false
+	var prefixes []string
+	err := readArgumentsV2(ctx, pr, hasArguments, func(argument string) error {
+		if argument == "symrefs" {
+			symrefs = true
+		} else if argument == "peel" {
+			peel = true
+		} else if argument == "unborn" {
+			unborn = true
+		} else if strings.HasPrefix(argument, "ref-prefix ") {
+			if len(prefixes) <= maxRefPrefixes {
+				prefixes = append(prefixes, strings.TrimPrefix(argument, "ref-prefix "))
+			}
+		} else {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf("unsupported ls-refs argument %s", argument),
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(prefixes) > maxRefPrefixes {
+		prefixes = nil
+	}
+	matchesPrefix := func(name string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	namespace := NamespaceFromContext(ctx)
+	advertisedRefs, err := advertisedReferences(ctx, repository, namespace, level, protocol, log)
+	if err != nil {
+		return err
+	}
+
+	p := NewPktLineWriter(w)
+	if matchesPrefix("HEAD") {
+		head, err := lookupHead(repository, namespace)
+		if err != nil && !git.IsErrorCode(err, git.ErrorCodeUnbornBranch) {
+			return errors.Wrap(
+				err,
+				"failed to read HEAD",
+			)
+		}
+		if head != nil {
+			defer head.Free()
+			line := fmt.Sprintf("%s HEAD", head.Target().String())
+			if symrefs {
+				headName, _ := stripNamespace(namespace, head.Name())
+				line += " symref-target:" + headName
+			}
+			p.WritePktLine([]byte(line + "\n"))
+		} else if unborn && protocol.AdvertiseUnbornHead {
+			if headName, ok := unbornHeadTarget(repository, namespace); ok {
+				line := "unborn HEAD"
+				if symrefs {
+					line += " symref-target:" + headName
+				}
+				p.WritePktLine([]byte(line + "\n"))
+			}
+		}
+	}
+	for _, ref := range advertisedRefs {
+		if !matchesPrefix(ref.name) {
+			continue
+		}
+		line := fmt.Sprintf("%s %s", ref.id, ref.name)
+		if peel {
+			if peeled := peeledTagTarget(repository, ref.id); peeled != nil {
+				line += " peeled:" + peeled.String()
+			}
+		}
+		p.WritePktLine([]byte(line + "\n"))
+	}
+	return p.Flush()
+}
+
+// peeledTagTarget returns the id of the object that the annotated tag with
+// the provided id ultimately points to, or nil if it is not an annotated tag.
+func peeledTagTarget(repository *git.Repository, id string) *git.Oid {
+	oid, err := git.NewOid(id)
+	if err != nil {
+		return nil
+	}
+	var peeled *git.Oid
+	for {
+		tag, err := repository.LookupTag(oid)
+		if err != nil {
+			return peeled
+		}
+		oid = tag.TargetId()
+		tag.Free()
+		peeled = oid
+	}
+}
+
+// handleFetch handles the fetch command of protocol v2. The negotiation is the
+// same as the one of protocol v0, but the response is split in sections, and
+// the packfile is always multiplexed with side-band-64k.
+func handleFetch(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	log logging.Logger,
+	pr *PktLineReader,
+	hasArguments bool,
+	w io.Writer,
+) error {
+	pb, err := repository.NewPackbuilder()
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"failed to create packbuilder",
+		)
+	}
+	defer pb.Free()
+
+	odb, err := repository.Odb()
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"failed to open git odb",
+		)
+	}
+	defer odb.Free()
+
+	// The trailers need to be declared before anything is written.
+	rw, sendStatistics := w.(http.ResponseWriter)
+	sendStatistics = sendStatistics && protocol.PackStatistics
+	if sendStatistics {
+		rw.Header().Add("Trailer", "Omegaup-Pack-Objects")
+		rw.Header().Add("Trailer", "Omegaup-Pack-Bytes")
+	}
+
+	wantMap := make(map[string]*git.Commit)
+	defer func() {
+		for _, commit := range wantMap {
+			if commit != nil {
+				commit.Free()
+			}
+		}
+	}()
+	wantObjects := make(map[string]*git.Oid)
+	var filter *objectFilter
+	wantCount := 0
+	var commonIDs []string
+	commonSet := make(map[string]struct{})
+	shallowSet := make(map[string]struct{})
+	done := false
+	haveCount := 0
+	noProgress := false
+	maxDepth := uint64(0)
+	var cutoff *shallowCutoff
+	var unknownWant *git.Oid
+	err = readArgumentsV2(ctx, pr, hasArguments, func(argument string) error {
+		log.Debug(
+			"fetch argument",
+			map[string]any{
+				"data": argument,
+			},
+		)
+		tokens := strings.Fields(argument)
+		if len(tokens) == 0 {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.New("empty fetch argument"),
+			)
+		}
+		if (tokens[0] == "shallow" || tokens[0] == "deepen" ||
+			tokens[0] == "deepen-since" || tokens[0] == "deepen-not") &&
+			!protocol.pullCapabilities.Contains("shallow") {
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf(
+					"'%s' requires the disabled shallow capability",
+					tokens[0],
+				),
+			)
+		}
+		switch tokens[0] {
+		case "thin-pack", "ofs-delta", "include-tag":
+			// libgit2's packfiles are always self-contained and use
+			// ofs-deltas. Annotated tags are not followed, so the client
+			// fetches them separately if needed.
+		case "no-progress":
+			noProgress = true
+		case "done":
+			done = true
+		case "want":
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("malformed 'want' argument"),
+				)
+			}
+			wantCount++
+			if wantCount > protocol.MaxWants {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf(
+						"too many 'want' lines, the limit is %d",
+						protocol.MaxWants,
+					),
+				)
+			}
+			oid, err := git.NewOid(tokens[1])
+			if err != nil {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf("invalid OID: %s", tokens[1]),
+				)
+			}
+			if _, ok := wantMap[tokens[1]]; ok {
+				return nil
+			}
+			if _, ok := wantObjects[tokens[1]]; ok {
+				return nil
+			}
+			commit, err := repository.LookupCommit(oid)
+			if err != nil {
+				if _, objectType, err := odb.ReadHeader(oid); err == nil &&
+					(objectType == git.ObjectBlob || objectType == git.ObjectTree) {
+					wantObjects[tokens[1]] = oid
+					return nil
+				}
+				if unknownWant == nil {
+					unknownWant = oid
+				}
+				return nil
+			}
+			wantMap[tokens[1]] = commit
+		case "have":
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("malformed 'have' argument"),
+				)
+			}
+			haveCount++
+			if haveCount > protocol.MaxNegotiationHaves {
+				// The negotiation was too expensive. The packfile is sent with
+				// whatever common commits have been found so far.
+				return nil
+			}
+			oid, err := git.NewOid(tokens[1])
+			if err != nil {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf("invalid OID: %s", tokens[1]),
+				)
+			}
+			if _, ok := commonSet[tokens[1]]; ok {
+				return nil
+			}
+			if commit, err := repository.LookupCommit(oid); err == nil {
+				commit.Free()
+				commonSet[tokens[1]] = struct{}{}
+				commonIDs = append(commonIDs, tokens[1])
+			}
+		case "shallow":
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("malformed 'shallow' argument"),
+				)
+			}
+			return addShallow(shallowSet, tokens[1], protocol.MaxShallows)
+		case "deepen":
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("malformed 'deepen' argument"),
+				)
+			}
+			maxDepth, err = strconv.ParseUint(tokens[1], 10, 64)
+			if err != nil {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf("invalid depth %s", tokens[1]),
+				)
+			}
+		case "deepen-since", "deepen-not":
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf("malformed '%s' argument", tokens[0]),
+				)
+			}
+			if cutoff == nil {
+				cutoff = &shallowCutoff{}
+			}
+			if tokens[0] == "deepen-since" {
+				return cutoff.parseDeepenSince(tokens[1])
+			}
+			return cutoff.parseDeepenNot(ctx, repository, level, protocol, tokens[1])
+		case "filter":
+			if !protocol.pullCapabilities.Contains("filter") {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("'filter' requires the filter capability, which is not allowed"),
+				)
+			}
+			if len(tokens) < 2 {
+				return base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.New("malformed 'filter' argument"),
+				)
+			}
+			filter, err = parseObjectFilter(tokens[1])
+			if err != nil {
+				return base.ErrorWithCategory(ErrBadRequest, err)
+			}
+		default:
+			return base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Errorf("unsupported fetch argument %s", tokens[0]),
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pw := NewPktLineWriter(w)
+	if unknownWant != nil {
+		log.Debug(
+			"Unknown commit requested",
+			map[string]any{
+				"oid": unknownWant.String(),
+			},
+		)
+		pw.WritePktLine([]byte(fmt.Sprintf("ERR upload-pack: not our ref %s", unknownWant.String())))
+		return nil
+	}
+
+	log.Debug(
+		"Negotiation",
+		map[string]any{
+			"want":   wantMap,
+			"common": commonSet,
+			"done":   done,
+		},
+	)
+
+	// Unless the client is done, the server acknowledges the common commits
+	// and, once it has found enough of them, tells the client that it is ready
+	// to send the packfile. Any common commit is considered enough.
+	if !done {
+		pw.WritePktLine([]byte("acknowledgments\n"))
+		if len(commonIDs) == 0 {
+			pw.WritePktLine([]byte("NAK\n"))
+		}
+		for _, id := range commonIDs {
+			pw.WritePktLine([]byte(fmt.Sprintf("ACK %s\n", id)))
+		}
+		if len(commonIDs) == 0 && haveCount <= protocol.MaxNegotiationHaves {
+			return pw.Flush()
+		}
+		pw.WritePktLine([]byte("ready\n"))
+		pw.Delim()
+	}
+
+	deepen := maxDepth != 0 || cutoff != nil
+	if maxDepth == 0 {
+		maxDepth = uint64(math.MaxUint64)
+	}
+	if deepen {
+		pw.WritePktLine([]byte("shallow-info\n"))
+		writeShallowUpdates(repository, pw, wantMap, shallowSet, maxDepth, cutoff)
+		pw.Delim()
+	}
+
+	pw.WritePktLine([]byte("packfile\n"))
+	sw := NewSideBandWriter(w)
+	var progress *SideBandWriter
+	if !noProgress {
+		progress = sw
+	}
+	if err := insertPullObjects(
+		ctx,
+		repository,
+		odb,
+		pb,
+		wantMap,
+		wantObjects,
+		commonSet,
+		shallowSet,
+		filter,
+		maxDepth,
+		cutoff,
+		progress,
+		log,
+	); err != nil {
+		return err
+	}
+	// The wanted commits are not needed to write the packfile, which can take
+	// a while, so they are released now. Only the keys of wantMap are used
+	// from here on.
+	for name, commit := range wantMap {
+		commit.Free()
+		wantMap[name] = nil
+	}
+	if progress != nil {
+		progress.Progress(fmt.Sprintf("Counting objects: %d, done.\n", pb.ObjectCount()))
+	}
+
+	reuseExistingPackfile := len(commonSet) == 0 && len(shallowSet) == 0 &&
+		maxDepth == math.MaxUint64 && cutoff == nil && filter == nil &&
+		len(wantObjects) == 0 && wantsAllReferences(repository, wantMap)
+	packBytes := writePullPackfile(
+		ctx,
+		repository,
+		pb,
+		reuseExistingPackfile,
+		protocol,
+		log,
+		sw,
+		sw,
+	)
+	if sendStatistics {
+		rw.Header().Set("Omegaup-Pack-Objects", strconv.FormatUint(uint64(pb.ObjectCount()), 10))
+		rw.Header().Set("Omegaup-Pack-Bytes", strconv.FormatInt(packBytes, 10))
+	}
+
+	return nil
+}
@@ -0,0 +1,297 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/omegaup/go-base/logging/log15/v3"
+
+	git "github.com/libgit2/git2go/v33"
+)
+
+// readSideBandPackfile reads the side-band-64k stream of a packfile section
+// up to its flush-pkt, and returns the contents of the packfile.
+func readSideBandPackfile(t *testing.T, pr *PktLineReader) *bytes.Buffer {
+	t.Helper()
+
+	var pack bytes.Buffer
+	for {
+		line, err := pr.ReadPktLine()
+		if err == ErrFlush {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read the side-band stream: %v", err)
+		}
+		switch line[0] {
+		case sideBandData:
+			pack.Write(line[1:])
+		case sideBandProgress:
+		default:
+			t.Fatalf("Unexpected band %d: %q", line[0], line[1:])
+		}
+	}
+	return &pack
+}
+
+func TestHandlePrePullV2(t *testing.T) {
+	var buf bytes.Buffer
+	log, _ := log15.New("info", false)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	err := handlePrePull(
+		WithProtocolVersion(context.Background(), 2),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			AllowFilter: true,
+			Log:         log,
+		}),
+		log,
+		&buf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to get pre-pull: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"version 2\n", nil},
+		{"agent=gohttp\n", nil},
+		{"ls-refs\n", nil},
+		{"fetch=shallow filter\n", nil},
+		{"object-format=sha1\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&buf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandleLsRefsV2(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		// Taken from git 2.34.1
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("command=ls-refs\n"))
+		pw.WritePktLine([]byte("agent=git/2.34.1\n"))
+		pw.WritePktLine([]byte("object-format=sha1\n"))
+		pw.Delim()
+		pw.WritePktLine([]byte("peel\n"))
+		pw.WritePktLine([]byte("symrefs\n"))
+		pw.WritePktLine([]byte("ref-prefix HEAD\n"))
+		pw.WritePktLine([]byte("ref-prefix refs/heads/\n"))
+		pw.WritePktLine([]byte("ref-prefix refs/meta/\n"))
+		pw.Flush()
+	}
+
+	log, _ := log15.New("info", false)
+	err := handlePull(
+		WithProtocolVersion(context.Background(), 2),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowedRestricted,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to list references: %v", err)
+	}
+
+	// refs/meta/config is restricted.
+	expected := []PktLineResponse{
+		{"6d2439d2e920ba92d8e485e75d1b740ae51b609a HEAD symref-target:refs/heads/master\n", nil},
+		{"6d2439d2e920ba92d8e485e75d1b740ae51b609a refs/heads/master\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHandleFetchV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocolv2_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		Log: log,
+	})
+
+	for _, testCase := range []struct {
+		name             string
+		arguments        []string
+		expectedSections []PktLineResponse
+		expectedObjects  int
+	}{
+		{
+			"clone",
+			[]string{
+				"thin-pack\n",
+				"ofs-delta\n",
+				"want 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n",
+				"done\n",
+			},
+			[]PktLineResponse{
+				{"packfile\n", nil},
+			},
+			5,
+		},
+		{
+			"fetch",
+			[]string{
+				"thin-pack\n",
+				"no-progress\n",
+				"want 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n",
+				"have 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n",
+			},
+			[]PktLineResponse{
+				{"acknowledgments\n", nil},
+				{"ACK 88aa3454adb27c3c343ab57564d962a0a7f6a3c1\n", nil},
+				{"ready\n", nil},
+				{"", ErrDelim},
+				{"packfile\n", nil},
+			},
+			3,
+		},
+		{
+			"shallow clone",
+			[]string{
+				"want 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n",
+				"deepen 1\n",
+				"done\n",
+			},
+			[]PktLineResponse{
+				{"shallow-info\n", nil},
+				{"shallow 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n", nil},
+				{"", ErrDelim},
+				{"packfile\n", nil},
+			},
+			3,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var inBuf, outBuf bytes.Buffer
+			{
+				pw := NewPktLineWriter(&inBuf)
+				pw.WritePktLine([]byte("command=fetch\n"))
+				pw.WritePktLine([]byte("agent=git/2.34.1\n"))
+				pw.WritePktLine([]byte("object-format=sha1\n"))
+				pw.Delim()
+				for _, argument := range testCase.arguments {
+					pw.WritePktLine([]byte(argument))
+				}
+				pw.Flush()
+			}
+
+			err := handlePull(
+				WithProtocolVersion(context.Background(), 2),
+				m,
+				"testdata/repo.git",
+				AuthorizationAllowed,
+				protocol,
+				log,
+				&inBuf,
+				&outBuf,
+			)
+			if err != nil {
+				t.Fatalf("Failed to fetch: %v", err)
+			}
+
+			if actual, ok := ComparePktLineResponse(
+				&outBuf,
+				testCase.expectedSections,
+			); !ok {
+				t.Fatalf("pkt-reader expected %q, got %q", testCase.expectedSections, actual)
+			}
+			pack := readSideBandPackfile(t, NewPktLineReader(&outBuf))
+			if outBuf.Len() != 0 {
+				t.Errorf("Unexpected data after the flush: %q", outBuf.Bytes())
+			}
+
+			odb, err := git.NewOdb()
+			if err != nil {
+				t.Fatalf("Failed to create odb: %v", err)
+			}
+			defer odb.Free()
+
+			idx, _, err := UnpackPackfile(odb, pack, dir, 0, nil)
+			if err != nil {
+				t.Fatalf("Failed to unpack the packfile: %v", err)
+			}
+			if len(idx.Entries) != testCase.expectedObjects {
+				t.Errorf("Expected %d objects, got %d", testCase.expectedObjects, len(idx.Entries))
+			}
+		})
+	}
+}
+
+func TestHandleFetchV2Negotiation(t *testing.T) {
+	var inBuf, outBuf bytes.Buffer
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte("command=fetch\n"))
+		pw.Delim()
+		pw.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n"))
+		pw.WritePktLine([]byte("have 0000000000000000000000000000000000000001\n"))
+		pw.Flush()
+	}
+
+	log, _ := log15.New("info", false)
+	err := handlePull(
+		WithProtocolVersion(context.Background(), 2),
+		m,
+		"testdata/repo.git",
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+
+	// Without any common commits, the server is not ready to send the
+	// packfile yet.
+	expected := []PktLineResponse{
+		{"acknowledgments\n", nil},
+		{"NAK\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+	if outBuf.Len() != 0 {
+		t.Errorf("Unexpected data after the flush: %q", outBuf.Bytes())
+	}
+}
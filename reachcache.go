@@ -0,0 +1,99 @@
+package githttp
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	git "github.com/libgit2/git2go/v33"
+)
+
+// A reachabilityCache remembers whether commits are reachable from a set of
+// references. Since the key includes a hash of the names and targets of the
+// references, entries never become stale: once any of the references is
+// updated, lookups use a different key and the old entries are eventually
+// evicted.
+type reachabilityCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+	hits       int
+}
+
+type reachabilityCacheEntry struct {
+	key       string
+	reachable bool
+}
+
+func newReachabilityCache(maxEntries int) *reachabilityCache {
+	return &reachabilityCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// reachabilityCacheKey returns the key of the reachability of commitID in the
+// provided repository from the provided references.
+func reachabilityCacheKey(
+	repositoryPath string,
+	commitID *git.Oid,
+	references map[string]*git.Oid,
+) string {
+	names := make([]string, 0, len(references))
+	for name := range references {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha1.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		if target := references[name]; target != nil {
+			h.Write(target[:])
+		}
+		h.Write([]byte{0})
+	}
+	return repositoryPath + "\x00" + commitID.String() + "\x00" + hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns whether the commit with the provided key is reachable, and
+// whether the key was present in the cache at all.
+func (c *reachabilityCache) get(key string) (reachable bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	c.hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*reachabilityCacheEntry).reachable, true
+}
+
+// put stores whether the commit with the provided key is reachable, evicting
+// the least recently used entry if the cache is full.
+func (c *reachabilityCache) put(key string, reachable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*reachabilityCacheEntry).reachable = reachable
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&reachabilityCacheEntry{
+		key:       key,
+		reachable: reachable,
+	})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*reachabilityCacheEntry).key)
+	}
+}
@@ -0,0 +1,86 @@
+package githttp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/omegaup/go-base/logging/log15/v3"
+
+	git "github.com/libgit2/git2go/v33"
+)
+
+func TestReachabilityCache(t *testing.T) {
+	log, _ := log15.New("info", false)
+	protocol := NewGitProtocol(GitProtocolOpts{
+		ReachabilityCacheSize: 2,
+		Log:                   log,
+	})
+
+	dir, err := ioutil.TempDir("", "reachcache_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repository := createDivergedRepository(t, dir, log)
+	defer repository.Free()
+
+	lookup := func(name string) *git.Oid {
+		ref, err := repository.References.Lookup(name)
+		if err != nil {
+			t.Fatalf("Failed to look up %s: %v", name, err)
+		}
+		defer ref.Free()
+		return ref.Target()
+	}
+	masterID := lookup("refs/heads/master")
+	topicID := lookup("refs/heads/topic")
+
+	for i, testCase := range []struct {
+		commitID     *git.Oid
+		expectedHits int
+	}{
+		{masterID, 0},
+		// The second check for the same commit and references is cached.
+		{masterID, 1},
+		{topicID, 1},
+		{topicID, 2},
+	} {
+		if err := isCommitIDReachable(
+			context.Background(),
+			repository,
+			AuthorizationAllowed,
+			protocol,
+			testCase.commitID,
+		); err != nil {
+			t.Fatalf("%d: Expected %s to be reachable, got %v", i, testCase.commitID, err)
+		}
+		if testCase.expectedHits != protocol.reachabilityCache.hits {
+			t.Errorf("%d: Expected %d hits, got %d", i, testCase.expectedHits, protocol.reachabilityCache.hits)
+		}
+	}
+
+	// Updating a reference changes the key, so the result is not reused.
+	ref, err := repository.References.Create("refs/heads/other", masterID, false, "")
+	if err != nil {
+		t.Fatalf("Failed to create reference: %v", err)
+	}
+	ref.Free()
+	if err := isCommitIDReachable(
+		context.Background(),
+		repository,
+		AuthorizationAllowed,
+		protocol,
+		masterID,
+	); err != nil {
+		t.Fatalf("Expected %s to be reachable, got %v", masterID, err)
+	}
+	if protocol.reachabilityCache.hits != 2 {
+		t.Errorf("Expected %d hits, got %d", 2, protocol.reachabilityCache.hits)
+	}
+	if protocol.reachabilityCache.lru.Len() != 2 {
+		t.Errorf("Expected the cache to be bounded to %d entries, got %d", 2, protocol.reachabilityCache.lru.Len())
+	}
+}
@@ -1,24 +1,39 @@
 package githttp
 
 import (
+	"compress/gzip"
 	"context"
 	stderrors "errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	base "github.com/omegaup/go-base/v3"
 	"github.com/omegaup/go-base/v3/logging"
 	"github.com/omegaup/go-base/v3/tracing"
 
 	git "github.com/libgit2/git2go/v33"
+	"github.com/pkg/errors"
 )
 
 type doNotCompare [0]func()
 
+// ExpectedOldOidHeader is the name of the HTTP header that can be sent along
+// with a push request to specify the object ids that references must point to
+// for the push to succeed, as a comma-separated list of
+// `<reference name>=<object id>` pairs. This is checked while holding the
+// repository's write lock, so it is stronger than the protocol's own stale
+// information check.
+const ExpectedOldOidHeader = "Expected-Old-Oid"
+
 // A GitOperation describes the current operation
 type GitOperation int
 
@@ -54,6 +69,14 @@ var (
 	// HTTP 412 will be returned to http clients.
 	ErrPreconditionFailed = stderrors.New("precondition-failed")
 
+	// ErrRateLimited is returned if the client has made too many requests.
+	// HTTP 429 will be returned to http clients.
+	ErrRateLimited = stderrors.New("rate-limited")
+
+	// ErrPackfileTooLarge is returned if the packfile of a push is larger than
+	// the configured maximum size. HTTP 413 will be returned to http clients.
+	ErrPackfileTooLarge = stderrors.New("packfile-too-large")
+
 	// ErrDeleteDisallowed is returned when a delete operation is attempted.
 	ErrDeleteDisallowed = stderrors.New("delete-disallowed")
 
@@ -83,11 +106,19 @@ var (
 	// ErrStaleInfo is returned if the provided old oid does not match the current tip.
 	ErrStaleInfo = stderrors.New("stale-info")
 
+	// ErrRefExists is returned if the user is attempting to create a ref that
+	// already exists.
+	ErrRefExists = stderrors.New("already-exists")
+
 	// ErrInvalidOldOid is returned if the provided old oid is not a valid object id.
 	ErrInvalidOldOid = stderrors.New("invalid-old-oid")
 
 	// ErrInvalidNewOid is returned if the provided new oid is not a valid object id.
 	ErrInvalidNewOid = stderrors.New("invalid-new-oid")
+
+	// ErrAtomicPushFailed is reported for the references of an atomic push that
+	// were rejected because another reference in the same push failed.
+	ErrAtomicPushFailed = stderrors.New("atomic-push-failed")
 )
 
 func (o GitOperation) String() string {
@@ -143,6 +174,83 @@ func noopAuthorizationCallback(
 	return AuthorizationDenied, ""
 }
 
+type usernameContextKey struct{}
+
+// WithUsername returns a copy of ctx that carries the name of the user that
+// was authenticated by the AuthorizationCallback. GitServer does this for
+// pushes before invoking any of the other callbacks.
+func WithUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, usernameContextKey{}, username)
+}
+
+// UsernameFromContext returns the username that was set with WithUsername, or
+// an empty string if there is none.
+func UsernameFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(usernameContextKey{}).(string)
+	return username
+}
+
+type pushOptionsContextKey struct{}
+
+// WithPushOptions returns a copy of ctx that carries the push options (as in
+// `git push --push-option`) that were sent by the client. handlePush does
+// this before invoking any of the push callbacks, so they can read them with
+// PushOptionsFromContext.
+func WithPushOptions(ctx context.Context, options []string) context.Context {
+	return context.WithValue(ctx, pushOptionsContextKey{}, options)
+}
+
+// PushOptionsFromContext returns the push options that were set with
+// WithPushOptions, or nil if there are none.
+func PushOptionsFromContext(ctx context.Context) []string {
+	options, _ := ctx.Value(pushOptionsContextKey{}).([]string)
+	return options
+}
+
+type protocolVersionContextKey struct{}
+
+// WithProtocolVersion returns a copy of ctx that carries the version of the
+// git wire protocol that was requested by the client. GitServer does this
+// with the version in the Git-Protocol header.
+func WithProtocolVersion(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, protocolVersionContextKey{}, version)
+}
+
+// ProtocolVersionFromContext returns the protocol version that was set with
+// WithProtocolVersion, or 0 (the original protocol) if there is none.
+func ProtocolVersionFromContext(ctx context.Context) int {
+	version, _ := ctx.Value(protocolVersionContextKey{}).(int)
+	return version
+}
+
+// requestedProtocolVersion returns the protocol version requested in the
+// provided Git-Protocol header, which is a colon-separated list of key=value
+// parameters. Only versions 0 and 2 are supported, so anything else falls
+// back to version 0.
+func requestedProtocolVersion(header string) int {
+	for _, param := range strings.Split(header, ":") {
+		if param == "version=2" {
+			return 2
+		}
+	}
+	return 0
+}
+
+// OdbBackendFactory is invoked by GitServer every time it opens a repository,
+// and returns an additional backend for the repository's object database
+// (e.g. one that reads objects from a cloud blob store). The object database
+// takes ownership of the backend, so it is freed along with the repository.
+type OdbBackendFactory func(repositoryPath string) (*git.OdbBackend, error)
+
+type odbBackendFactoryContextKey struct{}
+
+// withOdbBackendFactory returns a copy of ctx that makes openRepository add a
+// backend created by factory to the object database of the repositories it
+// opens.
+func withOdbBackendFactory(ctx context.Context, factory OdbBackendFactory) context.Context {
+	return context.WithValue(ctx, odbBackendFactoryContextKey{}, factory)
+}
+
 // ReferenceDiscoveryCallback is invoked by GitServer when performing reference
 // discovery or prior to updating a reference. It returhn whether the provided
 // reference should be visible to the user.
@@ -160,6 +268,39 @@ func noopReferenceDiscoveryCallback(
 	return true
 }
 
+// ArchiveCallback is invoked by GitServer when a user requests an archive of
+// a tree through the browse API. It returns whether archives are allowed for
+// the provided authorization level.
+type ArchiveCallback func(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+) bool
+
+func noopArchiveCallback(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+) bool {
+	return true
+}
+
+// ReflogMessageCallback is invoked by GitServer when a reference is updated
+// by a push. It returns the message that will be written to the reflog.
+type ReflogMessageCallback func(
+	ctx context.Context,
+	command *GitCommand,
+	username string,
+) string
+
+func noopReflogMessageCallback(
+	ctx context.Context,
+	command *GitCommand,
+	username string,
+) string {
+	return command.LogMessage()
+}
+
 // UpdateCallback is invoked by GitServer when a user attempts to update a
 // repository. It returns an error if the update request is invalid.
 type UpdateCallback func(
@@ -180,6 +321,80 @@ func noopUpdateCallback(
 	return nil
 }
 
+// PushPolicyCallback is invoked by GitServer for each reference that a push
+// attempts to update, before the UpdateCallback. It returns an error (usually
+// ErrForbidden) if the update is not allowed by the policy.
+type PushPolicyCallback func(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	command *GitCommand,
+	newCommit *git.Commit,
+) error
+
+func noopPushPolicyCallback(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	command *GitCommand,
+	newCommit *git.Commit,
+) error {
+	return nil
+}
+
+// RequireStagedPushPolicy returns a PushPolicyCallback that only allows
+// references that start with protectedPrefix (e.g. "refs/heads/") to be
+// updated to commits that can already be reached from a reference that starts
+// with stagingPrefix (e.g. "refs/changes/"). This forces new commits to go
+// through a review namespace before they land in protected branches. Pushes
+// to any other reference are allowed.
+func RequireStagedPushPolicy(stagingPrefix, protectedPrefix string) PushPolicyCallback {
+	return func(
+		ctx context.Context,
+		repository *git.Repository,
+		level AuthorizationLevel,
+		command *GitCommand,
+		newCommit *git.Commit,
+	) error {
+		if !strings.HasPrefix(command.ReferenceName, protectedPrefix) {
+			return nil
+		}
+
+		it, err := repository.NewReferenceIterator()
+		if err != nil {
+			return errors.Wrap(err, "failed to create a reference iterator")
+		}
+		defer it.Free()
+
+		namespace := NamespaceFromContext(ctx)
+		for {
+			ref, err := it.Next()
+			if err != nil {
+				if git.IsErrorCode(err, git.ErrorCodeIterOver) {
+					break
+				}
+				return errors.Wrap(err, "failed to get an entry from the reference iterator")
+			}
+			name, ok := stripNamespace(namespace, ref.Name())
+			target := ref.Target()
+			staged := false
+			if ok && target != nil && strings.HasPrefix(name, stagingPrefix) {
+				if target.Equal(newCommit.Id()) {
+					staged = true
+				} else if descendant, err := repository.DescendantOf(target, newCommit.Id()); err == nil && descendant {
+					staged = true
+				}
+			}
+			ref.Free()
+			if staged {
+				return nil
+			}
+		}
+		// This is reported as the status of the reference, so it is not wrapped.
+		return ErrForbidden
+	}
+}
+
 // PreprocessCallback is invoked by GitServer when a user attempts to update a
 // repository. It can perform an arbitrary transformation of the packfile and
 // the update commands to be performed. A temporary directory is provided so
@@ -212,6 +427,36 @@ func noopContextCallback(ctx context.Context) context.Context {
 	return ctx
 }
 
+// RateLimitCallback is invoked by GitServer at the beginning of each request,
+// before the repository is accessed. If it returns an error categorized as
+// ErrRateLimited, the request is rejected with HTTP 429. The cause of the
+// error can be a *RetryAfterError to also send a Retry-After header.
+type RateLimitCallback func(
+	ctx context.Context,
+	r *http.Request,
+	repositoryName string,
+	operation GitOperation,
+) error
+
+func noopRateLimitCallback(
+	ctx context.Context,
+	r *http.Request,
+	repositoryName string,
+	operation GitOperation,
+) error {
+	return nil
+}
+
+// A RetryAfterError is the cause of an ErrRateLimited error that tells the
+// client how long to wait before retrying the request.
+type RetryAfterError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
 // PostUpdateCallback is invoked by GitServer after an update occurs. It allows
 // for callers to know which files in the git directory have changed.
 type PostUpdateCallback func(
@@ -266,22 +511,145 @@ func WriteHeader(w http.ResponseWriter, err error, clearHeaders bool) error {
 			return cause
 		}
 		return err
+	} else if base.HasErrorCategory(err, ErrRateLimited) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		if cause := base.UnwrapCauseFromErrorCategory(err, ErrRateLimited); cause != nil {
+			return cause
+		}
+		return err
+	} else if base.HasErrorCategory(err, ErrPackfileTooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		if cause := base.UnwrapCauseFromErrorCategory(err, ErrPackfileTooLarge); cause != nil {
+			return cause
+		}
+		return err
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
 }
 
+// parseExpectedOldOids parses the values of the ExpectedOldOidHeader header.
+func parseExpectedOldOids(values []string) (map[string]*git.Oid, error) {
+	result := make(map[string]*git.Oid)
+	for _, value := range values {
+		for _, pair := range strings.Split(value, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			tokens := strings.SplitN(pair, "=", 2)
+			if len(tokens) != 2 {
+				return nil, base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Errorf("malformed %s entry %q", ExpectedOldOidHeader, pair),
+				)
+			}
+			oid, err := git.NewOid(tokens[1])
+			if err != nil {
+				return nil, base.ErrorWithCategory(
+					ErrBadRequest,
+					errors.Wrapf(err, "invalid OID in %s entry %q", ExpectedOldOidHeader, pair),
+				)
+			}
+			result[tokens[0]] = oid
+		}
+	}
+	return result, nil
+}
+
 // A gitHTTPHandler implements git's smart protocol.
 type gitHTTPHandler struct {
-	rootPath         string
-	repositorySuffix string
-	enableBrowse     bool
-	contextCallback  ContextCallback
-	lockfileManager  *LockfileManager
-	protocol         *GitProtocol
-	tracing          tracing.Provider
-	log              logging.Logger
+	rootPath          string
+	repositorySuffix  string
+	enableBrowse      bool
+	contextCallback   ContextCallback
+	rateLimitCallback RateLimitCallback
+	lockfileManager   *LockfileManager
+	protocol          *GitProtocol
+	odbBackendFactory OdbBackendFactory
+	tracing           tracing.Provider
+	log               logging.Logger
+}
+
+// ensurePathWithinRoot returns an error if p, after resolving all symbolic
+// links, is not located within rootPath.
+func ensurePathWithinRoot(rootPath, p string) error {
+	resolvedRootPath, err := filepath.EvalSymlinks(rootPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %s", rootPath)
+	}
+	resolvedPath, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Wrapf(err, "failed to resolve %s", p),
+		)
+	}
+	relativePath, err := filepath.Rel(resolvedRootPath, resolvedPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to make %s relative to %s", resolvedPath, resolvedRootPath)
+	}
+	if relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return base.ErrorWithCategory(
+			ErrNotFound,
+			errors.Errorf("%s resolves to %s, outside of %s", p, resolvedPath, resolvedRootPath),
+		)
+	}
+	return nil
+}
+
+// etagMatches returns whether the value of an If-None-Match header matches
+// the provided ETag, in which case the response can be replaced by a 304 Not
+// Modified. As required for If-None-Match, weak comparison is used.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// requestBody returns a reader for the decoded body of the request. Clients
+// may compress the body with gzip, and may send it with chunked transfer
+// encoding, so its length is not known in advance.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrBadRequest,
+				errors.Wrap(err, "failed to decode the gzip request body"),
+			)
+		}
+		return gz, nil
+	default:
+		return nil, base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding")),
+		)
+	}
+}
+
+// requestOperation returns the operation that a request with the provided
+// repository-relative path and service name will perform.
+func requestOperation(requestPath, serviceName string) GitOperation {
+	if requestPath == "/git-receive-pack" ||
+		(requestPath == "/info/refs" && serviceName == "git-receive-pack") {
+		return OperationPush
+	}
+	if requestPath == "/git-upload-pack" || requestPath == "/info/refs" {
+		return OperationPull
+	}
+	return OperationBrowse
 }
 
 func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -323,6 +691,40 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 	ctx = h.contextCallback(ctx)
+	if version := requestedProtocolVersion(r.Header.Get("Git-Protocol")); version != 0 {
+		ctx = WithProtocolVersion(ctx, version)
+	}
+	if h.odbBackendFactory != nil {
+		ctx = withOdbBackendFactory(ctx, h.odbBackendFactory)
+	}
+
+	serviceName := relativeURL.Query().Get("service")
+	if err := h.rateLimitCallback(
+		ctx,
+		r,
+		repositoryName,
+		requestOperation(relativeURL.Path, serviceName),
+	); err != nil {
+		if cause := base.UnwrapCauseFromErrorCategory(err, ErrRateLimited); cause != nil {
+			var retryAfterErr *RetryAfterError
+			if stderrors.As(cause, &retryAfterErr) {
+				w.Header().Set(
+					"Retry-After",
+					strconv.Itoa(int(math.Ceil(retryAfterErr.RetryAfter.Seconds()))),
+				)
+			}
+		}
+		err = WriteHeader(w, err, false)
+		log.Error(
+			"Request",
+			map[string]any{
+				"Method": r.Method,
+				"URL":    relativeURL,
+				"error":  err,
+			},
+		)
+		return
+	}
 
 	repositoryPath := path.Join(h.rootPath, fmt.Sprintf("%s%s", repositoryName, h.repositorySuffix))
 	if _, err := os.Stat(repositoryPath); os.IsNotExist(err) {
@@ -338,12 +740,27 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err := ensurePathWithinRoot(h.rootPath, repositoryPath); err != nil {
+		log.Error(
+			"Request",
+			map[string]any{
+				"Method": r.Method,
+				"URL":    relativeURL,
+				"path":   repositoryPath,
+				"error":  err,
+			},
+		)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	serviceName := relativeURL.Query().Get("service")
-	if r.Method == "GET" && relativeURL.Path == "/info/refs" &&
+	if (r.Method == "GET" || r.Method == "HEAD") && relativeURL.Path == "/info/refs" &&
 		serviceName == "git-upload-pack" {
 		txn.SetName(r.Method + " /:repo/info/refs?service=git-upload-pack")
-		level, _ := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationPull)
+		level, username := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationPull)
+		// The username is part of the key of the cached advertisements, since
+		// the ReferenceDiscoveryCallback can depend on it.
+		ctx = WithUsername(ctx, username)
 		if level == AuthorizationDenied {
 			log.Error(
 				"Request",
@@ -359,7 +776,19 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
 		w.Header().Set("Cache-Control", "no-cache")
-		if err := handlePrePull(ctx, h.lockfileManager, repositoryPath, level, h.protocol, log, w); err != nil {
+		if r.Method == "HEAD" {
+			return
+		}
+		advertisement, err := Advertisement(
+			ctx,
+			h.lockfileManager,
+			repositoryPath,
+			serviceName,
+			level,
+			h.protocol,
+			log,
+		)
+		if err != nil {
 			log.Error(
 				"Request",
 				map[string]any{
@@ -372,6 +801,24 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			WriteHeader(w, err, true)
 			return
 		}
+		etag := advertisementETag(advertisement)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if _, err := w.Write(advertisement); err != nil {
+			log.Error(
+				"Request",
+				map[string]any{
+					"Method": r.Method,
+					"URL":    relativeURL,
+					"path":   repositoryPath,
+					"error":  err,
+				},
+			)
+			return
+		}
 	} else if r.Method == "POST" && relativeURL.Path == "/git-upload-pack" {
 		txn.SetName(r.Method + " /:repo/git-upload-pack")
 		level, _ := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationPull)
@@ -388,9 +835,25 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		body, err := requestBody(r)
+		if err != nil {
+			log.Error(
+				"Request",
+				map[string]any{
+					"Method": r.Method,
+					"URL":    relativeURL,
+					"path":   repositoryPath,
+					"error":  err,
+				},
+			)
+			WriteHeader(w, err, true)
+			return
+		}
+		defer body.Close()
+
 		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
 		w.Header().Set("Cache-Control", "no-cache")
-		if err := handlePull(ctx, h.lockfileManager, repositoryPath, level, log, r.Body, w); err != nil {
+		if err := handlePull(ctx, h.lockfileManager, repositoryPath, level, h.protocol, log, body, w); err != nil {
 			log.Error(
 				"Request",
 				map[string]any{
@@ -403,10 +866,13 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			WriteHeader(w, err, true)
 			return
 		}
-	} else if r.Method == "GET" && relativeURL.Path == "/info/refs" &&
+	} else if (r.Method == "GET" || r.Method == "HEAD") && relativeURL.Path == "/info/refs" &&
 		serviceName == "git-receive-pack" {
 		txn.SetName(r.Method + " /:repo/info/refs?service=git-receive-pack")
-		level, _ := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationPush)
+		level, username := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationPush)
+		// The username is part of the key of the cached advertisements, since
+		// the ReferenceDiscoveryCallback can depend on it.
+		ctx = WithUsername(ctx, username)
 		if level == AuthorizationDenied {
 			log.Error(
 				"Request",
@@ -435,7 +901,19 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", "application/x-git-receive-pack-advertisement")
 		w.Header().Set("Cache-Control", "no-cache")
-		if err := handlePrePush(ctx, h.lockfileManager, repositoryPath, level, h.protocol, log, w); err != nil {
+		if r.Method == "HEAD" {
+			return
+		}
+		advertisement, err := Advertisement(
+			ctx,
+			h.lockfileManager,
+			repositoryPath,
+			serviceName,
+			level,
+			h.protocol,
+			log,
+		)
+		if err != nil {
 			log.Error(
 				"Request",
 				map[string]any{
@@ -448,9 +926,31 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			WriteHeader(w, err, true)
 			return
 		}
+		etag := advertisementETag(advertisement)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if _, err := w.Write(advertisement); err != nil {
+			log.Error(
+				"Request",
+				map[string]any{
+					"Method": r.Method,
+					"URL":    relativeURL,
+					"path":   repositoryPath,
+					"error":  err,
+				},
+			)
+			return
+		}
 	} else if r.Method == "POST" && relativeURL.Path == "/git-receive-pack" {
 		txn.SetName(r.Method + " /:repo/git-receive-pack")
-		level, _ := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationPush)
+		level, username := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationPush)
+		ctx = WithUsername(ctx, username)
+		if token := r.Header.Get(IdempotencyTokenHeader); token != "" {
+			ctx = WithIdempotencyToken(ctx, token)
+		}
 		if level == AuthorizationDenied {
 			log.Error(
 				"Request",
@@ -477,6 +977,37 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		expectedOldOids, err := parseExpectedOldOids(r.Header.Values(ExpectedOldOidHeader))
+		if err != nil {
+			log.Error(
+				"Request",
+				map[string]any{
+					"Method": r.Method,
+					"URL":    relativeURL,
+					"path":   repositoryPath,
+					"error":  err,
+				},
+			)
+			WriteHeader(w, err, true)
+			return
+		}
+
+		body, err := requestBody(r)
+		if err != nil {
+			log.Error(
+				"Request",
+				map[string]any{
+					"Method": r.Method,
+					"URL":    relativeURL,
+					"path":   repositoryPath,
+					"error":  err,
+				},
+			)
+			WriteHeader(w, err, true)
+			return
+		}
+		defer body.Close()
+
 		w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
 		w.Header().Set("Cache-Control", "no-cache")
 		if err := handlePush(
@@ -485,8 +1016,9 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			repositoryPath,
 			level,
 			h.protocol,
+			expectedOldOids,
 			log,
-			r.Body,
+			body,
 			w,
 		); err != nil {
 			log.Error(
@@ -501,7 +1033,8 @@ func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			WriteHeader(w, err, true)
 			return
 		}
-	} else if (r.Method == "GET" || r.Method == "HEAD") && h.enableBrowse {
+	} else if (r.Method == "GET" || r.Method == "HEAD" ||
+		(r.Method == "POST" && strings.TrimSuffix(relativeURL.Path, "/") == "/+commits")) && h.enableBrowse {
 		level, _ := h.protocol.AuthCallback(ctx, w, r, repositoryName, OperationBrowse)
 		if level == AuthorizationDenied {
 			log.Error(
@@ -592,6 +1125,16 @@ type GitServerOpts struct {
 	ContextCallback  ContextCallback
 	Log              logging.Logger
 	Tracing          tracing.Provider
+
+	// RateLimitCallback is invoked at the beginning of each request to allow
+	// rejecting clients that have made too many requests.
+	RateLimitCallback RateLimitCallback
+
+	// OdbBackendFactory, if set, is used to add a backend to the object
+	// database of every repository that is opened while serving requests. The
+	// backend is added with the lowest priority, so objects in the repository
+	// itself are preferred.
+	OdbBackendFactory OdbBackendFactory
 }
 
 // NewGitServer returns an http.Handler that implements git's smart protocol,
@@ -606,15 +1149,20 @@ func NewGitServer(opts GitServerOpts) http.Handler {
 	if opts.ContextCallback == nil {
 		opts.ContextCallback = noopContextCallback
 	}
+	if opts.RateLimitCallback == nil {
+		opts.RateLimitCallback = noopRateLimitCallback
+	}
 
 	return &gitHTTPHandler{
-		rootPath:         opts.RootPath,
-		repositorySuffix: opts.RepositorySuffix,
-		enableBrowse:     opts.EnableBrowse,
-		contextCallback:  opts.ContextCallback,
-		lockfileManager:  opts.LockfileManager,
-		protocol:         opts.Protocol,
-		log:              opts.Log,
-		tracing:          opts.Tracing,
+		rootPath:          opts.RootPath,
+		repositorySuffix:  opts.RepositorySuffix,
+		enableBrowse:      opts.EnableBrowse,
+		contextCallback:   opts.ContextCallback,
+		rateLimitCallback: opts.RateLimitCallback,
+		lockfileManager:   opts.LockfileManager,
+		protocol:          opts.Protocol,
+		odbBackendFactory: opts.OdbBackendFactory,
+		log:               opts.Log,
+		tracing:           opts.Tracing,
 	}
 }
@@ -2,17 +2,25 @@ package githttp
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/omegaup/go-base/logging/log15/v3"
+	"github.com/omegaup/go-base/v3"
 
 	git "github.com/libgit2/git2go/v33"
 )
@@ -348,3 +356,584 @@ func TestGitbomb(t *testing.T) {
 		t.Errorf("Failed to clone: %v %q", err, output)
 	}
 }
+
+func TestParseExpectedOldOids(t *testing.T) {
+	result, err := parseExpectedOldOids([]string{
+		"refs/heads/master=88aa3454adb27c3c343ab57564d962a0a7f6a3c1, refs/heads/public=0000000000000000000000000000000000000000",
+		"refs/meta/config=d0c442210b72c207637a63e4eda991bc27abc0bd",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse the header: %v", err)
+	}
+	expected := map[string]string{
+		"refs/heads/master": "88aa3454adb27c3c343ab57564d962a0a7f6a3c1",
+		"refs/heads/public": "0000000000000000000000000000000000000000",
+		"refs/meta/config":  "d0c442210b72c207637a63e4eda991bc27abc0bd",
+	}
+	if len(expected) != len(result) {
+		t.Fatalf("Expected %v, got %v", expected, result)
+	}
+	for name, oid := range expected {
+		if result[name] == nil || oid != result[name].String() {
+			t.Errorf("For %s, expected %s, got %v", name, oid, result[name])
+		}
+	}
+
+	for _, value := range []string{"refs/heads/master", "refs/heads/master=foo"} {
+		if _, err := parseExpectedOldOids([]string{value}); !base.HasErrorCategory(err, ErrBadRequest) {
+			t.Errorf("Expected ErrBadRequest parsing %q, got %v", value, err)
+		}
+	}
+}
+
+func TestServerSymlinkOutsideRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootPath := filepath.Join(dir, "root")
+	if err := os.Mkdir(rootPath, 0o755); err != nil {
+		t.Fatalf("Failed to create the root directory: %v", err)
+	}
+	outsidePath, err := filepath.Abs("testdata/repo.git")
+	if err != nil {
+		t.Fatalf("Failed to get the absolute path of the repository: %v", err)
+	}
+	if err := os.Symlink(outsidePath, filepath.Join(rootPath, "escape.git")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         rootPath,
+		RepositorySuffix: ".git",
+		EnableBrowse:     true,
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	for _, requestPath := range []string{
+		"/escape/info/refs?service=git-upload-pack",
+		"/escape/+refs/",
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", requestPath, nil)
+		handler.ServeHTTP(w, req)
+		if http.StatusNotFound != w.Code {
+			t.Errorf("For %s, expected status %d, got %d", requestPath, http.StatusNotFound, w.Code)
+		}
+	}
+}
+
+func TestServerInfoRefsHead(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         "testdata",
+		RepositorySuffix: ".git",
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	for serviceName, expectedContentType := range map[string]string{
+		"git-upload-pack":  "application/x-git-upload-pack-advertisement",
+		"git-receive-pack": "application/x-git-receive-pack-advertisement",
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("HEAD", "/repo/info/refs?service="+serviceName, nil)
+		handler.ServeHTTP(w, req)
+		if http.StatusOK != w.Code {
+			t.Errorf("For %s, expected status %d, got %d", serviceName, http.StatusOK, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); expectedContentType != contentType {
+			t.Errorf("For %s, expected content type %q, got %q", serviceName, expectedContentType, contentType)
+		}
+		if 0 != w.Body.Len() {
+			t.Errorf("For %s, expected an empty body, got %q", serviceName, w.Body.String())
+		}
+	}
+}
+
+func TestServerInfoRefsProtocolV2(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         "testdata",
+		RepositorySuffix: ".git",
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	for header, expectedFirstLine := range map[string]string{
+		"":                             "# service=git-upload-pack\n",
+		"version=2":                    "version 2\n",
+		"object-format=sha1:version=2": "version 2\n",
+		"version=1":                    "# service=git-upload-pack\n",
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+		if header != "" {
+			req.Header.Set("Git-Protocol", header)
+		}
+		handler.ServeHTTP(w, req)
+		if http.StatusOK != w.Code {
+			t.Errorf("For %q, expected status %d, got %d", header, http.StatusOK, w.Code)
+		}
+		line, err := NewPktLineReader(w.Body).ReadPktLine()
+		if err != nil || expectedFirstLine != string(line) {
+			t.Errorf("For %q, expected %q, got %q, %v", header, expectedFirstLine, line, err)
+		}
+	}
+}
+
+func TestServerRateLimited(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	var operations []GitOperation
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         "testdata",
+		RepositorySuffix: ".git",
+		EnableBrowse:     true,
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		RateLimitCallback: func(
+			ctx context.Context,
+			r *http.Request,
+			repositoryName string,
+			operation GitOperation,
+		) error {
+			operations = append(operations, operation)
+			if operation == OperationBrowse {
+				return nil
+			}
+			return base.ErrorWithCategory(
+				ErrRateLimited,
+				&RetryAfterError{RetryAfter: 1500 * time.Millisecond},
+			)
+		},
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	for _, requestPath := range []string{
+		"/repo/info/refs?service=git-upload-pack",
+		"/repo/info/refs?service=git-receive-pack",
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", requestPath, nil)
+		handler.ServeHTTP(w, req)
+		if http.StatusTooManyRequests != w.Code {
+			t.Errorf("For %s, expected status %d, got %d", requestPath, http.StatusTooManyRequests, w.Code)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); "2" != retryAfter {
+			t.Errorf("For %s, expected Retry-After %q, got %q", requestPath, "2", retryAfter)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/repo/+refs", nil)
+	handler.ServeHTTP(w, req)
+	if http.StatusOK != w.Code {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	expectedOperations := []GitOperation{OperationPull, OperationPush, OperationBrowse}
+	if !reflect.DeepEqual(expectedOperations, operations) {
+		t.Errorf("Expected operations %v, got %v", expectedOperations, operations)
+	}
+}
+
+func TestServerMalformedPktLine(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	ts := httptest.NewServer(NewGitServer(GitServerOpts{
+		RootPath:         "testdata",
+		RepositorySuffix: ".git",
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	}))
+	defer ts.Close()
+
+	res, err := ts.Client().Post(
+		ts.URL+"/repo/git-upload-pack",
+		"application/x-git-upload-pack-request",
+		strings.NewReader("zzzzwant 6d2439d2e920ba92d8e485e75d1b740ae51b609a\n"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if http.StatusBadRequest != res.StatusCode {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestServerChunkedGzipUploadPack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         "testdata",
+		RepositorySuffix: ".git",
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	})
+	var transferEncoding []string
+	var contentLength int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transferEncoding = r.TransferEncoding
+		contentLength = r.ContentLength
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// The body is streamed through a pipe, so its length is unknown and the
+	// client is forced to use chunked transfer encoding.
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		p := NewPktLineWriter(gz)
+		p.WritePktLine([]byte("want 6d2439d2e920ba92d8e485e75d1b740ae51b609a ofs-delta agent=git/2.14.1\n"))
+		p.Flush()
+		p.WritePktLine([]byte("done\n"))
+		gz.Close()
+		pw.Close()
+	}()
+
+	req, err := http.NewRequest("POST", ts.URL+"/repo/git-upload-pack", pr)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if http.StatusOK != res.StatusCode {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if -1 != contentLength || !reflect.DeepEqual([]string{"chunked"}, transferEncoding) {
+		t.Errorf("Expected a chunked request, got %v (length %d)", transferEncoding, contentLength)
+	}
+
+	expected := []PktLineResponse{
+		{"NAK\n", nil},
+	}
+	if actual, ok := ComparePktLineResponse(res.Body, expected); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+	idx, _, err := UnpackPackfile(odb, res.Body, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+	found := false
+	for _, entry := range idx.Entries {
+		if "6d2439d2e920ba92d8e485e75d1b740ae51b609a" == entry.Oid.String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the packfile to contain the wanted commit")
+	}
+}
+
+func TestServerGzipReceivePack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(filepath.Join(dir, "repo.git"), true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	log, _ := log15.New("info", false)
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         dir,
+		RepositorySuffix: ".git",
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	packContents, err := ioutil.ReadFile(packFilename)
+	if err != nil {
+		t.Fatalf("Failed to read the packfile: %v", err)
+	}
+	var body bytes.Buffer
+	{
+		gz := gzip.NewWriter(&body)
+		pw := NewPktLineWriter(gz)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+		gz.Write(packContents)
+		gz.Close()
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/repo/git-receive-pack", &body)
+	req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+	handler.ServeHTTP(w, req)
+	if http.StatusOK != w.Code {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	expected := []PktLineResponse{
+		{"unpack ok\n", nil},
+		{"ok refs/heads/master\n", nil},
+		{"", ErrFlush},
+	}
+	if actual, ok := ComparePktLineResponse(w.Body, expected); !ok {
+		t.Errorf("pkt-reader expected %q, got %q", expected, actual)
+	}
+}
+
+func TestServerInfoRefsETag(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	log, _ := log15.New("info", false)
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         "testdata",
+		RepositorySuffix: ".git",
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+	handler.ServeHTTP(w, req)
+	if http.StatusOK != w.Code {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	sum := sha256.Sum256(w.Body.Bytes())
+	expected := "\"" + hex.EncodeToString(sum[:]) + "\""
+	if actual := w.Header().Get("ETag"); expected != actual {
+		t.Errorf("Expected ETag %s, got %s", expected, actual)
+	}
+}
+
+func TestServerInfoRefsNotModified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(filepath.Join(dir, "repo.git"), true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	log, _ := log15.New("info", false)
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         dir,
+		RepositorySuffix: ".git",
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	infoRefs := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	push := func() {
+		var body bytes.Buffer
+		pw := NewPktLineWriter(&body)
+		pw.WritePktLine([]byte("0000000000000000000000000000000000000000 88aa3454adb27c3c343ab57564d962a0a7f6a3c1 refs/heads/master\x00report-status\n"))
+		pw.Flush()
+		packContents, err := ioutil.ReadFile(packFilename)
+		if err != nil {
+			t.Fatalf("Failed to read the packfile: %v", err)
+		}
+		body.Write(packContents)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/repo/git-receive-pack", &body)
+		req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		handler.ServeHTTP(w, req)
+		if http.StatusOK != w.Code {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	w := infoRefs("")
+	if http.StatusOK != w.Code {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Expected an ETag")
+	}
+
+	// The repository has not changed, so the ETag is the same.
+	w = infoRefs(etag)
+	if http.StatusNotModified != w.Code {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected an empty body, got %q", w.Body.String())
+	}
+	if actual := w.Header().Get("ETag"); etag != actual {
+		t.Errorf("Expected ETag %s, got %s", etag, actual)
+	}
+
+	push()
+
+	w = infoRefs(etag)
+	if http.StatusOK != w.Code {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if actual := w.Header().Get("ETag"); actual == "" || etag == actual {
+		t.Errorf("Expected the ETag to change after a push, got %s", actual)
+	}
+}
+
+func TestServerOdbBackendFactory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	{
+		repo, err := git.InitRepository(filepath.Join(dir, "repo.git"), true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	// The blob is only stored in a separate object store, which stands in for
+	// a remote one.
+	storePath := filepath.Join(dir, "store")
+	var blobID *git.Oid
+	{
+		store, err := git.InitRepository(storePath, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		blobID, err = store.CreateBlobFromBuffer([]byte("remote blob\n"))
+		if err != nil {
+			t.Fatalf("Failed to create blob: %v", err)
+		}
+		store.Free()
+	}
+
+	log, _ := log15.New("info", false)
+	factoryCalls := 0
+	handler := NewGitServer(GitServerOpts{
+		RootPath:         dir,
+		RepositorySuffix: ".git",
+		EnableBrowse:     true,
+		Protocol: NewGitProtocol(GitProtocolOpts{
+			AuthCallback: allowAuthorizationCallback,
+			Log:          log,
+		}),
+		OdbBackendFactory: func(repositoryPath string) (*git.OdbBackend, error) {
+			factoryCalls++
+			return git.NewOdbBackendLoose(filepath.Join(storePath, "objects"), -1, false, 0, 0)
+		},
+		LockfileManager: m,
+		Log:             log,
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/repo/+/"+blobID.String(), nil)
+	handler.ServeHTTP(w, req)
+	if http.StatusOK != w.Code {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result BlobResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to parse the response %q: %v", w.Body.String(), err)
+	}
+	if result.ID != blobID.String() || result.Size != int64(len("remote blob\n")) {
+		t.Errorf("Expected blob %s with size %d, got %v", blobID, len("remote blob\n"), result)
+	}
+	if factoryCalls != 1 {
+		t.Errorf("Expected the factory to be called once, got %d", factoryCalls)
+	}
+}
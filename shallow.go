@@ -0,0 +1,100 @@
+package githttp
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	git "github.com/libgit2/git2go/v33"
+	base "github.com/omegaup/go-base/v3"
+	"github.com/pkg/errors"
+)
+
+// A shallowCutoff describes where the history that is sent to a shallow
+// client ends, besides its depth: before the commits that are older than
+// since (as requested with `deepen-since`), and before the commits that are
+// reachable from any of the excluded references (as requested with
+// `deepen-not`).
+type shallowCutoff struct {
+	since    time.Time
+	excluded []*git.Oid
+}
+
+// parseDeepenSince parses the timestamp of a `deepen-since` directive, and
+// sets it as the cutoff time.
+func (c *shallowCutoff) parseDeepenSince(timestamp string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrBadRequest,
+			errors.Errorf("invalid timestamp %s", timestamp),
+		)
+	}
+	c.since = time.Unix(seconds, 0)
+	return nil
+}
+
+// parseDeepenNot resolves the reference of a `deepen-not` directive, and adds
+// its target to the excluded commits. Like git, the reference can be
+// abbreviated (e.g. `topic` instead of `refs/heads/topic`). References that
+// the requestor cannot view are treated as if they did not exist.
+func (c *shallowCutoff) parseDeepenNot(
+	ctx context.Context,
+	repository *git.Repository,
+	level AuthorizationLevel,
+	protocol *GitProtocol,
+	name string,
+) error {
+	namespace := NamespaceFromContext(ctx)
+	for _, candidate := range []string{name, "refs/tags/" + name, "refs/heads/" + name} {
+		if level == AuthorizationAllowedRestricted && isRestrictedRef(candidate) {
+			continue
+		}
+		if protocol.isHiddenRef(candidate) {
+			continue
+		}
+		if !protocol.ReferenceDiscoveryCallback(ctx, repository, candidate) {
+			continue
+		}
+		ref, err := repository.References.Lookup(namespacedReferenceName(namespace, candidate))
+		if err != nil {
+			continue
+		}
+		resolved, err := ref.Resolve()
+		ref.Free()
+		if err != nil {
+			continue
+		}
+		c.excluded = append(c.excluded, resolved.Target())
+		resolved.Free()
+		return nil
+	}
+	return base.ErrorWithCategory(
+		ErrBadRequest,
+		errors.Errorf("deepen-not is not a ref: %s", name),
+	)
+}
+
+// cutsParent returns whether the first parent of commit is cut off from the
+// history that is sent, which makes commit shallow. A nil cutoff never cuts
+// any parents.
+func (c *shallowCutoff) cutsParent(repository *git.Repository, commit *git.Commit) bool {
+	if c == nil || commit.ParentCount() == 0 {
+		return false
+	}
+	parent := commit.Parent(0)
+	if parent == nil {
+		return false
+	}
+	defer parent.Free()
+	if !c.since.IsZero() && parent.Committer().When.Before(c.since) {
+		return true
+	}
+	if len(c.excluded) != 0 {
+		reachable, err := repository.ReachableFromAny(parent.Id(), c.excluded)
+		if err == nil && reachable {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package githttp
+
+import (
+	"context"
+	stderrors "errors"
+
+	git "github.com/libgit2/git2go/v33"
+	"github.com/pkg/errors"
+)
+
+// errObjectStatsTruncated stops the iteration over the objects once the
+// maximum number of objects has been counted.
+var errObjectStatsTruncated = stderrors.New("object stats truncated")
+
+// ObjectStats is the number of objects of each type in a repository.
+type ObjectStats struct {
+	Counts map[git.ObjectType]int `json:"counts"`
+
+	// Truncated is set when the repository has more objects than the maximum
+	// that was requested, in which case only that many were counted.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// RepositoryObjectStats returns the number of objects of each type in the
+// repository, while holding its read lock. Objects are not deduplicated, so
+// that the memory used does not grow with the size of the repository: the
+// ones that are stored more than once (e.g. in several packfiles) are counted
+// once per copy, like git-count-objects(1) does. If maxObjects is not zero, at
+// most that many objects are counted.
+func RepositoryObjectStats(
+	ctx context.Context,
+	m *LockfileManager,
+	repositoryPath string,
+	maxObjects int,
+) (*ObjectStats, error) {
+	repository, err := openRepository(ctx, repositoryPath)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to open git repository",
+		)
+	}
+	defer repository.Free()
+
+	lockfile := m.NewLockfile(repository.Path())
+	if err := lockfile.RLockContext(ctx); err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to acquire the lockfile",
+		)
+	}
+	defer lockfile.Unlock()
+
+	odb, err := repository.Odb()
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to open git odb",
+		)
+	}
+	defer odb.Free()
+
+	stats := &ObjectStats{
+		Counts: make(map[git.ObjectType]int),
+	}
+	count := 0
+	err = odb.ForEach(func(id *git.Oid) error {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "context cancelled")
+		}
+		if maxObjects != 0 && count >= maxObjects {
+			return errObjectStatsTruncated
+		}
+		_, objectType, err := odb.ReadHeader(id)
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to read the header of %s",
+				id,
+			)
+		}
+		stats.Counts[objectType]++
+		count++
+		return nil
+	})
+	if errors.Is(err, errObjectStatsTruncated) {
+		stats.Truncated = true
+	} else if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to iterate over the objects",
+		)
+	}
+	return stats, nil
+}
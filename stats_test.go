@@ -0,0 +1,48 @@
+package githttp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	git "github.com/libgit2/git2go/v33"
+)
+
+func TestRepositoryObjectStats(t *testing.T) {
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	stats, err := RepositoryObjectStats(context.Background(), m, "testdata/repo.git", 0)
+	if err != nil {
+		t.Fatalf("Failed to get the object stats: %v", err)
+	}
+
+	expected := &ObjectStats{
+		Counts: map[git.ObjectType]int{
+			git.ObjectCommit: 4,
+			git.ObjectTree:   3,
+			git.ObjectBlob:   1,
+		},
+	}
+	if !reflect.DeepEqual(expected, stats) {
+		t.Errorf("Expected %v, got %v", expected, stats)
+	}
+
+	stats, err = RepositoryObjectStats(context.Background(), m, "testdata/repo.git", 5)
+	if err != nil {
+		t.Fatalf("Failed to get the object stats: %v", err)
+	}
+	total := 0
+	for _, count := range stats.Counts {
+		total += count
+	}
+	if total != 5 || !stats.Truncated {
+		t.Errorf("Expected 5 objects and a truncated result, got %v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RepositoryObjectStats(ctx, m, "testdata/repo.git", 0); err == nil {
+		t.Errorf("Expected an error with a cancelled context")
+	}
+}
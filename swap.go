@@ -0,0 +1,85 @@
+package githttp
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// SwapRepository replaces the repository at livePath with the one at
+// stagedPath, which is typically a repository that was rebuilt or re-imported
+// in a temporary location. This is done while holding the write lock of the
+// live repository, and both repositories are exchanged atomically, so clients
+// never observe a missing or partially-built repository. Both paths must be in
+// the same filesystem. The previous contents of livePath are deleted.
+//
+// The lockfile of the live repository is carried over to the staged one, so
+// requests that were waiting for the lock keep excluding (and being excluded
+// by) everyone else once the swap is done. Since libgit2 accesses repositories
+// through their paths, and objects are addressed by their contents, the
+// repositories that those requests had already opened see the swapped
+// repository once they acquire the lock. Cached reference advertisements are
+// not evicted, so callers that use AdvertisementCacheSize need to call
+// GitProtocol.EvictAdvertisements(livePath) afterwards.
+func SwapRepository(m *LockfileManager, livePath, stagedPath string) error {
+	lockfile := m.NewLockfile(livePath)
+	if err := lockfile.Lock(); err != nil {
+		return errors.Wrap(
+			err,
+			"failed to acquire the lockfile",
+		)
+	}
+	defer lockfile.Unlock()
+
+	stagedLockPath := filepath.Join(stagedPath, filepath.Base(lockfile.path))
+	if err := os.Remove(stagedLockPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(
+			err,
+			"failed to remove the lockfile of %s",
+			stagedPath,
+		)
+	}
+	if err := os.Link(lockfile.path, stagedLockPath); err != nil {
+		if isCrossDeviceError(err) {
+			return errors.Errorf(
+				"staged repository %s is not in the same filesystem as %s",
+				stagedPath,
+				livePath,
+			)
+		}
+		return errors.Wrapf(
+			err,
+			"failed to link the lockfile into %s",
+			stagedPath,
+		)
+	}
+
+	if err := exchangePaths(stagedPath, livePath); err != nil {
+		os.Remove(stagedLockPath)
+		return errors.Wrapf(
+			err,
+			"failed to swap %s and %s",
+			stagedPath,
+			livePath,
+		)
+	}
+
+	// The previous repository is now at stagedPath.
+	if err := os.RemoveAll(stagedPath); err != nil {
+		return errors.Wrapf(
+			err,
+			"failed to remove the previous repository at %s",
+			stagedPath,
+		)
+	}
+	return nil
+}
+
+// isCrossDeviceError returns whether err was caused by trying to link or
+// rename a file across filesystems.
+func isCrossDeviceError(err error) bool {
+	var linkErr *os.LinkError
+	return errors.As(err, &linkErr) && linkErr.Err == syscall.EXDEV
+}
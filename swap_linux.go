@@ -0,0 +1,16 @@
+package githttp
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangePaths atomically exchanges the files at oldPath and newPath with
+// renameat2(2).
+func exchangePaths(oldPath, newPath string) error {
+	if err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_EXCHANGE); err != nil {
+		return &os.LinkError{Op: "renameat2", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
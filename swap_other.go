@@ -0,0 +1,13 @@
+//go:build !linux
+
+package githttp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// exchangePaths atomically exchanges the files at oldPath and newPath. This
+// is only supported on Linux.
+func exchangePaths(oldPath, newPath string) error {
+	return errors.New("atomically exchanging paths is only supported on Linux")
+}
@@ -0,0 +1,198 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/omegaup/go-base/logging/log15/v3"
+
+	git "github.com/libgit2/git2go/v33"
+)
+
+func TestSwapRepository(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "swap_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	livePath := path.Join(dir, "live.git")
+	createDivergedRepository(t, livePath, log).Free()
+
+	// Cache the lockfile of the live repository.
+	lockfile := m.NewLockfile(livePath)
+	if err := lockfile.RLock(); err != nil {
+		t.Fatalf("Failed to lock the live repository: %v", err)
+	}
+	var lockStat syscall.Stat_t
+	if err := syscall.Fstat(lockfile.fd, &lockStat); err != nil {
+		t.Fatalf("Failed to stat the lockfile: %v", err)
+	}
+	lockfile.Unlock()
+
+	stagedPath := path.Join(dir, "staged.git")
+	var rebuiltID *git.Oid
+	{
+		repository, err := git.InitRepository(stagedPath, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		rebuiltID = createTestCommit(
+			t, repository, log, "refs/heads/master",
+			map[string]string{"rebuilt": "rebuilt\n"},
+			"Rebuilt\n",
+		)
+		repository.Free()
+	}
+
+	if err := SwapRepository(m, livePath, stagedPath); err != nil {
+		t.Fatalf("Failed to swap the repository: %v", err)
+	}
+	if _, err := os.Stat(stagedPath); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to not exist, got %v", stagedPath, err)
+	}
+
+	// The lockfile does not change, so that requests that were waiting for it
+	// are still excluded after the swap.
+	var swappedLockStat syscall.Stat_t
+	if err := syscall.Stat(lockfile.path, &swappedLockStat); err != nil {
+		t.Fatalf("Failed to stat the lockfile: %v", err)
+	}
+	if lockStat.Ino != swappedLockStat.Ino {
+		t.Errorf("Expected the lockfile to be carried over to the swapped repository")
+	}
+
+	var inBuf, outBuf bytes.Buffer
+	{
+		pw := NewPktLineWriter(&inBuf)
+		pw.WritePktLine([]byte(fmt.Sprintf("want %s ofs-delta agent=git/2.14.1\n", rebuiltID)))
+		pw.Flush()
+		pw.WritePktLine([]byte("done"))
+	}
+	if err := handlePull(
+		context.Background(),
+		m,
+		livePath,
+		AuthorizationAllowed,
+		NewGitProtocol(GitProtocolOpts{
+			Log: log,
+		}),
+		log,
+		&inBuf,
+		&outBuf,
+	); err != nil {
+		t.Fatalf("Failed to clone: %v", err)
+	}
+
+	expected := []PktLineResponse{
+		{"NAK\n", nil},
+	}
+	if actual, ok := ComparePktLineResponse(
+		&outBuf,
+		expected,
+	); !ok {
+		t.Fatalf("pkt-reader expected %q, got %q", expected, actual)
+	}
+
+	odb, err := git.NewOdb()
+	if err != nil {
+		t.Fatalf("Failed to create odb: %v", err)
+	}
+	defer odb.Free()
+	idx, _, err := UnpackPackfile(odb, &outBuf, dir, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to unpack the packfile: %v", err)
+	}
+	if len(idx.Entries) != 3 {
+		t.Errorf("Expected the commit, its tree and its blob, got %d objects", len(idx.Entries))
+	}
+}
+
+func TestSwapRepositoryMissingStaged(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "swap_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	livePath := path.Join(dir, "live.git")
+	createDivergedRepository(t, livePath, log).Free()
+
+	if err := SwapRepository(m, livePath, path.Join(dir, "missing.git")); err == nil {
+		t.Errorf("Expected the swap to fail")
+	}
+
+	// The live repository must be left untouched.
+	repository, err := git.OpenRepository(livePath)
+	if err != nil {
+		t.Fatalf("Failed to open the live repository: %v", err)
+	}
+	repository.Free()
+}
+
+func TestSwapRepositoryBlockedReader(t *testing.T) {
+	log, _ := log15.New("info", false)
+	dir, err := ioutil.TempDir("", "swap_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewLockfileManager()
+	defer m.Clear()
+
+	livePath := path.Join(dir, "live.git")
+	createDivergedRepository(t, livePath, log).Free()
+	stagedPath := path.Join(dir, "staged.git")
+	createDivergedRepository(t, stagedPath, log).Free()
+
+	// A reader opens the lockfile of the live repository and starts waiting
+	// for it while it is locked for writing.
+	writer := m.NewLockfile(livePath)
+	if err := writer.Lock(); err != nil {
+		t.Fatalf("Failed to lock the live repository: %v", err)
+	}
+	reader := m.NewLockfile(livePath)
+	if err := reader.open(); err != nil {
+		t.Fatalf("Failed to open the lockfile: %v", err)
+	}
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- reader.RLock()
+	}()
+
+	// The locked fd is handed over to SwapRepository through the cache, so
+	// that the reader stays blocked throughout the swap.
+	m.fdCache.Put(writer.path, writer.fd)
+	writer.fd = invalidFD
+	if err := SwapRepository(m, livePath, stagedPath); err != nil {
+		t.Fatalf("Failed to swap the repository: %v", err)
+	}
+
+	if err := <-acquired; err != nil {
+		t.Fatalf("Failed to lock the live repository for reading: %v", err)
+	}
+	defer reader.Unlock()
+
+	// Another process that opens the current lockfile must be excluded.
+	fd, err := syscall.Open(filepath.Join(livePath, "githttp.lock"), syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open the lockfile: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("Expected the lockfile to be locked, got %v", err)
+	}
+}